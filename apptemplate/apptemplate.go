@@ -8,11 +8,16 @@ import (
   "bufio"
   "strings"
   "unicode"
+  "unicode/utf8"
   "strconv"
+  "sort"
   "path"
   "path/filepath"
   "errors"
   "bytes"
+  "time"
+  "crypto/sha256"
+  "encoding/hex"
   "go/ast"
   "go/token"
   "go/parser"
@@ -20,25 +25,281 @@ import (
   "golang.org/x/tools/go/ast/astutil"
 )
 
-var Verbose = false
-var log = os.Stderr
 
 var MergeStaticText = true  // Concatenate consecutive static sections?
 
-var sections []*Section  // Stores output sections during template parsing.
-var stack []*Entry  // Used to prevent template insertion cycles.
+// RuntimePath is the import path of the runtime package, which generated
+// programs use for output.
+const RuntimePath = "github.com/michaellaszlo/boomerang/runtime"
 
-// Section contains the text of a code section or static section.
+// HelpersPath is the import path of the helpers package, which generated
+// programs import if their code refers to it by name.
+const HelpersPath = RuntimePath + "/helpers"
+
+// parseState holds the state of one call to Process, so that templates can be
+// processed concurrently.
+type parseState struct {
+  sections []*Section  // Stores output sections during template parsing.
+  stack []*Entry       // Used to prevent template insertion cycles.
+  blocks []*block      // The content-for and if tags not yet ended.
+  result *Result       // Accumulates information gathered during parsing.
+  options *Options     // The options passed to Process.
+}
+
+// block is a content-for or if tag whose end tag has not been reached.
+type block struct {
+  region string  // The name of a content-for region, or "" for an if.
+  keep bool      // For an if, whether the current branch is kept.
+  hasElse bool   // For an if, whether the else tag has been reached.
+}
+
+// Section contains the text of a code section or static section. Path is
+// the hard path of the template that contains the text, and Line is the
+// line on which the text begins.
 type Section struct {
   Kind uint
   Text string
+  Path string
+  Line int
+
+  parts []*Section  // The static sections that were merged into this one.
 }
 const (  // These are Section.Kind values.
   Static uint = iota
   Code
+  Asset  // The Text of an asset section is the URL path of the asset.
+  Verbatim  // The Text of a verbatim section is output without trimming.
 )
 
 
+// Options control template processing. A nil *Options is equivalent to
+// the zero value, which gives the default behavior.
+type Options struct {
+  Log io.Writer     // If Log is not nil, parsing progress is reported to it.
+  Errors io.Writer  // Error messages go here, or to os.Stderr if it is nil.
+
+  // If RuntimePath is not empty, generated code imports the runtime from
+  // this path, as from a vendored copy, instead of from the RuntimePath
+  // constant. Imports of the constant path in templates are rewritten.
+  RuntimePath string
+
+  // If FastCGI is true, the main function of the template becomes the page
+  // function, named PageFunction, and a new main function passes it to the
+  // runtime's ServeFastCGI, which runs it once per request.
+  FastCGI bool
+
+  // If Handler is true, the main function of the template becomes a
+  // function named HandlerFunction with the signature of an
+  // http.HandlerFunc, and output goes to a runtime context made for each
+  // request instead of to the runtime's globals. No main function is left,
+  // so Package should name a package other than main.
+  Handler bool
+
+  // If Lambda is true, the main function of the template becomes a handler
+  // as with Handler, and a new main function passes it to the runtime's
+  // ServeLambda, which runs it for each event of AWS Lambda.
+  Lambda bool
+
+  // If Package is not empty, it replaces the package name of the template.
+  Package string
+
+  // Each key of Defines is declared in the generated code as a string
+  // constant with the given value, so that templates can show build
+  // information such as a version. Keys must be Go identifiers.
+  Defines map[string]string
+
+  // Environment names the environment of the build, such as production,
+  // and Tags are its build tags. The conditions of if tags, env "name"
+  // and tag "name", are evaluated against them.
+  Environment string
+  Tags []string
+
+  // Markdown renders the files of insert-markdown tags. If it is nil,
+  // BasicMarkdown is used.
+  Markdown MarkdownRenderer
+
+  // If Fingerprint is true, asset tags output URL paths with a hash of the
+  // asset's contents before the extension, as in /css/site.1a2b3c4d5e.css,
+  // so that the asset can be cached indefinitely. The paths are recorded in
+  // the Fingerprints of the result, for the caller to put the assets there.
+  Fingerprint bool
+
+  // An img tag inlines an image of at most InlineImageLimit bytes as a data
+  // URI instead of linking to it as an asset. If InlineImageLimit is zero,
+  // no image is inlined.
+  InlineImageLimit int
+
+  // Static text of more than MaxLiteral bytes is split across several
+  // string literals in the generated code, since huge literals strain the
+  // compiler. MaxLiteral is DefaultMaxLiteral if it is zero, and there is
+  // no limit if it is negative. Each split is reported as a warning.
+  MaxLiteral int
+
+  // If a template has more than MaxSections sections of static text, code,
+  // and assets, a warning is added to the result, since every section
+  // becomes a statement of the generated main function. MaxSections is
+  // DefaultMaxSections if it is zero, and there is no limit if it is
+  // negative.
+  MaxSections int
+
+  // Insert tags may be nested at most MaxInsertDepth deep, so that a long
+  // chain of insertions, such as one made by a tool, fails with the chain
+  // listed instead of exhausting memory. MaxInsertDepth is
+  // DefaultMaxInsertDepth if it is zero, and there is no limit if it is
+  // negative.
+  MaxInsertDepth int
+
+  // UnknownTags says what to do with static text that looks like a tag but
+  // is not one, such as <?inserr x ?>. By default it is passed through.
+  // XML processing instructions and tags named in PassTags, as in
+  // []string{"php"}, are always passed through.
+  UnknownTags TagCheck
+  PassTags []string
+
+  // Overlay maps the hard paths of templates to text that is parsed in
+  // place of their files, such as the unsaved text of an editor. The files
+  // must still exist.
+  Overlay map[string][]byte
+}
+
+// DefaultMaxLiteral, DefaultMaxSections, and DefaultMaxInsertDepth are the
+// limits used when the options leave them at zero.
+const (
+  DefaultMaxLiteral = 16 << 10
+  DefaultMaxSections = 5000
+  DefaultMaxInsertDepth = 100
+)
+
+// PageFunction is the name that the main function of a template takes in
+// FastCGI mode.
+const PageFunction = "boomerangPage"
+
+// ContextName is the name of the variable that holds the runtime context
+// to which the output of a template goes. In CGI and FastCGI programs, it
+// is a package variable bound to the runtime's current context. In a
+// handler, it is a local variable that holds the context of the request,
+// and calls of the runtime's output functions in main are redirected to it.
+const ContextName = "boomerang"
+
+// errors returns the writer for error messages.
+func (p *parseState) errors() io.Writer {
+  if p.options.Errors != nil {
+    return p.options.Errors
+  }
+  return os.Stderr
+}
+
+// Result describes a template that was processed successfully.
+type Result struct {
+  Meta Meta                 // Key-value pairs declared in meta tags.
+  Templates []string        // Hard paths of the templates that were read.
+  Insertions []Insertion    // Insert tags, in parsing order.
+  Assets []string           // Hard paths of the files named by asset tags.
+  Fingerprints map[string]string  // Fingerprinted URL paths by hard path.
+  Sizes map[string]TemplateSize   // The size of each template by hard path.
+  ParseTime time.Duration   // The time spent reading and parsing templates.
+  SourceMap *SourceMap      // The template lines of the generated code.
+  Warnings []*Error         // Problems that did not stop generation.
+}
+
+// TemplateSize counts the text of a template as it was read. Bytes are
+// counted in the file's own encoding, so that they give the weight of the
+// template, and an invalid UTF-8 byte counts as one rune. A last line
+// without a line break is counted.
+type TemplateSize struct {
+  Bytes int  `json:"bytes"`
+  Runes int  `json:"runes"`
+  Lines int  `json:"lines"`
+}
+
+// Insertion records that one template inserted another.
+type Insertion struct {
+  Parent, Child string  // These are hard paths.
+  Line int              // Line is the line number of the tag in Parent.
+}
+
+// Error describes a problem found at a line of a template. Parsing errors
+// that can be pinned to a line are of this type.
+type Error struct {
+  Path string  // Path is the hard path of the template.
+  Line int
+  Err error
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+  return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+  return e.Err
+}
+
+// ProcessError is the error returned by a failed Process. Insertions lists
+// the insert tags that were parsed before the failure, from which
+// InsertionStack can tell how the template of an error was reached.
+type ProcessError struct {
+  Insertions []Insertion
+  Err error
+}
+
+// Error implements the error interface.
+func (e *ProcessError) Error() string {
+  return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ProcessError) Unwrap() error {
+  return e.Err
+}
+
+// InsertionStack returns the insertions that lead from the top-level
+// template to the template at path, outermost first, following the first
+// insertion of each template. It is empty if path was not inserted.
+func InsertionStack(insertions []Insertion, path string) []Insertion {
+  stack := []Insertion{}
+  for len(stack) < len(insertions) {  // An insertion cycle stops here.
+    found := false
+    for _, insertion := range insertions {
+      if insertion.Child == path {
+        stack = append([]Insertion{ insertion }, stack...)
+        path, found = insertion.Parent, true
+        break
+      }
+    }
+    if !found {
+      break
+    }
+  }
+  return stack
+}
+
+// Meta maps lower-case keys to the values declared for them with
+// <?meta key: value ?>. A key may be declared several times.
+type Meta map[string][]string
+
+// Get returns the first value declared for key, or "" if there is none.
+func (m Meta) Get(key string) string {
+  values := m[strings.ToLower(key)]
+  if len(values) == 0 {
+    return ""
+  }
+  return values[0]
+}
+
+// Values returns all values declared for key in order of appearance.
+func (m Meta) Values(key string) []string {
+  return m[strings.ToLower(key)]
+}
+
+// Add appends a value to the list of values declared for key.
+func (m Meta) Add(key, value string) {
+  key = strings.ToLower(key)
+  m[key] = append(m[key], value)
+}
+
+
 //--- Linear pattern matching
 
 // Pattern helps us keep track of progress in matching a string.
@@ -92,10 +353,10 @@ func (entry Entry) String() string {
 
 // parse makes an entry for the top-level template, initializes the section
 // list and the parsing stack, and calls doParse.
-func parse(siteRoot, templatePath string) error {
+func (p *parseState) parse(siteRoot, templatePath string) error {
   fileInfo, err := os.Stat(templatePath)
   if err != nil {
-    fmt.Fprintf(os.Stderr, "os.Stat failed in %s\n", templatePath)
+    fmt.Fprintf(p.errors(), "os.Stat failed in %s\n", templatePath)
     return err
   }
   // Work out the name of the containing directory. This becomes templateDir,
@@ -104,7 +365,7 @@ func parse(siteRoot, templatePath string) error {
   if !filepath.IsAbs(templatePath) {  // We want an absolute file-system path.
     workingDirectory, err := os.Getwd()
     if err != nil {
-      fmt.Fprintf(os.Stderr, "os.Getwd failed in %s\n", templatePath)
+      fmt.Fprintf(p.errors(), "os.Getwd failed in %s\n", templatePath)
       return err
     }
     templateDir = filepath.Join(workingDirectory, templateDir)
@@ -117,77 +378,240 @@ func parse(siteRoot, templatePath string) error {
       FileInfo: fileInfo,
       InsertionLine: 0,
     }
-  sections = []*Section{}
-  stack = []*Entry{ &entry }
-  return doParse(siteRoot, templateDir)
+  p.sections = []*Section{}
+  p.stack = []*Entry{ &entry }
+  p.result = &Result{ Meta: Meta{}, Fingerprints: map[string]string{},
+      Sizes: map[string]TemplateSize{} }
+  return p.doParse(siteRoot, templateDir)
 }
 
-// doParse recursively parses a template and its children.
-func doParse(siteRoot, templateDir string) error {
-  current := stack[len(stack)-1]
-  if Verbose {
-    fmt.Fprintf(log, "  doParse \"%s\"\n", current.GivenPath)
+// templateScan is the state of parsing one template of the insertion
+// stack. Parsing stops at an insert tag and resumes from the same state
+// once the inserted template has been parsed.
+type templateScan struct {
+  entry *Entry
+  templateDir string    // Relative insertion paths are resolved here.
+  file *os.File         // The template file, or nil for overlay text.
+  reader *bufio.Reader
+
+  // There are several opening patterns but only one closing pattern. There
+  // is no need to check tag depth because nested tags are not allowed.
+  codePattern, insertPattern, metaPattern, assetPattern, yieldPattern,
+      contentForPattern, ifPattern, elsePattern, endPattern,
+      includeStaticPattern, imgPattern, closePattern Pattern
+  openPatterns []*Pattern
+  customPatterns map[*Pattern]string
+  handlers map[string]TagHandler
+
+  blockDepth int        // Blocks opened in the template must end in it.
+  open *Pattern         // The opening pattern of the current tag, if any.
+  buffer []rune         // The text read since the last tag.
+  countBytes, countRunes int  // Byte and rune counts are logged.
+  lastRune rune         // The last rune read, which may end a line.
+  lineIndex int         // The line index is stored in template entries.
+  bufferLine int        // The line on which the buffer begins.
+}
+
+// closeFile closes the template file, if it is open.
+func (scan *templateScan) closeFile() {
+  if scan.file != nil {
+    scan.file.Close()
+    scan.file = nil
   }
+}
 
-  // Check for an insertion cycle.
-  for i := len(stack)-2; i >= 0; i-- {
-    ancestor := stack[i]
-    if os.SameFile(ancestor.FileInfo, current.FileInfo) {
-      lines := []string{ "doParse: insertion cycle" }
-      for j := 0; j < len(stack); j++ {           // In the event of a cycle,
-        lines = append(lines, stack[j].String())  // generate a stack trace.
+// doParse parses a template and its children. Inserted templates are
+// parsed on an explicit stack rather than by recursion, so that a long
+// chain of insertions does not grow the goroutine stack.
+func (p *parseState) doParse(siteRoot, templateDir string) error {
+  scans := []*templateScan{}
+  defer func() {
+    for _, scan := range scans {
+      scan.closeFile()
+    }
+  }()
+  scan, err := p.openScan(templateDir)
+  if err != nil {
+    return err
+  }
+  scans = append(scans, scan)
+  for len(scans) != 0 {
+    scan := scans[len(scans)-1]
+    child, err := p.scanTemplate(scan, siteRoot)
+    if err != nil {
+      return err
+    }
+    if child == nil {  // The template has been parsed to the end.
+      scan.closeFile()
+      scans = scans[:len(scans)-1]
+      if len(scans) != 0 {  // The top-level entry stays on the stack.
+        p.stack = p.stack[:len(p.stack)-1]
       }
-      message := fmt.Sprintf(strings.Join(lines, "\n  "))
-      return errors.New(message)
+      continue
+    }
+    p.stack = append(p.stack, child)
+    scan, err = p.openScan(filepath.Dir(child.HardPath))
+    if err != nil {
+      return err
     }
+    scans = append(scans, scan)
   }
+  return nil
+}
 
-  // Open the template file and make a reader.
-  var file *os.File
-  file, err := os.Open(current.HardPath)
-  if err != nil {
-    fmt.Fprintf(os.Stderr, "os.Open failed on %s\n", current.GivenPath)
-    return err
+// insertionTrace returns an error at the insert tag of the current
+// template that describes the insertion stack.
+func (p *parseState) insertionTrace(message string) error {
+  lines := []string{ message }
+  for j := 0; j < len(p.stack); j++ {
+    lines = append(lines, p.stack[j].String())
   }
-  reader := bufio.NewReader(file)
+  current, parent := p.stack[len(p.stack)-1], p.stack[len(p.stack)-2]
+  return &Error{ parent.HardPath, current.InsertionLine,
+      errors.New(strings.Join(lines, "\n  ")) }
+}
 
-  // There are two opening patterns but only one closing pattern. There is
-  // no need to check tag depth because nested tags are not allowed.
-  codePattern := NewPattern("<?code")
-  insertPattern := NewPattern("<?insert")
-  openPatterns := []*Pattern{ &codePattern, &insertPattern }
-  var open *Pattern
-  close := NewPattern("?>")
+// openScan checks the insertion of the current template and starts to
+// parse it.
+func (p *parseState) openScan(templateDir string) (*templateScan, error) {
+  current := p.stack[len(p.stack)-1]
+  if p.options.Log != nil {
+    fmt.Fprintf(p.options.Log, "  doParse \"%s\"\n", current.GivenPath)
+  }
+
+  // Check for an insertion cycle. In the event of a cycle, generate a
+  // stack trace at the tag of the parent, which closes the cycle.
+  for i := len(p.stack)-2; i >= 0; i-- {
+    ancestor := p.stack[i]
+    if os.SameFile(ancestor.FileInfo, current.FileInfo) {
+      return nil, p.insertionTrace("doParse: insertion cycle")
+    }
+  }
+
+  // Check the depth of insertion in the same way.
+  maxDepth := p.options.MaxInsertDepth
+  if maxDepth == 0 {
+    maxDepth = DefaultMaxInsertDepth
+  }
+  if maxDepth > 0 && len(p.stack)-1 > maxDepth {
+    return nil, p.insertionTrace(fmt.Sprintf(
+        "doParse: insertions are nested more than %d deep", maxDepth))
+  }
+
+  // Note the template as a dependency unless it has been read before.
+  p.noteTemplate(current.HardPath)
+
+  // Open the template file, or take its text from the overlay, and make a
+  // reader.
+  scan := &templateScan{ entry: current, templateDir: templateDir,
+      blockDepth: len(p.blocks), lineIndex: 1, bufferLine: 1 }
+  if text, found := p.options.Overlay[current.HardPath]; found {
+    scan.reader = bufio.NewReader(bytes.NewReader(text))
+  } else {
+    file, err := os.Open(current.HardPath)
+    if err != nil {
+      fmt.Fprintf(p.errors(), "os.Open failed on %s\n", current.GivenPath)
+      return nil, err
+    }
+    scan.file = file
+    scan.reader = bufio.NewReader(file)
+  }
+
+  scan.codePattern = NewPattern(TagOpen + "code")
+  scan.insertPattern = NewPattern(TagOpen + "insert")
+  scan.metaPattern = NewPattern(TagOpen + "meta")
+  scan.assetPattern = NewPattern(TagOpen + "asset")
+  scan.yieldPattern = NewPattern(TagOpen + "yield")
+  scan.contentForPattern = NewPattern(TagOpen + "content-for")
+  scan.ifPattern = NewPattern(TagOpen + "if")
+  scan.elsePattern = NewPattern(TagOpen + "else")
+  scan.endPattern = NewPattern(TagOpen + "end")
+  scan.includeStaticPattern = NewPattern(TagOpen + "include-static")
+  scan.imgPattern = NewPattern(TagOpen + "img")
+  scan.closePattern = NewPattern(TagClose)
+  scan.openPatterns = []*Pattern{ &scan.codePattern, &scan.insertPattern,
+      &scan.metaPattern, &scan.assetPattern, &scan.yieldPattern,
+      &scan.contentForPattern, &scan.ifPattern, &scan.elsePattern,
+      &scan.endPattern, &scan.includeStaticPattern, &scan.imgPattern }
+  scan.customPatterns = map[*Pattern]string{}
+  scan.handlers = customTagHandlers()
+  for name := range scan.handlers {
+    pattern := NewPattern(TagOpen + name)
+    scan.customPatterns[&pattern] = name
+    scan.openPatterns = append(scan.openPatterns, &pattern)
+  }
+  return scan, nil
+}
+
+// scanTemplate parses the current template until it reaches an insert
+// tag, and returns the entry of the template to insert, or until the end,
+// and returns nil.
+func (p *parseState) scanTemplate(scan *templateScan,
+    siteRoot string) (*Entry, error) {
+  current, templateDir := scan.entry, scan.templateDir
+  codePattern, insertPattern := &scan.codePattern, &scan.insertPattern
+  metaPattern, assetPattern := &scan.metaPattern, &scan.assetPattern
+  yieldPattern, contentForPattern := &scan.yieldPattern,
+      &scan.contentForPattern
+  ifPattern, elsePattern := &scan.ifPattern, &scan.elsePattern
+  endPattern, imgPattern := &scan.endPattern, &scan.imgPattern
+  includeStaticPattern := &scan.includeStaticPattern
+  closePattern := &scan.closePattern
+  openPatterns := scan.openPatterns
+  customPatterns, handlers := scan.customPatterns, scan.handlers
+  blockDepth := scan.blockDepth
+  open := scan.open
 
   // Each character goes into the buffer, which we empty whenever we match
   // an opening or closing tag. An opening tag signals the end of a static
   // portion. A closing tag marks the end of code or an insert statement.
-  var buffer []rune
-  countBytes, countRunes := 0, 0  // Byte and rune counts are logged.
-  lineIndex := 1  // The line index is stored in template entries.
+  buffer := scan.buffer
+  countBytes, countRunes := scan.countBytes, scan.countRunes
+  lastRune := scan.lastRune
+  lineIndex, bufferLine := scan.lineIndex, scan.bufferLine
 
   for {
-    ch, size, err := reader.ReadRune()
+    ch, size, err := scan.reader.ReadRune()
     if err == nil {
       buffer = append(buffer, ch)
       countBytes += size
       countRunes++
+      lastRune = ch
       if ch == '\n' {
         lineIndex++
       }
     } else if err == io.EOF {
+      if len(p.blocks) > blockDepth {
+        tag := "if"
+        if region := p.blocks[len(p.blocks)-1].region; region != "" {
+          tag = "content-for " + region
+        }
+        return nil, &Error{ current.HardPath, lineIndex,
+            fmt.Errorf("%s is not ended", tag) }
+      }
       content := string(buffer)
-      pushStatic(content)
-      if Verbose {
+      if open == nil {
+        if err := p.checkStatic(content, bufferLine); err != nil {
+          return nil, err
+        }
+      }
+      p.pushStatic(content, bufferLine)
+      lines := lineIndex
+      if countBytes == 0 || lastRune == '\n' {
+        lines--
+      }
+      p.result.Sizes[current.HardPath] = TemplateSize{ Bytes: countBytes,
+          Runes: countRunes, Lines: lines }
+      if log := p.options.Log; log != nil {
         fmt.Fprintf(log, "parsed \"%s\"\n", current.GivenPath)
         fmt.Fprintf(log, "read %d bytes, %d runes\n", countBytes, countRunes)
         fmt.Fprintf(log, "finished on line %d\n", lineIndex)
       }
-      return nil
+      return nil, nil
     } else {
-      fmt.Fprintf(os.Stderr, "reader.ReadRune failed in %s\n",
+      fmt.Fprintf(p.errors(), "reader.ReadRune failed in %s\n",
           current.GivenPath)
-      return err
+      return nil, &Error{ current.HardPath, lineIndex, err }
     }
 
     // Once a tag has been opened, we ignore further opening tags until
@@ -197,16 +621,80 @@ func doParse(siteRoot, templateDir string) error {
         if pattern.Next(ch) {
           open = pattern
           content := string(buffer[:len(buffer)-open.Length])  // Remove tag.
-          pushStatic(content)  // Text before an opening tag must be static.
-          buffer = []rune{}
+          if err := p.checkStatic(content, bufferLine); err != nil {
+            return nil, err
+          }
+          p.pushStatic(content, bufferLine)  // Text before an opening tag
+          buffer = []rune{}                  // must be static.
+          bufferLine = lineIndex
         }
       }
     } else {
-      if close.Next(ch) {
-        content := buffer[:len(buffer)-close.Length]  // Remove tag.
-        if open == &codePattern {           // Code sections are just text.
-          pushCode(string(content))
-        } else if open == &insertPattern {  // Insertion requires more work.
+      if closePattern.Next(ch) {
+        content := buffer[:len(buffer)-closePattern.Length]  // Remove tag.
+        isBlockTag := open == contentForPattern || open == ifPattern ||
+            open == elsePattern || open == endPattern
+        if p.skipping() && !isBlockTag {
+          // A branch that is left out produces nothing, and its tags are
+          // not followed, but its blocks must still be matched.
+        } else if open == codePattern {    // Code sections are just text.
+          p.pushCode(string(content), bufferLine)
+        } else if open == metaPattern {    // Meta tags produce no output.
+          err = p.parseMeta(string(content))
+          if err != nil {
+            return nil, &Error{ current.HardPath, lineIndex, err }
+          }
+        } else if open == assetPattern {   // Assets are output as URLs.
+          err = p.pushAsset(siteRoot, templateDir, string(content),
+              bufferLine)
+          if err != nil {
+            return nil, &Error{ current.HardPath, lineIndex, err }
+          }
+        } else if open == yieldPattern || open == contentForPattern {
+          err = p.pushRegion(open == yieldPattern, string(content),
+              bufferLine)  // Regions are made by the runtime.
+          if err != nil {
+            return nil, &Error{ current.HardPath, lineIndex, err }
+          }
+        } else if open == ifPattern || open == elsePattern {
+          err = p.pushBranch(open == elsePattern, string(content),
+              blockDepth)  // Branches are chosen now, not at run time.
+          if err != nil {
+            return nil, &Error{ current.HardPath, lineIndex, err }
+          }
+        } else if open == endPattern {
+          err = p.endBlock(string(content), blockDepth, bufferLine)
+          if err != nil {
+            return nil, &Error{ current.HardPath, lineIndex, err }
+          }
+        } else if open == includeStaticPattern {  // Files are not parsed.
+          err = p.pushStaticFile(siteRoot, templateDir, string(content),
+              lineIndex, bufferLine)
+          if err != nil {
+            return nil, &Error{ current.HardPath, lineIndex, err }
+          }
+        } else if name, found := customPatterns[open]; found {
+          err = p.pushCustom(name, handlers[name], string(content),
+              bufferLine)  // Registered tags make their own sections.
+          if err != nil {
+            return nil, &Error{ current.HardPath, lineIndex, err }
+          }
+        } else if open == imgPattern {  // Images are measured now.
+          err = p.pushImage(siteRoot, templateDir, string(content),
+              bufferLine)
+          if err != nil {
+            return nil, &Error{ current.HardPath, lineIndex, err }
+          }
+        } else if open == insertPattern &&
+            strings.HasPrefix(string(content), "-markdown") {
+          // The insert pattern also matches insert-markdown tags.
+          err = p.pushMarkdown(siteRoot, templateDir,
+              strings.TrimPrefix(string(content), "-markdown"), lineIndex,
+              bufferLine)
+          if err != nil {
+            return nil, &Error{ current.HardPath, lineIndex, err }
+          }
+        } else if open == insertPattern {  // Insertion requires more work.
           givenPath := strings.TrimSpace(string(content))
           // Convert the given path into a hard path.
           // Absolute given path: consult the site root.
@@ -220,8 +708,8 @@ func doParse(siteRoot, templateDir string) error {
           hardPath := filepath.Join(hardDir, givenPath)
           fileInfo, err := os.Stat(hardPath)
           if err != nil {
-            fmt.Fprintf(os.Stderr, "os.Stat failed on %s\n", hardPath)
-            return err
+            fmt.Fprintf(p.errors(), "os.Stat failed on %s\n", hardPath)
+            return nil, &Error{ current.HardPath, lineIndex, err }
           }
           entry := Entry{
               GivenPath: givenPath,
@@ -229,33 +717,387 @@ func doParse(siteRoot, templateDir string) error {
               FileInfo: fileInfo,
               InsertionLine: lineIndex,
             }
-          // Push the new entry onto the stack and make a recursive call.
-          stack = append(stack, &entry)
-          childTemplateDir := filepath.Dir(hardPath)
-          err = doParse(siteRoot, childTemplateDir)
-          if err != nil {
-            return err
-          }
-          stack = stack[:len(stack)-1]
+          p.result.Insertions = append(p.result.Insertions, Insertion{
+              Parent: current.HardPath,
+              Child: hardPath,
+              Line: lineIndex,
+            })
+          // Stop here to parse the new entry, and resume afterward.
+          scan.open, scan.buffer, scan.bufferLine = nil, []rune{}, lineIndex
+          scan.lineIndex = lineIndex
+          scan.countBytes, scan.countRunes = countBytes, countRunes
+          scan.lastRune = lastRune
+          return &entry, nil
         }
         open = nil
         buffer = []rune{}
+        bufferLine = lineIndex
       }
     }
   }
 }
 
-// pushCode makes a code section and adds it to the global sections.
-func pushCode(content string) {
-  sections = append(sections, &Section{ Kind: Code, Text: content })
+// pushCode makes a code section and adds it to the parse state.
+func (p *parseState) pushCode(content string, line int) {
+  p.pushSection(Code, content, line)
+}
+
+// pushStatic makes a static section and adds it to the parse state.
+func (p *parseState) pushStatic(chunk string, line int) {
+  p.pushSection(Static, chunk, line)
 }
 
-// pushStatic makes a static section and adds it to the global sections.
-func pushStatic(chunk string) {
-  sections = append(sections, &Section{ Kind: Static, Text: chunk })
+// pushSection adds a section that begins at a line of the current template,
+// unless it lies in a branch that is left out.
+func (p *parseState) pushSection(kind uint, text string, line int) {
+  if p.skipping() {
+    return
+  }
+  current := p.stack[len(p.stack)-1]
+  p.sections = append(p.sections, &Section{ Kind: kind, Text: text,
+      Path: current.HardPath, Line: line })
+}
+
+// pushAsset resolves the path given in an asset tag in the same way as an
+// insertion path, notes the file in the parse result, and adds an asset
+// section with the URL path of the file under the site root.
+func (p *parseState) pushAsset(siteRoot, templateDir, content string,
+    line int) error {
+  hardPath, relPath, err := resolveAsset(siteRoot, templateDir,
+      strings.TrimSpace(content))
+  if err != nil {
+    return err
+  }
+  seen := false
+  for _, assetPath := range p.result.Assets {
+    seen = seen || assetPath == hardPath
+  }
+  if !seen {
+    p.result.Assets = append(p.result.Assets, hardPath)
+  }
+  urlPath := "/" + filepath.ToSlash(relPath)
+  if p.options.Fingerprint {
+    urlPath, err = fingerprintPath(urlPath, hardPath)
+    if err != nil {
+      return err
+    }
+    p.result.Fingerprints[hardPath] = urlPath
+  }
+  p.pushSection(Asset, urlPath, line)
+  return nil
 }
 
-// makeRawStrings splits a string into back-quoted strings and back quotes.
+// resolveAsset returns the hard path of an asset and its path relative to
+// the site root, which the asset must lie within.
+func resolveAsset(siteRoot, templateDir, givenPath string) (string, string,
+    error) {
+  hardDir := templateDir
+  if path.IsAbs(givenPath) {
+    hardDir = siteRoot
+  }
+  hardPath := filepath.Join(hardDir, givenPath)
+  fileInfo, err := os.Stat(hardPath)
+  if err != nil {
+    return "", "", err
+  }
+  if fileInfo.IsDir() {
+    return "", "", fmt.Errorf("asset %s is a directory", givenPath)
+  }
+  absRoot, err := filepath.Abs(siteRoot)
+  if err != nil {
+    return "", "", err
+  }
+  relPath, err := filepath.Rel(absRoot, hardPath)
+  if err != nil || relPath == ".." ||
+      strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+    return "", "", fmt.Errorf("asset %s is outside the site root", givenPath)
+  }
+  return hardPath, relPath, nil
+}
+
+// fingerprintPath inserts a hash of the contents of an asset into its URL
+// path, before the extension if there is one.
+func fingerprintPath(urlPath, hardPath string) (string, error) {
+  data, err := os.ReadFile(hardPath)
+  if err != nil {
+    return "", err
+  }
+  sum := sha256.Sum256(data)
+  hash := hex.EncodeToString(sum[:5])
+  extension := path.Ext(urlPath)
+  return strings.TrimSuffix(urlPath, extension) + "." + hash + extension, nil
+}
+
+// pushStaticFile adds a verbatim section with the contents of the file
+// named by an include-static tag.
+func (p *parseState) pushStaticFile(siteRoot, templateDir, content string,
+    tagLine, line int) error {
+  data, err := p.includeFile(siteRoot, templateDir, content,
+      "include-static", tagLine)
+  if err != nil {
+    return err
+  }
+  p.pushSection(Verbatim, string(data), line)
+  return nil
+}
+
+// pushMarkdown renders the Markdown file named by an insert-markdown tag
+// with the renderer of the options, or BasicMarkdown, and adds a verbatim
+// section with the HTML.
+func (p *parseState) pushMarkdown(siteRoot, templateDir, content string,
+    tagLine, line int) error {
+  data, err := p.includeFile(siteRoot, templateDir, content,
+      "insert-markdown", tagLine)
+  if err != nil {
+    return err
+  }
+  renderer := p.options.Markdown
+  if renderer == nil {
+    renderer = BasicMarkdown
+  }
+  rendered, err := renderer.RenderMarkdown(data)
+  if err != nil {
+    return fmt.Errorf("insert-markdown %s: %s", strings.TrimSpace(content),
+        err)
+  }
+  p.pushSection(Verbatim, string(rendered), line)
+  return nil
+}
+
+// includeFile reads a file that a tag includes without parsing it,
+// resolving its path in the same way as an insertion path. The file is
+// recorded as an insertion and as a template of the parse result, so that
+// changing it rebuilds the page.
+func (p *parseState) includeFile(siteRoot, templateDir, content, tag string,
+    tagLine int) ([]byte, error) {
+  givenPath := strings.TrimSpace(content)
+  hardDir := templateDir
+  if path.IsAbs(givenPath) {
+    hardDir = siteRoot
+  }
+  hardPath := filepath.Join(hardDir, givenPath)
+  fileInfo, err := os.Stat(hardPath)
+  if err != nil {
+    return nil, err
+  }
+  if fileInfo.IsDir() {
+    return nil, fmt.Errorf("%s %s is a directory", tag, givenPath)
+  }
+  for _, ancestor := range p.stack {
+    if os.SameFile(ancestor.FileInfo, fileInfo) {
+      return nil, fmt.Errorf("%s cycle: %s is being parsed", tag, givenPath)
+    }
+  }
+  data, err := os.ReadFile(hardPath)
+  if err != nil {
+    return nil, err
+  }
+  current := p.stack[len(p.stack)-1]
+  p.result.Insertions = append(p.result.Insertions, Insertion{
+      Parent: current.HardPath,
+      Child: hardPath,
+      Line: tagLine,
+    })
+  p.noteTemplate(hardPath)
+  return data, nil
+}
+
+// noteTemplate records a file as a template of the parse result unless it
+// has been recorded before.
+func (p *parseState) noteTemplate(hardPath string) {
+  for _, templatePath := range p.result.Templates {
+    if templatePath == hardPath {
+      return
+    }
+  }
+  p.result.Templates = append(p.result.Templates, hardPath)
+}
+
+// pushRegion adds the code of a region tag. A yield tag reserves a place
+// for the region with the runtime's Placeholder. A content-for tag begins
+// a capture, and the matching end tag appends the captured output to the
+// region, so that the region may be filled before or after its yield.
+func (p *parseState) pushRegion(isYield bool, content string,
+    line int) error {
+  name := strings.TrimSpace(content)
+  if name == "" || strings.IndexFunc(name, unicode.IsSpace) != -1 {
+    return fmt.Errorf("region name %q is not a single word", name)
+  }
+  if isYield {
+    p.pushCode(fmt.Sprintf(";%s.Placeholder(%s);", ContextName,
+        strconv.Quote(name)), line)
+    return nil
+  }
+  p.blocks = append(p.blocks, &block{ region: name })
+  p.pushCode(fmt.Sprintf(";%s.BeginCapture();", ContextName), line)
+  return nil
+}
+
+// pushBranch handles an if or else tag. The condition of an if tag is
+// evaluated as the template is parsed, and the sections of the branch
+// that does not hold are left out of the generated code.
+func (p *parseState) pushBranch(isElse bool, content string,
+    blockDepth int) error {
+  if !isElse {
+    keep, err := p.evalCondition(content)
+    if err != nil {
+      return err
+    }
+    p.blocks = append(p.blocks, &block{ keep: keep })
+    return nil
+  }
+  if strings.TrimSpace(content) != "" {
+    return fmt.Errorf("else tag has arguments: %s", strings.TrimSpace(content))
+  }
+  if len(p.blocks) == blockDepth || p.blocks[len(p.blocks)-1].region != "" {
+    return errors.New("else tag without if")
+  }
+  latest := p.blocks[len(p.blocks)-1]
+  if latest.hasElse {
+    return errors.New("else tag after else")
+  }
+  latest.keep, latest.hasElse = !latest.keep, true
+  return nil
+}
+
+// endBlock handles an end tag, which ends the latest content-for or if
+// tag. The end of a content-for block appends its capture to the region.
+func (p *parseState) endBlock(content string, blockDepth, line int) error {
+  if strings.TrimSpace(content) != "" {
+    return fmt.Errorf("end tag has arguments: %s", strings.TrimSpace(content))
+  }
+  if len(p.blocks) == blockDepth {
+    return errors.New("end tag without content-for or if")
+  }
+  latest := p.blocks[len(p.blocks)-1]
+  p.blocks = p.blocks[:len(p.blocks)-1]
+  if latest.region != "" {
+    p.pushCode(fmt.Sprintf(";%s.AppendFill(%s, %s.EndCapture());",
+        ContextName, strconv.Quote(latest.region), ContextName), line)
+  }
+  return nil
+}
+
+// skipping reports whether the parser is in a branch that is left out.
+func (p *parseState) skipping() bool {
+  for _, b := range p.blocks {
+    if b.region == "" && !b.keep {
+      return true
+    }
+  }
+  return false
+}
+
+// evalCondition evaluates the condition of an if tag, which is env "name",
+// true if name is the environment of the build, or tag "name", true if
+// name is one of its build tags. A leading not negates the condition.
+func (p *parseState) evalCondition(content string) (bool, error) {
+  fields := strings.Fields(content)
+  negate := len(fields) != 0 && fields[0] == "not"
+  if negate {
+    fields = fields[1:]
+  }
+  if len(fields) != 2 {
+    return false, fmt.Errorf("condition %q is not of the form env \"name\" "+
+        "or tag \"name\"", strings.TrimSpace(content))
+  }
+  name, err := strconv.Unquote(fields[1])
+  if err != nil {
+    return false, fmt.Errorf("condition %q has an unquoted name",
+        strings.TrimSpace(content))
+  }
+  holds := false
+  switch fields[0] {
+  case "env":
+    holds = name == p.options.Environment
+  case "tag":
+    for _, tag := range p.options.Tags {
+      holds = holds || tag == name
+    }
+  default:
+    return false, fmt.Errorf("unknown condition %q", fields[0])
+  }
+  return holds != negate, nil
+}
+
+// templateName returns the path of a template relative to the site root
+// in the form of a URL path, which is how log lines name it, or the hard
+// path if the template lies outside the site root.
+func templateName(siteRoot, hardPath string) string {
+  absRoot, err := filepath.Abs(siteRoot)
+  if err != nil {
+    return hardPath
+  }
+  relPath, err := filepath.Rel(absRoot, hardPath)
+  if err != nil || relPath == ".." ||
+      strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+    return hardPath
+  }
+  return "/" + filepath.ToSlash(relPath)
+}
+
+// parseMeta reads "key: value" lines from the body of a meta tag into the
+// meta map of the parse result. Blank lines are ignored.
+func (p *parseState) parseMeta(content string) error {
+  for _, line := range strings.Split(content, "\n") {
+    line = strings.TrimSpace(line)
+    if line == "" {
+      continue
+    }
+    colon := strings.Index(line, ":")
+    if colon <= 0 {
+      return fmt.Errorf("meta line \"%s\" is not of the form key: value",
+          line)
+    }
+    key := strings.TrimSpace(line[:colon])
+    value := strings.TrimSpace(line[colon+1:])
+    p.result.Meta.Add(key, value)
+  }
+  return nil
+}
+
+// splitLiteral divides the text of a static or verbatim section into
+// chunks of at most MaxLiteral bytes, ending each chunk on a line break if
+// there is one in its second half, and otherwise on a character boundary.
+// A warning is added to the result if the section is split.
+func (p *parseState) splitLiteral(section *Section) []string {
+  maxLiteral := p.options.MaxLiteral
+  if maxLiteral == 0 {
+    maxLiteral = DefaultMaxLiteral
+  }
+  text := section.Text
+  if maxLiteral < 0 || len(text) <= maxLiteral {
+    return []string{ text }
+  }
+  chunks := []string{}
+  for len(text) > maxLiteral {
+    end := maxLiteral
+    if newline := strings.LastIndexByte(text[:end], '\n');
+        newline >= maxLiteral/2 {
+      end = newline+1
+    } else {
+      for end > 0 && !utf8.RuneStart(text[end]) {
+        end--
+      }
+      if end == 0 {  // A limit smaller than a character still progresses.
+        _, end = utf8.DecodeRuneInString(text)
+      }
+    }
+    chunks = append(chunks, text[:end])
+    text = text[end:]
+  }
+  if len(text) != 0 {
+    chunks = append(chunks, text)
+  }
+  p.result.Warnings = append(p.result.Warnings, &Error{ section.Path,
+      section.Line, fmt.Errorf("static text of %d bytes was split into %d "+
+      "literals of at most %d bytes", len(section.Text), len(chunks),
+      maxLiteral) })
+  return chunks
+}
+
+// makeRawStrings splits a string into back-quoted strings and quoted back
+// quotes, which raw strings cannot contain.
 func makeRawStrings(content string) (pieces []string) {
   pieces = []string{}
   from := 0
@@ -264,7 +1106,7 @@ func makeRawStrings(content string) (pieces []string) {
       if pos != from {
         pieces = append(pieces, fmt.Sprintf("`%s`", content[from:pos]))
       }
-      pieces = append(pieces, "'`'")
+      pieces = append(pieces, "\"`\"")
       from = pos+1
     }
   }
@@ -274,20 +1116,67 @@ func makeRawStrings(content string) (pieces []string) {
   return
 }
 
+// callsPrintCGI reports whether a function calls the runtime's PrintCGI
+// itself, with the given prefix, in which case no call is injected.
+func callsPrintCGI(funcDecl *ast.FuncDecl, printPrefix string) bool {
+  found := false
+  ast.Inspect(funcDecl.Body, func (node ast.Node) bool {
+    call, ok := node.(*ast.CallExpr)
+    if !ok || found {
+      return !found
+    }
+    switch fun := call.Fun.(type) {
+    case *ast.Ident:
+      found = printPrefix == "" && fun.Name == "PrintCGI"
+    case *ast.SelectorExpr:
+      x, ok := fun.X.(*ast.Ident)
+      found = ok && x.Name+"." == printPrefix && fun.Sel.Name == "PrintCGI"
+    }
+    return !found
+  })
+  return found
+}
+
+// failure wraps an error of Process with the insertions parsed so far.
+func (p *parseState) failure(err error) error {
+  var insertions []Insertion
+  if p.result != nil {
+    insertions = p.result.Insertions
+  }
+  return &ProcessError{ Insertions: insertions, Err: err }
+}
+
 // Process is the top-level template parsing function. It calls
 // parse, then glues the sections together and injects an import statement
-// as needed. The final result is printed to a buffered writer.
-func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
+// as needed. The final result is printed to a buffered writer. On success,
+// Process returns a Result describing the template; on failure, the error
+// is a *ProcessError. The options may be nil.
+// Process may be called concurrently. Static sections are written to the
+// runtime context named by ContextName. Unless the FastCGI, Handler, or
+// Lambda option is set, deferred calls are injected at the head of main:
+// one of the runtime's PrintCGI, unless main calls it itself, and one of
+// the context's Recover, which answers a panic with an error page.
+func Process(siteRoot, templatePath string, writer *bufio.Writer,
+    opts *Options) (*Result, error) {
+  if opts == nil {
+    opts = &Options{}
+  }
+  p := &parseState{ options: opts }
+
   // Parse the template to obtain code sections and static sections.
-  err := parse(siteRoot, templatePath)
+  startTime := time.Now()
+  err := p.parse(siteRoot, templatePath)
+  parseTime := time.Since(startTime)
   if err != nil {
     message := fmt.Sprintf("Template parsing error in %s: %s\n",
         templatePath, err)
-    fmt.Fprint(os.Stderr, message)
+    fmt.Fprint(p.errors(), message)
     writer.WriteString(message)
-    return err
+    return nil, p.failure(err)
   }
 
+  sections := p.sections
+
   // Discard whitespace sections before the first code section.
   for len(sections) != 0 {
     section := sections[0]
@@ -332,15 +1221,23 @@ func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
   // Between these code sections, left-trim the initial static sections and
   //  right-trim the final static sections.
   for i := codeLeft+1; i < codeRight; i++ {
+    if sections[i].Kind == Asset || sections[i].Kind == Verbatim {
+      break  // An asset is never empty, and verbatim text is not trimmed.
+    }
     if sections[i].Kind == Static {
-      sections[i].Text = strings.TrimLeftFunc(sections[i].Text,
-          unicode.IsSpace)
+      trimmed := strings.TrimLeftFunc(sections[i].Text, unicode.IsSpace)
+      sections[i].Line += strings.Count(
+          sections[i].Text[:len(sections[i].Text)-len(trimmed)], "\n")
+      sections[i].Text = trimmed
       if len(sections[i].Text) != 0 {  // Continue trimming until the
         break                          // resulting section is non-empty. 
       }
     }
   }
   for i := codeRight-1; i > codeLeft; i-- {
+    if sections[i].Kind == Asset || sections[i].Kind == Verbatim {
+      break
+    }
     if sections[i].Kind == Static {
       sections[i].Text = strings.TrimRightFunc(sections[i].Text,
           unicode.IsSpace)
@@ -358,16 +1255,21 @@ func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
     n := len(sections)
     for pos := 0; pos < n; pos++ {
       section := sections[pos]
-      if section.Kind == Code || pos+1 == n || sections[pos+1].Kind == Code {
+      if section.Kind != Static || pos+1 == n ||
+          sections[pos+1].Kind != Static {
         newSections = append(newSections, section)
         continue
       }
       substrings := []string{}
+      parts := []*Section{}
       var seek int
       for seek = pos; seek < n && sections[seek].Kind == Static; seek++ {
         substrings = append(substrings, sections[seek].Text)
+        part := *sections[seek]
+        parts = append(parts, &part)
       }
       section.Text = strings.Join(substrings, "")
+      section.parts = parts
       newSections = append(newSections, section)
       pos = seek-1
     }
@@ -384,12 +1286,27 @@ func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
   }
   sections = newSections
 
+  // Warn of a template whose sections would make an unwieldy function.
+  maxSections := opts.MaxSections
+  if maxSections == 0 {
+    maxSections = DefaultMaxSections
+  }
+  if maxSections > 0 && len(sections) > maxSections {
+    section := sections[maxSections]
+    p.result.Warnings = append(p.result.Warnings, &Error{ section.Path,
+        section.Line, fmt.Errorf("the template has %d sections, more than "+
+        "the limit of %d", len(sections), maxSections) })
+  }
+
   // Concatenate only the code sections. We're not adding print statements yet
   // because we don't know what the print command is going to look like. We
   // do want to parse the user's code in order to scan the imports.
+  // The offset of each section is noted to place syntax errors.
   output := bytes.Buffer{}
+  codeSpans := []sectionSpan{}
   for _, section := range sections {
     if section.Kind == Code {
+      codeSpans = append(codeSpans, sectionSpan{ output.Len(), section })
       fmt.Fprint(&output, section.Text)
       fmt.Fprint(&output, "\n")  // Ensure that statements are separated.
     }
@@ -398,14 +1315,18 @@ func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
   file, err := parser.ParseFile(fileSet, "output", output.Bytes(),
       parser.ParseComments)
   if err != nil {
+    placeSyntaxErrors(err, codeSpans, output.Bytes())
     message := fmt.Sprintf("Error parsing code sections: %s\n", err)
-    fmt.Fprint(os.Stderr, message)
+    fmt.Fprint(p.errors(), message)
     writer.WriteString(fmt.Sprintf("%s\n---\n%s", output.Bytes(), message))
-    return err
+    return nil, p.failure(err)
   }
 
   // seekPath is the import path of the package containing the print command.
-  seekPath := "github.com/michaellaszlo/boomerang/runtime" 
+  seekPath := RuntimePath
+  if opts.RuntimePath != "" {
+    seekPath = opts.RuntimePath
+  }
   seekName := path.Base(seekPath)
   printCall := "WriteString"
 
@@ -416,6 +1337,9 @@ func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
 
   for _, importSpec := range file.Imports {
     importPath, _ := strconv.Unquote(importSpec.Path.Value)
+    if importPath == RuntimePath {  // The path may be rewritten below.
+      importPath = seekPath
+    }
     var importName string
     if importSpec.Name == nil {
       importName = path.Base(importPath)
@@ -448,18 +1372,31 @@ func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
     }
     printPrefix = importAs+"."
   }
+  // Output goes to the runtime context, not to the runtime's globals.
+  outputPrefix := ContextName+"."
 
   // Concatenate the code with static sections wrapped in print statements.
+  // The offset of each section is noted for the source map.
   output.Reset()
+  spans := []sectionSpan{}
   for _, section := range sections {
+    spans = append(spans, sectionSpan{ output.Len(), section })
     if section.Kind == Code {
       fmt.Fprint(&output, section.Text)
       fmt.Fprint(&output, "\n")  // Ensure that statements are separated.
+    } else if section.Kind == Asset {  // The runtime decides on the URL.
+      fmt.Fprintf(&output, ";%s%s(%sAssetURL(%s));", outputPrefix,
+          printCall, outputPrefix, strconv.Quote(section.Text))
+    } else if section.Kind == Verbatim {  // Any bytes can be quoted.
+      for _, chunk := range p.splitLiteral(section) {
+        fmt.Fprintf(&output, ";%s%s(%s);", outputPrefix, printCall,
+            strconv.Quote(chunk))
+      }
     } else {
-      pieces := makeRawStrings(section.Text)
-      for _, piece := range pieces {
-        s := fmt.Sprintf(";%s%s(%s);", printPrefix, printCall, piece)
-        fmt.Fprintf(&output, s)
+      for _, chunk := range p.splitLiteral(section) {
+        for _, piece := range makeRawStrings(chunk) {
+          fmt.Fprintf(&output, ";%s%s(%s);", outputPrefix, printCall, piece)
+        }
       }
     }
   }
@@ -469,10 +1406,20 @@ func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
   file, err = parser.ParseFile(fileSet, "output", output.Bytes(),
       parser.ParseComments)
   if err != nil {
+    placeSyntaxErrors(err, spans, output.Bytes())
     message := fmt.Sprintf("Error parsing template output: %s\n", err)
-    fmt.Fprint(os.Stderr, message)
+    fmt.Fprint(p.errors(), message)
     writer.WriteString(fmt.Sprintf("%s\n---\n%s", output.Bytes(), message))
-    return err
+    return nil, p.failure(err)
+  }
+  // Point imports of the runtime at its replacement, if there is one.
+  for _, importSpec := range file.Imports {
+    importPath, _ := strconv.Unquote(importSpec.Path.Value)
+    if importPath == RuntimePath && seekPath != RuntimePath {
+      importSpec.Path.Value = strconv.Quote(seekPath)
+    } else if importPath == HelpersPath && seekPath != RuntimePath {
+      importSpec.Path.Value = strconv.Quote(seekPath + "/helpers")
+    }
   }
   // Inject an import statement if necessary.
   if !isImported {
@@ -482,25 +1429,135 @@ func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
       astutil.AddNamedImport(fileSet, file, importAs, seekPath)
     }
   }
+  // Import the helpers if the code names them but no import does.
+  if !seenName["helpers"] {
+    for _, ident := range file.Unresolved {
+      if ident.Name == "helpers" {
+        astutil.AddImport(fileSet, file, seekPath + "/helpers")
+        break
+      }
+    }
+  }
+
+  // runtimeFunc makes an expression for a function of the runtime, using
+  // the name under which the runtime is imported.
+  runtimeFunc := func(name string) ast.Expr {
+    if printPrefix == "" {
+      return ast.NewIdent(name)
+    }
+    return &ast.SelectorExpr {
+      X: ast.NewIdent(strings.TrimSuffix(printPrefix, ".")),
+      Sel: ast.NewIdent(name),
+    }
+  }
+
+  if p.options.Package != "" {
+    file.Name = ast.NewIdent(p.options.Package)
+  }
+  // Outside a handler, the context is the runtime's current one, which is
+  // declared at the end so as not to disturb the source map.
+  if !p.options.Handler && !p.options.Lambda {
+    file.Decls = append(file.Decls, &ast.GenDecl{
+      Tok: token.VAR,
+      Specs: []ast.Spec{ &ast.ValueSpec{
+        Names: []*ast.Ident{ ast.NewIdent(ContextName) },
+        Values: []ast.Expr{ &ast.CallExpr{ Fun: runtimeFunc("Current") } },
+      } },
+    })
+  }
+
+  // Constants given by the options are declared at the end, too.
+  if len(p.options.Defines) != 0 {
+    keys := []string{}
+    for key := range p.options.Defines {
+      keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    specs := []ast.Spec{}
+    for _, key := range keys {
+      specs = append(specs, &ast.ValueSpec{
+        Names: []*ast.Ident{ ast.NewIdent(key) },
+        Values: []ast.Expr{ &ast.BasicLit{ Kind: token.STRING,
+            Value: strconv.Quote(p.options.Defines[key]) } },
+      })
+    }
+    file.Decls = append(file.Decls, &ast.GenDecl{ Tok: token.CONST,
+        Lparen: 1, Specs: specs })
+  }
+
+  // Each run of the page names its template for the runtime's logs.
+  setTemplate := &ast.ExprStmt{ X: &ast.CallExpr{
+    Fun: &ast.SelectorExpr{ X: ast.NewIdent(ContextName),
+        Sel: ast.NewIdent("SetTemplate") },
+    Args: []ast.Expr{ &ast.BasicLit{ Kind: token.STRING,
+        Value: strconv.Quote(templateName(siteRoot, p.stack[0].HardPath)) } },
+  } }
+
+  // The page's deadline starts as it begins.
+  startDeadline := &ast.ExprStmt{ X: &ast.CallExpr{
+    Fun: &ast.SelectorExpr{ X: ast.NewIdent(ContextName),
+        Sel: ast.NewIdent("StartDeadline") },
+  } }
 
   // Look for the main function among the top-level declarations.
   for _, decl := range file.Decls {
     funcDecl, hasType := decl.(*ast.FuncDecl)
     if hasType {
       funcName := funcDecl.Name.Name
+      if funcName == "main" && funcDecl.Recv == nil &&
+          (p.options.Handler || p.options.Lambda) {
+        makeHandler(fileSet, file, funcDecl, runtimeFunc,
+            strings.TrimSuffix(printPrefix, "."), setTemplate, startDeadline)
+        if p.options.Lambda {
+          file.Decls = append(file.Decls, &ast.FuncDecl{
+            Name: ast.NewIdent("main"),
+            Type: &ast.FuncType{ Params: &ast.FieldList{} },
+            Body: &ast.BlockStmt{ List: []ast.Stmt{
+              &ast.ExprStmt{ X: &ast.CallExpr{
+                Fun: runtimeFunc("ServeLambda"),
+                Args: []ast.Expr{ ast.NewIdent(HandlerFunction) },
+              } },
+            } },
+          })
+        }
+        break
+      }
+      if funcName == "main" && funcDecl.Recv == nil && p.options.FastCGI {
+        // The runtime prints the response after each run of the page.
+        funcDecl.Name = ast.NewIdent(PageFunction)
+        funcDecl.Body.List = append([]ast.Stmt{ setTemplate, startDeadline },
+            funcDecl.Body.List...)
+        file.Decls = append(file.Decls, &ast.FuncDecl{
+          Name: ast.NewIdent("main"),
+          Type: &ast.FuncType{ Params: &ast.FieldList{} },
+          Body: &ast.BlockStmt{ List: []ast.Stmt{
+            &ast.ExprStmt{ X: &ast.CallExpr{
+              Fun: runtimeFunc("ServeFastCGI"),
+              Args: []ast.Expr{ ast.NewIdent(PageFunction) },
+            } },
+          } },
+        })
+        break
+      }
       if funcName == "main" {
-        // Build a new statement: defer runtime.PrintCGI()
-        statement := &ast.DeferStmt{
-          Call: &ast.CallExpr {
-            Fun: &ast.SelectorExpr {
-              X: ast.NewIdent("runtime"),
-              Sel: ast.NewIdent("PrintCGI"),
+        newStatements := []ast.Stmt{}
+        if !callsPrintCGI(funcDecl, printPrefix) {
+          // Build a new statement: defer runtime.PrintCGI().
+          newStatements = append(newStatements, &ast.DeferStmt{
+            Call: &ast.CallExpr {
+              Fun: runtimeFunc("PrintCGI"),
             },
-          },
+          })
         }
-        // Insert the new statement at the head of func main()
+        // A panic becomes an error page: defer boomerang.Recover().
+        newStatements = append(newStatements, &ast.DeferStmt{
+          Call: &ast.CallExpr{ Fun: &ast.SelectorExpr{
+            X: ast.NewIdent(ContextName),
+            Sel: ast.NewIdent("Recover"),
+          } },
+        }, setTemplate, startDeadline)
+        // Insert the new statements at the head of func main()
         oldStatements := funcDecl.Body.List
-        newStatements := []ast.Stmt{ statement }
         funcDecl.Body.List = append(newStatements, oldStatements...)
       }
     }
@@ -508,7 +1565,12 @@ func Process(siteRoot, templatePath string, writer *bufio.Writer) error {
 
   // Print with a custom configuration: soft tabs of two spaces each.
   config := printer.Config{ Mode: printer.UseSpaces, Tabwidth: 2 }
-  (&config).Fprint(writer, fileSet, file)
-  return nil
+  code := bytes.Buffer{}
+  (&config).Fprint(&code, fileSet, file)
+  writer.Write(code.Bytes())
+  p.result.ParseTime = parseTime
+  p.result.SourceMap = makeSourceMap(fileSet, file, output.Bytes(), spans,
+      code.Bytes())
+  return p.result, nil
 } // end Process
 
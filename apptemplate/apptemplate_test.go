@@ -0,0 +1,269 @@
+package apptemplate
+
+import (
+  "os"
+  "sync"
+  "errors"
+  "bufio"
+  "bytes"
+  "strings"
+  "testing"
+  "path/filepath"
+)
+
+// process writes a template to a new site and processes it, returning the
+// generated code and the result.
+func process(t *testing.T, text string, opts *Options) (string, *Result,
+    error) {
+  t.Helper()
+  siteRoot := t.TempDir()
+  templatePath := filepath.Join(siteRoot, "page.html")
+  if err := os.WriteFile(templatePath, []byte(text), 0644); err != nil {
+    t.Fatal(err)
+  }
+  if opts == nil {
+    opts = &Options{}
+  }
+  opts.Errors = &bytes.Buffer{}
+  var output bytes.Buffer
+  writer := bufio.NewWriter(&output)
+  result, err := Process(siteRoot, templatePath, writer, opts)
+  writer.Flush()
+  return output.String(), result, err
+}
+
+// page wraps a template body in a main function.
+func page(body string) string {
+  return "<?code\n  package main\n\n  func main() {\n?>" + body +
+      "<?code\n  }\n?>\n"
+}
+
+// TestStaticText checks that static text is written as it is, even where
+// it looks like a format.
+func TestStaticText(t *testing.T) {
+  cases := []string{
+    `<div style="width: 100%">50% off</div>`,
+    `%d %s %% %!`,
+    "100%\n",
+  }
+  for _, text := range cases {
+    output, _, err := process(t, page("<p>"+text+"</p>"), nil)
+    if err != nil {
+      t.Errorf("%q: %s", text, err.Error())
+      continue
+    }
+    if !strings.Contains(output, text) || strings.Contains(output, "%!(") {
+      t.Errorf("%q is not kept in:\n%s", text, output)
+    }
+  }
+}
+
+// TestMeta checks that meta tags are read into the result.
+func TestMeta(t *testing.T) {
+  body := "<?meta\n  title: Home\n\n  tag: a\n  tag: b\n?>"
+  _, result, err := process(t, page(body), nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got := result.Meta.Get("title"); got != "Home" {
+    t.Errorf("title is %q, want Home", got)
+  }
+  if got := result.Meta.Values("tag"); len(got) != 2 || got[0] != "a" ||
+      got[1] != "b" {
+    t.Errorf("tags are %q, want a and b", got)
+  }
+}
+
+// checkErrors processes templates that are expected to fail and checks
+// that each error has the given message and is placed at a line.
+func checkErrors(t *testing.T, cases [][2]string) {
+  t.Helper()
+  for _, c := range cases {
+    body, message := c[0], c[1]
+    _, _, err := process(t, page(body), nil)
+    if err == nil {
+      t.Errorf("%s: no error", body)
+      continue
+    }
+    if !strings.Contains(err.Error(), message) {
+      t.Errorf("%s: error %q, want %q", body, err.Error(), message)
+    }
+    var lineError *Error
+    if !errors.As(err, &lineError) || lineError.Line == 0 {
+      t.Errorf("%s: error is not placed at a line", body)
+    }
+  }
+}
+
+// TestMetaErrors checks that a meta line without a key is an error.
+func TestMetaErrors(t *testing.T) {
+  checkErrors(t, [][2]string{
+    { "<?meta\n  title\n?>", "is not of the form key: value" },
+    { "<?meta\n  : Home\n?>", "is not of the form key: value" },
+  })
+}
+
+// TestRegions checks the code of yield and content-for tags.
+func TestRegions(t *testing.T) {
+  body := `<?yield scripts ?><?content-for scripts ?>x<?end ?>`
+  output, _, err := process(t, page(body), nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, code := range []string{ `.Placeholder("scripts")`,
+      `.BeginCapture()`, `.AppendFill("scripts", ` } {
+    if !strings.Contains(output, code) {
+      t.Errorf("%s is missing from:\n%s", code, output)
+    }
+  }
+}
+
+// TestRegionErrors checks the errors of misused yield and content-for
+// tags.
+func TestRegionErrors(t *testing.T) {
+  checkErrors(t, [][2]string{
+    { `<?end ?>`, "end tag without content-for" },
+    { `<?content-for x ?><?end now ?>`, "end tag has arguments" },
+    { `<?content-for x ?>`, "content-for x is not ended" },
+    { `<?yield ?>`, "is not a single word" },
+    { `<?content-for a b ?><?end ?>`, "is not a single word" },
+  })
+}
+
+// TestBranches checks that if and else tags keep the branch whose
+// condition holds for the environment and tags of the build.
+func TestBranches(t *testing.T) {
+  opts := func() *Options {
+    return &Options{ Environment: "production", Tags: []string{ "beta" } }
+  }
+  cases := []struct {
+    body string
+    kept, dropped []string
+  }{
+    { `<?if env "production" ?>live<?else ?>draft<?end ?>`,
+        []string{ "live" }, []string{ "draft" } },
+    { `<?if env "staging" ?>live<?else ?>draft<?end ?>`,
+        []string{ "draft" }, []string{ "live" } },
+    { `<?if tag "beta" ?>new<?end ?>`, []string{ "new" }, nil },
+    { `<?if not tag "beta" ?>old<?end ?>`, nil, []string{ "old" } },
+    { `<?if not env "staging" ?>shown<?end ?>`, []string{ "shown" }, nil },
+    { `<?if env "production" ?>a<?if tag "alpha" ?>b<?else ?>c<?end ?>` +
+        `<?end ?>`, []string{ "a", "c" }, []string{ `"b"`, "`b`" } },
+    { `<?if tag "alpha" ?><?insert missing.html ?><?end ?>ok`,
+        []string{ "ok" }, nil },
+  }
+  for _, c := range cases {
+    output, _, err := process(t, page(c.body), opts())
+    if err != nil {
+      t.Errorf("%s: %s", c.body, err.Error())
+      continue
+    }
+    for _, text := range c.kept {
+      if !strings.Contains(output, text) {
+        t.Errorf("%s: %q is missing", c.body, text)
+      }
+    }
+    for _, text := range c.dropped {
+      if strings.Contains(output, text) {
+        t.Errorf("%s: %q is not left out", c.body, text)
+      }
+    }
+  }
+}
+
+// TestBranchErrors checks the errors of misused if, else, and end tags
+// and of malformed conditions.
+func TestBranchErrors(t *testing.T) {
+  checkErrors(t, [][2]string{
+    { `<?else ?>`, "else tag without if" },
+    { `<?if env "a" ?><?else ?><?else ?><?end ?>`, "else tag after else" },
+    { `<?content-for x ?><?else ?><?end ?>`, "else tag without if" },
+    { `<?if env "a" ?><?else now ?><?end ?>`, "else tag has arguments" },
+    { `<?end ?>`, "end tag without content-for or if" },
+    { `<?if env "a" ?><?end now ?>`, "end tag has arguments" },
+    { `<?if env "a" ?>`, "if is not ended" },
+    { `<?if env ?><?end ?>`, "is not of the form" },
+    { `<?if env a ?><?end ?>`, "has an unquoted name" },
+    { `<?if path "a" ?><?end ?>`, `unknown condition "path"` },
+  })
+}
+
+// TestRecursion processes the insertion fixtures: the correct templates
+// insert four others, and the incorrect ones insert themselves in a cycle.
+func TestRecursion(t *testing.T) {
+  siteRoot := filepath.Join("..", "tests", "recursion")
+  cases := []struct {
+    file string
+    fails bool
+  }{
+    { "0.correct.abs.html", false },
+    { "0.correct.rel.html", false },
+    { "0.incorrect.abs.html", true },
+    { "0.incorrect.rel.html", true },
+  }
+  for _, c := range cases {
+    var output, messages bytes.Buffer
+    writer := bufio.NewWriter(&output)
+    result, err := Process(siteRoot, filepath.Join(siteRoot, c.file), writer,
+        &Options{ Errors: &messages })
+    writer.Flush()
+    if c.fails {
+      if err == nil || !strings.Contains(err.Error(), "insertion cycle") {
+        t.Errorf("%s: error %v, want an insertion cycle", c.file, err)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%s: %s", c.file, err.Error())
+      continue
+    }
+    if len(result.Templates) != 5 {
+      t.Errorf("%s: read %d templates, want 5", c.file,
+          len(result.Templates))
+    }
+    for _, n := range []string{ "0", "1", "2", "3", "4" } {
+      if !strings.Contains(output.String(), "<p> "+n+" </p>") {
+        t.Errorf("%s: paragraph %s is missing", c.file, n)
+      }
+    }
+  }
+}
+
+// TestConcurrentProcess checks that templates processed at once do not
+// share a parse state.
+func TestConcurrentProcess(t *testing.T) {
+  siteRoot := t.TempDir()
+  templatePath := filepath.Join(siteRoot, "page.html")
+  text := page(`<?if env "a" ?>a<?end ?><?meta n: 1 ?>b`)
+  if err := os.WriteFile(templatePath, []byte(text), 0644); err != nil {
+    t.Fatal(err)
+  }
+  var wait sync.WaitGroup
+  outputs := make([]string, 8)
+  results := make([]*Result, len(outputs))
+  for i := range outputs {
+    wait.Add(1)
+    go func(i int) {
+      defer wait.Done()
+      var output bytes.Buffer
+      writer := bufio.NewWriter(&output)
+      results[i], _ = Process(siteRoot, templatePath, writer,
+          &Options{ Errors: &bytes.Buffer{}, Environment: "a" })
+      writer.Flush()
+      outputs[i] = output.String()
+    }(i)
+  }
+  wait.Wait()
+  for i, output := range outputs {
+    if results[i] == nil {
+      t.Errorf("process %d failed:\n%s", i, output)
+      continue
+    }
+    if output != outputs[0] {
+      t.Errorf("output %d differs:\n%s", i, output)
+    }
+    if got := results[i].Meta.Values("n"); len(got) != 1 {
+      t.Errorf("process %d read %d meta values, want 1", i, len(got))
+    }
+  }
+}
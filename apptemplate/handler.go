@@ -0,0 +1,172 @@
+package apptemplate
+
+import (
+  "go/ast"
+  "go/token"
+  "golang.org/x/tools/go/ast/astutil"
+)
+
+// HandlerFunction is the name that the main function of a template takes
+// with the Handler option.
+const HandlerFunction = "Handler"
+
+// httpImportName is the name under which net/http is imported for the
+// handler's signature, so that it cannot clash with the template's imports.
+const httpImportName = "boomerang_http"
+
+// contextMethods maps the functions of the runtime that write to the
+// default context to the methods of Context that do the same.
+var contextMethods = map[string]string{
+  "WriteString": "WriteString",
+  "Print": "Print",
+  "Println": "Println",
+  "Printf": "Printf",
+  "PrintEscaped": "PrintEscaped",
+  "PrintfEscaped": "PrintfEscaped",
+  "Placeholder": "Placeholder",
+  "Fill": "Fill",
+  "AppendFill": "AppendFill",
+  "BeginCapture": "BeginCapture",
+  "EndCapture": "EndCapture",
+  "AddFilter": "AddFilter",
+  "WriteJSON": "WriteJSON",
+  "WriteXML": "WriteXML",
+  "WriteRSS": "WriteRSS",
+  "WriteAtom": "WriteAtom",
+  "SendEvent": "SendEvent",
+  "RequestContext": "RequestContext",
+  "ClientGone": "ClientGone",
+  "PrintCGI": "Finish",
+  "SetCompression": "SetCompression",
+  "SetTrimming": "SetTrimming",
+  "SetOutputMode": "SetOutputMode",
+  "SetETag": "SetETag",
+  "SetLastModified": "SetLastModified",
+  "SetHTTPStatus": "SetHTTPStatus",
+  "SetStatus": "SetStatus",
+  "NotFound": "NotFound",
+  "Forbidden": "Forbidden",
+  "ServerError": "ServerError",
+  "Halt": "Halt",
+  "Redirect": "Redirect",
+  "RedirectWithStatus": "RedirectWithStatus",
+  "SetHeader": "SetHeader",
+  "AddHeader": "AddHeader",
+  "DelHeader": "DelHeader",
+  "ApplySecurityHeaders": "ApplySecurityHeaders",
+  "SetContentType": "SetContentType",
+  "ContentType": "ContentType",
+  "HTML": "HTML",
+  "JSON": "JSON",
+  "PlainText": "PlainText",
+  "XML": "XML",
+  "Getenv": "Getenv",
+  "Body": "Body",
+  "Request": "Request",
+  "FormFile": "FormFile",
+  "Cookie": "Cookie",
+  "SetCookie": "SetCookie",
+  "CSRFToken": "CSRFToken",
+  "CSRFInput": "CSRFInput",
+  "ValidateCSRF": "ValidateCSRF",
+  "Authorize": "Authorize",
+  "RequireBasicAuth": "RequireBasicAuth",
+  "AuthUser": "AuthUser",
+  "AssetURL": "AssetURL",
+  "URL": "URL",
+  "AbsoluteURL": "AbsoluteURL",
+  "Paginate": "Paginate",
+  "T": "T",
+  "Locale": "Locale",
+  "SetLocale": "SetLocale",
+  "Negotiate": "Negotiate",
+  "NegotiateLanguage": "NegotiateLanguage",
+  "NegotiateEncoding": "NegotiateEncoding",
+  "NegotiateCharset": "NegotiateCharset",
+  "Cache": "Cache",
+  "Allow": "Allow",
+  "RateLimit": "RateLimit",
+  "ClientIP": "ClientIP",
+  "DB": "DB",
+  "Log": "Log",
+  "Logf": "Logf",
+  "Debug": "Debug",
+  "Debugf": "Debugf",
+  "RequestID": "RequestID",
+  "TraceID": "TraceID",
+  "SpanID": "SpanID",
+  "TraceParent": "TraceParent",
+  "Propagate": "Propagate",
+}
+
+// makeHandler turns the main function of a template into a function
+// with the signature of an http.HandlerFunc. The handler makes a runtime
+// context for the request, runs the setup statements, recovers from
+// panics, and finishes the response when it returns unless main calls
+// PrintCGI itself. Uses of the runtime's
+// output functions in the body are redirected to the context. With a named
+// import of the runtime, runtimeName is the name; with a dot import, it is
+// "" and calls of the functions by their bare names are redirected.
+func makeHandler(fileSet *token.FileSet, file *ast.File,
+    funcDecl *ast.FuncDecl, runtimeFunc func(string) ast.Expr,
+    runtimeName string, setup ...ast.Stmt) {
+  printPrefix := runtimeName
+  if printPrefix != "" {
+    printPrefix += "."
+  }
+  finishes := callsPrintCGI(funcDecl, printPrefix)
+  contextMethod := func(name string) ast.Expr {
+    return &ast.SelectorExpr{ X: ast.NewIdent(ContextName),
+        Sel: ast.NewIdent(contextMethods[name]) }
+  }
+  ast.Inspect(funcDecl.Body, func (node ast.Node) bool {
+    switch node := node.(type) {
+    case *ast.SelectorExpr:
+      x, ok := node.X.(*ast.Ident)
+      if ok && runtimeName != "" && x.Name == runtimeName &&
+          contextMethods[node.Sel.Name] != "" {
+        *node = *contextMethod(node.Sel.Name).(*ast.SelectorExpr)
+      }
+    case *ast.CallExpr:
+      fun, ok := node.Fun.(*ast.Ident)
+      if ok && runtimeName == "" && contextMethods[fun.Name] != "" {
+        node.Fun = contextMethod(fun.Name)
+      }
+    }
+    return true
+  })
+  astutil.AddNamedImport(fileSet, file, httpImportName, "net/http")
+  httpType := func(name string) ast.Expr {
+    return &ast.SelectorExpr{ X: ast.NewIdent(httpImportName),
+        Sel: ast.NewIdent(name) }
+  }
+  contextCall := func(name string) *ast.CallExpr {
+    return &ast.CallExpr{ Fun: &ast.SelectorExpr{
+        X: ast.NewIdent(ContextName), Sel: ast.NewIdent(name) } }
+  }
+  funcDecl.Name = ast.NewIdent(HandlerFunction)
+  funcDecl.Type = &ast.FuncType{ Params: &ast.FieldList{ List: []*ast.Field{
+    { Names: []*ast.Ident{ ast.NewIdent("boomerangWriter") },
+        Type: httpType("ResponseWriter") },
+    { Names: []*ast.Ident{ ast.NewIdent("boomerangRequest") },
+        Type: &ast.StarExpr{ X: httpType("Request") } },
+  } } }
+  prologue := []ast.Stmt{
+    &ast.AssignStmt{
+      Lhs: []ast.Expr{ ast.NewIdent(ContextName) },
+      Tok: token.DEFINE,
+      Rhs: []ast.Expr{ &ast.CallExpr{
+        Fun: runtimeFunc("NewContext"),
+        Args: []ast.Expr{ ast.NewIdent("boomerangWriter"),
+            ast.NewIdent("boomerangRequest") },
+      } },
+    },
+  }
+  if !finishes {
+    prologue = append(prologue, &ast.DeferStmt{ Call: contextCall("Finish") })
+  }
+  prologue = append(prologue,
+      &ast.DeferStmt{ Call: contextCall("Recover") })
+  prologue = append(prologue, setup...)
+  funcDecl.Body.List = append(prologue, funcDecl.Body.List...)
+}
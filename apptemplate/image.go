@@ -0,0 +1,144 @@
+package apptemplate
+
+import (
+  "bytes"
+  "encoding/base64"
+  "encoding/xml"
+  "errors"
+  "fmt"
+  "image"
+  _ "image/gif"
+  _ "image/jpeg"
+  _ "image/png"
+  "io"
+  "math"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "unicode"
+)
+
+// pushImage handles an img tag, which names an image in the same way as an
+// asset tag, optionally followed by attributes such as alt="Logo". The tag
+// is replaced by an img element with the width and height of the image, so
+// that the page does not shift as the image loads. The image is linked as
+// an asset, or inlined as a data URI if it is no larger than the
+// InlineImageLimit of the options. Either way the image is recorded as a
+// template of the parse result, because its dimensions are in the page.
+func (p *parseState) pushImage(siteRoot, templateDir, content string,
+    line int) error {
+  content = strings.TrimSpace(content)
+  givenPath, attributes := content, ""
+  if i := strings.IndexFunc(content, unicode.IsSpace); i != -1 {
+    givenPath, attributes = content[:i], " "+strings.TrimSpace(content[i:])
+  }
+  if givenPath == "" {
+    return errors.New("img tag has no path")
+  }
+  hardPath, _, err := resolveAsset(siteRoot, templateDir, givenPath)
+  if err != nil {
+    return err
+  }
+  data, err := os.ReadFile(hardPath)
+  if err != nil {
+    return err
+  }
+  width, height, mediaType, err := imageSize(data, hardPath)
+  if err != nil {
+    return fmt.Errorf("img %s: %s", givenPath, err)
+  }
+  p.noteTemplate(hardPath)
+  tail := fmt.Sprintf(`" width="%d" height="%d"%s>`, width, height,
+      attributes)
+  if limit := p.options.InlineImageLimit; limit > 0 && len(data) <= limit {
+    p.pushStatic(`<img src="data:`+mediaType+";base64,"+
+        base64.StdEncoding.EncodeToString(data)+tail, line)
+    return nil
+  }
+  p.pushStatic(`<img src="`, line)
+  if err := p.pushAsset(siteRoot, templateDir, givenPath, line); err != nil {
+    return err
+  }
+  p.pushStatic(tail, line)
+  return nil
+}
+
+// imageSize returns the dimensions and media type of a PNG, JPEG, GIF, or
+// SVG image.
+func imageSize(data []byte, hardPath string) (int, int, string, error) {
+  if strings.EqualFold(filepath.Ext(hardPath), ".svg") {
+    width, height, err := svgSize(data)
+    return width, height, "image/svg+xml", err
+  }
+  config, format, err := image.DecodeConfig(bytes.NewReader(data))
+  if err != nil {
+    return 0, 0, "", err
+  }
+  return config.Width, config.Height, "image/" + format, nil
+}
+
+// svgSize returns the dimensions of an SVG image from the width and height
+// attributes of its root element, in pixels, or else from its viewBox.
+func svgSize(data []byte) (int, int, error) {
+  decoder := xml.NewDecoder(bytes.NewReader(data))
+  for {
+    token, err := decoder.Token()
+    if err == io.EOF {
+      return 0, 0, errors.New("no svg element")
+    }
+    if err != nil {
+      return 0, 0, err
+    }
+    element, ok := token.(xml.StartElement)
+    if !ok {
+      continue
+    }
+    if element.Name.Local != "svg" {
+      return 0, 0, fmt.Errorf("root element is %s, not svg",
+          element.Name.Local)
+    }
+    var widthAttr, heightAttr, viewBox string
+    for _, attr := range element.Attr {
+      switch attr.Name.Local {
+      case "width":
+        widthAttr = attr.Value
+      case "height":
+        heightAttr = attr.Value
+      case "viewBox":
+        viewBox = attr.Value
+      }
+    }
+    width, widthErr := svgLength(widthAttr)
+    height, heightErr := svgLength(heightAttr)
+    if widthErr == nil && heightErr == nil {
+      return width, height, nil
+    }
+    fields := strings.FieldsFunc(viewBox, func (r rune) bool {
+      return r == ',' || unicode.IsSpace(r)
+    })
+    if len(fields) == 4 {
+      width, widthErr := strconv.ParseFloat(fields[2], 64)
+      height, heightErr := strconv.ParseFloat(fields[3], 64)
+      if widthErr == nil && heightErr == nil && width > 0 && height > 0 {
+        return int(math.Round(width)), int(math.Round(height)), nil
+      }
+    }
+    return 0, 0, errors.New("svg has no width and height in pixels " +
+        "and no viewBox")
+  }
+}
+
+// svgLength converts an SVG length without units or in pixels to a whole
+// number of pixels.
+func svgLength(s string) (int, error) {
+  s = strings.TrimSuffix(strings.TrimSpace(s), "px")
+  value, err := strconv.ParseFloat(s, 64)
+  if err != nil {
+    return 0, err
+  }
+  if value <= 0 {
+    return 0, fmt.Errorf("length %s is not positive", s)
+  }
+  return int(math.Round(value)), nil
+}
@@ -0,0 +1,474 @@
+package apptemplate
+
+import (
+  "fmt"
+  "html"
+  "regexp"
+  "strconv"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+)
+
+// MarkdownRenderer converts the Markdown files of insert-markdown tags to
+// HTML as templates are parsed.
+type MarkdownRenderer interface {
+  RenderMarkdown(source []byte) ([]byte, error)
+}
+
+// MarkdownFunc adapts a function to the MarkdownRenderer interface.
+type MarkdownFunc func(source []byte) ([]byte, error)
+
+// RenderMarkdown calls f.
+func (f MarkdownFunc) RenderMarkdown(source []byte) ([]byte, error) {
+  return f(source)
+}
+
+// BasicMarkdown is the renderer used when Options.Markdown is nil. It
+// handles the common parts of CommonMark: ATX and setext headings,
+// paragraphs, emphasis, code spans, fenced and indented code blocks, block
+// quotes, bulleted and numbered lists, thematic breaks, hard line breaks,
+// inline links, images, autolinks, and raw HTML. Reference links and
+// tables are not supported.
+var BasicMarkdown MarkdownRenderer = MarkdownFunc(renderMarkdown)
+
+// renderMarkdown is the function of BasicMarkdown.
+func renderMarkdown(source []byte) ([]byte, error) {
+  if !utf8.Valid(source) {
+    return nil, fmt.Errorf("markdown is not valid UTF-8")
+  }
+  text := strings.ReplaceAll(string(source), "\r\n", "\n")
+  text = strings.ReplaceAll(text, "\t", "    ")
+  out := &strings.Builder{}
+  renderBlocks(strings.Split(text, "\n"), out)
+  return []byte(out.String()), nil
+}
+
+
+//--- Blocks
+
+var headingPattern = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ ]+(.*?))?[ ]*$`)
+var closingHashes = regexp.MustCompile(`(^|[ ]+)#+$`)
+var fencePattern = regexp.MustCompile("^ {0,3}(```+|~~~+)[ ]*([^ `]*)")
+var breakPattern = regexp.MustCompile(
+    `^ {0,3}((-[ ]*){3,}|(\*[ ]*){3,}|(_[ ]*){3,})$`)
+var setextPattern = regexp.MustCompile(`^ {0,3}(=+|-+)[ ]*$`)
+var itemPattern = regexp.MustCompile(`^( {0,3})([-*+]|[0-9]{1,9}[.)])( +|$)`)
+var htmlBlockPattern = regexp.MustCompile(
+    `^ {0,3}<(/?[A-Za-z][A-Za-z0-9-]*|!--)`)
+
+// isBlank reports whether a line has only spaces.
+func isBlank(line string) bool {
+  return strings.TrimSpace(line) == ""
+}
+
+// startsBlock reports whether a line begins a block that ends the
+// paragraph before it.
+func startsBlock(line string) bool {
+  return headingPattern.MatchString(line) || fencePattern.MatchString(line) ||
+      breakPattern.MatchString(line) || itemPattern.MatchString(line) ||
+      strings.HasPrefix(strings.TrimLeft(line, " "), ">") ||
+      htmlBlockPattern.MatchString(line)
+}
+
+// renderBlocks renders lines of Markdown as a sequence of HTML blocks.
+func renderBlocks(lines []string, out *strings.Builder) {
+  for i := 0; i < len(lines); {
+    line := lines[i]
+    switch {
+    case isBlank(line):
+      i++
+    case fencePattern.MatchString(line):
+      i = renderFence(lines, i, out)
+    case headingPattern.MatchString(line):
+      match := headingPattern.FindStringSubmatch(line)
+      text := closingHashes.ReplaceAllString(match[2], "")
+      fmt.Fprintf(out, "<h%d>%s</h%d>\n", len(match[1]), renderInline(text),
+          len(match[1]))
+      i++
+    case breakPattern.MatchString(line):
+      out.WriteString("<hr>\n")
+      i++
+    case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+      i = renderQuote(lines, i, out)
+    case itemPattern.MatchString(line):
+      i = renderList(lines, i, out)
+    case strings.HasPrefix(line, "    "):
+      i = renderIndentedCode(lines, i, out)
+    case htmlBlockPattern.MatchString(line):
+      for ; i < len(lines) && !isBlank(lines[i]); i++ {
+        out.WriteString(lines[i] + "\n")
+      }
+    default:
+      i = renderParagraph(lines, i, out)
+    }
+  }
+}
+
+// renderFence renders a fenced code block that begins at lines[i] and
+// returns the index of the line after it.
+func renderFence(lines []string, i int, out *strings.Builder) int {
+  match := fencePattern.FindStringSubmatch(lines[i])
+  fence, language := match[1], match[2]
+  out.WriteString("<pre><code")
+  if language != "" {
+    fmt.Fprintf(out, " class=\"language-%s\"", html.EscapeString(language))
+  }
+  out.WriteString(">")
+  for i++; i < len(lines); i++ {
+    trimmed := strings.TrimSpace(lines[i])
+    if strings.HasPrefix(trimmed, fence) &&
+        strings.Trim(trimmed, fence[:1]) == "" {
+      i++
+      break
+    }
+    out.WriteString(html.EscapeString(lines[i]) + "\n")
+  }
+  out.WriteString("</code></pre>\n")
+  return i
+}
+
+// renderIndentedCode renders a code block of lines indented by four spaces.
+func renderIndentedCode(lines []string, i int, out *strings.Builder) int {
+  code := []string{}
+  for ; i < len(lines); i++ {
+    if strings.HasPrefix(lines[i], "    ") {
+      code = append(code, lines[i][4:])
+    } else if isBlank(lines[i]) {
+      code = append(code, "")
+    } else {
+      break
+    }
+  }
+  for len(code) != 0 && code[len(code)-1] == "" {
+    code = code[:len(code)-1]  // Trailing blank lines are not code.
+  }
+  out.WriteString("<pre><code>")
+  for _, line := range code {
+    out.WriteString(html.EscapeString(line) + "\n")
+  }
+  out.WriteString("</code></pre>\n")
+  return i
+}
+
+// renderQuote renders a block quote. Lines without the > marker continue
+// the quote until a blank line.
+func renderQuote(lines []string, i int, out *strings.Builder) int {
+  inner := []string{}
+  for ; i < len(lines) && !isBlank(lines[i]); i++ {
+    line := strings.TrimLeft(lines[i], " ")
+    if strings.HasPrefix(line, ">") {
+      line = strings.TrimPrefix(line[1:], " ")
+    } else if startsBlock(line) {
+      break
+    }
+    inner = append(inner, line)
+  }
+  out.WriteString("<blockquote>\n")
+  renderBlocks(inner, out)
+  out.WriteString("</blockquote>\n")
+  return i
+}
+
+// renderList renders a list whose first item begins at lines[i]. The
+// content of an item is the text after its marker and the lines indented
+// under it. A list with blank lines between its items is loose, and the
+// paragraphs of its items are kept.
+func renderList(lines []string, i int, out *strings.Builder) int {
+  first := itemPattern.FindStringSubmatch(lines[i])
+  ordered := first[2][0] >= '0' && first[2][0] <= '9'
+  delimiter := first[2][len(first[2])-1:]
+  // sameList reports whether a line begins an item of this list.
+  sameList := func(line string) bool {
+    match := itemPattern.FindStringSubmatch(line)
+    return match != nil && len(match[1]) == len(first[1]) &&
+        (match[2][0] >= '0' && match[2][0] <= '9') == ordered &&
+        match[2][len(match[2])-1:] == delimiter
+  }
+  items := [][]string{}
+  loose := false
+  for i < len(lines) && sameList(lines[i]) {
+    match := itemPattern.FindStringSubmatch(lines[i])
+    width := len(match[0])  // Later lines of the item are indented as much.
+    if match[3] == "" || len(match[3]) > 4 {
+      width = len(match[1]) + len(match[2]) + 1
+    }
+    item := []string{ "" }
+    if len(lines[i]) > width {
+      item[0] = lines[i][width:]
+    }
+    for i++; i < len(lines); i++ {
+      line := lines[i]
+      if isBlank(line) {
+        item = append(item, "")
+        continue
+      }
+      indent := len(line) - len(strings.TrimLeft(line, " "))
+      if indent >= width {
+        item = append(item, line[width:])
+      } else if item[len(item)-1] != "" && !startsBlock(line) {
+        item = append(item, line)  // A lazy continuation of a paragraph.
+      } else {
+        break
+      }
+    }
+    for len(item) > 1 && item[len(item)-1] == "" {
+      item = item[:len(item)-1]
+      if i < len(lines) && sameList(lines[i]) {
+        loose = true  // A blank line separates this item from the next.
+      }
+    }
+    for _, line := range item[1:] {
+      loose = loose || line == ""
+    }
+    items = append(items, item)
+  }
+  tag, start := "ul", ""
+  if ordered {
+    tag = "ol"
+    number, _ := strconv.Atoi(first[2][:len(first[2])-1])
+    if number != 1 {
+      start = fmt.Sprintf(" start=\"%d\"", number)
+    }
+  }
+  fmt.Fprintf(out, "<%s%s>\n", tag, start)
+  for _, item := range items {
+    inner := &strings.Builder{}
+    renderBlocks(item, inner)
+    content := inner.String()
+    if !loose {  // A tight list drops the paragraph tags of its items.
+      content = strings.ReplaceAll(content, "<p>", "")
+      content = strings.ReplaceAll(content, "</p>", "")
+    }
+    content = strings.TrimSuffix(content, "\n")
+    if strings.Contains(content, "\n") || loose {
+      content = "\n" + content + "\n"
+    }
+    fmt.Fprintf(out, "<li>%s</li>\n", content)
+  }
+  fmt.Fprintf(out, "</%s>\n", tag)
+  return i
+}
+
+// renderParagraph renders a paragraph, or a setext heading if its lines
+// are underlined with = or -.
+func renderParagraph(lines []string, i int, out *strings.Builder) int {
+  text := []string{}
+  for ; i < len(lines) && !isBlank(lines[i]); i++ {
+    if len(text) != 0 && setextPattern.MatchString(lines[i]) {
+      level := 1
+      if strings.TrimSpace(lines[i])[0] == '-' {
+        level = 2
+      }
+      fmt.Fprintf(out, "<h%d>%s</h%d>\n", level,
+          renderInline(strings.Join(text, "\n")), level)
+      return i+1
+    }
+    if len(text) != 0 && startsBlock(lines[i]) {
+      break
+    }
+    text = append(text, strings.TrimLeft(lines[i], " "))
+  }
+  fmt.Fprintf(out, "<p>%s</p>\n",
+      renderInline(strings.TrimRight(strings.Join(text, "\n"), " ")))
+  return i
+}
+
+
+//--- Inlines
+
+var autolinkPattern = regexp.MustCompile(
+    `^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^<>\x00-\x20]*|[^<>@\s]+@[^<>@\s]+)>`)
+var inlineTagPattern = regexp.MustCompile(
+    `^<(/?[A-Za-z][A-Za-z0-9-]*(\s+[A-Za-z_:][^<>]*)?\s*/?|!--[\s\S]*?--)>`)
+var entityPattern = regexp.MustCompile(
+    `^&(#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+var hardBreakPattern = regexp.MustCompile(`[ ]{2,}\n`)
+
+// asciiPunctuation lists the characters that a backslash escapes.
+const asciiPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+var destinationPattern = regexp.MustCompile(
+    `^\(\s*(<[^<>\n]*>|[^\s()]*)(?:\s+("[^"]*"|'[^']*'))?\s*\)`)
+
+// renderInline renders the inline content of a block: the text with its
+// code spans, emphasis, links, images, and line breaks.
+func renderInline(text string) string {
+  text = hardBreakPattern.ReplaceAllString(text, "\\\n")  // As \ breaks.
+  out := &strings.Builder{}
+  for i := 0; i < len(text); {
+    c := text[i]
+    switch {
+    case c == '\\' && i+1 < len(text) && text[i+1] == '\n':
+      out.WriteString("<br>\n")
+      i += 2
+    case c == '\\' && i+1 < len(text) &&
+        strings.IndexByte(asciiPunctuation, text[i+1]) >= 0:
+      out.WriteString(html.EscapeString(text[i+1:i+2]))
+      i += 2
+    case c == '`':
+      run := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+      end := closingBackticks(text, i+run, run)
+      if end < 0 {
+        out.WriteString(text[i:i+run])
+        i += run
+        break
+      }
+      code := strings.ReplaceAll(text[i+run:end], "\n", " ")
+      if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' &&
+          strings.TrimSpace(code) != "" {
+        code = code[1:len(code)-1]
+      }
+      out.WriteString("<code>" + html.EscapeString(code) + "</code>")
+      i = end + run
+    case c == '*' || c == '_':
+      n := renderEmphasis(text, i, out)
+      i += n
+    case c == '!' && i+1 < len(text) && text[i+1] == '[':
+      if n := renderLink(text, i+1, true, out); n > 0 {
+        i += n + 1
+      } else {
+        out.WriteString("!")
+        i++
+      }
+    case c == '[':
+      if n := renderLink(text, i, false, out); n > 0 {
+        i += n
+      } else {
+        out.WriteString("[")
+        i++
+      }
+    case c == '<':
+      if match := autolinkPattern.FindStringSubmatch(text[i:]); match != nil {
+        target := match[1]
+        if !strings.Contains(target, ":") {
+          target = "mailto:" + target
+        }
+        fmt.Fprintf(out, "<a href=\"%s\">%s</a>", html.EscapeString(target),
+            html.EscapeString(match[1]))
+        i += len(match[0])
+      } else if tag := inlineTagPattern.FindString(text[i:]); tag != "" {
+        out.WriteString(tag)  // Raw HTML passes through.
+        i += len(tag)
+      } else {
+        out.WriteString("&lt;")
+        i++
+      }
+    case c == '&':
+      if entity := entityPattern.FindString(text[i:]); entity != "" {
+        out.WriteString(entity)
+        i += len(entity)
+      } else {
+        out.WriteString("&amp;")
+        i++
+      }
+    default:
+      out.WriteString(html.EscapeString(text[i:i+1]))
+      i++
+    }
+  }
+  return out.String()
+}
+
+// closingBackticks returns the index of the run of exactly n backticks
+// that closes a code span, searching from start, or -1 if there is none.
+func closingBackticks(text string, start, n int) int {
+  for i := start; i < len(text); {
+    if text[i] != '`' {
+      i++
+      continue
+    }
+    run := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+    if run == n {
+      return i
+    }
+    i += run
+  }
+  return -1
+}
+
+// renderEmphasis renders emphasis that opens with the delimiter run at
+// text[i], as <em> for one delimiter and <strong> for two, and returns the
+// number of bytes consumed. A run that is not closed is written as text.
+func renderEmphasis(text string, i int, out *strings.Builder) int {
+  c := text[i]
+  run := len(text[i:]) - len(strings.TrimLeft(text[i:], string(c)))
+  before, _ := utf8.DecodeLastRuneInString(text[:i])
+  after, _ := utf8.DecodeRuneInString(text[i+run:])
+  opens := i+run < len(text) && !unicode.IsSpace(after)
+  if c == '_' && i > 0 && (unicode.IsLetter(before) ||
+      unicode.IsDigit(before)) {
+    opens = false  // Underscores within words are not emphasis.
+  }
+  for _, n := range []int{ 2, 1 } {
+    if !opens || run < n {
+      continue
+    }
+    delimiter := strings.Repeat(string(c), n)
+    for j := i + n + 1; j+n <= len(text); j++ {
+      if text[j:j+n] != delimiter || unicode.IsSpace(rune(text[j-1])) {
+        continue
+      }
+      if n == 1 && j+1 < len(text) && text[j+1] == c {
+        j++  // A double delimiter does not close single emphasis.
+        continue
+      }
+      if c == '_' && j+n < len(text) {
+        next, _ := utf8.DecodeRuneInString(text[j+n:])
+        if unicode.IsLetter(next) || unicode.IsDigit(next) {
+          continue
+        }
+      }
+      tag := "em"
+      if n == 2 {
+        tag = "strong"
+      }
+      fmt.Fprintf(out, "<%s>%s</%s>", tag, renderInline(text[i+n:j]), tag)
+      return j + n - i
+    }
+  }
+  out.WriteString(text[i:i+run])
+  return run
+}
+
+// renderLink renders a link, or an image if image is true, whose text
+// begins with the bracket at text[i], and returns the number of bytes
+// consumed, or 0 if there is no link there.
+func renderLink(text string, i int, image bool, out *strings.Builder) int {
+  depth := 0
+  end := -1
+  for j := i; j < len(text) && end < 0; j++ {
+    switch text[j] {
+    case '\\':
+      j++
+    case '[':
+      depth++
+    case ']':
+      depth--
+      if depth == 0 {
+        end = j
+      }
+    }
+  }
+  if end < 0 {
+    return 0
+  }
+  match := destinationPattern.FindStringSubmatch(text[end+1:])
+  if match == nil {
+    return 0
+  }
+  label := text[i+1:end]
+  destination := strings.TrimSuffix(strings.TrimPrefix(match[1], "<"), ">")
+  title := ""
+  if match[2] != "" {
+    title = fmt.Sprintf(" title=\"%s\"",
+        html.EscapeString(match[2][1:len(match[2])-1]))
+  }
+  if image {
+    fmt.Fprintf(out, "<img src=\"%s\" alt=\"%s\"%s>",
+        html.EscapeString(destination), html.EscapeString(label), title)
+  } else {
+    fmt.Fprintf(out, "<a href=\"%s\"%s>%s</a>",
+        html.EscapeString(destination), title, renderInline(label))
+  }
+  return end + 1 + len(match[0]) - i
+}
@@ -0,0 +1,217 @@
+package apptemplate
+
+import (
+  "bytes"
+  "errors"
+  "go/ast"
+  "go/token"
+  "go/scanner"
+  "go/parser"
+  "path/filepath"
+  "reflect"
+  "strings"
+)
+
+// SourceMap relates the lines of the generated code to the lines of the
+// templates that they were made from.
+type SourceMap struct {
+  // Lines[i] is the origin of line i+1 of the generated code. The zero
+  // Position marks a line that does not come from a template, such as an
+  // injected import.
+  Lines []Position `json:"lines"`
+}
+
+// Position is a line of a template, given by its hard path.
+type Position struct {
+  Path string  `json:"path,omitempty"`
+  Line int     `json:"line,omitempty"`
+}
+
+// Lookup returns the template position of a line of the generated code.
+// The second result is false if the line has no known origin.
+func (m *SourceMap) Lookup(line int) (Position, bool) {
+  if m == nil || line < 1 || line > len(m.Lines) {
+    return Position{}, false
+  }
+  position := m.Lines[line-1]
+  return position, position.Path != ""
+}
+
+// sectionSpan notes the offset at which a section begins in the code that
+// is parsed before printing.
+type sectionSpan struct {
+  offset int
+  section *Section
+}
+
+// makeSourceMap works out the template lines of the printed code. Every
+// node of the parsed file knows its offset in the unprinted code, which
+// leads to a section and a template line. The printed code is parsed
+// again, and because printing keeps the structure of the syntax tree, the
+// nodes of the two trees correspond in order. Each printed line takes the
+// origin of the first node that begins on it; the lines of multi-line
+// literals, which are printed verbatim, map one to one.
+func makeSourceMap(fileSet *token.FileSet, file *ast.File, unprinted []byte,
+    spans []sectionSpan, printed []byte) *SourceMap {
+  lineCount := bytes.Count(printed, []byte("\n")) + 1
+  sourceMap := &SourceMap{ Lines: make([]Position, lineCount) }
+  printedSet := token.NewFileSet()
+  printedFile, err := parser.ParseFile(printedSet, "printed", printed,
+      parser.ParseComments)
+  if err != nil {
+    return sourceMap
+  }
+  setLine := func(line int, position Position) {
+    if line >= 1 && line <= lineCount && sourceMap.Lines[line-1].Path == "" {
+      sourceMap.Lines[line-1] = position
+    }
+  }
+  nodes, printedNodes := syntaxNodes(file), syntaxNodes(printedFile)
+  for i := 0; i < len(nodes) && i < len(printedNodes); i++ {
+    node, printedNode := nodes[i], printedNodes[i]
+    if reflect.TypeOf(node) != reflect.TypeOf(printedNode) {
+      break  // The trees have diverged, so the rest cannot be trusted.
+    }
+    if !node.Pos().IsValid() || !printedNode.Pos().IsValid() {
+      continue
+    }
+    offset := fileSet.Position(node.Pos()).Offset
+    line := printedSet.Position(printedNode.Pos()).Line
+    setLine(line, spanPosition(spans, unprinted, offset))
+    if literal, ok := node.(*ast.BasicLit); ok {
+      for j, ch := range []byte(literal.Value) {
+        if ch == '\n' {
+          line++
+          setLine(line, spanPosition(spans, unprinted, offset+j+1))
+        }
+      }
+    }
+  }
+  return sourceMap
+}
+
+// spanPosition finds the template position of an offset in the unprinted
+// code, or the zero Position if the offset comes before every section.
+func spanPosition(spans []sectionSpan, unprinted []byte,
+    offset int) Position {
+  var span *sectionSpan
+  for i := range spans {
+    if spans[i].offset > offset {
+      break
+    }
+    span = &spans[i]
+  }
+  if span == nil {
+    return Position{}
+  }
+  // The lines of a merged section are counted off through its parts.
+  newlines := bytes.Count(unprinted[span.offset:offset], []byte("\n"))
+  parts := span.section.parts
+  if len(parts) == 0 {
+    parts = []*Section{ span.section }
+  }
+  for i, part := range parts {
+    count := strings.Count(part.Text, "\n")
+    if i == len(parts)-1 || (part.Text != "" && newlines <= count) {
+      return Position{ part.Path, part.Line + newlines }
+    }
+    newlines -= count
+  }
+  return Position{}
+}
+
+// placeSyntaxErrors moves the syntax errors of unprinted code, if err has
+// any, to the template lines that the code came from. The column is kept
+// where the line of code is a whole line of the template.
+func placeSyntaxErrors(err error, spans []sectionSpan, unprinted []byte) {
+  var syntaxErrors scanner.ErrorList
+  if !errors.As(err, &syntaxErrors) {
+    return
+  }
+  for _, syntaxError := range syntaxErrors {
+    offset := syntaxError.Pos.Offset
+    if offset < 0 || offset > len(unprinted) {
+      continue
+    }
+    position := spanPosition(spans, unprinted, offset)
+    if position.Path == "" {
+      continue
+    }
+    // A line that begins a section follows the tag that opened it.
+    lineStart := bytes.LastIndexByte(unprinted[:offset], '\n') + 1
+    wholeLine := false
+    for _, span := range spans {
+      if span.offset <= offset {
+        wholeLine = span.offset < lineStart
+      }
+    }
+    syntaxError.Pos.Filename = position.Path
+    syntaxError.Pos.Line = position.Line
+    if !wholeLine {
+      syntaxError.Pos.Column = 0
+    }
+  }
+}
+
+// syntaxNodes lists the nodes of a syntax tree in depth-first order. Empty
+// statements are left out because the printer drops them.
+func syntaxNodes(file *ast.File) []ast.Node {
+  nodes := []ast.Node{}
+  ast.Inspect(file, func (node ast.Node) bool {
+    if _, empty := node.(*ast.EmptyStmt); node != nil && !empty {
+      nodes = append(nodes, node)
+    }
+    return true
+  })
+  return nodes
+}
+
+// MapFile is the JSON form of a source map that is written beside the
+// generated code for other tools, such as coverage reports, profilers, and
+// error trackers, to translate positions in the generated code into
+// template positions.
+type MapFile struct {
+  Version int          `json:"version"`   // The format version, 1.
+  File string          `json:"file"`      // The base name of the code.
+  Sources []string     `json:"sources"`   // The hard paths of templates.
+  Mappings []Mapping   `json:"mappings"`  // In order of Start.
+}
+
+// Mapping relates a line of the generated code, from byte offset Start up
+// to End, which includes the line break, to a line of the template at
+// index Source in Sources. Lines that come from no template are left out.
+type Mapping struct {
+  Start int          `json:"start"`
+  End int            `json:"end"`
+  GeneratedLine int  `json:"generatedLine"`
+  Source int         `json:"source"`
+  Line int           `json:"line"`
+}
+
+// MapFile makes the map file of the generated code, given its contents and
+// file name.
+func (m *SourceMap) MapFile(code []byte, file string) *MapFile {
+  mapFile := &MapFile{ Version: 1, File: filepath.Base(file),
+      Sources: []string{}, Mappings: []Mapping{} }
+  sourceIndex := map[string]int{}
+  start := 0
+  for i := 0; start < len(code); i++ {
+    end := len(code)
+    if newline := bytes.IndexByte(code[start:], '\n'); newline != -1 {
+      end = start+newline+1
+    }
+    if position, ok := m.Lookup(i+1); ok {
+      index, found := sourceIndex[position.Path]
+      if !found {
+        index = len(mapFile.Sources)
+        sourceIndex[position.Path] = index
+        mapFile.Sources = append(mapFile.Sources, position.Path)
+      }
+      mapFile.Mappings = append(mapFile.Mappings, Mapping{ Start: start,
+          End: end, GeneratedLine: i+1, Source: index,
+          Line: position.Line })
+    }
+    start = end
+  }
+  return mapFile
+}
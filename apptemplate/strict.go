@@ -0,0 +1,114 @@
+package apptemplate
+
+import (
+  "fmt"
+  "regexp"
+  "strings"
+)
+
+// TagCheck says what becomes of text that looks like a tag but is not one.
+type TagCheck int
+
+const (
+  AllowUnknownTags TagCheck = iota  // Pass unknown tags through silently.
+  WarnUnknownTags                   // Pass them through with a warning.
+  RejectUnknownTags                 // Make them parsing errors.
+)
+
+// TagOpen and TagClose are the delimiters of tags, as in <?insert x ?>.
+const (
+  TagOpen = "<?"
+  TagClose = "?>"
+)
+
+// tagNames are the names of the built-in tags.
+var tagNames = []string{ "code", "insert", "insert-markdown", "meta",
+    "asset", "yield", "content-for", "if", "else", "end", "include-static",
+    "img" }
+
+// tagLike matches the start of a processing instruction in static text.
+var tagLike = regexp.MustCompile(regexp.QuoteMeta(TagOpen) +
+    `([A-Za-z][A-Za-z0-9_-]*)`)
+
+// checkStatic looks for unknown tags in static text that begins at a line
+// of the current template, such as <?inserr x ?> for <?insert x ?>, and
+// reports them as the UnknownTags option says. XML processing instructions
+// and the tags named in PassTags are left alone.
+func (p *parseState) checkStatic(text string, line int) error {
+  if p.options.UnknownTags == AllowUnknownTags || p.skipping() {
+    return nil
+  }
+  current := p.stack[len(p.stack)-1]
+  for _, match := range tagLike.FindAllStringSubmatchIndex(text, -1) {
+    name := text[match[2]:match[3]]
+    if p.passTag(name) {
+      continue
+    }
+    message := fmt.Sprintf("unknown tag <?%s", name)
+    if suggestion := closestTag(name); suggestion != "" {
+      message += fmt.Sprintf("; did you mean <?%s?", suggestion)
+    }
+    tagError := &Error{ current.HardPath,
+        line + strings.Count(text[:match[0]], "\n"),
+        fmt.Errorf("%s", message) }
+    if p.options.UnknownTags == RejectUnknownTags {
+      return tagError
+    }
+    p.result.Warnings = append(p.result.Warnings, tagError)
+  }
+  return nil
+}
+
+// passTag reports whether an unknown tag is passed through as intended.
+func (p *parseState) passTag(name string) bool {
+  if strings.HasPrefix(strings.ToLower(name), "xml") {
+    return true  // The XML declaration and stylesheet instructions.
+  }
+  for _, passName := range p.options.PassTags {
+    if name == passName {
+      return true
+    }
+  }
+  return false
+}
+
+// closestTag returns the tag name that an unknown name is most likely a
+// misspelling of, or "" if none is close.
+func closestTag(name string) string {
+  tagMutex.RLock()
+  defer tagMutex.RUnlock()
+  closest, best := "", 3  // At most two edits apart.
+  for _, tagName := range allTagNames() {
+    if d := editDistance(strings.ToLower(name), tagName); d < best {
+      closest, best = tagName, d
+    }
+  }
+  return closest
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+  previous := make([]int, len(b)+1)
+  for j := range previous {
+    previous[j] = j
+  }
+  for i := 1; i <= len(a); i++ {
+    row := make([]int, len(b)+1)
+    row[0] = i
+    for j := 1; j <= len(b); j++ {
+      cost := 1
+      if a[i-1] == b[j-1] {
+        cost = 0
+      }
+      row[j] = previous[j-1]+cost
+      if previous[j]+1 < row[j] {
+        row[j] = previous[j]+1
+      }
+      if row[j-1]+1 < row[j] {
+        row[j] = row[j-1]+1
+      }
+    }
+    previous = row
+  }
+  return previous[len(b)]
+}
@@ -0,0 +1,107 @@
+package apptemplate
+
+import (
+  "fmt"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+)
+
+// TagHandler generates the sections of a custom tag as templates are
+// parsed. It is given the text between the tag name and the closing ?>,
+// and the Position of the line on which the tag begins. The sections it
+// returns are added in place of the tag: static and verbatim text are
+// output, code goes into the main function, and an asset section outputs
+// the URL of the URL path in its Text. A section without a Path or Line
+// takes those of the tag. An error makes the template fail at the tag.
+type TagHandler func(args string, pos Position) ([]Section, error)
+
+// tagMutex guards customTags.
+var tagMutex sync.RWMutex
+
+// customTags holds the registered tag handlers by name.
+var customTags = map[string]TagHandler{}
+
+// validTagName matches the names that tags may have.
+var validTagName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// RegisterTag adds a custom tag, so that <?name args ?> is handled by the
+// given handler in every template parsed afterward. Programs usually
+// register their tags in an init function. Tags are recognized by their
+// beginnings, so RegisterTag panics if the name is not a valid tag name,
+// or if it begins another tag's name or another tag's name begins it, as
+// sql would begin sqlx. It also panics if the handler is nil.
+func RegisterTag(name string, handler TagHandler) {
+  tagMutex.Lock()
+  defer tagMutex.Unlock()
+  if handler == nil {
+    panic("apptemplate: RegisterTag handler is nil")
+  }
+  if !validTagName.MatchString(name) {
+    panic(fmt.Sprintf("apptemplate: RegisterTag %q is not a tag name", name))
+  }
+  for _, other := range allTagNames() {
+    if strings.HasPrefix(name, other) || strings.HasPrefix(other, name) {
+      panic(fmt.Sprintf("apptemplate: RegisterTag %s clashes with tag %s",
+          name, other))
+    }
+  }
+  customTags[name] = handler
+}
+
+// TagNames returns the names of the tags that templates may use: the
+// built-in tags followed by the registered ones in sorted order.
+func TagNames() []string {
+  tagMutex.RLock()
+  defer tagMutex.RUnlock()
+  return allTagNames()
+}
+
+// allTagNames returns the names of the built-in tags and, in sorted order,
+// the registered ones. The caller must hold tagMutex.
+func allTagNames() []string {
+  names := []string{}
+  for name := range customTags {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return append(append([]string{}, tagNames...), names...)
+}
+
+// customTagHandlers returns a copy of the registered tag handlers.
+func customTagHandlers() map[string]TagHandler {
+  tagMutex.RLock()
+  defer tagMutex.RUnlock()
+  handlers := map[string]TagHandler{}
+  for name, handler := range customTags {
+    handlers[name] = handler
+  }
+  return handlers
+}
+
+// pushCustom runs the handler of a custom tag and adds the sections that
+// it returns.
+func (p *parseState) pushCustom(name string, handler TagHandler,
+    content string, line int) error {
+  current := p.stack[len(p.stack)-1]
+  sections, err := handler(content, Position{ current.HardPath, line })
+  if err != nil {
+    return fmt.Errorf("%s tag: %w", name, err)
+  }
+  for _, section := range sections {
+    if section.Kind > Verbatim {
+      return fmt.Errorf("%s tag: unknown section kind %d", name,
+          section.Kind)
+    }
+    if section.Path == "" {
+      section.Path = current.HardPath
+    }
+    if section.Line == 0 {
+      section.Line = line
+    }
+    p.sections = append(p.sections, &Section{ Kind: section.Kind,
+        Text: section.Text, Path: section.Path, Line: section.Line })
+  }
+  return nil
+}
@@ -0,0 +1,36 @@
+// The buildapp command turns Boomerang templates into CGI programs. It is
+// organized into subcommands:
+//
+//   buildapp build [flags] [file ...]     generate and compile templates
+//   buildapp check [flags] [file ...]     parse templates without writing
+//   buildapp lint [flags] [file ...]      report common problems in templates
+//   buildapp fmt [flags] [file ...]       normalize the layout of templates
+//   buildapp lsp [flags]                  serve the language server protocol
+//   buildapp grammar [flags]              write syntax highlighting grammars
+//   buildapp watch [flags] [file ...]     rebuild templates when they change
+//   buildapp clean [flags]                remove generated files
+//   buildapp graph [flags] [file ...]     print the insertion graph
+//   buildapp doc [flags] [file ...]       write an inventory of the pages
+//   buildapp serve [flags]                serve the site for development
+//   buildapp smoke [flags]                request every page of a deployment
+//   buildapp status [flags]               list pages that are out of date
+//   buildapp new [flags] path ...         create templates from a skeleton
+//   buildapp convert [flags] file ...     translate Go templates
+//   buildapp server [flags] [file ...]    compile the site into one server
+//   buildapp messages [flags] [file ...]  extract translatable messages
+//
+// Without a subcommand name, buildapp behaves like buildapp build, so the
+// flags of earlier versions keep working.
+//
+// The work is done by the builder package, which Go programs can also use
+// to run builds.
+package main
+
+import (
+  "github.com/michaellaszlo/boomerang/builder"
+  "os"
+)
+
+func main() {
+  os.Exit(builder.Main(os.Args[1:]))
+}
@@ -0,0 +1,180 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "io"
+  "os"
+  "fmt"
+  "flag"
+  "sync"
+  "errors"
+  "context"
+)
+
+// Options describes a build for Build, Walk, and Compile. The fields stand
+// for flags of buildapp build, and Flags gives any others as they would
+// appear on the command line, as in []string{"-fastcgi", "-goos", "linux"}.
+// The configuration file of the site applies as it does to buildapp.
+type Options struct {
+  Root string        // The site root; the working directory if "".
+  Paths []string     // Templates and directories; the site root if none.
+  Force bool         // Build templates even if they are up to date, as -a.
+  DryRun bool        // Report what would be built without writing, as -n.
+  FailFast bool      // Stop at the first template that fails.
+  Jobs int           // The number of templates built at once, if not 0.
+  Flags []string     // Further flags of buildapp build.
+
+  // Messages receives the messages that buildapp prints on stderr. They
+  // are discarded if it is nil.
+  Messages io.Writer
+
+  // Context, if it is not nil, abandons the build when it is canceled, as
+  // an interrupt does.
+  Context context.Context
+}
+
+// runMutex keeps calls of Build, Walk, and Compile from running at the
+// same time, since the settings of a run are held in package variables.
+var runMutex sync.Mutex
+
+// Build builds the templates selected by the options as buildapp build
+// does, holding the site lock, and returns the report that build -json
+// prints. If the build runs, the report is returned even if it fails, and
+// the error says why: the templates could not be listed, a template
+// failed, an afterRun hook or the saving of the manifest failed, or the
+// context was canceled.
+func Build(options Options) (*Report, error) {
+  runMutex.Lock()
+  defer runMutex.Unlock()
+  ctx, err := setUpRun(options)
+  if err != nil {
+    return nil, err
+  }
+  reports, _, err := runBuild(ctx, options.Paths, options.DryRun,
+      options.FailFast, false)
+  if reports == nil {
+    return nil, err
+  }
+  report := newReport(reports)
+  switch {
+  case err != nil:
+    return report, err
+  case ctx.Err() != nil:
+    return report, ctx.Err()
+  case report.Failed == 1:
+    return report, errors.New("1 template failed")
+  case report.Failed != 0:
+    return report, fmt.Errorf("%d templates failed", report.Failed)
+  }
+  return report, nil
+}
+
+// Walk returns the paths of the templates that the options select, in the
+// order in which Build would build them, without building them. If the
+// list file cannot be read or the walk fails, the paths found so far are
+// returned with the error.
+func Walk(options Options) ([]string, error) {
+  runMutex.Lock()
+  defer runMutex.Unlock()
+  _, err := setUpRun(options)
+  if err == nil {
+    err = resolveGlobals()
+  }
+  if err != nil {
+    return nil, err
+  }
+  paths := []string{}
+  err = forEachTemplate(options.Paths, false, func (path string) {
+    paths = append(paths, path)
+  })
+  return paths, err
+}
+
+// Compile generates and compiles a single template whether or not its
+// outputs are up to date, holding the site lock, and records it in the
+// manifest. The Paths, Force, DryRun, FailFast, and Jobs options do not
+// apply. If the template fails, the report is returned with an error
+// that gives the stage and the first error message.
+func Compile(path string, options Options) (*TemplateReport, error) {
+  runMutex.Lock()
+  defer runMutex.Unlock()
+  ctx, err := setUpRun(options)
+  if err != nil {
+    return nil, err
+  }
+  unlock, err := openManifestLocked()
+  if err != nil {
+    return nil, err
+  }
+  defer unlock()
+  if err := prepareModule(); err != nil {
+    return nil, err
+  }
+  log := newTemplateLog(path)
+  report := processTemplate(ctx, path, log)
+  log.finish()
+  if err := manifest.save(manifestPath); err != nil {
+    return report, err
+  }
+  if report.failed() {
+    message := "failed"
+    if len(report.Errors) != 0 {
+      message = report.Errors[0].Message
+    }
+    return report, fmt.Errorf("%s: %s: %s", path, report.Stage, message)
+  }
+  return report, nil
+}
+
+// setUpRun returns the settings to their defaults, sets them from the
+// options, and returns the context of the run. The configuration is read
+// later, when the settings are resolved.
+func setUpRun(options Options) (context.Context, error) {
+  messageFile = options.Messages
+  if messageFile == nil {
+    messageFile = io.Discard
+  }
+  if workingDirectory == "" {
+    var err error
+    workingDirectory, err = os.Getwd()
+    if err != nil {
+      return nil, err
+    }
+  }
+  // Defining the flags resets the variables they set, except for repeated
+  // flags and the settings that are derived later.
+  extensions, excludePatterns, defineFlags = nil, nil, nil
+  afterBuildHooks, afterRunHooks = nil, nil
+  stdinList, stdinErr, stdinRead = nil, nil, false
+  verbosity, buildPhase, profileTop = normalLevel, "", 0
+  runtimeImport = apptemplate.RuntimePath
+  flags := newFlagSet("build")
+  flags.Init("build", flag.ContinueOnError)
+  flags.SetOutput(messageFile)
+  addSelectionFlags(flags)
+  addBuildFlags(flags)
+  addLockFlags(flags)
+  flags.BoolVar(&forceBuild, "a", false, "")
+  flags.IntVar(&jobs, "j", 1, "")
+  args := append([]string{}, options.Flags...)
+  if options.Root != "" {
+    args = append(args, "-root", options.Root)
+  }
+  if options.Force {
+    args = append(args, "-a")
+  }
+  if options.Jobs != 0 {
+    args = append(args, "-j", fmt.Sprint(options.Jobs))
+  }
+  if err := flags.Parse(args); err != nil {
+    return nil, err
+  }
+  if flags.NArg() != 0 {
+    return nil, fmt.Errorf("Flags holds %q, which is not a flag; give " +
+        "templates in Paths", flags.Arg(0))
+  }
+  if options.Context != nil {
+    return options.Context, nil
+  }
+  return context.Background(), nil
+}
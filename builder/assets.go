@@ -0,0 +1,148 @@
+package builder
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "path"
+  "strings"
+  "path/filepath"
+)
+
+// AssetRule says what to do with non-template files that match a pattern
+// when the walk exports the site. A pattern containing a slash is matched
+// against the slash-separated path relative to the site root; any other
+// pattern is matched against the base name. Mode is "copy", "symlink", or
+// "skip". The first matching rule applies, and files that match no rule
+// are not exported.
+type AssetRule struct {
+  Pattern string  `json:"pattern"`
+  Mode string     `json:"mode"`
+}
+
+// exportRoot is the directory that receives binaries and assets, or "" if
+// the outputs are placed alongside the templates.
+var exportRoot string
+
+// outputRoot returns the directory from which the site is served.
+func outputRoot() string {
+  if exportRoot != "" {
+    return exportRoot
+  }
+  return siteRoot
+}
+
+// exportPath maps a path under the site root to the corresponding path in
+// the export tree.
+func exportPath(sourcePath string) (string, error) {
+  return mirrorPath(exportRoot, sourcePath)
+}
+
+// matchAssetRule returns the mode of the first rule matching a file, or ""
+// if no rule matches.
+func matchAssetRule(sourcePath string) string {
+  relPath, err := filepath.Rel(siteRoot, sourcePath)
+  if err != nil {
+    return ""
+  }
+  relPath = filepath.ToSlash(relPath)
+  for _, rule := range config.Assets {
+    subject := path.Base(relPath)
+    if strings.Contains(rule.Pattern, "/") {
+      subject = relPath
+    }
+    if matched, _ := path.Match(rule.Pattern, subject); matched {
+      return rule.Mode
+    }
+  }
+  return ""
+}
+
+// exportAsset copies or links a non-template file into the export tree
+// according to the asset rules and records it in the manifest.
+func exportAsset(sourcePath string) {
+  if exportRoot == "" {
+    return
+  }
+  mode := matchAssetRule(sourcePath)
+  if mode == "" || mode == "skip" {
+    return
+  }
+  targetPath, err := exportPath(sourcePath)
+  if err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return
+  }
+  absSource, _ := filepath.Abs(sourcePath)
+  err = os.MkdirAll(filepath.Dir(targetPath), 0755)
+  if err == nil {
+    switch mode {
+    case "copy":
+      err = copyFile(absSource, targetPath, globalLog)
+    case "symlink":
+      err = linkFile(absSource, targetPath, globalLog)
+    default:
+      err = fmt.Errorf("unknown asset mode %q for %s", mode, sourcePath)
+    }
+  }
+  if err == nil {
+    err = setPermissions(targetPath, assetMode)
+  }
+  if err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return
+  }
+  manifest.Assets[targetPath] = absSource
+}
+
+// copyFile copies a file unless the target already has the same size and
+// modification time. The copy gets the permissions and modification time
+// of the source. The copy is reported to the log.
+func copyFile(sourcePath, targetPath string, log *templateLog) error {
+  sourceInfo, err := os.Stat(sourcePath)
+  if err != nil {
+    return err
+  }
+  targetInfo, err := os.Lstat(targetPath)
+  if err == nil && targetInfo.Mode().IsRegular() &&
+      targetInfo.Size() == sourceInfo.Size() &&
+      targetInfo.ModTime().Equal(sourceInfo.ModTime()) {
+    return nil
+  }
+  os.Remove(targetPath)  // The target may be a symlink to the source.
+  source, err := os.Open(sourcePath)
+  if err != nil {
+    return err
+  }
+  defer source.Close()
+  target, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+      sourceInfo.Mode().Perm())
+  if err != nil {
+    return err
+  }
+  _, err = io.Copy(target, source)
+  closeErr := target.Close()
+  if err != nil {
+    return err
+  }
+  if closeErr != nil {
+    return closeErr
+  }
+  log.inform("copied %s\n", targetPath)
+  return os.Chtimes(targetPath, sourceInfo.ModTime(), sourceInfo.ModTime())
+}
+
+// linkFile makes the target a symbolic link to the source, replacing
+// whatever was there before.
+func linkFile(sourcePath, targetPath string, log *templateLog) error {
+  if current, err := os.Readlink(targetPath); err == nil &&
+      current == sourcePath {
+    return nil
+  }
+  os.Remove(targetPath)
+  err := os.Symlink(sourcePath, targetPath)
+  if err == nil {
+    log.inform("linked %s\n", targetPath)
+  }
+  return err
+}
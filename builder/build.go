@@ -0,0 +1,657 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "bufio"
+  "context"
+  "os"
+  "os/exec"
+  "fmt"
+  "strings"
+  "time"
+  "path/filepath"
+  "text/template"
+  goruntime "runtime"
+)
+
+// buildCommand implements "buildapp build", which makes a .go file and a
+// .cgi binary from each selected template and records them in the manifest.
+// Templates whose outputs are up to date are skipped unless -a is given.
+// The exit code is 1 if any template fails. With -json, a report on each
+// template is printed on stdout. With -n, nothing is written; the
+// templates that would be built are listed with the reason and outputs.
+// Failures do not stop the build unless -failfast is given, and a summary
+// of them is printed at the end. Hooks run after each template that is
+// built and, if none failed, after the whole run. With -j, several
+// templates are built at once. The generation and compilation phases can
+// be run separately with -gen-only and -compile-only. With -profile, the
+// slowest templates are listed at the end. An interrupt abandons the build
+// and exits with interruptedStatus once the manifest is saved. The site lock
+// keeps other runs out while the build writes.
+func buildCommand(args []string) int {
+  if serverArgs, single := singleArgs(args); single {
+    return serverCommand(serverArgs)
+  }
+  flags := newFlagSet("build")
+  addSelectionFlags(flags)
+  addBuildFlags(flags)
+  var jsonReport, showProgress, dryRun, failFast, genOnly, compileOnly bool
+  flags.BoolVar(&forceBuild, "a", false,
+      "build templates even if they are up to date")
+  flags.BoolVar(&dryRun, "n", false,
+      "print what would be built and why without writing anything")
+  flags.BoolVar(&genOnly, "gen-only", false,
+      "write the .go files without compiling them")
+  flags.BoolVar(&compileOnly, "compile-only", false,
+      "compile .go files that were written before, without generating them")
+  flags.BoolVar(&failFast, "failfast", false,
+      "stop at the first template that fails")
+  flags.BoolVar(&jsonReport, "json", false,
+      "print a JSON report of the results on stdout")
+  flags.IntVar(&jobs, "j", 1,
+      "the number of templates to build at once, or 0 for one per CPU")
+  flags.BoolVar(&showProgress, "progress", false,
+      "count off the templates as they are built")
+  flags.IntVar(&profileTop, "profile", 0,
+      "list the given number of slowest templates with their timings")
+  flags.StringVar(&cpuProfilePath, "cpuprofile", "",
+      "write a pprof CPU profile of buildapp to the named file")
+  flags.Bool("single", false,
+      "compile the site into one server, as buildapp server does")
+  addLockFlags(flags)
+  flags.Parse(args)
+
+  if genOnly && compileOnly {
+    globalLog.errorf("-gen-only and -compile-only exclude each other\n")
+    return 2
+  } else if genOnly {
+    buildPhase = "generate"
+  } else if compileOnly {
+    buildPhase = "compile"
+  }
+  stopProfile, err := startCPUProfile()
+  if err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return 1
+  }
+  defer stopProfile()
+  ctx, stop := interruptContext()
+  defer stop()
+  reports, status, _ := runBuild(ctx, flags.Args(), dryRun, failFast,
+      showProgress)
+  if jsonReport && reports != nil {
+    err = writeJSONReport(reports)
+    if err != nil {
+      globalLog.errorf("%s\n", err.Error())
+      status = 1
+    }
+  }
+  return status
+}
+
+// runBuild builds the templates selected by args with the settings that
+// have been resolved from the flags, and saves the manifest. It returns
+// the reports of the templates, the exit code of the build, and the first
+// error other than the failure of a template, all of which are logged. If
+// the build could not start, the reports are nil.
+func runBuild(ctx context.Context, args []string, dryRun, failFast,
+    showProgress bool) ([]*TemplateReport, int, error) {
+  var err error
+  if dryRun {  // A dry run writes nothing, so it needs no lock.
+    err = openManifest()
+  } else {
+    var unlock func()
+    unlock, err = openManifestLocked()
+    if err == nil {
+      defer unlock()
+      err = prepareModule()
+    }
+  }
+  if err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return nil, 1, err
+  }
+  // The templates are collected first so that progress can be counted.
+  paths := []string{}
+  assetFn := exportAsset
+  if dryRun {
+    assetFn = nil
+  }
+  listErr := forEachFile(args, true, func (path string) {
+    paths = append(paths, path)
+  }, assetFn)
+  var meter *progressMeter
+  if showProgress {
+    meter = newProgressMeter(len(paths))
+  }
+  status := 0
+  if listErr != nil {
+    status = 1
+  }
+  reports := buildTemplates(ctx, paths, dryRun, failFast, meter)
+  for _, report := range reports {
+    if report.failed() {
+      status = 1
+    }
+  }
+  if meter != nil {
+    meter.finish()
+  }
+  stopped := "stopped at the first failure"
+  if ctx.Err() != nil {
+    stopped = "interrupted"
+    status = interruptedStatus
+  }
+  printFailureSummary(reports, len(paths), stopped)
+  if profileTop > 0 {
+    printProfile(reports)
+  }
+  firstErr := listErr
+  if status == 0 {
+    data := runHookData{ Root: siteRoot, Export: exportRoot }
+    for _, report := range reports {
+      if report.Status == "up to date" {
+        data.UpToDate++
+      } else if report.Binary != "" {
+        data.Built++
+        data.Binaries = append(data.Binaries, report.Binary)
+      }
+    }
+    firstErr = runHooks(afterRunHooks, data, dryRun, globalLog)
+    if firstErr != nil {
+      globalLog.errorf("%s\n", firstErr.Error())
+      status = 1
+    }
+  }
+  if !dryRun {
+    err = manifest.save(manifestPath)
+    if err != nil {
+      globalLog.errorf("%s\n", err.Error())
+      status = 1
+      if firstErr == nil {
+        firstErr = err
+      }
+    }
+  }
+  return reports, status, firstErr
+}
+
+// binaryName is the pattern, set by -binname, that names the binary of a
+// template relative to the template's directory. It is a text/template
+// with these fields:
+//   .Name    the template's file name without the template extension
+//   .Dir     the slash-separated directory of the template relative to
+//            the site root, or "." at the site root
+//   .Target  the platform suffix with -targetsuffix, as in ".linux-arm64"
+var binaryName string
+var binaryNameTemplate *template.Template
+
+// defaultBinaryName gives binaries the .cgi suffix that web servers
+// commonly associate with CGI.
+const defaultBinaryName = "{{.Name}}{{.Target}}.cgi"
+
+// parseBinaryName fills in the binary name pattern from the configuration
+// and checks it.
+func parseBinaryName() error {
+  if binaryName == "" {
+    binaryName = config.BinaryName
+  }
+  if binaryName == "" {
+    binaryName = defaultBinaryName
+  }
+  var err error
+  binaryNameTemplate, err = template.New("binname").Option(
+      "missingkey=error").Parse(binaryName)
+  if err != nil {
+    return fmt.Errorf("-binname: %s", err.Error())
+  }
+  return nil
+}
+
+// outputPaths returns the paths of the .go file and the binary made from a
+// template. The template extension is dropped from the name of the .go
+// file, and the binary is named by the -binname pattern. The outputs can
+// be placed in mirrors of the site tree.
+func outputPaths(path string) (goCodePath, binaryPath string, err error) {
+  dir, file := filepath.Split(path)
+  file = strings.TrimSuffix(file, templateExtension(file))
+  goCodePath = filepath.Join(dir, file + ".go")
+  relDir := "."
+  if absDir, err := filepath.Abs(dir); err == nil {
+    if rel, err := filepath.Rel(siteRoot, absDir); err == nil {
+      relDir = filepath.ToSlash(rel)
+    }
+  }
+  name := &strings.Builder{}
+  err = binaryNameTemplate.Execute(name, struct{ Name, Dir, Target string }{
+    file, relDir, targetName(),
+  })
+  if err == nil && (name.Len() == 0 || strings.HasSuffix(name.String(), "/")) {
+    err = fmt.Errorf("-binname yields no file name for %s", path)
+  }
+  if err != nil {
+    return "", "", err
+  }
+  binaryPath = filepath.Join(dir, filepath.FromSlash(name.String()))
+  if genDir != "" {
+    goCodePath, err = mirrorPath(genDir, goCodePath)
+    if err != nil {
+      return "", "", err
+    }
+  }
+  if root := binaryRoot(); root != siteRoot {
+    binaryPath, err = mirrorPath(root, binaryPath)
+    if err != nil {
+      return "", "", err
+    }
+  }
+  return goCodePath, binaryPath, nil
+}
+
+// binaryRoot returns the directory under which binaries mirror the site
+// tree: the binary directory if there is one, and otherwise the export
+// tree or the site root itself.
+func binaryRoot() string {
+  if binDir != "" {
+    return binDir
+  }
+  return outputRoot()
+}
+
+// buildTemplate builds a template unless its outputs are up to date. In a
+// dry run, it only reports what would be built and why. Messages go to the
+// template's log.
+func buildTemplate(ctx context.Context, path string, dryRun bool,
+    log *templateLog) *TemplateReport {
+  goCodePath, binaryPath, err := outputPaths(path)
+  if err != nil {  // This fails before anything is written.
+    return processTemplate(ctx, path, log)
+  }
+  report := &TemplateReport{ Template: path, GoFile: goCodePath,
+      Binary: binaryPath }
+  report.Reason = rebuildReason(path, goCodePath, binaryPath)
+  switch {
+  case report.Reason == "":
+    log.detail("%s is up to date\n", path)
+    report.Status = "up to date"
+  case dryRun:
+    log.result("would build %s (%s)\n", path, report.Reason)
+    if buildPhase != "compile" {
+      log.result("  would write %s\n", goCodePath)
+      if writeSourceMaps {
+        log.result("  would write %s\n", mapPath(goCodePath))
+      }
+    }
+    if buildPhase != "generate" {
+      log.result("  would write %s\n", binaryPath)
+    }
+    report.Status = "would build"
+    err = runHooks(afterBuildHooks, templateData(path, goCodePath,
+        binaryPath), true, log)
+    if err != nil {
+      log.errorf("%s\n", err.Error())
+      report.fail("hook", BuildError{ Message: err.Error() })
+    }
+  default:
+    reason := report.Reason
+    log.detail("building %s (%s)\n", path, reason)
+    report = processTemplate(ctx, path, log)
+    report.Reason = reason
+  }
+  return report
+}
+
+// buildPhase limits builds to one of their two phases: "generate" with
+// -gen-only, which writes .go files, and "compile" with -compile-only,
+// which compiles .go files that already exist. It is "" for both phases.
+var buildPhase string
+
+// processTemplate generates and compiles a single template and reports
+// the outcome. Messages go to the template's log. If the context is
+// canceled, the template fails at the "interrupted" stage and the files it
+// generated are removed.
+func processTemplate(ctx context.Context, path string,
+    log *templateLog) *TemplateReport {
+  report := &TemplateReport{ Template: path, Status: "ok" }
+  defer func() {  // A failure makes the template stale for the next build.
+    manifest.update(path, func(entry *ManifestEntry) {
+      entry.Failed = report.failed()
+    })
+  }()
+  // interrupted abandons the template if the context has been canceled.
+  interrupted := func(goCodePath string) bool {
+    if ctx.Err() == nil {
+      return false
+    }
+    removePartialOutputs(goCodePath, log)
+    report.fail("interrupted", BuildError{ Message: "build interrupted" })
+    return true
+  }
+
+  goCodePath, binaryPath, err := outputPaths(path)
+  for _, outputPath := range []string{ goCodePath, binaryPath } {
+    if err == nil {
+      err = os.MkdirAll(filepath.Dir(outputPath), 0755)
+    }
+  }
+  if err != nil {
+    log.errorf("%s\n", err.Error())
+    report.fail("create", BuildError{ Message: err.Error() })
+    return report
+  }
+  report.GoFile, report.Binary = goCodePath, binaryPath
+  var sources []string
+  if buildPhase == "compile" {
+    sources = existingSources(goCodePath)
+    recordBinary(path, goCodePath, binaryPath)
+  } else {
+    sources = generateCode(path, goCodePath, binaryPath, report, log)
+  }
+  if buildPhase == "generate" {
+    report.Binary = ""  // Nothing was compiled.
+  }
+  if report.failed() || interrupted(goCodePath) || buildPhase == "generate" {
+    return report
+  }
+  if remoteCache == nil || !remoteCache.fetch(path, binaryPath, report,
+      log) {
+    if !compileCode(ctx, binaryPath, sources, report, log) {
+      interrupted(goCodePath)
+      return report
+    }
+    if remoteCache != nil {
+      remoteCache.save(path, binaryPath, log)
+    }
+  }
+  binaryHash, err := hashFile(binaryPath)
+  if err != nil {
+    log.errorf("%s\n", err.Error())
+  }
+  manifest.update(path, func(entry *ManifestEntry) {
+    entry.BinaryHash = binaryHash
+  })
+  var sourceMap *apptemplate.SourceMap
+  if report.result != nil {
+    sourceMap = report.result.SourceMap
+  }
+  if !vetCode(ctx, sources, sourceMap, report, log) ||
+      interrupted(goCodePath) {
+    return report
+  }
+  if err := runHooks(afterBuildHooks, templateData(path, goCodePath,
+      binaryPath), false, log); err != nil {
+    log.errorf("%s\n", err.Error())
+    report.fail("hook", BuildError{ Message: err.Error() })
+  }
+  return report
+}
+
+// generateCode writes the .go file of a template, along with the file that
+// embeds its assets if they are embedded, and records the outputs in the
+// manifest. It returns the generated files that make up the program.
+func generateCode(path, goCodePath, binaryPath string,
+    report *TemplateReport, log *templateLog) []string {
+  startTime := time.Now()
+  outFile, err := os.Create(goCodePath)
+  if err == nil {
+    log.inform("created %s\n", goCodePath)
+  } else {
+    log.errorf("error on creating %s\n", goCodePath)
+    report.fail("create", BuildError{ Message: err.Error() })
+    return nil
+  }
+
+  // Process the template, flush the output, close the file.
+  templateWriter := bufio.NewWriter(outFile)
+  log.inform("parsing %s\n", path)
+  result, err := apptemplate.Process(siteRoot, path, templateWriter,
+      templateOptions(log))
+  templateWriter.Flush()
+  outFile.Close()
+  report.GenerateSeconds = time.Since(startTime).Seconds()
+  report.ParseSeconds = report.GenerateSeconds
+  if result != nil {
+    report.ParseSeconds = result.ParseTime.Seconds()
+  }
+  report.CodegenSeconds = report.GenerateSeconds - report.ParseSeconds
+  report.result = result
+  recordOutputs(path, goCodePath, binaryPath, result, startTime)
+  if err != nil {
+    log.errorf("skipping compilation due to parsing error\n")
+    report.failGeneration(err, goCodePath)
+    return nil
+  }
+  report.noteWarnings(result, log)
+  report.Sizes = result.Sizes
+  if err := setPermissions(goCodePath, goMode); err != nil {
+    log.errorf("%s\n", err.Error())
+    report.fail("permissions", BuildError{ Message: err.Error() })
+    return nil
+  }
+  if writeSourceMaps {
+    err = writeSourceMap(goCodePath, result, log)
+  } else {
+    err = removeSourceMap(goCodePath)
+  }
+  if err != nil {
+    log.errorf("%s\n", err.Error())
+    report.fail("sourcemap", BuildError{ Message: err.Error() })
+    return nil
+  }
+
+  // The assets of the template are embedded in a companion .go file.
+  sources := []string{ goCodePath }
+  if embedAssets && len(result.Assets) != 0 {
+    err = writeEmbedding(goCodePath, result, log)
+    _, embedGoPath := embedPaths(goCodePath)
+    sources = append(sources, embedGoPath)
+  } else {
+    err = removeEmbedding(goCodePath)
+    if err == nil && fingerprintAssets {
+      err = writeFingerprinted(result, log)
+    }
+  }
+  if err != nil {
+    log.errorf("%s\n", err.Error())
+    report.fail("embed", BuildError{ Message: err.Error() })
+    return nil
+  }
+  return sources
+}
+
+// existingSources returns the generated files of a template that exist,
+// for -compile-only: the .go file and, if there is one, the file that
+// embeds its assets. A missing .go file is left for the compiler to report.
+func existingSources(goCodePath string) []string {
+  sources := []string{ goCodePath }
+  _, embedGoPath := embedPaths(goCodePath)
+  if _, err := os.Stat(embedGoPath); err == nil {
+    sources = append(sources, embedGoPath)
+  }
+  return sources
+}
+
+// compileCode builds a binary from generated files and reports whether it
+// succeeded.
+func compileCode(ctx context.Context, binaryPath string, sources []string,
+    report *TemplateReport, log *templateLog) bool {
+  log.inform("compiling %s\n", sources[0])
+  startTime := time.Now()
+  cmd := exec.CommandContext(ctx, GoPath,
+      goBuildArgs(binaryPath, sources...)...)
+  cmd.Dir = moduleRoot
+  cmd.Env = buildEnv()
+  output, err := cmd.CombinedOutput()
+  report.CompileSeconds = time.Since(startTime).Seconds()
+  if ctx.Err() != nil {
+    return false  // The caller reports the interrupt.
+  }
+  if err != nil {
+    log.errorf("compilation error: %s\n", err)
+    log.errorf("command output: %s", string(output))
+    report.fail("compile", compilerErrors(string(output),
+        workingDirectory)...)
+    return false
+  }
+  if err := setPermissions(binaryPath, binaryMode); err != nil {
+    log.errorf("%s\n", err.Error())
+    report.fail("permissions", BuildError{ Message: err.Error() })
+    return false
+  }
+  return true
+}
+
+// templateData returns the fields of an afterBuild hook for a template.
+func templateData(path, goCodePath, binaryPath string) templateHookData {
+  binaryPath, _ = filepath.Abs(binaryPath)
+  data := templateHookData{ Source: path, GoFile: goCodePath,
+      Binary: binaryPath, Root: siteRoot }
+  data.Route = routeFor(outputRoot(), binaryPath)
+  return data
+}
+
+// Flags passed through to go build. The linker flags that buildapp needs
+// for its own settings are added to ldflags.
+var gcFlags, ldFlags, buildTags string
+var trimPath bool
+
+// maxLiteral, maxSections, and maxInsertDepth are set by -maxliteral,
+// -maxsections, and -maxinsertdepth or the settings of the same names.
+// They limit the size of string literals, warn of templates with too many
+// sections, and limit the nesting of insertions, as described for the
+// template options. Zero leaves the parser's defaults.
+var maxLiteral, maxSections, maxInsertDepth int
+
+// fastCGI is set by -fastcgi, which makes binaries that run persistently
+// under a FastCGI server and fall back to CGI otherwise.
+var fastCGI bool
+
+// lambdaTarget is set by -lambda, which makes binaries that run as AWS
+// Lambda functions behind API Gateway or a function URL.
+var lambdaTarget bool
+
+// wasiTarget is set by -wasi, which makes WebAssembly binaries for WASI
+// hosts such as wasmtime. They take the request from the environment and
+// standard input and write the response to standard output, as in CGI.
+var wasiTarget bool
+
+// goBuildArgs returns the arguments of the go command that compiles the
+// generated files of a template.
+func goBuildArgs(binaryPath string, sources ...string) []string {
+  // With -mod=mod, the go command records missing requirements and sums.
+  args := []string{ "build", "-mod=mod", "-o", binaryPath }
+  if gcFlags != "" {
+    args = append(args, "-gcflags", gcFlags)
+  }
+  ldflags := strings.TrimSpace(ldFlags + " " + buildLDFlags())
+  if ldflags != "" {
+    args = append(args, "-ldflags", ldflags)
+  }
+  if buildTags != "" {
+    args = append(args, "-tags", buildTags)
+  }
+  if trimPath {
+    args = append(args, "-trimpath")
+  }
+  return append(args, sources...)
+}
+
+// targetOS and targetArch select the platform that binaries are built for.
+// If they are "", the go command's defaults apply. If targetSuffix is true,
+// binary names include the platform.
+var targetOS, targetArch string
+var targetSuffix bool
+
+// wasiBinaryName is the default binary name pattern under -wasi.
+const wasiBinaryName = "{{.Name}}{{.Target}}.wasm"
+
+// resolveWASI sets the platform for -wasi, which cannot be combined with
+// another platform or with the targets that serve requests over the
+// network.
+func resolveWASI() error {
+  if !wasiTarget {
+    return nil
+  }
+  switch {
+  case targetOS != "" && targetOS != "wasip1",
+      targetArch != "" && targetArch != "wasm":
+    return fmt.Errorf("-wasi builds for wasip1/wasm; drop -goos and -goarch")
+  case fastCGI:
+    return fmt.Errorf("WASI binaries cannot serve FastCGI; drop -fastcgi")
+  case lambdaTarget:
+    return fmt.Errorf("WASI binaries cannot run on Lambda; drop -lambda")
+  }
+  targetOS, targetArch = "wasip1", "wasm"
+  if binaryName == "" && config.BinaryName == "" {
+    binaryName = wasiBinaryName
+  }
+  return nil
+}
+
+// targetName returns the platform part of a binary name, such as
+// ".linux-arm64", or "" if binaries are not named after the platform.
+func targetName() string {
+  if !targetSuffix {
+    return ""
+  }
+  goos, goarch := targetOS, targetArch
+  if goos == "" {
+    goos = goruntime.GOOS
+  }
+  if goarch == "" {
+    goarch = goruntime.GOARCH
+  }
+  return "." + goos + "-" + goarch
+}
+
+// recordBinary notes a binary compiled by -compile-only in the manifest.
+// The entry made by the generation phase is kept if there is one;
+// otherwise a new entry is made, which a full build treats as new.
+func recordBinary(templatePath, goCodePath, binaryPath string) {
+  binaryPath, _ = filepath.Abs(binaryPath)
+  entry := manifest.entry(templatePath)
+  if entry == nil {
+    templatePath, _ = filepath.Abs(templatePath)
+    goCodePath, _ = filepath.Abs(goCodePath)
+    entry = &ManifestEntry{ Template: templatePath, GoFile: goCodePath,
+        Built: time.Now().UTC() }
+    manifest.setEntry(entry)
+  }
+  entry.Binary = binaryPath
+  entry.Route = routeFor(outputRoot(), binaryPath)
+}
+
+// recordOutputs makes a manifest entry for the files generated from a
+// template. The entry is made even if parsing failed because the .go file
+// has been written regardless. The inputs of the template are those read
+// by a build that started at the given time.
+func recordOutputs(templatePath, goCodePath, binaryPath string,
+    result *apptemplate.Result, started time.Time) {
+  templatePath, _ = filepath.Abs(templatePath)
+  goCodePath, _ = filepath.Abs(goCodePath)
+  binaryPath, _ = filepath.Abs(binaryPath)
+  entry := &ManifestEntry{
+    Template: templatePath,
+    GoFile: goCodePath,
+    Binary: binaryPath,
+    Route: routeFor(outputRoot(), binaryPath),
+    Inputs: []string{ templatePath },
+    Settings: settingsHash(),
+    Built: started.UTC(),
+  }
+  if result != nil {
+    entry.Meta = result.Meta
+    entry.Inputs = result.Templates
+    if embedAssets && len(result.Assets) != 0 {
+      entry.EmbedDir, entry.EmbedFile = embedPaths(goCodePath)
+    }
+    if writeSourceMaps {
+      entry.MapFile = mapPath(goCodePath)
+    }
+    if (embedAssets || fingerprintAssets) && len(result.Assets) != 0 {
+      entry.Inputs = append(entry.Inputs, result.Assets...)
+    }
+    entry.InputHash, _ = hashFiles(entry.Inputs...)
+  }
+  manifest.setEntry(entry)
+}
@@ -0,0 +1,643 @@
+// Package builder turns Boomerang templates into CGI programs. It holds
+// the whole of the buildapp command, which calls Main, and offers Build,
+// Walk, and Compile to Go programs, such as deploy tools and content
+// management systems, that drive builds themselves.
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "io"
+  "bufio"
+  "strings"
+  "os"
+  "flag"
+  "fmt"
+  "path/filepath"
+)
+
+// Command-line flags
+var siteRoot, walkDirectory, listPath, manifestPath string
+var verbose, quiet, nulSeparated bool
+var extensions stringList
+
+// Verbosity levels, chosen with -q and -v. Errors are printed at every
+// level.
+const (
+  quietLevel = iota    // Only errors and results are printed.
+  normalLevel          // Each step of a build is reported.
+  verboseLevel         // Details are reported, including template parsing.
+)
+var verbosity = normalLevel
+
+// stringList is a flag value that collects the values of a repeated flag.
+type stringList []string
+
+func (list *stringList) String() string {
+  return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+  *list = append(*list, value)
+  return nil
+}
+
+// The manifest is loaded before templates are processed and saved afterward.
+var manifest *Manifest
+
+// We print parsing updates and errors to this writer: stderr under Main,
+// and the writer given in the options under Build, Walk, and Compile.
+var messageFile io.Writer
+
+var GoPath = "go"
+
+// The current working directory is a default value for the site root
+//  and for the starting point of a directory walk.
+var workingDirectory string
+
+// command describes a subcommand. The run function receives the arguments
+// that follow the subcommand name and returns an exit code.
+type command struct {
+  name, summary string
+  run func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+  commands = []*command{
+    { "build", "generate and compile templates", buildCommand },
+    { "check", "parse templates without writing files", checkCommand },
+    { "lint", "check templates for common problems", lintCommand },
+    { "fmt", "normalize the layout of templates", fmtCommand },
+    { "lsp", "serve the language server protocol for editors", lspCommand },
+    { "grammar", "write syntax highlighting data for editors",
+        grammarCommand },
+    { "watch", "rebuild templates when they change", watchCommand },
+    { "clean", "remove generated files listed in the manifest",
+        cleanCommand },
+    { "graph", "print the template insertion graph", graphCommand },
+    { "doc", "write an inventory of the site's pages", docCommand },
+    { "serve", "serve the site for development", serveCommand },
+    { "smoke", "request every page of a deployed site", smokeCommand },
+    { "status", "list pages whose binaries are out of date", statusCommand },
+    { "new", "create templates from a skeleton", newCommand },
+    { "convert", "translate Go templates into Boomerang templates",
+        convertCommand },
+    { "server", "compile the site into a single Go server", serverCommand },
+    { "messages", "extract translatable messages into a catalog",
+        messagesCommand },
+  }
+}
+
+// Main runs buildapp with the given command-line arguments, not including
+// the program name, and returns its exit code.
+func Main(args []string) int {
+  messageFile = os.Stderr
+
+  var err error
+  workingDirectory, err = os.Getwd()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+
+  if len(args) > 0 {
+    for _, cmd := range commands {
+      if args[0] == cmd.name {
+        return cmd.run(args[1:])
+      }
+    }
+    if args[0] == "help" {
+      usage()
+      return 0
+    }
+  }
+  // Without a subcommand name, the arguments are those of build.
+  return buildCommand(args)
+}
+
+// usage lists the subcommands.
+func usage() {
+  fmt.Fprintf(messageFile, "usage: buildapp <command> [flags] [file ...]\n")
+  fmt.Fprintf(messageFile, "\ncommands:\n")
+  for _, cmd := range commands {
+    fmt.Fprintf(messageFile, "  %-8s %s\n", cmd.name, cmd.summary)
+  }
+  fmt.Fprintf(messageFile, "\nRun \"buildapp <command> -h\" for the flags" +
+      " of a command.\n")
+}
+
+// newFlagSet makes a flag set for a subcommand with the global flags
+// already registered.
+func newFlagSet(name string) *flag.FlagSet {
+  flags := flag.NewFlagSet(name, flag.ExitOnError)
+
+  // Absolute template paths are resolved relative to the site root.
+  // A running app can ask Apache for this value. The app builder cannot.
+  flags.StringVar(&siteRoot, "root", workingDirectory,
+      "the physical location of the website's root directory")
+
+  flags.StringVar(&manifestPath, "manifest", "",
+      "the path of the build manifest (default <statedir>/manifest.json)")
+
+  flags.BoolVar(&verbose, "v", false,
+      "print verbose messages, including template parsing details")
+
+  flags.BoolVar(&quiet, "q", false,
+      "print only errors and results")
+
+  flags.StringVar(&configPath, "config", "",
+      "the path of the configuration file (default <root>/.boomerang/config.json)")
+
+  flags.StringVar(&stateDir, "statedir", "",
+      "the directory of the manifest (default <root>/.boomerang)")
+
+  return flags
+}
+
+// inform prints a message unless the verbosity level is quiet.
+func inform(format string, a ...interface{}) {
+  globalLog.inform(format, a...)
+}
+
+// detail prints a message at the verbose level.
+func detail(format string, a ...interface{}) {
+  globalLog.detail(format, a...)
+}
+
+// templateOptions returns the options for processing templates, with
+// messages going to the given log.
+func templateOptions(log *templateLog) *apptemplate.Options {
+  options := &apptemplate.Options{ Errors: log, FastCGI: fastCGI,
+      Lambda: lambdaTarget,
+      Defines: defines, Environment: buildEnvironment,
+      Tags: buildTagList(), Fingerprint: fingerprintAssets,
+      InlineImageLimit: inlineImageLimit, MaxLiteral: maxLiteral,
+      MaxSections: maxSections, MaxInsertDepth: maxInsertDepth,
+      UnknownTags: tagCheck,
+      PassTags: passTagList() }
+  if runtimeImport != apptemplate.RuntimePath {
+    options.RuntimePath = runtimeImport
+  }
+  if markdownCommand != "" {
+    options.Markdown = apptemplate.MarkdownFunc(commandMarkdown)
+  }
+  if verbosity >= verboseLevel {
+    options.Log = log
+  }
+  return options
+}
+
+// addSelectionFlags registers the flags that choose which templates a
+// subcommand works on.
+func addSelectionFlags(flags *flag.FlagSet) {
+  flags.StringVar(&walkDirectory, "w", "",
+      "the starting directory for a recursive walk of template files")
+
+  flags.StringVar(&listPath, "l", "",
+      "the path of a file that lists files to be processed, or - for stdin")
+
+  flags.BoolVar(&nulSeparated, "0", false,
+      "the file list is separated by NUL characters, as from find -print0")
+
+  flags.Var(&extensions, "ext",
+      "a template file extension, such as .boo (repeatable; default .boo)")
+
+  flags.BoolVar(&followLinks, "follow", false,
+      "follow symbolic links to directories during a walk")
+
+  flags.Var(&excludePatterns, "exclude",
+      "a glob pattern for files and directories to skip in a walk (repeatable)")
+}
+
+// templateExtension returns the longest template extension that the file
+// name ends with, or "" if the file is not a template.
+func templateExtension(path string) string {
+  longest := ""
+  for _, extension := range extensions {
+    if strings.HasSuffix(path, extension) && len(extension) > len(longest) {
+      longest = extension
+    }
+  }
+  return longest
+}
+
+// addBuildFlags registers the flags that control the outputs of a build.
+func addBuildFlags(flags *flag.FlagSet) {
+  flags.StringVar(&exportRoot, "export", "",
+      "a directory that receives the binaries and exported assets")
+
+  flags.StringVar(&targetOS, "goos", "",
+      "the operating system of the deployment host, such as linux")
+
+  flags.StringVar(&targetArch, "goarch", "",
+      "the architecture of the deployment host, such as arm64")
+
+  flags.BoolVar(&targetSuffix, "targetsuffix", false,
+      "name binaries after the target platform, as in index.linux-arm64.cgi")
+
+  flags.StringVar(&gcFlags, "gcflags", "",
+      "flags passed to go build -gcflags")
+
+  flags.StringVar(&ldFlags, "ldflags", "",
+      "flags passed to go build -ldflags, such as \"-s -w\"")
+
+  flags.StringVar(&buildTags, "tags", "",
+      "a comma-separated list of build tags passed to go build")
+
+  flags.BoolVar(&trimPath, "trimpath", false,
+      "pass -trimpath to go build")
+
+  flags.BoolVar(&runVet, "vet", false,
+      "run go vet on the generated code and report template lines")
+
+  flags.StringVar(&analyzerCommand, "analyzer", "",
+      "a further command, such as staticcheck, to run on the generated code")
+
+  flags.BoolVar(&fastCGI, "fastcgi", false,
+      "make binaries that serve FastCGI requests persistently, or CGI")
+
+  flags.BoolVar(&lambdaTarget, "lambda", false,
+      "make binaries that run as AWS Lambda functions")
+
+  flags.BoolVar(&wasiTarget, "wasi", false,
+      "make WebAssembly binaries for WASI hosts, named with .wasm")
+
+  flags.Var(&defineFlags, "define",
+      "a string constant for templates, as in -define Version=1.2 "+
+      "(repeatable)")
+
+  flags.StringVar(&buildEnvironment, "env", "",
+      "the environment of the build, such as production, for if tags")
+
+  flags.StringVar(&markdownCommand, "markdown", "",
+      "a command that converts Markdown on stdin to HTML for insert-markdown")
+
+  flags.BoolVar(&embedAssets, "embed", false,
+      "embed the files named by asset tags in the binaries")
+
+  flags.BoolVar(&fingerprintAssets, "fingerprint", false,
+      "put a hash of each asset's contents in its URL and copy it there")
+
+  flags.IntVar(&inlineImageLimit, "inlineimages", 0,
+      "inline images of img tags up to this many bytes as data URIs")
+
+  flags.IntVar(&maxLiteral, "maxliteral", 0,
+      "split static text into string literals of at most this many bytes "+
+      "(default 16384, -1 for no limit)")
+
+  flags.IntVar(&maxSections, "maxsections", 0,
+      "warn of templates with more sections than this "+
+      "(default 5000, -1 for no limit)")
+
+  flags.IntVar(&maxInsertDepth, "maxinsertdepth", 0,
+      "fail templates whose insertions are nested deeper than this "+
+      "(default 100, -1 for no limit)")
+
+  addStrictFlags(flags)
+
+  flags.BoolVar(&writeSourceMaps, "sourcemap", false,
+      "write a JSON source map beside each generated .go file")
+
+  flags.StringVar(&runtimeVersion, "runtimeversion", "",
+      "the version of the Boomerang runtime that generated programs require")
+
+  flags.BoolVar(&vendorRuntime, "vendorruntime", false,
+      "copy the runtime source into the module so that no download is needed")
+
+  flags.StringVar(&runtimeDir, "runtimedir", "",
+      "a local copy of the Boomerang module to build generated programs with")
+
+  flags.StringVar(&binDir, "bindir", "",
+      "a directory that receives the binaries, mirroring the site tree")
+
+  flags.StringVar(&binaryName, "binname", "",
+      "a pattern for binary names, such as \"{{.Name}}\" (default \""+
+      defaultBinaryName+"\")")
+
+  flags.StringVar(&logFormat, "log", "text",
+      "the format of messages: text, or json for one object per line")
+
+  flags.Var(&afterBuildHooks, "afterbuild",
+      "a shell command to run after each template is built (repeatable)")
+
+  flags.Var(&afterRunHooks, "afterrun",
+      "a shell command to run after a build in which nothing failed "+
+      "(repeatable)")
+
+  flags.StringVar(&genDir, "gendir", "",
+      "a directory that receives the generated .go files")
+
+  flags.StringVar(&tmpDir, "tmpdir", "",
+      "the directory for temporary files of the go command")
+
+  flags.StringVar(&cacheDir, "cachedir", "",
+      "the build cache directory of the go command")
+
+  flags.StringVar(&remoteCacheURL, "remotecache", "",
+      "a shared cache of binaries: an http(s) URL or s3://bucket/prefix")
+
+  flags.StringVar(&remoteCacheMode, "remotecachemode", "",
+      "readwrite to fetch and store binaries, or read to only fetch them")
+
+  flags.StringVar(&spoolDir, "spooldir", "",
+      "the directory that binaries use for temporary files at run time")
+
+  flags.StringVar(&permissionFlags.GoMode, "gomode", "",
+      "the octal file mode of generated .go files")
+
+  flags.StringVar(&permissionFlags.BinaryMode, "binmode", "",
+      "the octal file mode of binaries, such as 0755")
+
+  flags.StringVar(&permissionFlags.AssetMode, "assetmode", "",
+      "the octal file mode of copied assets")
+
+  flags.StringVar(&permissionFlags.Owner, "owner", "",
+      "the user who owns generated files (requires privileges)")
+
+  flags.StringVar(&permissionFlags.Group, "group", "",
+      "the group that owns generated files")
+}
+
+// resolveGlobals completes the global settings after flag parsing and
+// loads the configuration file. The site root is made absolute so that
+// manifest paths and routes are too.
+func resolveGlobals() error {
+  if quiet {
+    verbosity = quietLevel
+  } else if verbose {
+    verbosity = verboseLevel
+  }
+  var err error
+  siteRoot, err = filepath.Abs(siteRoot)
+  if err != nil {
+    return err
+  }
+  if configPath == "" {
+    configPath = defaultConfigPath(siteRoot)
+  }
+  config, err = loadConfig(configPath)
+  if err != nil {
+    return err
+  }
+  err = resolveDirectories()
+  if err != nil {
+    return err
+  }
+  if manifestPath == "" {
+    manifestPath = filepath.Join(stateDir, "manifest.json")
+  }
+  followLinks = followLinks || config.FollowLinks
+  if targetOS == "" {
+    targetOS = config.GOOS
+  }
+  if targetArch == "" {
+    targetArch = config.GOARCH
+  }
+  targetSuffix = targetSuffix || config.TargetSuffix
+  for _, pair := range []struct{ flag *string; setting string }{
+    { &gcFlags, config.GCFlags },
+    { &ldFlags, config.LDFlags },
+    { &buildTags, config.Tags },
+    { &analyzerCommand, config.Analyzer },
+    { &markdownCommand, config.Markdown },
+  } {
+    if *pair.flag == "" {
+      *pair.flag = pair.setting
+    }
+  }
+  trimPath = trimPath || config.TrimPath
+  runVet = runVet || config.Vet
+  embedAssets = embedAssets || config.Embed
+  fingerprintAssets = fingerprintAssets || config.Fingerprint
+  writeSourceMaps = writeSourceMaps || config.SourceMap
+  if inlineImageLimit == 0 {
+    inlineImageLimit = config.InlineImages
+  }
+  for _, pair := range []struct{ flag *int; setting int }{
+    { &maxLiteral, config.MaxLiteral },
+    { &maxSections, config.MaxSections },
+    { &maxInsertDepth, config.MaxInsertDepth },
+  } {
+    if *pair.flag == 0 {
+      *pair.flag = pair.setting
+    }
+  }
+  if inlineImageLimit < 0 {
+    return fmt.Errorf("-inlineimages %d is negative", inlineImageLimit)
+  }
+  fastCGI = fastCGI || config.FastCGI
+  lambdaTarget = lambdaTarget || config.Lambda
+  if fastCGI && lambdaTarget {
+    return fmt.Errorf("-fastcgi and -lambda make different binaries; " +
+        "give only one")
+  }
+  wasiTarget = wasiTarget || config.WASI
+  err = resolveWASI()
+  if err != nil {
+    return err
+  }
+  err = resolveRemoteCache()
+  if err != nil {
+    return err
+  }
+  vendorRuntime = vendorRuntime || config.VendorRuntime
+  err = parseBinaryName()
+  if err != nil {
+    return err
+  }
+  err = resolveHooks()
+  if err != nil {
+    return err
+  }
+  err = resolveDefines()
+  if err != nil {
+    return err
+  }
+  err = resolveStrict()
+  if err != nil {
+    return err
+  }
+  if logFormat != "text" && logFormat != "json" {
+    return fmt.Errorf("unknown log format %q", logFormat)
+  }
+  err = resolveModuleSettings()
+  if err != nil {
+    return err
+  }
+  if len(extensions) == 0 {
+    extensions = config.Extensions
+  }
+  if len(extensions) == 0 {
+    extensions = stringList{ ".boo" }
+  }
+  if exportRoot == "" {
+    exportRoot = siteRelative(config.Export)
+  }
+  err = loadExcludes()
+  if err != nil {
+    return err
+  }
+  if exportRoot != "" {
+    exportRoot, err = filepath.Abs(exportRoot)
+    if err != nil {
+      return err
+    }
+  }
+  return resolvePermissions()
+}
+
+// openManifest resolves the global settings and loads the manifest.
+func openManifest() error {
+  err := resolveGlobals()
+  if err != nil {
+    return err
+  }
+  manifest, err = loadManifest(manifestPath)
+  return err
+}
+
+// stdinList holds the paths read from stdin, which can only be read once,
+// and stdinErr the error that ended the reading, if any.
+var stdinList []string
+var stdinErr error
+var stdinRead bool
+
+// readList returns the paths listed in the file named by -l, or on stdin
+// if the name is "-". Paths are separated by newlines or, with -0, by NUL
+// characters. Surrounding whitespace and empty entries are dropped from a
+// newline-separated list, while NUL-separated paths are taken verbatim.
+// If reading fails, the paths read so far are returned with the error.
+func readList() ([]string, error) {
+  if listPath == "-" && stdinRead {
+    return stdinList, stdinErr
+  }
+  var input io.Reader = os.Stdin
+  if listPath != "-" {
+    file, err := os.Open(listPath)
+    if err != nil {
+      return nil, err
+    }
+    defer file.Close()
+    input = file
+  }
+  separator := byte('\n')
+  if nulSeparated {
+    separator = 0
+  }
+  paths := []string{}
+  reader := bufio.NewReader(input)
+  for {
+    entry, err := reader.ReadString(separator)
+    if err != nil && err != io.EOF {
+      if listPath == "-" {
+        stdinList, stdinErr, stdinRead = paths, err, true
+      }
+      return paths, err
+    }
+    entry = strings.TrimSuffix(entry, string(separator))
+    if !nulSeparated {
+      entry = strings.TrimSpace(entry)
+    }
+    if entry != "" {
+      paths = append(paths, entry)
+    }
+    if err == io.EOF {
+      break
+    }
+  }
+  if listPath == "-" {
+    stdinList, stdinRead = paths, true
+  }
+  return paths, nil
+}
+
+// forEachTemplate calls fn on each template selected by the non-flag
+// arguments or, if there are none, by the -l and -w flags. Messages about
+// the selection method are printed if announce is true. If the list cannot
+// be read or the walk fails, the error is printed and returned, after fn
+// has been called on the templates that were found.
+func forEachTemplate(args []string, announce bool,
+    fn func(path string)) error {
+  return forEachFile(args, announce, fn, nil)
+}
+
+// forEachFile is like forEachTemplate, but if a directory walk takes place
+// and other is not nil, it also calls other on every file that is not a
+// template. The walk skips excluded paths and the export directory.
+func forEachFile(args []string, announce bool,
+    fn, other func(path string)) error {
+  if len(args) == 0  {
+    // If no arguments remain after flag parsing, we're doing one of these:
+    // buildapp -l <file>       # process the files listed in the named file
+    // buildapp -w <directory>  # recursively walk a directory for templates
+    // buildapp                 # walk from cwd; equivalent to "buildapp -w ."
+
+    // buildapp -l <file>       # process the files listed in the named file
+    if listPath != "" {
+      if announce && listPath == "-" {
+        inform("reading file names from standard input\n")
+      } else if announce {
+        inform("reading file names from %s\n", listPath)
+      }
+      paths, err := readList()
+      if err != nil {
+        fmt.Fprintf(messageFile, "%s\n", err.Error())
+      }
+      for _, path := range paths {
+        fn(path)
+      }
+      return err
+    }
+
+    // buildapp                 # equivalent to buildapp -w .
+    directory := walkDirectory
+    if directory == "" {
+      directory = workingDirectory
+    }
+
+    // buildapp -w <directory>  # recursively walk a directory for templates
+    if announce {
+      inform("recursive walk from %s\n", directory)
+    }
+    err := walkTree(directory,
+        func (path string, info os.FileInfo, err error) error {
+      if err != nil {
+        return err
+      }
+      mode := info.Mode()
+      if mode & os.ModeDir != 0 {
+        if exportRoot != "" {
+          if absPath, _ := filepath.Abs(path); absPath == exportRoot {
+            return filepath.SkipDir
+          }
+        }
+        if path != directory && isExcluded(path, true) {
+          return filepath.SkipDir
+        }
+        return nil
+      }
+      if isExcluded(path, false) {
+        return nil
+      }
+      if templateExtension(path) != "" {
+        fn(path)
+      } else if other != nil {
+        other(path)
+      }
+      return nil
+    })
+    if err != nil {
+      fmt.Fprintf(messageFile, "%s\n", err.Error())
+    }
+    return err
+
+  } else {
+    // If we have non-flag arguments, each must name a template file.
+    // buildapp <file 1> ...    # process the named files
+    for _, path := range args {
+      fn(path)
+    }
+  }
+  return nil
+}
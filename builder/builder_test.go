@@ -0,0 +1,93 @@
+package builder
+
+import (
+  "os"
+  "strings"
+  "testing"
+  "path/filepath"
+)
+
+// setList points the -l and -0 flags at a list for the rest of a test and
+// clears the paths kept from stdin.
+func setList(t *testing.T, path string, nul bool) {
+  savedPath, savedNul := listPath, nulSeparated
+  t.Cleanup(func() {
+    listPath, nulSeparated = savedPath, savedNul
+    stdinList, stdinErr, stdinRead = nil, nil, false
+  })
+  listPath, nulSeparated = path, nul
+  stdinList, stdinErr, stdinRead = nil, nil, false
+}
+
+// TestReadList reads lists separated by newlines and by NULs.
+func TestReadList(t *testing.T) {
+  cases := []struct {
+    text string
+    nul bool
+    paths []string
+  }{
+    { "a.html\nb/c.html\n", false, []string{ "a.html", "b/c.html" } },
+    { "  a.html \r\n\n\t\nb.html", false, []string{ "a.html", "b.html" } },
+    { "", false, []string{} },
+    { "a b.html\x00 c.html \x00\x00d\n.html", true,
+        []string{ "a b.html", " c.html ", "d\n.html" } },
+    { "a.html\x00", true, []string{ "a.html" } },
+  }
+  for _, c := range cases {
+    listFile := filepath.Join(t.TempDir(), "list")
+    if err := os.WriteFile(listFile, []byte(c.text), 0644); err != nil {
+      t.Fatal(err)
+    }
+    setList(t, listFile, c.nul)
+    paths, err := readList()
+    if err != nil {
+      t.Errorf("%q: %s", c.text, err.Error())
+      continue
+    }
+    if strings.Join(paths, "|") != strings.Join(c.paths, "|") ||
+        len(paths) != len(c.paths) {
+      t.Errorf("%q: read %q, want %q", c.text, paths, c.paths)
+    }
+  }
+}
+
+// TestReadListMissing checks that a list that cannot be opened is an
+// error.
+func TestReadListMissing(t *testing.T) {
+  setList(t, filepath.Join(t.TempDir(), "missing"), false)
+  if _, err := readList(); err == nil {
+    t.Errorf("no error for a missing list")
+  }
+}
+
+// TestReadListStdin checks that the list on stdin is read once and kept,
+// along with the error that ended the reading.
+func TestReadListStdin(t *testing.T) {
+  reader, writer, err := os.Pipe()
+  if err != nil {
+    t.Fatal(err)
+  }
+  savedStdin := os.Stdin
+  os.Stdin = reader
+  defer func() {
+    os.Stdin = savedStdin
+  }()
+  writer.WriteString("a.html\nb.html\n")
+  writer.Close()
+  setList(t, "-", false)
+  for i := 0; i < 2; i++ {
+    paths, err := readList()
+    if err != nil || strings.Join(paths, "|") != "a.html|b.html" {
+      t.Errorf("read %d: %q, %v", i+1, paths, err)
+    }
+  }
+
+  // A read error is kept as well, so that every caller sees it.
+  reader.Close()
+  stdinList, stdinErr, stdinRead = nil, nil, false
+  for i := 0; i < 2; i++ {
+    if _, err := readList(); err == nil {
+      t.Errorf("read %d of a closed stdin: no error", i+1)
+    }
+  }
+}
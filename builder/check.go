@@ -0,0 +1,47 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "io"
+  "bufio"
+  "fmt"
+)
+
+// checkCommand implements "buildapp check", which parses the selected
+// templates and generates their code in memory. Nothing is written to disk
+// and nothing is compiled. Warnings are printed but do not fail a template.
+// The exit code is 1 if any template fails or the templates cannot be
+// listed.
+func checkCommand(args []string) int {
+  flags := newFlagSet("check")
+  addSelectionFlags(flags)
+  addStrictFlags(flags)
+  flags.Parse(args)
+
+  err := resolveGlobals()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  checked, failed := 0, 0
+  listErr := forEachTemplate(flags.Args(), true, func (path string) {
+    checked++
+    writer := bufio.NewWriter(io.Discard)
+    result, err := apptemplate.Process(siteRoot, path, writer,
+        templateOptions(globalLog))
+    if err != nil {
+      failed++
+      fmt.Fprintf(messageFile, "FAIL %s\n", path)
+      return
+    }
+    inform("ok   %s\n", path)
+    for _, warning := range result.Warnings {
+      globalLog.warnf("%s\n", warning.Error())
+    }
+  })
+  fmt.Fprintf(messageFile, "%d of %d templates failed\n", failed, checked)
+  if failed != 0 || listErr != nil {
+    return 1
+  }
+  return 0
+}
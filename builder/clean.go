@@ -0,0 +1,106 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+  "sort"
+)
+
+// cleanCommand implements "buildapp clean": it removes the .go files,
+// binaries, and exported assets recorded in the manifest and drops their
+// entries. With -stale, only the outputs of templates and assets that no
+// longer exist are removed, which gets rid of leftovers from renamed or
+// deleted files.
+func cleanCommand(args []string) int {
+  flags := newFlagSet("clean")
+  var staleOnly, dryRun bool
+  flags.BoolVar(&staleOnly, "stale", false,
+      "only clean up after templates that no longer exist")
+  flags.BoolVar(&dryRun, "n", false,
+      "print the files that would be removed without removing them")
+  addLockFlags(flags)
+  flags.Parse(args)
+
+  unlock, err := openManifestLocked()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  defer unlock()
+
+  status := 0
+  for _, entry := range manifest.sortedEntries() {
+    if staleOnly {
+      if _, err := os.Stat(entry.Template); err == nil {
+        continue
+      }
+    }
+    // Keep the entry if something could not be removed so that a later
+    // clean can try again.
+    paths := []string{ entry.GoFile, entry.Binary }
+    for _, path := range []string{ entry.EmbedFile, entry.EmbedDir,
+        entry.MapFile } {
+      if path != "" {
+        paths = append(paths, path)
+      }
+    }
+    if !removeFiles(dryRun, paths...) {
+      status = 1
+    } else if !dryRun {
+      delete(manifest.Entries, entry.Template)
+    }
+  }
+
+  targets := []string{}
+  for target := range manifest.Assets {
+    targets = append(targets, target)
+  }
+  sort.Strings(targets)
+  for _, target := range targets {
+    if staleOnly {
+      if _, err := os.Stat(manifest.Assets[target]); err == nil {
+        continue
+      }
+    }
+    if !removeFiles(dryRun, target) {
+      status = 1
+    } else if !dryRun {
+      delete(manifest.Assets, target)
+    }
+  }
+
+  if !dryRun {
+    err = manifest.save(manifestPath)
+    if err != nil {
+      fmt.Fprintf(messageFile, "%s\n", err.Error())
+      return 1
+    }
+  }
+  return status
+}
+
+// removeFiles deletes files and directory trees, or only reports them if
+// dryRun is true. Files that are already gone are skipped. The return
+// value is false if some file could not be removed.
+func removeFiles(dryRun bool, paths ...string) bool {
+  ok := true
+  for _, path := range paths {
+    if dryRun {
+      fmt.Fprintf(messageFile, "would remove %s\n", path)
+      continue
+    }
+    info, err := os.Lstat(path)
+    if err == nil && info.IsDir() {
+      err = os.RemoveAll(path)
+    } else if err == nil {
+      err = os.Remove(path)
+    }
+    if err == nil {
+      inform("removed %s\n", path)
+    } else if !os.IsNotExist(err) {
+      fmt.Fprintf(messageFile, "%s\n", err.Error())
+      ok = false
+    }
+  }
+  return ok
+}
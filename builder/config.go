@@ -0,0 +1,107 @@
+package builder
+
+import (
+  "os"
+  "encoding/json"
+  "path/filepath"
+)
+
+// Config holds the settings read from a site's configuration file, which
+// is .boomerang/config.json under the site root unless -config names
+// another file. A setting made with a command-line flag takes precedence.
+type Config struct {
+  Extensions []string   `json:"extensions,omitempty"`
+  Exclude []string      `json:"exclude,omitempty"`
+  FollowLinks bool      `json:"followLinks,omitempty"`
+  Export string         `json:"export,omitempty"`
+  Assets []AssetRule    `json:"assets,omitempty"`
+  Permissions Permissions  `json:"permissions"`
+  GOOS string           `json:"goos,omitempty"`
+  GOARCH string         `json:"goarch,omitempty"`
+  TargetSuffix bool     `json:"targetSuffix,omitempty"`
+  GCFlags string        `json:"gcflags,omitempty"`
+  LDFlags string        `json:"ldflags,omitempty"`
+  Tags string           `json:"tags,omitempty"`
+  TrimPath bool         `json:"trimpath,omitempty"`
+  Vet bool              `json:"vet,omitempty"`
+  Analyzer string       `json:"analyzer,omitempty"`
+  Embed bool            `json:"embed,omitempty"`
+  Fingerprint bool      `json:"fingerprint,omitempty"`
+  InlineImages int      `json:"inlineImages,omitempty"`
+  MaxLiteral int        `json:"maxLiteral,omitempty"`
+  MaxSections int       `json:"maxSections,omitempty"`
+  MaxInsertDepth int    `json:"maxInsertDepth,omitempty"`
+  UnknownTags string    `json:"unknownTags,omitempty"`
+  PassTags string       `json:"passTags,omitempty"`
+  SourceMap bool        `json:"sourceMap,omitempty"`
+  Lint Lint             `json:"lint"`
+  FastCGI bool          `json:"fastCGI,omitempty"`
+  Lambda bool           `json:"lambda,omitempty"`
+  WASI bool             `json:"wasi,omitempty"`
+  BinDir string         `json:"binDir,omitempty"`
+  BinaryName string     `json:"binaryName,omitempty"`
+  Hooks Hooks           `json:"hooks"`
+  Scaffold Scaffold     `json:"scaffold"`
+  RuntimeVersion string `json:"runtimeVersion,omitempty"`
+  RuntimeDir string     `json:"runtimeDir,omitempty"`
+  VendorRuntime bool    `json:"vendorRuntime,omitempty"`
+  StateDir string       `json:"stateDir,omitempty"`
+  GenDir string         `json:"genDir,omitempty"`
+  TmpDir string         `json:"tmpDir,omitempty"`
+  CacheDir string       `json:"cacheDir,omitempty"`
+  RemoteCache string    `json:"remoteCache,omitempty"`
+  RemoteCacheMode string `json:"remoteCacheMode,omitempty"`
+  SpoolDir string       `json:"spoolDir,omitempty"`
+  WritableRoots []string  `json:"writableRoots,omitempty"`
+  Filters []string      `json:"filters,omitempty"`
+  CSRFKeyFile string    `json:"csrfKeyFile,omitempty"`
+  LocaleDir string      `json:"localeDir,omitempty"`
+  DefaultLocale string  `json:"defaultLocale,omitempty"`
+  Cache string          `json:"cache,omitempty"`
+  RateStore string      `json:"rateStore,omitempty"`
+  Metrics string        `json:"metrics,omitempty"`
+  DBDriver string       `json:"dbDriver,omitempty"`
+  DBSource string       `json:"dbSource,omitempty"`
+  Deadline string       `json:"deadline,omitempty"`
+  MaxBodySize int       `json:"maxBodySize,omitempty"`
+  Overflow string       `json:"overflow,omitempty"`
+  Defines map[string]string  `json:"defines,omitempty"`
+  Env string            `json:"env,omitempty"`
+  Markdown string       `json:"markdown,omitempty"`
+}
+
+// config is loaded by resolveGlobals.
+var config = &Config{}
+var configPath string
+
+// defaultConfigPath returns the configuration location for a site root.
+func defaultConfigPath(root string) string {
+  return filepath.Join(root, ".boomerang", "config.json")
+}
+
+// loadConfig reads a configuration file. A missing file yields the default
+// configuration.
+func loadConfig(path string) (*Config, error) {
+  config := &Config{}
+  data, err := os.ReadFile(path)
+  if os.IsNotExist(err) {
+    return config, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  err = json.Unmarshal(data, config)
+  if err != nil {
+    return nil, &os.PathError{ Op: "parse", Path: path, Err: err }
+  }
+  return config, nil
+}
+
+// siteRelative resolves a path from the configuration file, which is taken
+// to be relative to the site root unless it is absolute.
+func siteRelative(path string) string {
+  if path == "" || filepath.IsAbs(path) {
+    return path
+  }
+  return filepath.Join(siteRoot, path)
+}
@@ -0,0 +1,671 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "fmt"
+  "sort"
+  "regexp"
+  "strings"
+  "strconv"
+  "go/token"
+  "path/filepath"
+  "text/template/parse"
+)
+
+// convertCommand implements "buildapp convert", which translates Go
+// html/template or text/template files into Boomerang templates to ease
+// the move of an existing site. Actions become code sections, template
+// calls become inserts, and each {{define}} becomes a template of its own.
+// Constructs that cannot be translated faithfully are reported with their
+// positions, and the exit code is then 1. The converted templates are
+// written beside the originals: .mer files, or .boo pages with -page.
+func convertCommand(args []string) int {
+  flags := newFlagSet("convert")
+  var textTemplates, page, print, overwrite bool
+  flags.BoolVar(&textTemplates, "text", false,
+      "the templates are text/template ones, whose output is not escaped")
+  flags.BoolVar(&page, "page", false,
+      "make pages of the given templates instead of inserted templates")
+  flags.BoolVar(&print, "print", false,
+      "write the converted templates to standard output instead of files")
+  flags.BoolVar(&overwrite, "f", false, "overwrite existing files")
+  flags.Parse(args)
+
+  if flags.NArg() == 0 {
+    fmt.Fprintf(messageFile, "convert: no templates given\n")
+    return 2
+  }
+  err := resolveGlobals()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  status := 0
+  for _, path := range flags.Args() {
+    files, faithful, err := convertTemplate(path, !textTemplates, page)
+    if err != nil {
+      globalLog.errorf("%s\n", err.Error())
+      status = 1
+      continue
+    }
+    if !faithful {
+      status = 1
+    }
+    for _, file := range files {
+      if print {
+        fmt.Fprintf(os.Stdout, "==> %s <==\n%s", file.path, file.text)
+        continue
+      }
+      err := writeConverted(file, overwrite)
+      if err != nil {
+        globalLog.errorf("%s\n", err.Error())
+        status = 1
+        continue
+      }
+      inform("created %s\n", file.path)
+    }
+  }
+  return status
+}
+
+// convertedFile is a Boomerang template made from a Go template.
+type convertedFile struct {
+  path, text string
+}
+
+// convertTemplate translates the Go template in a file and the templates
+// that it defines. It reports whether every construct was translated
+// faithfully.
+func convertTemplate(path string, escape, page bool) ([]convertedFile,
+    bool, error) {
+  source, err := os.ReadFile(path)
+  if err != nil {
+    return nil, false, err
+  }
+  trees := map[string]*parse.Tree{}
+  tree := parse.New(path)
+  tree.Mode = parse.ParseComments | parse.SkipFuncCheck
+  _, err = tree.Parse(string(source), "", "", trees)
+  if err != nil {
+    return nil, false, err
+  }
+  dir := filepath.Dir(path)
+  files := []convertedFile{}
+  faithful := true
+  add := func(tree *parse.Tree, name string, page bool) {
+    c := &converter{ tree: tree, escape: escape, dot: "data",
+        used: map[string]bool{}, imports: map[string]bool{},
+        faithful: true }
+    text := c.list(tree.Root)
+    file := convertedFile{ filepath.Join(dir, templateFileName(name)),
+        text }
+    if page {
+      file.path += extensions[0]
+      file.text = pageTemplate(text, c.imports)
+    } else {
+      file.path += ".mer"
+      for imported := range c.imports {
+        inform("%s uses %s, which the pages that insert it must import\n",
+            file.path, imported)
+      }
+    }
+    files = append(files, file)
+    faithful = faithful && c.faithful
+  }
+  names := []string{}
+  for name := range trees {
+    if name != path {
+      names = append(names, name)
+    }
+  }
+  sort.Strings(names)
+  if len(names) == 0 || !parse.IsEmptyTree(tree.Root) {
+    add(tree, filepath.Base(path), page)
+  }
+  for _, name := range names {
+    if !validTemplateName(name) {
+      globalLog.warnf("%s: cannot convert template %q: its name is not a " +
+          "relative file path\n", path, name)
+      faithful = false
+      continue
+    }
+    add(trees[name], name, false)
+  }
+  return files, faithful, nil
+}
+
+// goTemplateExtension matches the extensions of Go template files, which
+// are dropped from the names of converted templates.
+var goTemplateExtension = regexp.MustCompile(
+    `(\.(tmpl|tpl|gotmpl|gohtml|html|htm|txt))+$`)
+
+// templateFileName returns the path, without an extension, of the
+// converted template made from a Go template of the given name.
+func templateFileName(name string) string {
+  return filepath.FromSlash(goTemplateExtension.ReplaceAllString(name, ""))
+}
+
+// templateName matches the Go template names that can be turned into
+// the paths of converted templates.
+var templateName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_./-]*$`)
+
+// validTemplateName reports whether a Go template name can be turned into
+// a relative path within the directory of the template.
+func validTemplateName(name string) bool {
+  return templateName.MatchString(name) && !strings.Contains(name, "..")
+}
+
+// pageTemplate wraps converted text in a main function, making a page.
+// The value that the Go template was executed with is the variable data,
+// which the page must then set.
+func pageTemplate(body string, imports map[string]bool) string {
+  paths := []string{}
+  for path := range imports {
+    paths = append(paths, path)
+  }
+  paths = append(paths, runtimeImport)
+  sort.Strings(paths)
+  var out strings.Builder
+  out.WriteString(apptemplate.TagOpen + "code\n  package main\n\n" +
+      "  import (\n")
+  for _, path := range paths {
+    fmt.Fprintf(&out, "    %q\n", path)
+  }
+  out.WriteString("  )\n\n  func main() {\n    defer runtime.PrintCGI()\n" +
+      "    // TODO: set data to the value that the template was executed " +
+      "with.\n    var data interface{}\n    _ = data\n" +
+      apptemplate.TagClose + "\n")
+  out.WriteString(body)
+  out.WriteString(apptemplate.TagOpen + "code\n  }\n" +
+      apptemplate.TagClose + "\n")
+  return out.String()
+}
+
+// writeConverted writes a converted template, which must not exist unless
+// overwrite is true.
+func writeConverted(file convertedFile, overwrite bool) error {
+  flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+  if overwrite {
+    flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+  }
+  err := os.MkdirAll(filepath.Dir(file.path), 0755)
+  if err != nil {
+    return err
+  }
+  out, err := os.OpenFile(file.path, flag, 0644)
+  if err != nil {
+    return err
+  }
+  _, err = out.WriteString(file.text)
+  if closeErr := out.Close(); err == nil {
+    err = closeErr
+  }
+  return err
+}
+
+// converter translates the nodes of a Go template. The dot of the template
+// becomes a Go variable: data at the top level, and a new variable in each
+// range and with action.
+type converter struct {
+  tree *parse.Tree
+  escape bool               // Output is escaped, as by html/template.
+  dot string                // The variable that holds the current dot.
+  count int                 // The number of variables made so far.
+  used map[string]bool      // The variables that have been referred to.
+  imports map[string]bool   // The packages that the code uses.
+  faithful bool             // Nothing has been reported.
+}
+
+// goExpr is a Go expression made from a pipeline or an operand. boolean
+// is true if the expression is of type bool.
+type goExpr struct {
+  text string
+  boolean bool
+}
+
+// codeTag returns a code section holding Go code.
+func codeTag(code string) string {
+  return apptemplate.TagOpen + "code " + code + " " + apptemplate.TagClose
+}
+
+// report notes a construct that is not translated faithfully.
+func (c *converter) report(node parse.Node, format string,
+    args ...interface{}) {
+  location, _ := c.tree.ErrorContext(node)
+  globalLog.warnf("%s: %s\n", location, fmt.Sprintf(format, args...))
+  c.faithful = false
+}
+
+// todo returns a code section that holds a comment in place of a node
+// that could not be translated.
+func todo(node parse.Node) string {
+  text := strings.NewReplacer("*/", "* /", apptemplate.TagClose, "? >").
+      Replace(node.String())
+  return codeTag("/* TODO: " + text + " */")
+}
+
+// list translates a list of nodes.
+func (c *converter) list(list *parse.ListNode) string {
+  var out strings.Builder
+  if list == nil {
+    return ""
+  }
+  for _, node := range list.Nodes {
+    out.WriteString(c.node(node))
+  }
+  return out.String()
+}
+
+// node translates a node. Static text is kept, except that text that
+// would be taken for a tag is written by code.
+func (c *converter) node(node parse.Node) string {
+  switch n := node.(type) {
+  case *parse.TextNode:
+    if strings.Contains(string(n.Text), apptemplate.TagOpen) {
+      return codeTag("runtime.WriteString(" + goString(string(n.Text)) +
+          ")")
+    }
+    return string(n.Text)
+  case *parse.CommentNode:
+    return codeTag(strings.ReplaceAll(n.Text, apptemplate.TagClose,
+        "? >"))
+  case *parse.ActionNode:
+    return c.action(n)
+  case *parse.IfNode:
+    return c.branch(n.Pipe, n.List, n.ElseList, false)
+  case *parse.WithNode:
+    return c.branch(n.Pipe, n.List, n.ElseList, true)
+  case *parse.RangeNode:
+    return c.rangeLoop(n)
+  case *parse.TemplateNode:
+    return c.insert(n)
+  case *parse.BreakNode:
+    return codeTag("break")
+  case *parse.ContinueNode:
+    return codeTag("continue")
+  }
+  c.report(node, "cannot translate %s", node)
+  return todo(node)
+}
+
+// action translates an action, which prints its value or sets a variable.
+func (c *converter) action(n *parse.ActionNode) string {
+  value := c.pipeline(n.Pipe)
+  if len(n.Pipe.Decl) == 0 {
+    if c.escape {
+      return codeTag("runtime.PrintEscaped(" + value.text + ")")
+    }
+    return codeTag("runtime.Print(" + value.text + ")")
+  }
+  name := c.variable(n.Pipe.Decl[0])
+  if n.Pipe.IsAssign {
+    return codeTag(name + " = " + value.text)
+  }
+  return codeTag(name + " := " + value.text + "; _ = " + name)
+}
+
+// branch translates an if or with action, whose condition holds if its
+// value is true as Go templates judge it. A with action makes the value
+// the dot of its first branch.
+func (c *converter) branch(pipe *parse.PipeNode, list,
+    elseList *parse.ListNode, with bool) string {
+  value := c.pipeline(pipe)
+  saved := c.dot
+  var head string
+  switch {
+  case pipe.IsAssign:
+    c.report(pipe, "cannot assign a variable in a condition")
+    head = "if " + condition(value) + " {"
+  case len(pipe.Decl) != 0 || with:
+    var name string
+    if len(pipe.Decl) != 0 {
+      name = c.variable(pipe.Decl[0])
+    } else {
+      name = c.newVariable("dot")
+    }
+    head = "if " + name + " := " + value.text + "; " +
+        condition(goExpr{ name, value.boolean }) + " {"
+    if with {
+      c.dot = name
+    }
+  default:
+    head = "if " + condition(value) + " {"
+  }
+  out := codeTag(head) + c.list(list)
+  c.dot = saved
+  if elseList != nil {
+    out += codeTag("} else {") + c.list(elseList)
+  }
+  return out + codeTag("}")
+}
+
+// rangeLoop translates a range action. Its variables, or else a new
+// variable that becomes the dot, take the elements in turn. The else
+// branch runs if there are none.
+func (c *converter) rangeLoop(n *parse.RangeNode) string {
+  value := c.pipeline(n.Pipe)
+  saved := c.dot
+  key, element := "_", ""
+  switch len(n.Pipe.Decl) {
+  case 0:
+    element = c.newVariable("dot")
+  case 1:
+    element = c.variable(n.Pipe.Decl[0])
+  default:
+    key = c.variable(n.Pipe.Decl[0])
+    element = c.variable(n.Pipe.Decl[1])
+  }
+  c.dot = element
+  body := c.list(n.List)
+  c.dot = saved
+  if !c.used[key] {
+    key = "_"
+  }
+  if !c.used[element] {
+    element = ""
+  }
+  over := value.text
+  var out strings.Builder
+  if n.ElseList != nil {
+    over = c.newVariable("items")
+    out.WriteString(codeTag("if " + over + " := " + value.text +
+        "; len(" + over + ") != 0 {"))
+  }
+  switch {
+  case element != "":
+    out.WriteString(codeTag("for " + key + ", " + element +
+        " := range " + over + " {"))
+  case key != "_":
+    out.WriteString(codeTag("for " + key + " := range " + over + " {"))
+  default:
+    out.WriteString(codeTag("for range " + over + " {"))
+  }
+  out.WriteString(body + codeTag("}"))
+  if n.ElseList != nil {
+    out.WriteString(codeTag("} else {") + c.list(n.ElseList) +
+        codeTag("}"))
+  }
+  return out.String()
+}
+
+// insert translates a template call. If the call passes a value other
+// than the top-level dot, the value is given to the inserted template as
+// data in a block around the insert tag.
+func (c *converter) insert(n *parse.TemplateNode) string {
+  if !validTemplateName(n.Name) {
+    c.report(n, "cannot insert template %q: its name is not a relative " +
+        "file path", n.Name)
+    return todo(n)
+  }
+  insert := apptemplate.TagOpen + "insert " +
+      filepath.ToSlash(templateFileName(n.Name)) + ".mer " +
+      apptemplate.TagClose
+  if n.Pipe == nil {
+    return insert
+  }
+  value := c.pipeline(n.Pipe)
+  if value.text == "data" {
+    return insert
+  }
+  return codeTag("{ data := " + value.text + "; _ = data") + insert +
+      codeTag("}")
+}
+
+// pipeline translates a pipeline, passing the value of each command to
+// the next as its last argument.
+func (c *converter) pipeline(pipe *parse.PipeNode) goExpr {
+  var value goExpr
+  for i, cmd := range pipe.Cmds {
+    args := []goExpr{}
+    for _, arg := range cmd.Args[1:] {
+      args = append(args, c.operand(arg))
+    }
+    if i != 0 {
+      args = append(args, value)
+    }
+    value = c.command(cmd, args)
+  }
+  return value
+}
+
+// command translates a command: a function call, a method call, or an
+// operand.
+func (c *converter) command(cmd *parse.CommandNode, args []goExpr) goExpr {
+  first := cmd.Args[0]
+  switch n := first.(type) {
+  case *parse.IdentifierNode:
+    return c.function(cmd, n.Ident, args)
+  case *parse.FieldNode, *parse.ChainNode, *parse.VariableNode:
+    if len(args) != 0 {
+      return goExpr{ c.operand(first).text + "(" + joinExprs(args) + ")",
+          false }
+    }
+  }
+  if len(args) != 0 {
+    c.report(cmd, "%s cannot take arguments", first)
+  }
+  return c.operand(first)
+}
+
+// operand translates an argument of a command.
+func (c *converter) operand(node parse.Node) goExpr {
+  switch n := node.(type) {
+  case *parse.DotNode:
+    return goExpr{ c.useDot(), false }
+  case *parse.FieldNode:
+    return goExpr{ c.useDot() + "." + strings.Join(n.Ident, "."), false }
+  case *parse.VariableNode:
+    name := "data"
+    if n.Ident[0] != "$" {
+      name = variableName(n.Ident[0])
+      c.used[name] = true
+    }
+    return goExpr{ strings.Join(append([]string{ name }, n.Ident[1:]...),
+        "."), false }
+  case *parse.ChainNode:
+    return goExpr{ "(" + c.operand(n.Node).text + ")." +
+        strings.Join(n.Field, "."), false }
+  case *parse.PipeNode:
+    return c.pipeline(n)  // Operator expressions are in parentheses.
+  case *parse.IdentifierNode:
+    return c.function(n, n.Ident, nil)
+  case *parse.StringNode:
+    return goExpr{ goString(n.Text), false }
+  case *parse.NumberNode:
+    return goExpr{ n.Text, false }
+  case *parse.BoolNode:
+    return goExpr{ strconv.FormatBool(n.True), true }
+  case *parse.NilNode:
+    return goExpr{ "nil", false }
+  }
+  c.report(node, "cannot translate %s", node)
+  return goExpr{ "nil", false }
+}
+
+// comparisons are the Go operators of the comparison functions.
+var comparisons = map[string]string{
+  "eq": "==", "ne": "!=", "lt": "<", "le": "<=", "gt": ">", "ge": ">=",
+}
+
+// escapers are the runtime functions that stand in for the escaping
+// functions of Go templates.
+var escapers = map[string]string{
+  "html": "runtime.EscapeHTML", "js": "runtime.EscapeJS",
+  "urlquery": "runtime.EscapeURL",
+}
+
+// function translates a call of a function of Go templates. A function
+// that is not predefined is taken to be a Go function of the same name.
+func (c *converter) function(node parse.Node, name string,
+    args []goExpr) goExpr {
+  need := func(min, max int) bool {
+    if len(args) < min || max != -1 && len(args) > max {
+      c.report(node, "wrong number of arguments for %s", name)
+      return false
+    }
+    return true
+  }
+  switch name {
+  case "and", "or":
+    if !need(1, -1) {
+      break
+    }
+    operator := map[string]string{ "and": " && ", "or": " || " }[name]
+    terms := []string{}
+    for _, arg := range args {
+      terms = append(terms, truth(arg))
+    }
+    return goExpr{ "(" + strings.Join(terms, operator) + ")", true }
+  case "not":
+    if need(1, 1) {
+      return goExpr{ "!" + truth(args[0]), true }
+    }
+  case "eq":
+    if !need(2, -1) {
+      break
+    }
+    terms := []string{}
+    for _, arg := range args[1:] {
+      terms = append(terms, args[0].text + " == " + arg.text)
+    }
+    return goExpr{ "(" + strings.Join(terms, " || ") + ")", true }
+  case "ne", "lt", "le", "gt", "ge":
+    if need(2, 2) {
+      return goExpr{ "(" + args[0].text + " " + comparisons[name] + " " +
+          args[1].text + ")", true }
+    }
+  case "len":
+    if need(1, 1) {
+      return goExpr{ "len(" + args[0].text + ")", false }
+    }
+  case "index":
+    if need(1, -1) {
+      text := args[0].text
+      for _, arg := range args[1:] {
+        text += "[" + arg.text + "]"
+      }
+      return goExpr{ text, false }
+    }
+  case "slice":
+    if need(1, 4) {
+      indices := []string{}
+      for _, arg := range args[1:] {
+        indices = append(indices, arg.text)
+      }
+      if len(indices) == 0 {
+        return args[0]
+      }
+      if len(indices) == 1 {
+        indices = append(indices, "")
+      }
+      return goExpr{ args[0].text + "[" + strings.Join(indices, ":") + "]",
+          false }
+    }
+  case "print", "printf", "println":
+    c.imports["fmt"] = true
+    return goExpr{ "fmt.S" + name + "(" + joinExprs(args) + ")", false }
+  case "html", "js", "urlquery":
+    c.imports["fmt"] = true
+    return goExpr{ escapers[name] + "(fmt.Sprint(" + joinExprs(args) +
+        "))", false }
+  case "call":
+    if need(1, -1) {
+      return goExpr{ args[0].text + "(" + joinExprs(args[1:]) + ")", false }
+    }
+  default:
+    c.report(node, "unknown function %s is taken to be a Go function", name)
+    return goExpr{ name + "(" + joinExprs(args) + ")", false }
+  }
+  return goExpr{ "nil", false }
+}
+
+// truth returns a Go condition that holds if an expression is true as Go
+// templates judge it.
+func truth(value goExpr) string {
+  if value.boolean {
+    return value.text
+  }
+  return "runtime.Truth(" + value.text + ")"
+}
+
+// condition is like truth, but without the parentheses around an
+// operator expression, which stands alone in an if statement.
+func condition(value goExpr) string {
+  text := truth(value)
+  if strings.HasPrefix(text, "(") && strings.HasSuffix(text, ")") &&
+      closingParen(text) == len(text)-1 {
+    return text[1:len(text)-1]
+  }
+  return text
+}
+
+// closingParen returns the index of the parenthesis that closes the one
+// that begins a Go expression, skipping string and rune literals.
+func closingParen(text string) int {
+  depth := 0
+  for i := 0; i < len(text); i++ {
+    switch text[i] {
+    case '"', '\'', '`':
+      quote := text[i]
+      for i++; i < len(text) && text[i] != quote; i++ {
+        if text[i] == '\\' && quote != '`' {
+          i++
+        }
+      }
+    case '(':
+      depth++
+    case ')':
+      depth--
+      if depth == 0 {
+        return i
+      }
+    }
+  }
+  return -1
+}
+
+// joinExprs joins expressions into an argument list.
+func joinExprs(exprs []goExpr) string {
+  texts := []string{}
+  for _, expr := range exprs {
+    texts = append(texts, expr.text)
+  }
+  return strings.Join(texts, ", ")
+}
+
+// useDot returns the variable that holds the dot and notes its use.
+func (c *converter) useDot() string {
+  c.used[c.dot] = true
+  return c.dot
+}
+
+// newVariable returns a new variable name with the given prefix.
+func (c *converter) newVariable(prefix string) string {
+  c.count++
+  return fmt.Sprintf("%s%d", prefix, c.count)
+}
+
+// variable returns the Go name of a variable declared in a pipeline.
+func (c *converter) variable(node *parse.VariableNode) string {
+  return variableName(node.Ident[0])
+}
+
+// variableName returns the Go name of a template variable, such as item
+// for $item. Names that Go or the generated code reserve get an
+// underscore.
+func variableName(name string) string {
+  name = strings.TrimPrefix(name, "$")
+  if token.IsKeyword(name) || name == "data" || name == "runtime" ||
+      name == "fmt" || name == "boomerang" || name == "" {
+    return name + "_"
+  }
+  return name
+}
+
+// goString returns a Go string literal of text, with ?> written so that
+// it does not end the code section.
+func goString(text string) string {
+  return strings.ReplaceAll(strconv.Quote(text), apptemplate.TagClose,
+      `?\x3e`)
+}
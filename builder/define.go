@@ -0,0 +1,69 @@
+package builder
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "go/token"
+)
+
+// defineFlags holds the values of -define, each of the form key=value.
+var defineFlags stringList
+
+// defines maps the names of the constants given to templates to their
+// values. It is made by resolveDefines from the defines section of the
+// configuration and the -define flags, which take precedence.
+var defines map[string]string
+
+// buildEnvironment is set by -env or the env setting. It names the
+// environment of the build, such as production, for the if tags of
+// templates.
+var buildEnvironment string
+
+// buildTagList returns the build tags, which the if tags of templates can
+// test, as a list.
+func buildTagList() []string {
+  return strings.FieldsFunc(buildTags, func(r rune) bool {
+    return r == ',' || r == ' '
+  })
+}
+
+// resolveDefines merges the constants of the configuration and the command
+// line, and checks that each name can be declared in Go. It also takes the
+// environment from the configuration unless -env is given.
+func resolveDefines() error {
+  if buildEnvironment == "" {
+    buildEnvironment = config.Env
+  }
+  defines = map[string]string{}
+  for key, value := range config.Defines {
+    defines[key] = value
+  }
+  for _, definition := range defineFlags {
+    key, value, found := strings.Cut(definition, "=")
+    if !found {
+      return fmt.Errorf("-define %q is not of the form key=value", definition)
+    }
+    defines[strings.TrimSpace(key)] = value
+  }
+  for key := range defines {
+    if !token.IsIdentifier(key) || key == "_" {
+      return fmt.Errorf("define %q is not a Go identifier", key)
+    }
+  }
+  return nil
+}
+
+// definesHash returns the constants in a stable order for settingsHash.
+func definesHash() string {
+  keys := []string{}
+  for key := range defines {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  pairs := []string{}
+  for _, key := range keys {
+    pairs = append(pairs, key+"="+defines[key])
+  }
+  return strings.Join(pairs, "\x00")
+}
@@ -0,0 +1,171 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+  "strings"
+  "path/filepath"
+)
+
+// These directories let buildapp run on hosts where the site tree must not
+// be written to except for the outputs themselves. Each one can be set
+// with a flag or in the configuration file, and "" means the default.
+//   stateDir   holds the manifest (default <root>/.boomerang)
+//   genDir     receives the generated .go files, mirroring the site tree
+//              (default: alongside the templates)
+//   tmpDir     holds temporary files of the go command (GOTMPDIR, TMPDIR)
+//   cacheDir   holds the build cache of the go command (GOCACHE)
+//   spoolDir   is compiled into binaries as the runtime's directory for
+//              temporary files (default: the host's temporary directory)
+//   binDir     receives the binaries, mirroring the site tree (default:
+//              the export tree or, without one, alongside the templates)
+var stateDir, genDir, tmpDir, cacheDir, spoolDir, binDir string
+
+// resolveDirectories fills in the directory settings from the configuration
+// and makes them absolute.
+func resolveDirectories() error {
+  for _, pair := range []struct{ dir *string; setting string }{
+    { &stateDir, config.StateDir },
+    { &genDir, config.GenDir },
+    { &tmpDir, config.TmpDir },
+    { &cacheDir, config.CacheDir },
+    { &spoolDir, config.SpoolDir },
+    { &binDir, config.BinDir },
+  } {
+    if *pair.dir == "" {
+      *pair.dir = siteRelative(pair.setting)
+    }
+    if *pair.dir != "" {
+      absDir, err := filepath.Abs(*pair.dir)
+      if err != nil {
+        return err
+      }
+      *pair.dir = absDir
+    }
+  }
+  if stateDir == "" {
+    stateDir = filepath.Join(siteRoot, ".boomerang")
+  }
+  return nil
+}
+
+// makeGoDirectories creates the directories of the go command, which
+// expects them to exist.
+func makeGoDirectories() error {
+  for _, dir := range []string{ tmpDir, cacheDir } {
+    if dir != "" {
+      err := os.MkdirAll(dir, 0755)
+      if err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// mirrorPath maps a path under the site root to the corresponding path
+// under another directory. Paths outside the site root cannot be mapped.
+func mirrorPath(dir, sourcePath string) (string, error) {
+  absPath, err := filepath.Abs(sourcePath)
+  if err != nil {
+    return "", err
+  }
+  relPath, err := filepath.Rel(siteRoot, absPath)
+  if err != nil || relPath == ".." ||
+      strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+    return "", fmt.Errorf("%s is outside the site root", sourcePath)
+  }
+  return filepath.Join(dir, relPath), nil
+}
+
+// buildEnv returns the environment for the go command, including the
+// target platform.
+func buildEnv() []string {
+  env := os.Environ()
+  if targetOS != "" {
+    env = append(env, "GOOS="+targetOS)
+  }
+  if targetArch != "" {
+    env = append(env, "GOARCH="+targetArch)
+  }
+  if tmpDir != "" {
+    env = append(env, "GOTMPDIR="+tmpDir, "TMPDIR="+tmpDir)
+  }
+  if cacheDir != "" {
+    env = append(env, "GOCACHE="+cacheDir)
+  }
+  return env
+}
+
+// buildLDFlags returns the linker flags that compile settings into the
+// runtime package, or "" if there are none.
+func buildLDFlags() string {
+  settings := []string{}
+  if spoolDir != "" {
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultTempDir=%s'",
+        runtimeImport, spoolDir))
+  }
+  if len(config.WritableRoots) != 0 {
+    list := strings.Join(config.WritableRoots, string(filepath.ListSeparator))
+    settings = append(settings, fmt.Sprintf(
+        "-X '%s.defaultWritableRoots=%s'", runtimeImport, list))
+  }
+  if config.CSRFKeyFile != "" {
+    settings = append(settings, fmt.Sprintf(
+        "-X '%s.defaultCSRFKeyFile=%s'", runtimeImport,
+        siteRelative(config.CSRFKeyFile)))
+  }
+  if config.LocaleDir != "" {
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultLocaleDir=%s'",
+        runtimeImport, siteRelative(config.LocaleDir)))
+  }
+  if config.DefaultLocale != "" {
+    settings = append(settings, fmt.Sprintf("-X '%s.DefaultLocale=%s'",
+        runtimeImport, config.DefaultLocale))
+  }
+  if config.Cache != "" {
+    cache := config.Cache
+    if dir, found := strings.CutPrefix(cache, "file:"); found {
+      cache = "file:" + siteRelative(dir)
+    }
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultCache=%s'",
+        runtimeImport, cache))
+  }
+  if config.RateStore != "" {
+    store := config.RateStore
+    if dir, found := strings.CutPrefix(store, "file:"); found {
+      store = "file:" + siteRelative(dir)
+    }
+    settings = append(settings, fmt.Sprintf(
+        "-X '%s.defaultRateStore=%s'", runtimeImport, store))
+  }
+  if config.Metrics != "" {
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultMetrics=%s'",
+        runtimeImport, config.Metrics))
+  }
+  if config.DBDriver != "" {
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultDBDriver=%s'",
+        runtimeImport, config.DBDriver))
+  }
+  if config.DBSource != "" {
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultDBSource=%s'",
+        runtimeImport, config.DBSource))
+  }
+  if config.Deadline != "" {
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultDeadline=%s'",
+        runtimeImport, config.Deadline))
+  }
+  if config.MaxBodySize != 0 {
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultMaxBody=%d'",
+        runtimeImport, config.MaxBodySize))
+  }
+  if config.Overflow != "" {
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultOverflow=%s'",
+        runtimeImport, config.Overflow))
+  }
+  if len(config.Filters) != 0 {
+    settings = append(settings, fmt.Sprintf("-X '%s.defaultFilters=%s'",
+        runtimeImport, strings.Join(config.Filters, ",")))
+  }
+  return strings.Join(settings, " ")
+}
@@ -0,0 +1,208 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "io"
+  "os"
+  "fmt"
+  "sort"
+  "bufio"
+  "strings"
+  "html/template"
+  "path/filepath"
+  "encoding/json"
+)
+
+// docCommand implements "buildapp doc", which writes an inventory of the
+// pages of the site to stdout, as an HTML site map or as JSON. Each page
+// is described by its meta tags and by the comment at the top of its
+// template, and lists the templates it inserts.
+func docCommand(args []string) int {
+  flags := newFlagSet("doc")
+  addSelectionFlags(flags)
+  var format string
+  flags.StringVar(&format, "format", "html",
+      "the output format: html or json")
+  flags.Parse(args)
+
+  if format != "html" && format != "json" {
+    fmt.Fprintf(messageFile, "doc: unknown format %q\n", format)
+    return 2
+  }
+  err := resolveGlobals()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  pages := []*pageDoc{}
+  status := 0
+  forEachTemplate(flags.Args(), false, func (path string) {
+    page := describePage(path)
+    if page.Error != "" {
+      status = 1
+    }
+    pages = append(pages, page)
+  })
+  sort.Slice(pages, func (i, j int) bool {
+    return pages[i].Template < pages[j].Template
+  })
+  out := bufio.NewWriter(os.Stdout)
+  if format == "json" {
+    data, _ := json.MarshalIndent(struct {
+      Pages []*pageDoc  `json:"pages"`
+    }{ pages }, "", "  ")
+    out.Write(append(data, '\n'))
+  } else {
+    err = siteMapTemplate.Execute(out, pages)
+  }
+  if err == nil {
+    err = out.Flush()
+  }
+  if err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return 1
+  }
+  return status
+}
+
+// pageDoc describes a page. Title, Description, Params, and Owners come
+// from the meta keys title, description, param, and owner; a param value
+// is a name followed by a description. Comment is the comment at the top
+// of the template. Includes and Assets are the templates and asset files
+// that the page uses, as site paths. Error is the reason the template
+// could not be parsed, in which case only the comment is known.
+type pageDoc struct {
+  Template string          `json:"template"`
+  Route string             `json:"route,omitempty"`
+  Title string             `json:"title,omitempty"`
+  Description string       `json:"description,omitempty"`
+  Comment string           `json:"comment,omitempty"`
+  Params []pageParam       `json:"params,omitempty"`
+  Owners []string          `json:"owners,omitempty"`
+  Includes []string        `json:"includes,omitempty"`
+  Assets []string          `json:"assets,omitempty"`
+  Meta apptemplate.Meta    `json:"meta,omitempty"`
+  Error string             `json:"error,omitempty"`
+}
+
+// pageParam is a parameter that a page declares, such as a form value.
+type pageParam struct {
+  Name string          `json:"name"`
+  Description string   `json:"description,omitempty"`
+}
+
+// describePage parses a template and describes the page it makes.
+func describePage(path string) *pageDoc {
+  if absPath, err := filepath.Abs(path); err == nil {
+    path = absPath
+  }
+  page := &pageDoc{ Template: sitePath(path) }
+  if _, binaryPath, err := outputPaths(path); err == nil {
+    page.Route = routeFor(binaryRoot(), binaryPath)
+  }
+  if source, err := os.ReadFile(path); err == nil {
+    page.Comment = leadingComment(string(source))
+  }
+  result, err := apptemplate.Process(siteRoot, path,
+      bufio.NewWriter(io.Discard), templateOptions(globalLog))
+  if err != nil {
+    page.Error = err.Error()
+    return page
+  }
+  page.Meta = result.Meta
+  page.Title = result.Meta.Get("title")
+  page.Description = result.Meta.Get("description")
+  page.Owners = result.Meta.Values("owner")
+  for _, value := range result.Meta.Values("param") {
+    name, description, _ := strings.Cut(value, " ")
+    page.Params = append(page.Params, pageParam{
+      Name: strings.TrimSuffix(name, ":"),
+      Description: strings.TrimSpace(description),
+    })
+  }
+  for _, hardPath := range result.Templates[1:] {
+    page.Includes = append(page.Includes, sitePath(hardPath))
+  }
+  for _, hardPath := range result.Assets {
+    page.Assets = append(page.Assets, sitePath(hardPath))
+  }
+  return page
+}
+
+// leadingComment returns the text of the comment that begins a template:
+// an HTML comment, or the Go comments at the start of the first code
+// section, such as those above the package clause.
+func leadingComment(source string) string {
+  source = strings.TrimSpace(source)
+  if strings.HasPrefix(source, "<!--") {
+    end := strings.Index(source, "-->")
+    if end == -1 {
+      return ""
+    }
+    return strings.TrimSpace(source[len("<!--"):end])
+  }
+  if !strings.HasPrefix(source, apptemplate.TagOpen+"code") {
+    return ""
+  }
+  code := source[len(apptemplate.TagOpen+"code"):]
+  if end := strings.Index(code, apptemplate.TagClose); end != -1 {
+    code = code[:end]
+  }
+  lines := []string{}
+  for {
+    code = strings.TrimSpace(code)
+    if strings.HasPrefix(code, "//") {
+      line, rest, _ := strings.Cut(code, "\n")
+      lines = append(lines, strings.TrimSpace(line[2:]))
+      code = rest
+    } else if strings.HasPrefix(code, "/*") {
+      end := strings.Index(code, "*/")
+      if end == -1 {
+        break
+      }
+      for _, line := range strings.Split(code[2:end], "\n") {
+        lines = append(lines, strings.TrimSpace(line))
+      }
+      code = code[end+2:]
+    } else {
+      break
+    }
+  }
+  return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// siteMapTemplate lays out the page inventory as HTML.
+var siteMapTemplate = template.Must(template.New("doc").Parse(
+`<!DOCTYPE html>
+<html>
+<head>
+<title>Site map</title>
+<style>
+  body { font-family: sans-serif; margin: 2em; }
+  table { border-collapse: collapse; }
+  th, td { border: 1px solid #ccc; padding: 0.4em; text-align: left;
+      vertical-align: top; }
+  .error { color: #a00; }
+  pre { white-space: pre-wrap; margin: 0; }
+</style>
+</head>
+<body>
+<h1>Site map</h1>
+<table>
+<tr><th>Page</th><th>Description</th><th>Parameters</th><th>Owners</th>
+<th>Includes</th></tr>
+{{range .}}<tr>
+<td>{{if .Route}}<a href="{{.Route}}">{{.Route}}</a><br>{{end}}
+<code>{{.Template}}</code></td>
+<td>{{if .Title}}<strong>{{.Title}}</strong><br>{{end}}
+{{if .Description}}{{.Description}}
+{{else if .Comment}}<pre>{{.Comment}}</pre>{{end}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}</td>
+<td>{{range .Params}}<code>{{.Name}}</code> {{.Description}}<br>{{end}}</td>
+<td>{{range .Owners}}{{.}}<br>{{end}}</td>
+<td>{{range .Includes}}<code>{{.}}</code><br>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,89 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "fmt"
+  "strings"
+  "path/filepath"
+)
+
+// embedAssets is set by -embed. The files named by asset tags are then
+// copied into a directory beside the generated .go file and embedded in
+// the binary, which serves them itself.
+var embedAssets bool
+
+// embedTemplate is the source of the .go file that embeds the assets of a
+// template. The directory name is filled in.
+const embedTemplate = `// Code generated by buildapp. DO NOT EDIT.
+
+package main
+
+import (
+  "embed"
+  boomerang_runtime %q
+)
+
+//go:embed %s
+var boomerangEmbeddedAssets embed.FS
+
+func init() {
+  boomerang_runtime.EmbedAssets(boomerangEmbeddedAssets, %q)
+}
+`
+
+// embedPaths returns the paths of the directory and the .go file that
+// embed the assets of the template whose generated code is at goCodePath.
+func embedPaths(goCodePath string) (embedDir, embedGoPath string) {
+  base := strings.TrimSuffix(goCodePath, ".go")
+  return base + ".assets", base + "_embed.go"
+}
+
+// writeEmbedding copies the assets of a template into its embedding
+// directory, mirroring the site tree, and writes the .go file that embeds
+// them. Outputs of an earlier embedding are replaced.
+func writeEmbedding(goCodePath string, result *apptemplate.Result,
+    log *templateLog) error {
+  embedDir, embedGoPath := embedPaths(goCodePath)
+  err := os.RemoveAll(embedDir)
+  if err != nil {
+    return err
+  }
+  for _, assetPath := range result.Assets {
+    targetPath, err := mirrorPath(embedDir, assetPath)
+    if urlPath, found := result.Fingerprints[assetPath]; found {
+      targetPath = filepath.Join(embedDir, filepath.FromSlash(urlPath))
+    }
+    if err == nil {
+      err = os.MkdirAll(filepath.Dir(targetPath), 0755)
+    }
+    if err == nil {
+      err = copyFile(assetPath, targetPath, log)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  dirName := filepath.Base(embedDir)
+  source := fmt.Sprintf(embedTemplate, runtimeImport, dirName,
+      dirName)
+  err = os.WriteFile(embedGoPath, []byte(source), 0644)
+  if err != nil {
+    return err
+  }
+  log.inform("embedded %d assets in %s\n", len(result.Assets), embedGoPath)
+  return setPermissions(embedGoPath, goMode)
+}
+
+// removeEmbedding deletes the outputs of an earlier embedding, if any.
+func removeEmbedding(goCodePath string) error {
+  embedDir, embedGoPath := embedPaths(goCodePath)
+  err := os.RemoveAll(embedDir)
+  if err == nil {
+    err = os.Remove(embedGoPath)
+  }
+  if os.IsNotExist(err) {
+    return nil
+  }
+  return err
+}
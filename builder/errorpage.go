@@ -0,0 +1,115 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+  "strings"
+  "net/http"
+  "html/template"
+  "github.com/michaellaszlo/boomerang/apptemplate"
+)
+
+// contextLines is the number of lines shown on either side of the line of
+// an error.
+const contextLines = 3
+
+// sourceLine is a line of a file shown around an error.
+type sourceLine struct {
+  Number int
+  Text string
+  Marked bool  // The error refers to this line.
+}
+
+// pageError is an error on the error page, with the lines around it and,
+// for an error in an inserted template, the insert tags that lead to it.
+type pageError struct {
+  BuildError
+  Source []sourceLine
+  Stack []string
+}
+
+// errorPageTemplate lays out the errors of a failed build.
+var errorPageTemplate = template.Must(template.New("error").Parse(
+`<!DOCTYPE html>
+<html>
+<head>
+<title>Build failed: {{.Template}}</title>
+<style>
+  body { font-family: sans-serif; margin: 2em; }
+  pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+  .marked { background: #fdd; display: block; }
+  .stack { color: #555; margin: 0 0 0.5em 1.5em; padding: 0; }
+</style>
+</head>
+<body>
+<h1>Build failed at the {{.Stage}} stage</h1>
+<p>{{.Template}}</p>
+{{range .Errors}}
+<h2>{{.String}}</h2>
+{{if .Stack}}<ol class="stack">{{range .Stack}}<li>{{.}}</li>{{end}}</ol>{{end}}
+{{if .Source}}<pre>{{range .Source}}<span{{if .Marked}} class="marked"{{end}}>{{printf "%5d" .Number}}  {{.Text}}
+</span>{{end}}</pre>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// writeErrorPage shows the errors of a failed build in the browser, with
+// the source lines around each of them and the insertions that lead to
+// their templates. Errors in the generated code are moved to the template
+// lines that the code came from.
+func writeErrorPage(w http.ResponseWriter, report *TemplateReport) {
+  var sourceMap *apptemplate.SourceMap
+  if report.result != nil {
+    sourceMap = report.result.SourceMap
+  }
+  data := struct {
+    Template, Stage string
+    Errors []pageError
+  }{ Template: report.Template, Stage: report.Stage }
+  for _, e := range report.Errors {
+    e = templatePosition(e, report.GoFile, sourceMap)
+    data.Errors = append(data.Errors, pageError{ e, sourceContext(e),
+        insertionContext(report, e) })
+  }
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  w.WriteHeader(http.StatusInternalServerError)
+  err := errorPageTemplate.Execute(w, data)
+  if err != nil {
+    globalLog.errorf("%s\n", err.Error())
+  }
+}
+
+// insertionContext describes the insert tags that lead from the template
+// of a report to the file of an error, outermost first.
+func insertionContext(report *TemplateReport, e BuildError) []string {
+  stack := []string{}
+  for _, insertion := range report.insertionStack(e.File) {
+    stack = append(stack, fmt.Sprintf("%s:%d inserts %s",
+        sitePath(insertion.Parent), insertion.Line,
+        sitePath(insertion.Child)))
+  }
+  return stack
+}
+
+// sourceContext returns the lines of a file around the line of an error,
+// or nil if the error has no position or the file cannot be read.
+func sourceContext(e BuildError) []sourceLine {
+  if e.File == "" || e.Line == 0 {
+    return nil
+  }
+  data, err := os.ReadFile(e.File)
+  if err != nil {
+    return nil
+  }
+  lines := strings.Split(string(data), "\n")
+  source := []sourceLine{}
+  for number := e.Line - contextLines; number <= e.Line + contextLines;
+      number++ {
+    if number >= 1 && number <= len(lines) {
+      source = append(source, sourceLine{ number, lines[number-1],
+          number == e.Line })
+    }
+  }
+  return source
+}
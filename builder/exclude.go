@@ -0,0 +1,83 @@
+package builder
+
+import (
+  "os"
+  "path"
+  "bufio"
+  "strings"
+  "path/filepath"
+)
+
+// excludePatterns name the files and directories that a walk skips. They
+// come from -exclude flags, the exclude setting, and the .booignore file
+// in the site root, which lists one pattern per line and allows comments
+// starting with #. A pattern containing a slash is matched against the
+// slash-separated path relative to the site root, ignoring a leading
+// slash; any other pattern is matched against the base name at any depth.
+// A pattern ending in a slash only matches directories.
+var excludePatterns stringList
+
+// loadExcludes adds the patterns of the configuration and .booignore to
+// those given on the command line.
+func loadExcludes() error {
+  excludePatterns = append(excludePatterns, config.Exclude...)
+  file, err := os.Open(filepath.Join(siteRoot, ".booignore"))
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if line != "" && !strings.HasPrefix(line, "#") {
+      excludePatterns = append(excludePatterns, line)
+    }
+  }
+  return scanner.Err()
+}
+
+// isExcluded reports whether a walk should skip a path. The directories
+// of buildapp's state, generated code, binaries, and embedded assets are
+// always skipped.
+func isExcluded(filePath string, isDir bool) bool {
+  absPath, err := filepath.Abs(filePath)
+  if err != nil {
+    return false
+  }
+  if isDir && (absPath == stateDir || absPath == genDir ||
+      absPath == binDir) {
+    return true
+  }
+  if isDir && manifest != nil {
+    for _, entry := range manifest.Entries {
+      if absPath == entry.EmbedDir {
+        return true
+      }
+    }
+  }
+  relPath, err := filepath.Rel(siteRoot, absPath)
+  if err != nil {
+    relPath = filepath.Base(absPath)
+  }
+  relPath = filepath.ToSlash(relPath)
+  for _, pattern := range excludePatterns {
+    if strings.HasSuffix(pattern, "/") {
+      if !isDir {
+        continue
+      }
+      pattern = strings.TrimSuffix(pattern, "/")
+    }
+    subject := path.Base(relPath)
+    if strings.Contains(pattern, "/") {
+      pattern = strings.TrimPrefix(pattern, "/")
+      subject = relPath
+    }
+    if matched, _ := path.Match(pattern, subject); matched {
+      return true
+    }
+  }
+  return false
+}
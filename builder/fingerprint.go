@@ -0,0 +1,46 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "sync"
+  "path/filepath"
+)
+
+// fingerprintAssets is set by -fingerprint. Asset tags then output URLs
+// with a hash of the asset's contents, and the assets are copied to those
+// URLs, so that web servers can send them with far-future cache headers.
+var fingerprintAssets bool
+
+// inlineImageLimit is set by -inlineimages or the inlineImages setting.
+// Images named by img tags that are no larger than this many bytes are
+// inlined in the page as data URIs instead of being linked as assets.
+var inlineImageLimit int
+
+// fingerprintMutex keeps templates built at once from copying the same
+// asset together.
+var fingerprintMutex sync.Mutex
+
+// writeFingerprinted copies the assets of a template to their fingerprinted
+// paths under the output root, beside the originals or in the export tree,
+// and records the copies in the manifest so that clean removes them.
+// Embedded assets are served from the binary instead.
+func writeFingerprinted(result *apptemplate.Result, log *templateLog) error {
+  fingerprintMutex.Lock()
+  defer fingerprintMutex.Unlock()
+  for hardPath, urlPath := range result.Fingerprints {
+    targetPath := filepath.Join(outputRoot(), filepath.FromSlash(urlPath))
+    err := os.MkdirAll(filepath.Dir(targetPath), 0755)
+    if err == nil {
+      err = copyFile(hardPath, targetPath, log)
+    }
+    if err == nil {
+      err = setPermissions(targetPath, assetMode)
+    }
+    if err != nil {
+      return err
+    }
+    manifest.setAsset(targetPath, hardPath)
+  }
+  return nil
+}
@@ -0,0 +1,253 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+  "bytes"
+  "regexp"
+  "strings"
+  "go/format"
+)
+
+// fmtCommand implements "buildapp fmt", which normalizes the layout of
+// templates so that reviews are not dominated by whitespace changes. Tags
+// are written as <?name args ?> on one line, code sections are formatted
+// with gofmt where they are complete statements or declarations, and
+// static text is left alone, since it is output. By default the files
+// that would change are listed and the exit code is 1 if there are any;
+// -write rewrites them, and -print writes the formatted text to stdout.
+func fmtCommand(args []string) int {
+  flags := newFlagSet("fmt")
+  addSelectionFlags(flags)
+  var write, print bool
+  flags.BoolVar(&write, "write", false,
+      "rewrite templates whose formatting differs")
+  flags.BoolVar(&print, "print", false,
+      "write the formatted templates to standard output")
+  flags.Parse(args)
+
+  err := resolveGlobals()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  status := 0
+  forEachTemplate(flags.Args(), true, func (path string) {
+    source, err := os.ReadFile(path)
+    if err != nil {
+      globalLog.errorf("%s\n", err.Error())
+      status = 1
+      return
+    }
+    formatted := formatTemplate(source)
+    if print {
+      os.Stdout.Write(formatted)
+    }
+    if bytes.Equal(source, formatted) {
+      return
+    }
+    if !write {
+      if !print {
+        fmt.Fprintf(os.Stdout, "%s\n", path)
+        status = 1
+      }
+      return
+    }
+    info, err := os.Stat(path)
+    if err == nil {
+      err = os.WriteFile(path, formatted, info.Mode().Perm())
+    }
+    if err != nil {
+      globalLog.errorf("%s\n", err.Error())
+      status = 1
+      return
+    }
+    inform("formatted %s\n", path)
+  })
+  return status
+}
+
+// templateTag matches the opening of a tag. Longer names come first, as
+// the parser recognizes insert-markdown and include-static before insert.
+var templateTag = regexp.MustCompile(`<\?(include-static|insert-markdown|` +
+    `content-for|insert|code|meta|asset|yield|if|else|end|img)`)
+
+// formatTemplate returns the formatted text of a template. Text outside
+// tags is copied as it is.
+func formatTemplate(source []byte) []byte {
+  text := string(source)
+  var out strings.Builder
+  for {
+    match := templateTag.FindStringSubmatchIndex(text)
+    if match == nil {
+      break
+    }
+    end := strings.Index(text[match[1]:], "?>")
+    if end == -1 {
+      break  // An unclosed tag is left for the parser to report.
+    }
+    name := text[match[2]:match[3]]
+    content := text[match[1]:match[1]+end]
+    out.WriteString(text[:match[0]])
+    if content != "" && !strings.ContainsAny(content[:1], " \t\r\n") {
+      // The parser takes <?codex ?> as a code tag, but the formatter
+      // leaves such a tag alone rather than change what it means.
+      out.WriteString(text[match[0]:match[1]+end+2])
+    } else {
+      written := out.String()
+      linePrefix := written[strings.LastIndex(written, "\n")+1:]
+      out.WriteString(formatTag(name, content, linePrefix))
+    }
+    text = text[match[1]+end+2:]
+  }
+  out.WriteString(text)
+  return []byte(out.String())
+}
+
+// formatTag formats a tag given its name, its content, and the text that
+// precedes it on its line.
+func formatTag(name, content, linePrefix string) string {
+  switch name {
+  case "code":
+    return formatCode(content, linePrefix)
+  case "meta":  // Meta tags may declare a value on each line.
+    return "<?meta" + content + "?>"
+  case "else", "end":
+    if strings.TrimSpace(content) == "" {
+      return "<?" + name + "?>"
+    }
+  }
+  args := collapseSpace(content)
+  if args == "" {
+    return "<?" + name + "?>"
+  }
+  return "<?" + name + " " + args + " ?>"
+}
+
+// collapseSpace trims a tag's arguments and reduces each run of whitespace
+// outside double quotes to one space, so that a tag spread over several
+// lines is joined into one.
+func collapseSpace(content string) string {
+  var out strings.Builder
+  quoted, space := false, false
+  for _, ch := range strings.TrimSpace(content) {
+    isSpace := !quoted && strings.ContainsRune(" \t\r\n", ch)
+    if isSpace {
+      space = true
+      continue
+    }
+    if space {
+      out.WriteByte(' ')
+      space = false
+    }
+    if ch == '"' {
+      quoted = !quoted
+    }
+    out.WriteRune(ch)
+  }
+  return out.String()
+}
+
+// multilineRawString matches a raw string literal that spans lines, whose
+// lines must not be reindented.
+var multilineRawString = regexp.MustCompile("`[^`]*\n[^`]*`")
+
+// formatCode formats a code section with gofmt. A section that is not
+// complete Go, such as one that opens the main function, is only trimmed
+// if it is on one line, and is otherwise left as it is. A multi-line
+// section is written with the code on the lines between <?code and ?>,
+// indented as it was, with the indentation of gofmt's tabs converted to
+// the section's own indentation unit.
+func formatCode(content, linePrefix string) string {
+  body := strings.TrimSpace(content)
+  if body == "" {
+    return "<?code" + content + "?>"
+  }
+  formatted, err := format.Source([]byte(body))
+  lines := strings.Split(strings.TrimRight(string(formatted), "\n"), "\n")
+  if !strings.Contains(content, "\n") {
+    if err == nil && len(lines) == 1 {
+      body = strings.TrimSpace(lines[0])
+    }
+    return "<?code " + body + " ?>"
+  }
+  if err != nil || multilineRawString.MatchString(body) {
+    return "<?code" + content + "?>"
+  }
+  tagIndent := leadingSpace(linePrefix)
+  if strings.TrimSpace(linePrefix) != "" {
+    tagIndent = ""  // The tag follows other text.
+  }
+  unit, baseIndent := indentation(content, tagIndent)
+  minTabs := -1
+  for _, line := range lines {
+    if strings.TrimSpace(line) != "" {
+      tabs := len(line) - len(strings.TrimLeft(line, "\t"))
+      if minTabs == -1 || tabs < minTabs {
+        minTabs = tabs
+      }
+    }
+  }
+  var out strings.Builder
+  out.WriteString("<?code\n")
+  for _, line := range lines {
+    if strings.TrimSpace(line) == "" {
+      out.WriteString("\n")
+      continue
+    }
+    tabs := len(line) - len(strings.TrimLeft(line, "\t"))
+    out.WriteString(baseIndent + strings.Repeat(unit, tabs-minTabs) +
+        line[tabs:] + "\n")
+  }
+  out.WriteString(tagIndent + "?>")
+  return out.String()
+}
+
+// leadingSpace returns the spaces and tabs at the start of a line.
+func leadingSpace(line string) string {
+  return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// indentation works out the indentation unit of a code section, a tab or
+// the smallest step between the indentations of its lines (two spaces if
+// there is none), and the indentation of its outermost lines, which is one
+// unit more than the tag's if the code begins on the tag's line.
+func indentation(content, tagIndent string) (string, string) {
+  lines := strings.Split(content, "\n")
+  indents := []string{}
+  for i, line := range lines {
+    if i != 0 && strings.TrimSpace(line) != "" {
+      indents = append(indents, leadingSpace(line))
+    }
+  }
+  unit := "  "
+  step := 0
+  for i, indent := range indents {
+    if strings.Contains(indent, "\t") {
+      unit, step = "\t", -1
+      break
+    }
+    if i != 0 {
+      d := len(indent) - len(indents[i-1])
+      if d < 0 {
+        d = -d
+      }
+      if d != 0 && (step == 0 || d < step) {
+        step = d
+      }
+    }
+  }
+  if step > 0 {
+    unit = strings.Repeat(" ", step)
+  }
+  if strings.TrimSpace(lines[0]) != "" || len(indents) == 0 {
+    return unit, tagIndent + unit
+  }
+  base := indents[0]
+  for _, indent := range indents {
+    if len(indent) < len(base) {
+      base = indent
+    }
+  }
+  return unit, base
+}
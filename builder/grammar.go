@@ -0,0 +1,216 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "fmt"
+  "sort"
+  "bytes"
+  "regexp"
+  "strings"
+  "strconv"
+  "encoding/json"
+)
+
+// grammarCommand implements "buildapp grammar", which writes syntax
+// highlighting data for editors to stdout. The data is generated from the
+// tag delimiters and tag names that the parser uses, including any tags
+// registered with apptemplate.RegisterTag, so that it stays in step with
+// the templates. -format chooses a TextMate grammar, a Tree-sitter
+// grammar.js, or the Tree-sitter highlights or injections queries that go
+// with it.
+func grammarCommand(args []string) int {
+  flags := newFlagSet("grammar")
+  var format string
+  flags.StringVar(&format, "format", "textmate",
+      "the data to write: textmate, treesitter, highlights, or injections")
+  flags.Var(&extensions, "ext",
+      "a template file extension, such as .boo (repeatable; default .boo)")
+  flags.Parse(args)
+
+  err := resolveGlobals()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  var data []byte
+  switch format {
+  case "textmate":
+    data, err = textMateGrammar()
+  case "treesitter":
+    data = []byte(treeSitterGrammar())
+  case "highlights":
+    data = []byte(treeSitterHighlights)
+  case "injections":
+    data = []byte(treeSitterInjections)
+  default:
+    err = fmt.Errorf("unknown grammar format %q", format)
+  }
+  if err == nil {
+    _, err = os.Stdout.Write(data)
+  }
+  if err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return 1
+  }
+  return 0
+}
+
+// grammarTagNames returns the names of the tags other than code, longest
+// first, so that a pattern that tries them in order matches insert-markdown
+// before insert, as the parser does.
+func grammarTagNames() []string {
+  names := []string{}
+  for _, name := range apptemplate.TagNames() {
+    if name != "code" {
+      names = append(names, name)
+    }
+  }
+  sort.SliceStable(names, func (i, j int) bool {
+    return len(names[i]) > len(names[j])
+  })
+  return names
+}
+
+// textMateGrammar returns a TextMate grammar, as used by VS Code, Sublime
+// Text, and others. Code sections are highlighted as Go and the arguments
+// of other tags as strings, in the static text, which is highlighted as
+// HTML, and also inside HTML attribute values.
+func textMateGrammar() ([]byte, error) {
+  quotedNames := []string{}
+  for _, name := range grammarTagNames() {
+    quotedNames = append(quotedNames, regexp.QuoteMeta(name))
+  }
+  open := "(" + regexp.QuoteMeta(apptemplate.TagOpen) + ")"
+  close := "(" + regexp.QuoteMeta(apptemplate.TagClose) + ")"
+  scope := func(name string) map[string]string {
+    return map[string]string{ "name": name + ".boomerang" }
+  }
+  beginCaptures := map[string]interface{}{
+    "1": scope("punctuation.definition.tag.begin"),
+    "2": scope("entity.name.tag"),
+  }
+  endCaptures := map[string]interface{}{
+    "1": scope("punctuation.definition.tag.end"),
+  }
+  fileTypes := []string{}
+  for _, extension := range extensions {
+    fileTypes = append(fileTypes, strings.TrimPrefix(extension, "."))
+  }
+  tags := []interface{}{
+    map[string]string{ "include": "#code" },
+    map[string]string{ "include": "#tag" },
+  }
+  grammar := map[string]interface{}{
+    "name": "Boomerang",
+    "scopeName": "text.html.boomerang",
+    "fileTypes": fileTypes,
+    "patterns": append(tags, map[string]string{
+      "include": "text.html.basic",
+    }),
+    "injections": map[string]interface{}{
+      "L:text.html.boomerang - meta.embedded.block.go.boomerang - " +
+          "meta.tag.boomerang": map[string]interface{}{ "patterns": tags },
+    },
+    "repository": map[string]interface{}{
+      "code": map[string]interface{}{
+        "name": "meta.embedded.block.go.boomerang",
+        "begin": open + "(code)",
+        "beginCaptures": beginCaptures,
+        "end": close,
+        "endCaptures": endCaptures,
+        "contentName": "source.go",
+        "patterns": []interface{}{
+          map[string]string{ "include": "source.go" },
+        },
+      },
+      "tag": map[string]interface{}{
+        "name": "meta.tag.boomerang",
+        "begin": open + "(" + strings.Join(quotedNames, "|") + ")",
+        "beginCaptures": beginCaptures,
+        "end": close,
+        "endCaptures": endCaptures,
+        "contentName": "string.unquoted.argument.boomerang",
+      },
+    },
+  }
+  var buffer bytes.Buffer
+  encoder := json.NewEncoder(&buffer)
+  encoder.SetEscapeHTML(false)
+  encoder.SetIndent("", "  ")
+  if err := encoder.Encode(grammar); err != nil {
+    return nil, err
+  }
+  return buffer.Bytes(), nil
+}
+
+// treeSitterGrammar returns the grammar.js of a Tree-sitter parser for
+// templates. A template is a sequence of static text, code sections, and
+// other tags; the queries from treeSitterInjections parse the text as HTML
+// and the code as Go.
+func treeSitterGrammar() string {
+  quotedNames := []string{}
+  for _, name := range grammarTagNames() {
+    quotedNames = append(quotedNames, strconv.Quote(name))
+  }
+  open := strconv.Quote(apptemplate.TagOpen)
+  close := strconv.Quote(apptemplate.TagClose)
+  return fmt.Sprintf(`// Generated by buildapp grammar.
+module.exports = grammar({
+  name: 'boomerang',
+  extras: $ => [],
+  rules: {
+    template: $ => repeat(choice($.code_section, $.tag, $.text)),
+    code_section: $ => seq(%s, alias('code', $.tag_name), optional($.code),
+        %s),
+    tag: $ => seq(%s, field('name', alias(choice(%s), $.tag_name)),
+        optional($.arguments), %s),
+    code: $ => token(/%s/),
+    arguments: $ => token(/%s/),
+    text: $ => token(/%s/),
+  },
+});
+`, open, close, open, strings.Join(quotedNames, ", "), close,
+      excludingDelimiter(apptemplate.TagClose),
+      excludingDelimiter(apptemplate.TagClose),
+      excludingDelimiter(apptemplate.TagOpen))
+}
+
+// excludingDelimiter returns a regular expression that matches a run of
+// text in which a two-character delimiter does not occur.
+func excludingDelimiter(delimiter string) string {
+  first, second := classChar(delimiter[0]), classChar(delimiter[1])
+  return "(?:[^" + first + "]|" + regexp.QuoteMeta(delimiter[:1]) + "+[^" +
+      first + second + "])+"
+}
+
+// classChar escapes a character for use in a bracketed character class.
+func classChar(c byte) string {
+  if strings.IndexByte(`\^]-/`, c) != -1 {
+    return `\` + string(c)
+  }
+  return string(c)
+}
+
+// treeSitterHighlights is the highlights.scm query of the Tree-sitter
+// grammar.
+const treeSitterHighlights = `; Generated by buildapp grammar.
+(tag_name) @tag
+(arguments) @string
+(code_section ["` + apptemplate.TagOpen + `" "` + apptemplate.TagClose +
+    `"] @punctuation.bracket)
+(tag ["` + apptemplate.TagOpen + `" "` + apptemplate.TagClose +
+    `"] @punctuation.bracket)
+`
+
+// treeSitterInjections is the injections.scm query of the Tree-sitter
+// grammar, which parses the code sections of a template together as Go
+// and its static text together as HTML.
+const treeSitterInjections = `; Generated by buildapp grammar.
+((code) @injection.content
+  (#set! injection.language "go")
+  (#set! injection.combined))
+((text) @injection.content
+  (#set! injection.language "html")
+  (#set! injection.combined))
+`
@@ -0,0 +1,80 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "io"
+  "os"
+  "bufio"
+  "fmt"
+  "path/filepath"
+)
+
+// graphCommand implements "buildapp graph", which prints the insertion
+// relationships among the selected templates and the templates they insert.
+// The default format is Graphviz DOT. With -format text, each line names a
+// parent template, the line of the insert tag, and the inserted template.
+func graphCommand(args []string) int {
+  flags := newFlagSet("graph")
+  addSelectionFlags(flags)
+  var format string
+  flags.StringVar(&format, "format", "dot",
+      "the output format: dot or text")
+  flags.Parse(args)
+
+  if format != "dot" && format != "text" {
+    fmt.Fprintf(messageFile, "graph: unknown format %q\n", format)
+    return 2
+  }
+  err := resolveGlobals()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+
+  // Edges are printed once even if several top-level templates share them.
+  out := bufio.NewWriter(os.Stdout)
+  defer out.Flush()
+  seen := map[apptemplate.Insertion]bool{}
+  status := 0
+  if format == "dot" {
+    fmt.Fprintf(out, "digraph templates {\n")
+  }
+  forEachTemplate(flags.Args(), false, func (path string) {
+    result, err := apptemplate.Process(siteRoot, path,
+        bufio.NewWriter(io.Discard), templateOptions(globalLog))
+    if err != nil {
+      status = 1
+      return
+    }
+    if format == "dot" && len(result.Templates) != 0 {
+      fmt.Fprintf(out, "  %q;\n", sitePath(result.Templates[0]))
+    }
+    for _, insertion := range result.Insertions {
+      if seen[insertion] {
+        continue
+      }
+      seen[insertion] = true
+      parent, child := sitePath(insertion.Parent), sitePath(insertion.Child)
+      if format == "dot" {
+        fmt.Fprintf(out, "  %q -> %q [label=\"%d\"];\n",
+            parent, child, insertion.Line)
+      } else {
+        fmt.Fprintf(out, "%s:%d %s\n", parent, insertion.Line, child)
+      }
+    }
+  })
+  if format == "dot" {
+    fmt.Fprintf(out, "}\n")
+  }
+  return status
+}
+
+// sitePath expresses a file-system path relative to the site root if the
+// path lies within it.
+func sitePath(path string) string {
+  relPath, err := filepath.Rel(siteRoot, path)
+  if err != nil || routeFor(siteRoot, path) == "" {
+    return path
+  }
+  return filepath.ToSlash(relPath)
+}
@@ -0,0 +1,94 @@
+package builder
+
+import (
+  "os/exec"
+  "fmt"
+  "strings"
+  "text/template"
+)
+
+// Hooks are shell commands that run after builds. Each command line is a
+// text/template that is expanded before it is passed to sh -c. The quote
+// function quotes a value for the shell, as in {{quote .Binary}}.
+//   afterBuild  runs after each template that is built successfully, with
+//               the fields of templateHookData
+//   afterRun    runs once after a run in which no template failed, with
+//               the fields of runHookData
+var afterBuildHooks, afterRunHooks stringList
+
+// Hooks is the hooks section of the configuration.
+type Hooks struct {
+  AfterBuild []string  `json:"afterBuild,omitempty"`
+  AfterRun []string    `json:"afterRun,omitempty"`
+}
+
+// templateHookData supplies the fields of an afterBuild hook.
+type templateHookData struct {
+  Source string  // The template.
+  GoFile string  // The generated .go file.
+  Binary string  // The compiled binary.
+  Route string   // The URL path of the binary, if it is served.
+  Root string    // The site root.
+}
+
+// runHookData supplies the fields of an afterRun hook.
+type runHookData struct {
+  Root string        // The site root.
+  Export string      // The export tree, if any.
+  Binaries []string  // The binaries built in this run.
+  Built int          // The number of templates built.
+  UpToDate int       // The number of templates that were skipped.
+}
+
+// hookFuncs are the functions available in hook command lines.
+var hookFuncs = template.FuncMap{
+  "quote": shellQuote,
+}
+
+// shellQuote quotes a string for the shell.
+func shellQuote(s string) string {
+  return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// resolveHooks adds the hooks of the configuration to those given on the
+// command line and checks that they can be expanded.
+func resolveHooks() error {
+  afterBuildHooks = append(afterBuildHooks, config.Hooks.AfterBuild...)
+  afterRunHooks = append(afterRunHooks, config.Hooks.AfterRun...)
+  for _, hook := range append(afterBuildHooks, afterRunHooks...) {
+    _, err := template.New("hook").Funcs(hookFuncs).Parse(hook)
+    if err != nil {
+      return fmt.Errorf("hook %q: %s", hook, err.Error())
+    }
+  }
+  return nil
+}
+
+// runHooks expands and runs hook commands in order, stopping at the first
+// one that fails. Their output goes to the log. With dryRun,
+// the commands are only printed.
+func runHooks(hooks []string, data interface{}, dryRun bool,
+    log *templateLog) error {
+  for _, hook := range hooks {
+    expansion := &strings.Builder{}
+    tmpl := template.Must(template.New("hook").Funcs(hookFuncs).Parse(hook))
+    err := tmpl.Execute(expansion, data)
+    if err != nil {
+      return fmt.Errorf("hook %q: %s", hook, err.Error())
+    }
+    command := expansion.String()
+    if dryRun {
+      log.result("would run %s\n", command)
+      continue
+    }
+    log.inform("running %s\n", command)
+    cmd := exec.Command("sh", "-c", command)
+    cmd.Dir = siteRoot
+    cmd.Stdout, cmd.Stderr = log, log
+    err = cmd.Run()
+    if err != nil {
+      return fmt.Errorf("hook %q: %s", command, err.Error())
+    }
+  }
+  return nil
+}
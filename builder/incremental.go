@@ -0,0 +1,124 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+  "strings"
+  "crypto/sha256"
+  "encoding/hex"
+  "path/filepath"
+)
+
+// forceBuild is set by -a. Templates are then rebuilt even if they are up
+// to date.
+var forceBuild bool
+
+// hashFile returns a hash of the contents of a file.
+func hashFile(path string) (string, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return "", err
+  }
+  sum := sha256.Sum256(data)
+  return hex.EncodeToString(sum[:]), nil
+}
+
+// hashFiles returns a hash of the names and contents of files.
+func hashFiles(paths ...string) (string, error) {
+  hash := sha256.New()
+  for _, path := range paths {
+    fileHash, err := hashFile(path)
+    if err != nil {
+      return "", err
+    }
+    fmt.Fprintf(hash, "%s\x00%s\n", path, fileHash)
+  }
+  return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// settingsHash summarizes the settings that affect the outputs of a build,
+// so that changing one of them causes templates to be rebuilt.
+func settingsHash() string {
+  settings := []string{
+    targetOS, targetArch, gcFlags, ldFlags, buildLDFlags(), buildTags,
+    fmt.Sprint(trimPath), fmt.Sprint(embedAssets), fmt.Sprint(fastCGI),
+    fmt.Sprint(lambdaTarget), fmt.Sprint(wasiTarget),
+    fmt.Sprint(fingerprintAssets), fmt.Sprint(inlineImageLimit),
+    fmt.Sprint(maxLiteral), fmt.Sprint(maxSections),
+    fmt.Sprint(maxInsertDepth), unknownTags, passTags,
+    fmt.Sprint(writeSourceMaps),
+    runtimeVersion, runtimeDir, fmt.Sprint(vendorRuntime), definesHash(),
+    buildEnvironment, markdownCommand,
+  }
+  sum := sha256.Sum256([]byte(strings.Join(settings, "\x00")))
+  return hex.EncodeToString(sum[:])
+}
+
+// compileReason tells why a binary must be compiled from generated files
+// that already exist, or returns "" if it is newer than all of them.
+func compileReason(goCodePath, binaryPath string) string {
+  info, err := os.Stat(binaryPath)
+  if err != nil {
+    return "new"
+  }
+  for _, path := range existingSources(goCodePath) {
+    sourceInfo, err := os.Stat(path)
+    if err != nil || sourceInfo.ModTime().After(info.ModTime()) {
+      return "changed: " + sitePath(path)
+    }
+  }
+  return ""
+}
+
+// rebuildReason tells why a template must be built, or returns "" if its
+// outputs are up to date. The reasons are "forced", "new", and "changed",
+// which is followed by what changed. A template is up to date if its last
+// build succeeded with the current settings and outputs, the outputs still
+// exist, and none of its inputs has been modified since.
+func rebuildReason(templatePath, goCodePath, binaryPath string) string {
+  if forceBuild {
+    return "forced"
+  }
+  if buildPhase == "compile" {
+    return compileReason(goCodePath, binaryPath)
+  }
+  entry := manifest.entry(templatePath)
+  if entry == nil || entry.Settings == "" {
+    return "new"
+  }
+  if entry.Failed {
+    return "changed: the last build failed"
+  }
+  if entry.Settings != settingsHash() {
+    return "changed: build settings"
+  }
+  goCodePath, _ = filepath.Abs(goCodePath)
+  binaryPath, _ = filepath.Abs(binaryPath)
+  if entry.GoFile != goCodePath || entry.Binary != binaryPath {
+    return "changed: output paths"
+  }
+  outputs := []string{ entry.GoFile }
+  if buildPhase != "generate" {
+    outputs = append(outputs, entry.Binary)
+  }
+  for _, path := range []string{ entry.EmbedFile, entry.MapFile } {
+    if path != "" {
+      outputs = append(outputs, path)
+    }
+  }
+  for _, path := range outputs {
+    if _, err := os.Stat(path); err != nil {
+      return "changed: " + sitePath(path) + " is missing"
+    }
+  }
+  for _, path := range entry.Inputs {
+    info, err := os.Stat(path)
+    if err != nil {
+      return "changed: " + sitePath(path) + " is missing"
+    }
+    if info.ModTime().After(entry.Built) {
+      return "changed: " + sitePath(path)
+    }
+  }
+  return ""
+}
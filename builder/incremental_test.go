@@ -0,0 +1,92 @@
+package builder
+
+import (
+  "os"
+  "time"
+  "strings"
+  "testing"
+  "path/filepath"
+)
+
+// TestRebuildReason checks why a template is rebuilt, or that it is not,
+// against a manifest entry of its last build.
+func TestRebuildReason(t *testing.T) {
+  savedManifest, savedRoot := manifest, siteRoot
+  savedForce, savedPhase := forceBuild, buildPhase
+  defer func() {
+    manifest, siteRoot = savedManifest, savedRoot
+    forceBuild, buildPhase = savedForce, savedPhase
+  }()
+  siteRoot = t.TempDir()
+  templatePath := filepath.Join(siteRoot, "page.html")
+  goCodePath := filepath.Join(siteRoot, "page.go")
+  binaryPath := filepath.Join(siteRoot, "page.cgi")
+  for _, path := range []string{ templatePath, goCodePath, binaryPath } {
+    if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+  built := time.Now().Add(time.Hour)
+  upToDate := func() *ManifestEntry {
+    return &ManifestEntry{ Template: templatePath, GoFile: goCodePath,
+        Binary: binaryPath, Inputs: []string{ templatePath },
+        Settings: settingsHash(), Built: built }
+  }
+  cases := []struct {
+    name string
+    change func(entry *ManifestEntry)
+    reason string
+  }{
+    { "up to date", nil, "" },
+    { "forced", func(entry *ManifestEntry) { forceBuild = true }, "forced" },
+    { "not built", func(entry *ManifestEntry) { entry.Settings = "" },
+        "new" },
+    { "failed", func(entry *ManifestEntry) { entry.Failed = true },
+        "changed: the last build failed" },
+    { "settings", func(entry *ManifestEntry) { entry.Settings = "old" },
+        "changed: build settings" },
+    { "moved", func(entry *ManifestEntry) {
+        entry.Binary = filepath.Join(siteRoot, "old.cgi")
+      }, "changed: output paths" },
+    { "missing output", func(entry *ManifestEntry) {
+        entry.MapFile = filepath.Join(siteRoot, "page.map")
+      }, "changed: page.map is missing" },
+    { "missing input", func(entry *ManifestEntry) {
+        entry.Inputs = append(entry.Inputs,
+            filepath.Join(siteRoot, "gone.html"))
+      }, "changed: gone.html is missing" },
+    { "modified input", func(entry *ManifestEntry) {
+        entry.Built = time.Now().Add(-time.Hour)
+      }, "changed: page.html" },
+  }
+  for _, c := range cases {
+    forceBuild, buildPhase = false, ""
+    manifest = &Manifest{ Entries: map[string]*ManifestEntry{} }
+    entry := upToDate()
+    if c.change != nil {
+      c.change(entry)
+    }
+    manifest.setEntry(entry)
+    reason := rebuildReason(templatePath, goCodePath, binaryPath)
+    if reason != c.reason {
+      t.Errorf("%s: reason %q, want %q", c.name, reason, c.reason)
+    }
+  }
+
+  // A template that is not in the manifest is new.
+  manifest = &Manifest{ Entries: map[string]*ManifestEntry{} }
+  if reason := rebuildReason(templatePath, goCodePath,
+      binaryPath); reason != "new" {
+    t.Errorf("unknown template: reason %q, want new", reason)
+  }
+
+  // In the compile phase, only the generated files are compared with the
+  // binary.
+  buildPhase = "compile"
+  past := time.Now().Add(-time.Hour)
+  os.Chtimes(binaryPath, past, past)
+  reason := rebuildReason(templatePath, goCodePath, binaryPath)
+  if !strings.HasPrefix(reason, "changed: ") {
+    t.Errorf("stale binary: reason %q, want a change", reason)
+  }
+}
@@ -0,0 +1,1995 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "github.com/michaellaszlo/boomerang/runtime"
+  "fmt"
+  "bytes"
+  "bufio"
+  "errors"
+  "reflect"
+  "strconv"
+  "strings"
+  "context"
+  "go/ast"
+  "go/token"
+  "go/types"
+  "go/parser"
+  "net/http"
+)
+
+// Previews run the code that a template generates for the handler target
+// in an interpreter instead of compiling it, so that buildapp serve can show
+// a page without the Go toolchain. The interpreter walks the syntax tree of
+// the generated code and keeps its values in reflect.Values. It supports
+// expressions, the usual statements, function literals and declarations,
+// and struct types declared by the template, and it can call into the
+// packages listed in previewPackages. Anything else, such as goroutines,
+// channels, methods, and generics, stops the preview with a previewError
+// that points at the code. Constants are given the default types of
+// untyped constants, and numbers of different types are converted to each
+// other as they meet, so the interpreter is more lenient than the compiler.
+
+
+//--- Previews
+
+// previewTemplate serves a request with a template, interpreting the code
+// that the template generates for the handler target. If the template
+// cannot be previewed, a report of the failure is returned, and what was
+// written to w should be discarded. Errors are placed at template lines by
+// the source map, as those of compiling are.
+func previewTemplate(w http.ResponseWriter, r *http.Request,
+    templatePath string) *TemplateReport {
+  report := &TemplateReport{ Template: templatePath, Status: "ok" }
+  report.GoFile, _, _ = outputPaths(templatePath)
+  options := templateOptions(globalLog)
+  options.Handler, options.FastCGI, options.Lambda = true, false, false
+  var code bytes.Buffer
+  writer := bufio.NewWriter(&code)
+  result, err := apptemplate.Process(siteRoot, templatePath, writer, options)
+  writer.Flush()
+  report.result = result
+  if err != nil {
+    report.failGeneration(err, report.GoFile)
+    return report
+  }
+  fileSet := token.NewFileSet()
+  file, err := parser.ParseFile(fileSet, report.GoFile, code.Bytes(), 0)
+  if err != nil {
+    errs := generationErrors(err, report.GoFile)
+    for i := range errs {
+      errs[i] = templatePosition(errs[i], report.GoFile, result.SourceMap)
+    }
+    report.fail("generate", errs...)
+    return report
+  }
+  in := &interpreter{ fileSet: fileSet, ctx: r.Context(),
+      imports: map[string]string{}, globals: newScope(nil) }
+  if failure := in.run(file, w, r); failure != nil {
+    report.fail("preview", templatePosition(BuildError{
+        File: report.GoFile, Line: fileSet.Position(failure.pos).Line,
+        Message: failure.message }, report.GoFile, result.SourceMap))
+    return report
+  }
+  return nil
+}
+
+// previewError reports code that a preview cannot run. It is raised as a
+// panic, which the interpreter lets through the deferred calls of the page.
+type previewError struct {
+  pos token.Pos
+  message string
+}
+
+// interpreter runs the code of a template.
+type interpreter struct {
+  fileSet *token.FileSet
+  ctx context.Context          // Canceled when the request goes away.
+  imports map[string]string    // Import paths by the names they are used by.
+  dotImports []string          // The paths of dot imports.
+  globals *scope               // Package-level functions, variables, types.
+  pos token.Pos                // The statement being run.
+  steps int                    // Loop iterations, counted for cancellation.
+  iota int                     // The value of iota in a constant declaration.
+  recovering []*interface{}    // The panics that deferred calls may recover.
+}
+
+// errorAt makes a previewError for a node. It is returned rather than
+// raised so that callers can panic with it and end a function.
+func (in *interpreter) errorAt(node ast.Node, format string,
+    a ...interface{}) *previewError {
+  return &previewError{ node.Pos(), fmt.Sprintf(format, a...) }
+}
+
+// unsupported makes a previewError for a construct that previews cannot run.
+func (in *interpreter) unsupported(node ast.Node, what string) *previewError {
+  return in.errorAt(node, "%s cannot be previewed; build the template to " +
+      "run it", what)
+}
+
+// run loads a file and calls its handler. A panic that escapes the page,
+// as from the initialization of a package variable, fails the preview.
+func (in *interpreter) run(file *ast.File, w http.ResponseWriter,
+    r *http.Request) (failure *previewError) {
+  defer func() {
+    switch recovered := recover().(type) {
+    case nil:
+    case *previewError:
+      failure = recovered
+    default:
+      failure = &previewError{ in.pos, fmt.Sprintf("panic: %v", recovered) }
+    }
+  }()
+  in.load(file)
+  handler, ok := in.globals.values[apptemplate.HandlerFunction]
+  if !ok {
+    return &previewError{ file.Package, "the template has no main function" }
+  }
+  handler.Call([]reflect.Value{ reflect.ValueOf(&w).Elem(),
+      reflect.ValueOf(r) })
+  return nil
+}
+
+// load declares the imports and the top-level declarations of a file and
+// runs its init functions. Types are declared first, then functions, then
+// variables and constants in the order in which they appear.
+func (in *interpreter) load(file *ast.File) {
+  for _, spec := range file.Imports {
+    path, _ := strconv.Unquote(spec.Path.Value)
+    name := path[strings.LastIndex(path, "/")+1:]
+    if spec.Name != nil {
+      name = spec.Name.Name
+    }
+    switch name {
+    case "_":
+    case ".":
+      in.dotImports = append(in.dotImports, path)
+    default:
+      in.imports[name] = path
+    }
+  }
+  for _, decl := range file.Decls {
+    if decl, ok := decl.(*ast.GenDecl); ok && decl.Tok == token.TYPE {
+      in.declare(decl, in.globals)
+    }
+  }
+  inits := []reflect.Value{}
+  for _, decl := range file.Decls {
+    decl, ok := decl.(*ast.FuncDecl)
+    if !ok {
+      continue
+    }
+    if decl.Recv != nil {
+      panic(in.unsupported(decl, "a method"))
+    }
+    if decl.Type.TypeParams != nil {
+      panic(in.unsupported(decl, "a generic function"))
+    }
+    function := in.makeFunc(decl.Type, decl.Body, in.globals)
+    if decl.Name.Name == "init" {
+      inits = append(inits, function)
+    } else {
+      in.globals.define(decl.Name.Name, function)
+    }
+  }
+  for _, decl := range file.Decls {
+    if decl, ok := decl.(*ast.GenDecl); ok && decl.Tok != token.TYPE &&
+        decl.Tok != token.IMPORT {
+      in.declare(decl, in.globals)
+    }
+  }
+  for _, function := range inits {
+    function.Call(nil)
+  }
+}
+
+// tick counts an iteration of a loop and stops the page if the request has
+// been canceled, so that a page that loops forever does not run on.
+func (in *interpreter) tick(node ast.Node) {
+  in.steps++
+  if in.steps % 1024 == 0 && in.ctx.Err() != nil {
+    panic(in.errorAt(node, "the request was canceled"))
+  }
+}
+
+// runtimePanic raises a panic like one of the Go runtime's, for the page
+// to recover from as it would when compiled.
+func runtimePanic(format string, a ...interface{}) {
+  panic(errors.New("runtime error: " + fmt.Sprintf(format, a...)))
+}
+
+
+//--- Scopes
+
+// scope holds the variables and types declared in a block. Variables are
+// addressable, so that they can be assigned to and shared by closures.
+type scope struct {
+  parent *scope
+  values map[string]reflect.Value
+  types map[string]reflect.Type
+}
+
+func newScope(parent *scope) *scope {
+  return &scope{ parent: parent, values: map[string]reflect.Value{},
+      types: map[string]reflect.Type{} }
+}
+
+// lookup finds a variable in a scope or the scopes around it.
+func (s *scope) lookup(name string) (reflect.Value, bool) {
+  for ; s != nil; s = s.parent {
+    if value, ok := s.values[name]; ok {
+      return value, true
+    }
+    if _, ok := s.types[name]; ok {
+      return reflect.Value{}, false
+    }
+  }
+  return reflect.Value{}, false
+}
+
+// lookupType finds a type in a scope or the scopes around it.
+func (s *scope) lookupType(name string) (reflect.Type, bool) {
+  for ; s != nil; s = s.parent {
+    if t, ok := s.types[name]; ok {
+      return t, true
+    }
+    if _, ok := s.values[name]; ok {
+      return nil, false
+    }
+  }
+  return nil, false
+}
+
+// define declares a variable in a scope with a copy of a value.
+func (s *scope) define(name string, value reflect.Value) {
+  if name == "_" {
+    return
+  }
+  s.values[name] = detach(value)
+}
+
+// detach copies a value into a new variable, so that it no longer changes
+// with the variable or element it was read from.
+func detach(value reflect.Value) reflect.Value {
+  variable := reflect.New(value.Type()).Elem()
+  variable.Set(value)
+  return variable
+}
+
+
+//--- Functions
+
+// frame is a call of an interpreted function.
+type frame struct {
+  results []reflect.Value  // The result variables.
+  defers []deferredCall    // The deferred calls, in the order of deferral.
+}
+
+// deferredCall is a call deferred by a function. A deferred Recover of a
+// runtime context is noted as the context, since it must be called by the
+// deferred function itself for its recover to work.
+type deferredCall struct {
+  call func() []reflect.Value
+  recoverer *runtime.Context
+}
+
+// makeFunc makes a function value that runs a body in the interpreter. The
+// body sees the variables of the scope in which the function is made.
+func (in *interpreter) makeFunc(funcType *ast.FuncType, body *ast.BlockStmt,
+    outer *scope) reflect.Value {
+  t := in.funcType(funcType, outer)
+  return reflect.MakeFunc(t, func (args []reflect.Value) []reflect.Value {
+    s := newScope(outer)
+    i := 0
+    for _, field := range funcType.Params.List {
+      if len(field.Names) == 0 {
+        i++
+      }
+      for _, name := range field.Names {
+        s.define(name.Name, args[i])
+        i++
+      }
+    }
+    f := &frame{}
+    if funcType.Results != nil {
+      for _, field := range funcType.Results.List {
+        names := field.Names
+        if len(names) == 0 {
+          names = []*ast.Ident{ nil }
+        }
+        for _, name := range names {
+          result := reflect.New(t.Out(len(f.results))).Elem()
+          if name != nil && name.Name != "_" {
+            s.values[name.Name] = result
+          }
+          f.results = append(f.results, result)
+        }
+      }
+    }
+    in.runFrame(f, func () {
+      in.execList(body.List, s, f)
+    })
+    return f.results
+  })
+}
+
+// runFrame runs the body of a function and then its deferred calls, last
+// first. A panic goes through the deferred calls as it does in Go, except
+// that a previewError stops the page without running them, so that the
+// page does not finish its response.
+func (in *interpreter) runFrame(f *frame, body func()) {
+  defer func() {
+    pending := in.internalPanic(recover())
+    for i := len(f.defers) - 1; i >= 0; i-- {
+      if _, stopped := pending.(*previewError); stopped {
+        break
+      }
+      pending = in.internalPanic(in.runDeferred(f.defers[i], pending))
+    }
+    if pending != nil {
+      panic(pending)
+    }
+  }()
+  body()
+}
+
+// internalPanic turns a panic of the reflect package, which means that the
+// interpreter was asked to do what Go would not have compiled, into a
+// previewError at the statement being run.
+func (in *interpreter) internalPanic(recovered interface{}) interface{} {
+  switch value := recovered.(type) {
+  case *reflect.ValueError:
+    return &previewError{ in.pos, value.Error() }
+  case string:
+    if strings.HasPrefix(value, "reflect") {
+      return &previewError{ in.pos, value }
+    }
+  }
+  return recovered
+}
+
+// runDeferred makes a deferred call while a panic may be pending, and
+// returns the panic that is pending afterward. A panic in the call takes
+// the place of the pending one.
+func (in *interpreter) runDeferred(deferred deferredCall,
+    pending interface{}) (result interface{}) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      result = recovered
+    }
+  }()
+  if deferred.recoverer != nil {
+    if pending != nil {
+      func () {
+        defer deferred.recoverer.Recover()
+        panic(pending)
+      }()
+    }
+    return nil
+  }
+  in.recovering = append(in.recovering, &pending)
+  defer func() {
+    in.recovering = in.recovering[:len(in.recovering)-1]
+  }()
+  deferred.call()
+  return pending
+}
+
+// fieldCount returns the number of parameters or results that a field of
+// a function type declares. A field without names declares one.
+func fieldCount(field *ast.Field) int {
+  if len(field.Names) == 0 {
+    return 1
+  }
+  return len(field.Names)
+}
+
+// funcType makes the type of a function.
+func (in *interpreter) funcType(funcType *ast.FuncType,
+    s *scope) reflect.Type {
+  params, results := []reflect.Type{}, []reflect.Type{}
+  variadic := false
+  for _, field := range funcType.Params.List {
+    var t reflect.Type
+    if ellipsis, ok := field.Type.(*ast.Ellipsis); ok {
+      t, variadic = reflect.SliceOf(in.mustType(ellipsis.Elt, s)), true
+    } else {
+      t = in.mustType(field.Type, s)
+    }
+    for i := 0; i < fieldCount(field); i++ {
+      params = append(params, t)
+    }
+  }
+  if funcType.Results != nil {
+    for _, field := range funcType.Results.List {
+      t := in.mustType(field.Type, s)
+      for i := 0; i < fieldCount(field); i++ {
+        results = append(results, t)
+      }
+    }
+  }
+  return reflect.FuncOf(params, results, variadic)
+}
+
+
+//--- Types
+
+// localFieldName is the name under which an unexported field of a struct
+// type declared by a template is kept, since reflect can only make structs
+// with exported fields.
+func localFieldName(name string) string {
+  if token.IsExported(name) {
+    return name
+  }
+  return "X_" + name
+}
+
+// typeOf returns the type that an expression names, or false if the
+// expression is not a type.
+func (in *interpreter) typeOf(expr ast.Expr, s *scope) (reflect.Type, bool) {
+  switch e := expr.(type) {
+  case *ast.Ident:
+    if t, ok := s.lookupType(e.Name); ok {
+      return t, true
+    }
+    if _, ok := s.lookup(e.Name); ok {
+      return nil, false
+    }
+    if t, ok := basicTypes[e.Name]; ok {
+      return t, true
+    }
+    for _, path := range in.dotImports {
+      if t, ok := previewTypes[previewPath(path)][e.Name]; ok {
+        return t, true
+      }
+    }
+  case *ast.SelectorExpr:
+    if path, ok := in.packageOf(e.X, s); ok {
+      t, ok := previewTypes[previewPath(path)][e.Sel.Name]
+      return t, ok
+    }
+  case *ast.ParenExpr:
+    return in.typeOf(e.X, s)
+  case *ast.StarExpr:
+    if t, ok := in.typeOf(e.X, s); ok {
+      return reflect.PointerTo(t), true
+    }
+  case *ast.ArrayType:
+    elem := in.mustType(e.Elt, s)
+    if e.Len == nil {
+      return reflect.SliceOf(elem), true
+    }
+    return reflect.ArrayOf(in.intValue(e.Len, s), elem), true
+  case *ast.MapType:
+    return reflect.MapOf(in.mustType(e.Key, s), in.mustType(e.Value, s)), true
+  case *ast.FuncType:
+    return in.funcType(e, s), true
+  case *ast.InterfaceType:
+    if len(e.Methods.List) != 0 {
+      panic(in.unsupported(e, "an interface type with methods"))
+    }
+    return basicTypes["any"], true
+  case *ast.StructType:
+    return in.structType(e, s), true
+  case *ast.ChanType:
+    panic(in.unsupported(e, "a channel"))
+  }
+  return nil, false
+}
+
+// mustType returns the type that an expression names, and fails if it is
+// not a type.
+func (in *interpreter) mustType(expr ast.Expr, s *scope) reflect.Type {
+  t, ok := in.typeOf(expr, s)
+  if !ok {
+    panic(in.errorAt(expr, "%s is not a type that previews know",
+        types.ExprString(expr)))
+  }
+  return t
+}
+
+// structType makes a struct type. Embedded fields are not supported.
+func (in *interpreter) structType(structType *ast.StructType,
+    s *scope) reflect.Type {
+  fields := []reflect.StructField{}
+  for _, field := range structType.Fields.List {
+    if len(field.Names) == 0 {
+      panic(in.unsupported(field, "an embedded field"))
+    }
+    t := in.mustType(field.Type, s)
+    tag := ""
+    if field.Tag != nil {
+      tag, _ = strconv.Unquote(field.Tag.Value)
+    }
+    for _, name := range field.Names {
+      fields = append(fields, reflect.StructField{
+          Name: localFieldName(name.Name), Type: t,
+          Tag: reflect.StructTag(tag) })
+    }
+  }
+  return reflect.StructOf(fields)
+}
+
+// previewPath returns the path under which an imported package is found
+// in the tables of previews. A vendored runtime is the runtime, and so are
+// its helpers.
+func previewPath(path string) string {
+  if path == runtimeImport {
+    return apptemplate.RuntimePath
+  }
+  if path == runtimeImport + "/helpers" {
+    return apptemplate.HelpersPath
+  }
+  return path
+}
+
+// packageOf returns the import path of a package named by an expression,
+// or false if the expression does not name a package.
+func (in *interpreter) packageOf(expr ast.Expr, s *scope) (string, bool) {
+  ident, ok := expr.(*ast.Ident)
+  if !ok {
+    return "", false
+  }
+  if _, shadowed := s.lookup(ident.Name); shadowed {
+    return "", false
+  }
+  path, ok := in.imports[ident.Name]
+  return path, ok
+}
+
+
+//--- Declarations
+
+// declare runs a declaration of variables, constants, or types.
+func (in *interpreter) declare(decl *ast.GenDecl, s *scope) {
+  var lastType ast.Expr
+  var lastValues []ast.Expr
+  for i, spec := range decl.Specs {
+    switch spec := spec.(type) {
+    case *ast.TypeSpec:
+      if spec.TypeParams != nil {
+        panic(in.unsupported(spec, "a generic type"))
+      }
+      s.types[spec.Name.Name] = in.mustType(spec.Type, s)
+    case *ast.ValueSpec:
+      typeExpr, valueExprs := spec.Type, spec.Values
+      if decl.Tok == token.CONST {
+        in.iota = i
+        if typeExpr == nil && len(valueExprs) == 0 {
+          typeExpr, valueExprs = lastType, lastValues
+        }
+        lastType, lastValues = typeExpr, valueExprs
+      }
+      var t reflect.Type
+      if typeExpr != nil {
+        t = in.mustType(typeExpr, s)
+      }
+      values := []reflect.Value{}
+      if len(valueExprs) == 1 && len(spec.Names) > 1 {
+        values = in.evalMulti(valueExprs[0], s)
+      } else {
+        for _, expr := range valueExprs {
+          values = append(values, in.evalFor(expr, t, s))
+        }
+      }
+      if len(values) != 0 && len(values) != len(spec.Names) {
+        panic(in.errorAt(spec, "%d names are given %d values",
+            len(spec.Names), len(values)))
+      }
+      for j, name := range spec.Names {
+        var value reflect.Value
+        switch {
+        case len(values) == 0:
+          value = reflect.Zero(t)
+        case t != nil:
+          value = in.assign(spec, values[j], t)
+        default:
+          value = in.typed(spec, values[j])
+        }
+        s.define(name.Name, value)
+      }
+    }
+  }
+}
+
+// typed returns a value for a new variable, which cannot be untyped nil.
+func (in *interpreter) typed(node ast.Node, value reflect.Value) reflect.Value {
+  if !value.IsValid() {
+    panic(in.errorAt(node, "use of untyped nil"))
+  }
+  return value
+}
+
+
+//--- Statements
+
+// control says how a statement ended.
+type control int
+
+const (
+  proceed control = iota
+  breakStatement
+  continueLoop
+  returnFunction
+  fallThrough
+)
+
+// execList runs a list of statements until one of them ends otherwise than
+// by proceeding. The label goes with a break or a continue.
+func (in *interpreter) execList(list []ast.Stmt, s *scope,
+    f *frame) (control, string) {
+  for _, stmt := range list {
+    if result, label := in.exec(stmt, s, f, ""); result != proceed {
+      return result, label
+    }
+  }
+  return proceed, ""
+}
+
+// exec runs a statement. The label is that of a labeled loop or switch.
+func (in *interpreter) exec(stmt ast.Stmt, s *scope, f *frame,
+    label string) (control, string) {
+  in.pos = stmt.Pos()
+  switch st := stmt.(type) {
+  case *ast.EmptyStmt:
+  case *ast.ExprStmt:
+    if call, ok := st.X.(*ast.CallExpr); ok {
+      in.call(call, s)
+    } else {
+      in.eval(st.X, s)
+    }
+  case *ast.AssignStmt:
+    in.assignStmt(st, s)
+  case *ast.IncDecStmt:
+    op := token.ADD
+    if st.Tok == token.DEC {
+      op = token.SUB
+    }
+    old := in.eval(st.X, s)
+    one := reflect.ValueOf(1).Convert(old.Type())
+    in.store(st.X, in.binary(st, op, old, one), s)
+  case *ast.DeclStmt:
+    in.declare(st.Decl.(*ast.GenDecl), s)
+  case *ast.BlockStmt:
+    return in.execList(st.List, newScope(s), f)
+  case *ast.LabeledStmt:
+    return in.exec(st.Stmt, s, f, st.Label.Name)
+  case *ast.IfStmt:
+    s = newScope(s)
+    if st.Init != nil {
+      in.exec(st.Init, s, f, "")
+    }
+    if in.boolValue(st.Cond, s) {
+      return in.execList(st.Body.List, newScope(s), f)
+    }
+    if st.Else != nil {
+      return in.exec(st.Else, s, f, "")
+    }
+  case *ast.ForStmt:
+    return in.forStmt(st, s, f, label)
+  case *ast.RangeStmt:
+    return in.rangeStmt(st, s, f, label)
+  case *ast.SwitchStmt:
+    return in.switchStmt(st, s, f, label)
+  case *ast.TypeSwitchStmt:
+    return in.typeSwitchStmt(st, s, f, label)
+  case *ast.ReturnStmt:
+    in.returnStmt(st, s, f)
+    return returnFunction, ""
+  case *ast.BranchStmt:
+    labelName := ""
+    if st.Label != nil {
+      labelName = st.Label.Name
+    }
+    switch st.Tok {
+    case token.BREAK:
+      return breakStatement, labelName
+    case token.CONTINUE:
+      return continueLoop, labelName
+    case token.FALLTHROUGH:
+      return fallThrough, ""
+    }
+    panic(in.unsupported(st, "goto"))
+  case *ast.DeferStmt:
+    f.defers = append(f.defers, in.deferredCall(st.Call, s))
+  case *ast.GoStmt:
+    panic(in.unsupported(st, "a go statement"))
+  case *ast.SendStmt, *ast.SelectStmt:
+    panic(in.unsupported(st, "a channel"))
+  default:
+    panic(in.unsupported(st, "this statement"))
+  }
+  return proceed, ""
+}
+
+// loopControl decides what a loop does after its body ends: whether it
+// goes on, and if not, how the loop statement ends.
+func loopControl(result control, label, loopLabel string) (bool, control,
+    string) {
+  ours := label == "" || label == loopLabel
+  switch {
+  case result == proceed, result == continueLoop && ours:
+    return true, proceed, ""
+  case result == breakStatement && ours:
+    return false, proceed, ""
+  }
+  return false, result, label
+}
+
+// forStmt runs a three-clause for loop. Each iteration has its own copy
+// of the variables declared by the init statement, as in Go 1.22.
+func (in *interpreter) forStmt(st *ast.ForStmt, s *scope, f *frame,
+    label string) (control, string) {
+  current := newScope(s)
+  if st.Init != nil {
+    in.exec(st.Init, current, f, "")
+  }
+  for {
+    in.tick(st)
+    if st.Cond != nil && !in.boolValue(st.Cond, current) {
+      return proceed, ""
+    }
+    result, resultLabel := in.execList(st.Body.List, newScope(current), f)
+    goOn, result, resultLabel := loopControl(result, resultLabel, label)
+    if !goOn {
+      return result, resultLabel
+    }
+    next := newScope(s)
+    for name, value := range current.values {
+      next.define(name, value)
+    }
+    current = next
+    if st.Post != nil {
+      in.exec(st.Post, current, f, "")
+    }
+  }
+}
+
+// rangeStmt runs a range loop over an integer, a string, a slice, an
+// array or a pointer to one, or a map.
+func (in *interpreter) rangeStmt(st *ast.RangeStmt, s *scope, f *frame,
+    label string) (control, string) {
+  x := in.eval(st.X, s)
+  if x.Kind() == reflect.Pointer && x.Type().Elem().Kind() == reflect.Array {
+    x = x.Elem()
+  }
+  iteration := func (key, value reflect.Value) (bool, control, string) {
+    in.tick(st)
+    body := newScope(s)
+    for _, pair := range []struct { expr ast.Expr; value reflect.Value }{
+        { st.Key, key }, { st.Value, value } } {
+      switch {
+      case pair.expr == nil:
+      case st.Tok == token.DEFINE:
+        body.define(pair.expr.(*ast.Ident).Name, pair.value)
+      default:
+        in.store(pair.expr, pair.value, s)
+      }
+    }
+    result, resultLabel := in.execList(st.Body.List, body, f)
+    return loopControl(result, resultLabel, label)
+  }
+  var goOn bool
+  var result control
+  var resultLabel string
+  switch x.Kind() {
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+      reflect.Int64:
+    for i := int64(0); i < x.Int(); i++ {
+      key := reflect.New(x.Type()).Elem()
+      key.SetInt(i)
+      if goOn, result, resultLabel = iteration(key, reflect.Value{});
+          !goOn {
+        return result, resultLabel
+      }
+    }
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+      reflect.Uint64:
+    for i := uint64(0); i < x.Uint(); i++ {
+      key := reflect.New(x.Type()).Elem()
+      key.SetUint(i)
+      if goOn, result, resultLabel = iteration(key, reflect.Value{});
+          !goOn {
+        return result, resultLabel
+      }
+    }
+  case reflect.String:
+    for i, r := range x.String() {
+      if goOn, result, resultLabel = iteration(reflect.ValueOf(i),
+          reflect.ValueOf(r)); !goOn {
+        return result, resultLabel
+      }
+    }
+  case reflect.Slice, reflect.Array:
+    if x.Kind() == reflect.Array {
+      x = detach(x)  // The loop ranges over a copy of an array.
+    }
+    for i := 0; i < x.Len(); i++ {
+      if goOn, result, resultLabel = iteration(reflect.ValueOf(i),
+          x.Index(i)); !goOn {
+        return result, resultLabel
+      }
+    }
+  case reflect.Map:
+    for _, key := range x.MapKeys() {
+      value := x.MapIndex(key)
+      if !value.IsValid() {
+        continue  // The entry was deleted by an earlier iteration.
+      }
+      if goOn, result, resultLabel = iteration(key, value); !goOn {
+        return result, resultLabel
+      }
+    }
+  case reflect.Func:
+    panic(in.unsupported(st, "a range over a function"))
+  case reflect.Chan:
+    panic(in.unsupported(st, "a channel"))
+  default:
+    panic(in.errorAt(st.X, "cannot range over %s", types.ExprString(st.X)))
+  }
+  return proceed, ""
+}
+
+// runCases runs the case clauses of a switch from the one that matched,
+// going on to the next while they end with fallthrough.
+func (in *interpreter) runCases(clauses []ast.Stmt, matched int, s *scope,
+    f *frame, label string) (control, string) {
+  for i := matched; i >= 0 && i < len(clauses); i++ {
+    result, resultLabel := in.execList(clauses[i].(*ast.CaseClause).Body,
+        newScope(s), f)
+    switch {
+    case result == fallThrough:
+      continue
+    case result == breakStatement &&
+        (resultLabel == "" || resultLabel == label):
+      return proceed, ""
+    }
+    return result, resultLabel
+  }
+  return proceed, ""
+}
+
+// switchStmt runs an expression switch.
+func (in *interpreter) switchStmt(st *ast.SwitchStmt, s *scope, f *frame,
+    label string) (control, string) {
+  s = newScope(s)
+  if st.Init != nil {
+    in.exec(st.Init, s, f, "")
+  }
+  var tag reflect.Value
+  if st.Tag != nil {
+    tag = in.eval(st.Tag, s)
+  }
+  matched, fallback := -1, -1
+  for i, clause := range st.Body.List {
+    clause := clause.(*ast.CaseClause)
+    if clause.List == nil {
+      fallback = i
+    }
+    for _, expr := range clause.List {
+      if st.Tag == nil && in.boolValue(expr, s) ||
+          st.Tag != nil && in.binary(expr, token.EQL, tag,
+          in.eval(expr, s)).Bool() {
+        matched = i
+        break
+      }
+    }
+    if matched != -1 {
+      break
+    }
+  }
+  if matched == -1 {
+    matched = fallback
+  }
+  return in.runCases(st.Body.List, matched, s, f, label)
+}
+
+// typeSwitchStmt runs a type switch.
+func (in *interpreter) typeSwitchStmt(st *ast.TypeSwitchStmt, s *scope,
+    f *frame, label string) (control, string) {
+  s = newScope(s)
+  if st.Init != nil {
+    in.exec(st.Init, s, f, "")
+  }
+  var assertion *ast.TypeAssertExpr
+  name := ""
+  switch assign := st.Assign.(type) {
+  case *ast.ExprStmt:
+    assertion = assign.X.(*ast.TypeAssertExpr)
+  case *ast.AssignStmt:
+    assertion = assign.Rhs[0].(*ast.TypeAssertExpr)
+    name = assign.Lhs[0].(*ast.Ident).Name
+  }
+  x := in.eval(assertion.X, s)
+  if x.Kind() != reflect.Interface {
+    panic(in.errorAt(assertion.X, "%s is not an interface",
+        types.ExprString(assertion.X)))
+  }
+  matched, fallback := -1, -1
+  bound := x
+  for i, clause := range st.Body.List {
+    clause := clause.(*ast.CaseClause)
+    if clause.List == nil {
+      fallback = i
+    }
+    for _, expr := range clause.List {
+      if ident, ok := expr.(*ast.Ident); ok && ident.Name == "nil" {
+        if x.IsNil() {
+          matched = i
+        }
+      } else if value, ok := in.assertType(x, in.mustType(expr, s)); ok {
+        matched = i
+        if len(clause.List) == 1 {
+          bound = value
+        }
+      }
+      if matched != -1 {
+        break
+      }
+    }
+    if matched != -1 {
+      break
+    }
+  }
+  if matched == -1 {
+    matched = fallback
+  }
+  if name != "" {
+    s.define(name, bound)
+  }
+  return in.runCases(st.Body.List, matched, s, f, label)
+}
+
+// returnStmt sets the results of a function.
+func (in *interpreter) returnStmt(st *ast.ReturnStmt, s *scope, f *frame) {
+  if len(st.Results) == 0 {
+    return
+  }
+  values := []reflect.Value{}
+  if len(st.Results) == 1 && len(f.results) > 1 {
+    values = in.evalMulti(st.Results[0], s)
+  } else {
+    for i, expr := range st.Results {
+      if i < len(f.results) {
+        values = append(values, in.evalFor(expr, f.results[i].Type(), s))
+      }
+    }
+  }
+  if len(values) != len(f.results) {
+    panic(in.errorAt(st, "%d values are returned where %d are expected",
+        len(values), len(f.results)))
+  }
+  for i, value := range values {
+    f.results[i].Set(in.assign(st, value, f.results[i].Type()))
+  }
+}
+
+// assignStmt runs an assignment or a short variable declaration.
+func (in *interpreter) assignStmt(st *ast.AssignStmt, s *scope) {
+  if st.Tok != token.ASSIGN && st.Tok != token.DEFINE {
+    op := st.Tok - (token.ADD_ASSIGN - token.ADD)
+    in.store(st.Lhs[0], in.binary(st, op, in.eval(st.Lhs[0], s),
+        in.eval(st.Rhs[0], s)), s)
+    return
+  }
+  values := []reflect.Value{}
+  if len(st.Rhs) == 1 && len(st.Lhs) == 2 {
+    values = in.evalCommaOk(st.Rhs[0], s)
+  } else if len(st.Rhs) == 1 && len(st.Lhs) > 2 {
+    values = in.evalMulti(st.Rhs[0], s)
+  } else {
+    for _, expr := range st.Rhs {
+      value := in.eval(expr, s)
+      if value.IsValid() {
+        value = detach(value)  // As in a, b = b, a.
+      }
+      values = append(values, value)
+    }
+  }
+  if len(values) != len(st.Lhs) {
+    panic(in.errorAt(st, "%d variables are assigned %d values",
+        len(st.Lhs), len(values)))
+  }
+  for i, lhs := range st.Lhs {
+    if st.Tok == token.DEFINE {
+      name := lhs.(*ast.Ident).Name
+      if variable, ok := s.values[name]; ok {
+        variable.Set(in.assign(lhs, values[i], variable.Type()))
+      } else {
+        s.define(name, in.typed(lhs, values[i]))
+      }
+      continue
+    }
+    in.store(lhs, values[i], s)
+  }
+}
+
+// store assigns a value to a variable, element, or field.
+func (in *interpreter) store(lhs ast.Expr, value reflect.Value, s *scope) {
+  switch e := lhs.(type) {
+  case *ast.ParenExpr:
+    in.store(e.X, value, s)
+    return
+  case *ast.Ident:
+    if e.Name == "_" {
+      return
+    }
+  case *ast.IndexExpr:
+    x := in.eval(e.X, s)
+    if x.Kind() == reflect.Map {
+      if x.IsNil() {
+        panic(errors.New("assignment to entry in nil map"))
+      }
+      key := in.evalFor(e.Index, x.Type().Key(), s)
+      x.SetMapIndex(key, in.assign(lhs, value, x.Type().Elem()))
+      return
+    }
+  }
+  target := in.eval(lhs, s)
+  if !target.CanSet() {
+    panic(in.errorAt(lhs, "cannot assign to %s", types.ExprString(lhs)))
+  }
+  target.Set(in.assign(lhs, value, target.Type()))
+}
+
+// deferredCall evaluates the function and arguments of a deferred call.
+func (in *interpreter) deferredCall(call *ast.CallExpr,
+    s *scope) deferredCall {
+  if selector, ok := call.Fun.(*ast.SelectorExpr); ok &&
+      selector.Sel.Name == "Recover" && len(call.Args) == 0 {
+    if _, isPackage := in.packageOf(selector.X, s); !isPackage {
+      x := in.eval(selector.X, s)
+      if x.IsValid() && x.Type() == reflect.TypeOf((*runtime.Context)(nil)) {
+        return deferredCall{ recoverer: x.Interface().(*runtime.Context) }
+      }
+    }
+  }
+  if _, ok := in.typeOf(call.Fun, s); !ok && !in.isBuiltin(call.Fun, s) {
+    return deferredCall{ call: in.prepareCall(call, s) }
+  }
+  return deferredCall{ call: func () []reflect.Value {
+    return in.call(call, s)
+  } }
+}
+
+
+//--- Expressions
+
+// eval evaluates an expression that has a single value. Untyped nil is
+// the invalid reflect.Value.
+func (in *interpreter) eval(expr ast.Expr, s *scope) reflect.Value {
+  switch e := expr.(type) {
+  case *ast.BasicLit:
+    return in.literal(e)
+  case *ast.Ident:
+    return in.ident(e, s)
+  case *ast.ParenExpr:
+    return in.eval(e.X, s)
+  case *ast.SelectorExpr:
+    return in.selector(e, s)
+  case *ast.CallExpr:
+    values := in.call(e, s)
+    if len(values) != 1 {
+      panic(in.errorAt(e, "%s is used as a value but has %d values",
+          types.ExprString(e), len(values)))
+    }
+    return values[0]
+  case *ast.IndexExpr:
+    value, _ := in.index(e, s)
+    return value
+  case *ast.SliceExpr:
+    return in.slice(e, s)
+  case *ast.StarExpr:
+    x := in.eval(e.X, s)
+    if x.Kind() != reflect.Pointer {
+      panic(in.errorAt(e, "cannot indirect %s", types.ExprString(e.X)))
+    }
+    if x.IsNil() {
+      runtimePanic("invalid memory address or nil pointer dereference")
+    }
+    return x.Elem()
+  case *ast.UnaryExpr:
+    return in.unary(e, s)
+  case *ast.BinaryExpr:
+    if e.Op == token.LAND || e.Op == token.LOR {
+      x := in.boolValue(e.X, s)
+      if x == (e.Op == token.LOR) {
+        return reflect.ValueOf(x)
+      }
+      return reflect.ValueOf(in.boolValue(e.Y, s))
+    }
+    return in.binary(e, e.Op, in.eval(e.X, s), in.eval(e.Y, s))
+  case *ast.CompositeLit:
+    return in.composite(e, nil, s)
+  case *ast.FuncLit:
+    return in.makeFunc(e.Type, e.Body, s)
+  case *ast.TypeAssertExpr:
+    x := in.eval(e.X, s)
+    t := in.mustType(e.Type, s)
+    value, ok := in.assertType(x, t)
+    if !ok {
+      panic(fmt.Errorf("interface conversion: interface is %s, not %s",
+          dynamicType(x), t))
+    }
+    return value
+  }
+  panic(in.unsupported(expr, "this expression"))
+}
+
+// evalFor evaluates an expression whose type is known from where it is
+// used, so that the type of a composite literal may be left out. The value
+// is converted to the type if the type is not nil.
+func (in *interpreter) evalFor(expr ast.Expr, t reflect.Type,
+    s *scope) reflect.Value {
+  if t == nil {
+    return in.eval(expr, s)
+  }
+  if literal, ok := expr.(*ast.CompositeLit); ok && literal.Type == nil {
+    return in.composite(literal, t, s)
+  }
+  return in.assign(expr, in.eval(expr, s), t)
+}
+
+// evalMulti evaluates a call that has any number of values.
+func (in *interpreter) evalMulti(expr ast.Expr, s *scope) []reflect.Value {
+  if paren, ok := expr.(*ast.ParenExpr); ok {
+    return in.evalMulti(paren.X, s)
+  }
+  if call, ok := expr.(*ast.CallExpr); ok {
+    return in.call(call, s)
+  }
+  return []reflect.Value{ in.eval(expr, s) }
+}
+
+// evalCommaOk evaluates the right side of an assignment to two variables:
+// a map index, a type assertion, or a call with two results.
+func (in *interpreter) evalCommaOk(expr ast.Expr, s *scope) []reflect.Value {
+  switch e := expr.(type) {
+  case *ast.ParenExpr:
+    return in.evalCommaOk(e.X, s)
+  case *ast.IndexExpr:
+    value, ok := in.index(e, s)
+    return []reflect.Value{ detach(value), reflect.ValueOf(ok) }
+  case *ast.TypeAssertExpr:
+    value, ok := in.assertType(in.eval(e.X, s), in.mustType(e.Type, s))
+    return []reflect.Value{ value, reflect.ValueOf(ok) }
+  case *ast.UnaryExpr:
+    if e.Op == token.ARROW {
+      panic(in.unsupported(e, "a channel"))
+    }
+  }
+  return in.evalMulti(expr, s)
+}
+
+// literal evaluates a basic literal. Numbers take the default types of
+// untyped constants.
+func (in *interpreter) literal(lit *ast.BasicLit) reflect.Value {
+  switch lit.Kind {
+  case token.INT:
+    if n, err := strconv.ParseInt(lit.Value, 0, 64); err == nil {
+      return reflect.ValueOf(int(n))
+    }
+    if n, err := strconv.ParseUint(lit.Value, 0, 64); err == nil {
+      return reflect.ValueOf(n)
+    }
+  case token.FLOAT:
+    value := strings.ReplaceAll(lit.Value, "_", "")
+    if x, err := strconv.ParseFloat(value, 64); err == nil {
+      return reflect.ValueOf(x)
+    }
+  case token.CHAR:
+    r, _, _, err := strconv.UnquoteChar(lit.Value[1:len(lit.Value)-1], '\'')
+    if err == nil {
+      return reflect.ValueOf(r)
+    }
+  case token.STRING:
+    if text, err := strconv.Unquote(lit.Value); err == nil {
+      return reflect.ValueOf(text)
+    }
+  case token.IMAG:
+    panic(in.unsupported(lit, "a complex number"))
+  }
+  panic(in.errorAt(lit, "cannot read the literal %s", lit.Value))
+}
+
+// ident evaluates an identifier.
+func (in *interpreter) ident(ident *ast.Ident, s *scope) reflect.Value {
+  if value, ok := s.lookup(ident.Name); ok {
+    return value
+  }
+  switch ident.Name {
+  case "nil":
+    return reflect.Value{}
+  case "true", "false":
+    return reflect.ValueOf(ident.Name == "true")
+  case "iota":
+    return reflect.ValueOf(in.iota)
+  }
+  for _, path := range in.dotImports {
+    if value, ok := previewPackages[previewPath(path)][ident.Name]; ok {
+      return value
+    }
+  }
+  if _, ok := in.typeOf(ident, s); ok {
+    panic(in.errorAt(ident, "%s is a type, not a value", ident.Name))
+  }
+  panic(in.errorAt(ident, "undefined: %s", ident.Name))
+}
+
+// selector evaluates a member of a package, a field, or a method value.
+func (in *interpreter) selector(e *ast.SelectorExpr, s *scope) reflect.Value {
+  name := e.Sel.Name
+  if path, ok := in.packageOf(e.X, s); ok {
+    if value, ok := previewPackages[previewPath(path)][name]; ok {
+      return value
+    }
+    panic(in.errorAt(e, "%s is not available in previews; build the " +
+        "template to use it", types.ExprString(e)))
+  }
+  x := in.eval(e.X, s)
+  if !x.IsValid() {
+    panic(in.errorAt(e.X, "use of untyped nil"))
+  }
+  if method := methodOf(x, name); method.IsValid() {
+    return method
+  }
+  if field, ok := in.field(e, x, name); ok {
+    return field
+  }
+  panic(in.errorAt(e.Sel, "%s has no field or method %s", x.Type(), name))
+}
+
+// methodOf returns a method value, or the invalid value if there is no
+// method of the name. Methods with pointer receivers are found for
+// addressable values.
+func methodOf(x reflect.Value, name string) reflect.Value {
+  if x.Kind() == reflect.Interface && x.IsNil() {
+    if _, ok := x.Type().MethodByName(name); ok {
+      runtimePanic("invalid memory address or nil pointer dereference")
+    }
+    return reflect.Value{}
+  }
+  if method := x.MethodByName(name); method.IsValid() {
+    return method
+  }
+  if x.Kind() != reflect.Pointer && x.Kind() != reflect.Interface &&
+      x.CanAddr() {
+    return x.Addr().MethodByName(name)
+  }
+  return reflect.Value{}
+}
+
+// field returns a field of a struct or of a pointer to one.
+func (in *interpreter) field(node ast.Node, x reflect.Value,
+    name string) (reflect.Value, bool) {
+  if x.Kind() == reflect.Pointer && x.Type().Elem().Kind() == reflect.Struct {
+    if x.IsNil() {
+      runtimePanic("invalid memory address or nil pointer dereference")
+    }
+    x = x.Elem()
+  }
+  if x.Kind() != reflect.Struct {
+    return reflect.Value{}, false
+  }
+  field, ok := x.Type().FieldByName(name)
+  if !ok {
+    field, ok = x.Type().FieldByName(localFieldName(name))
+  }
+  if !ok {
+    return reflect.Value{}, false
+  }
+  if !field.IsExported() {
+    panic(in.errorAt(node, "%s is an unexported field of %s", name,
+        x.Type()))
+  }
+  value, err := x.FieldByIndexErr(field.Index)
+  if err != nil {
+    runtimePanic("invalid memory address or nil pointer dereference")
+  }
+  return value, true
+}
+
+// index evaluates an index expression. For a map, it also reports whether
+// the key was present.
+func (in *interpreter) index(e *ast.IndexExpr, s *scope) (reflect.Value,
+    bool) {
+  x := in.eval(e.X, s)
+  if x.Kind() == reflect.Pointer && x.Type().Elem().Kind() == reflect.Array {
+    x = x.Elem()
+  }
+  switch x.Kind() {
+  case reflect.Map:
+    value := x.MapIndex(in.evalFor(e.Index, x.Type().Key(), s))
+    if !value.IsValid() {
+      return reflect.Zero(x.Type().Elem()), false
+    }
+    return value, true
+  case reflect.Slice, reflect.Array, reflect.String:
+    i := in.intValue(e.Index, s)
+    if i < 0 || i >= x.Len() {
+      runtimePanic("index out of range [%d] with length %d", i, x.Len())
+    }
+    return x.Index(i), true
+  case reflect.Func:
+    panic(in.unsupported(e, "a generic function"))
+  }
+  panic(in.errorAt(e, "cannot index %s", types.ExprString(e.X)))
+}
+
+// slice evaluates a slice expression.
+func (in *interpreter) slice(e *ast.SliceExpr, s *scope) reflect.Value {
+  x := in.eval(e.X, s)
+  if x.Kind() == reflect.Pointer && x.Type().Elem().Kind() == reflect.Array {
+    x = x.Elem()
+  }
+  if x.Kind() == reflect.Array && !x.CanAddr() {
+    panic(in.errorAt(e, "cannot slice %s, which is not addressable",
+        types.ExprString(e.X)))
+  }
+  if x.Kind() != reflect.Slice && x.Kind() != reflect.Array &&
+      x.Kind() != reflect.String {
+    panic(in.errorAt(e, "cannot slice %s", types.ExprString(e.X)))
+  }
+  limit := x.Len()
+  if x.Kind() != reflect.String {
+    limit = x.Cap()
+  }
+  low, high, capacity := 0, x.Len(), limit
+  if e.Low != nil {
+    low = in.intValue(e.Low, s)
+  }
+  if e.High != nil {
+    high = in.intValue(e.High, s)
+  }
+  if e.Max != nil {
+    capacity = in.intValue(e.Max, s)
+  }
+  if low < 0 || low > high || high > capacity || capacity > limit {
+    runtimePanic("slice bounds out of range [%d:%d] with capacity %d", low,
+        high, limit)
+  }
+  if e.Slice3 {
+    return x.Slice3(low, high, capacity)
+  }
+  return x.Slice(low, high)
+}
+
+// unary evaluates a unary expression.
+func (in *interpreter) unary(e *ast.UnaryExpr, s *scope) reflect.Value {
+  if e.Op == token.AND {
+    if literal, ok := e.X.(*ast.CompositeLit); ok {
+      value := in.composite(literal, nil, s)
+      pointer := reflect.New(value.Type())
+      pointer.Elem().Set(value)
+      return pointer
+    }
+    x := in.eval(e.X, s)
+    if !x.CanAddr() {
+      panic(in.errorAt(e, "cannot take the address of %s",
+          types.ExprString(e.X)))
+    }
+    return x.Addr()
+  }
+  x := in.eval(e.X, s)
+  switch {
+  case e.Op == token.ADD && isNumber(x.Kind()):
+    return x
+  case e.Op == token.SUB && isNumber(x.Kind()):
+    return in.binary(e, token.SUB, reflect.Zero(x.Type()), x)
+  case e.Op == token.NOT && x.Kind() == reflect.Bool:
+    return reflect.ValueOf(!x.Bool()).Convert(x.Type())
+  case e.Op == token.XOR && isInteger(x.Kind()):
+    result := reflect.New(x.Type()).Elem()
+    if isSigned(x.Kind()) {
+      result.SetInt(^x.Int())
+    } else {
+      result.SetUint(^x.Uint())
+    }
+    return result
+  case e.Op == token.ARROW:
+    panic(in.unsupported(e, "a channel"))
+  }
+  panic(in.errorAt(e, "operator %s is not defined on %s", e.Op,
+      types.ExprString(e.X)))
+}
+
+// composite evaluates a composite literal. The type is given when the
+// literal leaves it out.
+func (in *interpreter) composite(e *ast.CompositeLit, t reflect.Type,
+    s *scope) reflect.Value {
+  if array, ok := e.Type.(*ast.ArrayType); ok && array.Len != nil {
+    if _, ok := array.Len.(*ast.Ellipsis); ok {
+      t = reflect.ArrayOf(in.compositeLength(e, s), in.mustType(array.Elt, s))
+    }
+  }
+  if t == nil && e.Type != nil {
+    t = in.mustType(e.Type, s)
+  }
+  if t == nil {
+    panic(in.errorAt(e, "the composite literal has no type"))
+  }
+  pointer := t.Kind() == reflect.Pointer && e.Type == nil
+  if pointer {
+    t = t.Elem()
+  }
+  value := reflect.New(t).Elem()
+  switch t.Kind() {
+  case reflect.Struct:
+    for i, element := range e.Elts {
+      field := reflect.Value{}
+      if pair, ok := element.(*ast.KeyValueExpr); ok {
+        name := pair.Key.(*ast.Ident).Name
+        var found bool
+        if field, found = in.field(pair.Key, value, name); !found {
+          panic(in.errorAt(pair.Key, "%s has no field %s", t, name))
+        }
+        element = pair.Value
+      } else if i < t.NumField() {
+        field = value.Field(i)
+      } else {
+        panic(in.errorAt(element, "too many values in the literal of %s", t))
+      }
+      field.Set(in.evalFor(element, field.Type(), s))
+    }
+  case reflect.Slice, reflect.Array:
+    if t.Kind() == reflect.Slice {
+      length := in.compositeLength(e, s)
+      value = reflect.MakeSlice(t, length, length)
+    }
+    i := 0
+    for _, element := range e.Elts {
+      if pair, ok := element.(*ast.KeyValueExpr); ok {
+        i, element = in.intValue(pair.Key, s), pair.Value
+      }
+      if i >= value.Len() {
+        panic(in.errorAt(element, "index %d is out of bounds", i))
+      }
+      value.Index(i).Set(in.evalFor(element, t.Elem(), s))
+      i++
+    }
+  case reflect.Map:
+    value = reflect.MakeMapWithSize(t, len(e.Elts))
+    for _, element := range e.Elts {
+      pair, ok := element.(*ast.KeyValueExpr)
+      if !ok {
+        panic(in.errorAt(element, "a map literal needs keys"))
+      }
+      value.SetMapIndex(in.evalFor(pair.Key, t.Key(), s),
+          in.evalFor(pair.Value, t.Elem(), s))
+    }
+  default:
+    panic(in.errorAt(e, "invalid composite literal type %s", t))
+  }
+  if pointer {
+    return value.Addr()
+  }
+  return value
+}
+
+// compositeLength returns the length of a slice or array literal, which
+// its keys may make longer than its list of elements.
+func (in *interpreter) compositeLength(e *ast.CompositeLit, s *scope) int {
+  length, i := 0, 0
+  for _, element := range e.Elts {
+    if pair, ok := element.(*ast.KeyValueExpr); ok {
+      i = in.intValue(pair.Key, s)
+    }
+    i++
+    if i > length {
+      length = i
+    }
+  }
+  return length
+}
+
+// assertType asserts that an interface holds a type, returning the zero
+// value of the type and false if it does not.
+func (in *interpreter) assertType(x reflect.Value,
+    t reflect.Type) (reflect.Value, bool) {
+  if x.Kind() != reflect.Interface {
+    panic(&previewError{ in.pos, fmt.Sprintf("%s is not an interface",
+        x.Type()) })
+  }
+  if x.IsNil() {
+    return reflect.Zero(t), false
+  }
+  dynamic := x.Elem()
+  if t.Kind() == reflect.Interface && dynamic.Type().Implements(t) {
+    return dynamic.Convert(t), true
+  }
+  if dynamic.Type() == t {
+    return dynamic, true
+  }
+  return reflect.Zero(t), false
+}
+
+// dynamicType describes the type held by an interface, for messages.
+func dynamicType(x reflect.Value) string {
+  if x.IsNil() {
+    return "nil"
+  }
+  return x.Elem().Type().String()
+}
+
+// boolValue evaluates a condition.
+func (in *interpreter) boolValue(expr ast.Expr, s *scope) bool {
+  value := in.eval(expr, s)
+  if value.Kind() != reflect.Bool {
+    panic(in.errorAt(expr, "%s is not a condition", types.ExprString(expr)))
+  }
+  return value.Bool()
+}
+
+// intValue evaluates an index, length, or other integer.
+func (in *interpreter) intValue(expr ast.Expr, s *scope) int {
+  value := in.eval(expr, s)
+  switch {
+  case isSigned(value.Kind()):
+    return int(value.Int())
+  case isInteger(value.Kind()):
+    return int(value.Uint())
+  }
+  panic(in.errorAt(expr, "%s is not an integer", types.ExprString(expr)))
+}
+
+
+//--- Calls
+
+// builtins are the predeclared functions that previews support.
+var builtins = map[string]bool{
+  "append": true, "cap": true, "clear": true, "copy": true, "delete": true,
+  "len": true, "make": true, "max": true, "min": true, "new": true,
+  "panic": true, "recover": true,
+}
+
+// isBuiltin reports whether an expression names a predeclared function.
+func (in *interpreter) isBuiltin(expr ast.Expr, s *scope) bool {
+  ident, ok := expr.(*ast.Ident)
+  if !ok {
+    return false
+  }
+  _, shadowed := s.lookup(ident.Name)
+  return !shadowed && builtins[ident.Name]
+}
+
+// call evaluates a call, a conversion, or a call of a builtin, and returns
+// its results.
+func (in *interpreter) call(call *ast.CallExpr, s *scope) []reflect.Value {
+  if t, ok := in.typeOf(call.Fun, s); ok {
+    if len(call.Args) != 1 {
+      panic(in.errorAt(call, "a conversion to %s takes one value", t))
+    }
+    return []reflect.Value{ in.convert(call.Args[0], t, s) }
+  }
+  if in.isBuiltin(call.Fun, s) {
+    return in.builtin(call, call.Fun.(*ast.Ident).Name, s)
+  }
+  return in.prepareCall(call, s)()
+}
+
+// prepareCall evaluates the function and the arguments of a call and
+// returns a function that makes the call, as a defer statement needs.
+func (in *interpreter) prepareCall(call *ast.CallExpr,
+    s *scope) func() []reflect.Value {
+  function := in.eval(call.Fun, s)
+  if !function.IsValid() || function.Kind() != reflect.Func {
+    panic(in.errorAt(call, "%s is not a function",
+        types.ExprString(call.Fun)))
+  }
+  if function.IsNil() {
+    runtimePanic("invalid memory address or nil pointer dereference")
+  }
+  t := function.Type()
+  args := []reflect.Value{}
+  if len(call.Args) == 1 && t.NumIn() > 1 {
+    args = in.evalMulti(call.Args[0], s)
+  } else {
+    for _, arg := range call.Args {
+      args = append(args, in.eval(arg, s))
+    }
+  }
+  count := t.NumIn()
+  if call.Ellipsis.IsValid() || !t.IsVariadic() {
+    if len(args) != count {
+      panic(in.errorAt(call, "%s takes %d arguments, not %d",
+          types.ExprString(call.Fun), count, len(args)))
+    }
+  } else if len(args) < count-1 {
+    panic(in.errorAt(call, "%s takes at least %d arguments, not %d",
+        types.ExprString(call.Fun), count-1, len(args)))
+  }
+  for i, arg := range args {
+    var paramType reflect.Type
+    if i < count-1 || !t.IsVariadic() || call.Ellipsis.IsValid() {
+      paramType = t.In(i)
+    } else {
+      paramType = t.In(count-1).Elem()
+    }
+    node := ast.Node(call)
+    if len(args) == len(call.Args) {
+      node = call.Args[i]
+    }
+    args[i] = detach(in.assign(node, arg, paramType))
+  }
+  if call.Ellipsis.IsValid() {
+    return func () []reflect.Value {
+      return function.CallSlice(args)
+    }
+  }
+  return func () []reflect.Value {
+    return function.Call(args)
+  }
+}
+
+// convert evaluates a conversion.
+func (in *interpreter) convert(expr ast.Expr, t reflect.Type,
+    s *scope) reflect.Value {
+  value := in.eval(expr, s)
+  switch {
+  case !value.IsValid():
+    return in.assign(expr, value, t)
+  case value.Type().ConvertibleTo(t):
+    return value.Convert(t)
+  }
+  panic(in.errorAt(expr, "cannot convert %s to %s", value.Type(), t))
+}
+
+// builtin evaluates a call of a predeclared function.
+func (in *interpreter) builtin(call *ast.CallExpr, name string,
+    s *scope) []reflect.Value {
+  args := call.Args
+  need := func (count int) {
+    if len(args) < count {
+      panic(in.errorAt(call, "not enough arguments to %s", name))
+    }
+  }
+  switch name {
+  case "len", "cap":
+    need(1)
+    x := in.eval(args[0], s)
+    if x.Kind() == reflect.Pointer &&
+        x.Type().Elem().Kind() == reflect.Array {
+      x = reflect.Zero(x.Type().Elem())
+    }
+    switch {
+    case name == "len" && (x.Kind() == reflect.String ||
+        x.Kind() == reflect.Map):
+      return []reflect.Value{ reflect.ValueOf(x.Len()) }
+    case x.Kind() == reflect.Slice, x.Kind() == reflect.Array:
+      if name == "cap" {
+        return []reflect.Value{ reflect.ValueOf(x.Cap()) }
+      }
+      return []reflect.Value{ reflect.ValueOf(x.Len()) }
+    }
+    panic(in.errorAt(args[0], "invalid argument to %s", name))
+  case "append":
+    need(1)
+    x := in.eval(args[0], s)
+    if x.Kind() != reflect.Slice {
+      panic(in.errorAt(args[0], "the first argument to append must be a " +
+          "slice"))
+    }
+    if call.Ellipsis.IsValid() {
+      need(2)
+      more := in.eval(args[1], s)
+      if more.Kind() == reflect.String {
+        more = more.Convert(reflect.TypeOf([]byte(nil)))
+      }
+      return []reflect.Value{ reflect.AppendSlice(x,
+          in.assign(args[1], more, x.Type())) }
+    }
+    elements := []reflect.Value{}
+    for _, arg := range args[1:] {
+      elements = append(elements, in.evalFor(arg, x.Type().Elem(), s))
+    }
+    return []reflect.Value{ reflect.Append(x, elements...) }
+  case "make":
+    need(1)
+    t := in.mustType(args[0], s)
+    sizes := []int{}
+    for _, arg := range args[1:] {
+      sizes = append(sizes, in.intValue(arg, s))
+    }
+    switch {
+    case t.Kind() == reflect.Slice && len(sizes) == 1:
+      return []reflect.Value{ reflect.MakeSlice(t, sizes[0], sizes[0]) }
+    case t.Kind() == reflect.Slice && len(sizes) == 2:
+      return []reflect.Value{ reflect.MakeSlice(t, sizes[0], sizes[1]) }
+    case t.Kind() == reflect.Map && len(sizes) == 0:
+      return []reflect.Value{ reflect.MakeMap(t) }
+    case t.Kind() == reflect.Map && len(sizes) == 1:
+      return []reflect.Value{ reflect.MakeMapWithSize(t, sizes[0]) }
+    }
+    panic(in.errorAt(call, "cannot make %s with %d sizes", t, len(sizes)))
+  case "new":
+    need(1)
+    return []reflect.Value{ reflect.New(in.mustType(args[0], s)) }
+  case "delete":
+    need(2)
+    x := in.eval(args[0], s)
+    if x.Kind() != reflect.Map {
+      panic(in.errorAt(args[0], "the first argument to delete must be a map"))
+    }
+    x.SetMapIndex(in.evalFor(args[1], x.Type().Key(), s), reflect.Value{})
+    return nil
+  case "clear":
+    need(1)
+    in.eval(args[0], s).Clear()
+    return nil
+  case "copy":
+    need(2)
+    destination, source := in.eval(args[0], s), in.eval(args[1], s)
+    if source.Kind() == reflect.String {
+      source = source.Convert(reflect.TypeOf([]byte(nil)))
+    }
+    return []reflect.Value{ reflect.ValueOf(reflect.Copy(destination,
+        source)) }
+  case "min", "max":
+    need(1)
+    result := in.eval(args[0], s)
+    op := token.LSS
+    if name == "max" {
+      op = token.GTR
+    }
+    for _, arg := range args[1:] {
+      value := in.eval(arg, s)
+      if in.binary(arg, op, value, result).Bool() {
+        result = value
+      }
+    }
+    return []reflect.Value{ result }
+  case "panic":
+    need(1)
+    value := in.eval(args[0], s)
+    if !value.IsValid() {
+      panic(nil)
+    }
+    panic(value.Interface())
+  case "recover":
+    var recovered interface{}
+    if count := len(in.recovering); count != 0 {
+      pending := in.recovering[count-1]
+      if _, stopped := (*pending).(*previewError); !stopped {
+        recovered, *pending = *pending, nil
+      }
+    }
+    return []reflect.Value{ reflect.ValueOf(&recovered).Elem() }
+  }
+  panic(in.unsupported(call, name))
+}
+
+
+//--- Operators
+
+// isNumber reports whether a kind is an integer or a float kind.
+func isNumber(kind reflect.Kind) bool {
+  return isInteger(kind) || kind == reflect.Float32 || kind == reflect.Float64
+}
+
+// isInteger reports whether a kind is a signed or unsigned integer kind.
+func isInteger(kind reflect.Kind) bool {
+  return isSigned(kind) || kind >= reflect.Uint && kind <= reflect.Uintptr
+}
+
+// isSigned reports whether a kind is a signed integer kind.
+func isSigned(kind reflect.Kind) bool {
+  return kind >= reflect.Int && kind <= reflect.Int64
+}
+
+// literalRanks holds the types that constants default to, ranked as the
+// kinds of untyped constants are: an operation on an integer and a float
+// constant makes a float.
+var literalRanks = map[reflect.Type]int{
+  reflect.TypeOf(0): 1,
+  reflect.TypeOf('a'): 2,
+  reflect.TypeOf(0.5): 3,
+  reflect.TypeOf(""): 1,
+  reflect.TypeOf(false): 1,
+}
+
+// sameClass reports whether two kinds are both numbers, both strings, or
+// both booleans, so that a value of one can stand in for the other.
+func sameClass(a, b reflect.Kind) bool {
+  return isNumber(a) && isNumber(b) || a == b &&
+      (a == reflect.String || a == reflect.Bool)
+}
+
+// assign converts a value to a type it is assigned to. Untyped nil
+// becomes the zero value of a type that has one, and numbers, strings,
+// and booleans convert to types of the same class, as constants would.
+func (in *interpreter) assign(node ast.Node, value reflect.Value,
+    t reflect.Type) reflect.Value {
+  switch {
+  case !value.IsValid():
+    switch t.Kind() {
+    case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map,
+        reflect.Func, reflect.Chan, reflect.UnsafePointer:
+      return reflect.Zero(t)
+    }
+    panic(in.errorAt(node, "cannot use nil as %s", t))
+  case value.Type() == t:
+    return value
+  case value.Type().AssignableTo(t),
+      sameClass(value.Kind(), t.Kind()) && value.Type().ConvertibleTo(t):
+    return value.Convert(t)
+  }
+  panic(in.errorAt(node, "cannot use a value of type %s as %s",
+      value.Type(), t))
+}
+
+// unify converts the operands of a binary operator to a common type. An
+// operand of a type that constants default to converts to the type of the
+// other operand.
+func (in *interpreter) unify(node ast.Node, x,
+    y reflect.Value) (reflect.Value, reflect.Value) {
+  xt, yt := x.Type(), y.Type()
+  if xt == yt || x.Kind() == reflect.Interface ||
+      y.Kind() == reflect.Interface {
+    return x, y
+  }
+  if !sameClass(x.Kind(), y.Kind()) {
+    panic(in.errorAt(node, "mismatched types %s and %s", xt, yt))
+  }
+  xRank, yRank := literalRanks[xt], literalRanks[yt]
+  if xRank != 0 && (yRank == 0 || xRank < yRank) {
+    return x.Convert(yt), y
+  }
+  return x, y.Convert(xt)
+}
+
+// binary evaluates a binary operator other than && and ||.
+func (in *interpreter) binary(node ast.Node, op token.Token, x,
+    y reflect.Value) reflect.Value {
+  switch op {
+  case token.SHL, token.SHR:
+    return in.shift(node, op, x, y)
+  case token.EQL, token.NEQ:
+    return reflect.ValueOf(in.equal(node, x, y) == (op == token.EQL))
+  }
+  if !x.IsValid() || !y.IsValid() {
+    panic(in.errorAt(node, "operator %s is not defined on nil", op))
+  }
+  x, y = in.unify(node, x, y)
+  t := x.Type()
+  switch op {
+  case token.LSS, token.GTR, token.LEQ, token.GEQ:
+    order := 0
+    switch {
+    case isSigned(x.Kind()):
+      order = ordering(x.Int() < y.Int(), x.Int() > y.Int())
+    case isInteger(x.Kind()):
+      order = ordering(x.Uint() < y.Uint(), x.Uint() > y.Uint())
+    case isNumber(x.Kind()):
+      order = ordering(x.Float() < y.Float(), x.Float() > y.Float())
+    case x.Kind() == reflect.String:
+      order = strings.Compare(x.String(), y.String())
+    default:
+      panic(in.errorAt(node, "operator %s is not defined on %s", op, t))
+    }
+    switch op {
+    case token.LSS:
+      return reflect.ValueOf(order < 0)
+    case token.GTR:
+      return reflect.ValueOf(order > 0)
+    case token.LEQ:
+      return reflect.ValueOf(order <= 0)
+    }
+    return reflect.ValueOf(order >= 0)
+  }
+  result := reflect.New(t).Elem()
+  switch {
+  case isSigned(x.Kind()):
+    a, b := x.Int(), y.Int()
+    if (op == token.QUO || op == token.REM) && b == 0 {
+      runtimePanic("integer divide by zero")
+    }
+    switch op {
+    case token.ADD: result.SetInt(a + b)
+    case token.SUB: result.SetInt(a - b)
+    case token.MUL: result.SetInt(a * b)
+    case token.QUO: result.SetInt(a / b)
+    case token.REM: result.SetInt(a % b)
+    case token.AND: result.SetInt(a & b)
+    case token.OR: result.SetInt(a | b)
+    case token.XOR: result.SetInt(a ^ b)
+    case token.AND_NOT: result.SetInt(a &^ b)
+    default: result = reflect.Value{}
+    }
+  case isInteger(x.Kind()):
+    a, b := x.Uint(), y.Uint()
+    if (op == token.QUO || op == token.REM) && b == 0 {
+      runtimePanic("integer divide by zero")
+    }
+    switch op {
+    case token.ADD: result.SetUint(a + b)
+    case token.SUB: result.SetUint(a - b)
+    case token.MUL: result.SetUint(a * b)
+    case token.QUO: result.SetUint(a / b)
+    case token.REM: result.SetUint(a % b)
+    case token.AND: result.SetUint(a & b)
+    case token.OR: result.SetUint(a | b)
+    case token.XOR: result.SetUint(a ^ b)
+    case token.AND_NOT: result.SetUint(a &^ b)
+    default: result = reflect.Value{}
+    }
+  case isNumber(x.Kind()):
+    a, b := x.Float(), y.Float()
+    switch op {
+    case token.ADD: result.SetFloat(a + b)
+    case token.SUB: result.SetFloat(a - b)
+    case token.MUL: result.SetFloat(a * b)
+    case token.QUO: result.SetFloat(a / b)
+    default: result = reflect.Value{}
+    }
+  case x.Kind() == reflect.String && op == token.ADD:
+    result.SetString(x.String() + y.String())
+  default:
+    result = reflect.Value{}
+  }
+  if !result.IsValid() {
+    panic(in.errorAt(node, "operator %s is not defined on %s", op, t))
+  }
+  return result
+}
+
+// ordering turns the results of comparisons into -1, 0, or 1.
+func ordering(less, greater bool) int {
+  switch {
+  case less:
+    return -1
+  case greater:
+    return 1
+  }
+  return 0
+}
+
+// shift evaluates a shift, whose result has the type of its left operand.
+func (in *interpreter) shift(node ast.Node, op token.Token, x,
+    y reflect.Value) reflect.Value {
+  if !x.IsValid() || !y.IsValid() || !isInteger(x.Kind()) ||
+      !isInteger(y.Kind()) {
+    panic(in.errorAt(node, "a shift needs integers"))
+  }
+  var count uint64
+  if isSigned(y.Kind()) {
+    if y.Int() < 0 {
+      runtimePanic("negative shift amount")
+    }
+    count = uint64(y.Int())
+  } else {
+    count = y.Uint()
+  }
+  result := reflect.New(x.Type()).Elem()
+  switch {
+  case isSigned(x.Kind()) && op == token.SHL:
+    result.SetInt(x.Int() << count)
+  case isSigned(x.Kind()):
+    result.SetInt(x.Int() >> count)
+  case op == token.SHL:
+    result.SetUint(x.Uint() << count)
+  default:
+    result.SetUint(x.Uint() >> count)
+  }
+  return result
+}
+
+// equal compares two values for == and !=. Untyped nil equals the nil
+// value of a pointer, interface, slice, map, or function.
+func (in *interpreter) equal(node ast.Node, x, y reflect.Value) bool {
+  if !x.IsValid() && !y.IsValid() {
+    return true
+  }
+  if !x.IsValid() || !y.IsValid() {
+    if !x.IsValid() {
+      x = y
+    }
+    switch x.Kind() {
+    case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map,
+        reflect.Func, reflect.Chan, reflect.UnsafePointer:
+      return x.IsNil()
+    }
+    panic(in.errorAt(node, "cannot compare %s with nil", x.Type()))
+  }
+  x, y = in.unify(node, x, y)
+  return x.Interface() == y.Interface()
+}
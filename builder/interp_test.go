@@ -0,0 +1,238 @@
+package builder
+
+import (
+  "os"
+  "strings"
+  "context"
+  "testing"
+  "go/token"
+  "go/parser"
+  "path/filepath"
+  "net/http/httptest"
+)
+
+// previewImports are the imports of the code that the tests interpret.
+// Unused imports are allowed, since the interpreter does not check them.
+const previewImports = `package main
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "time"
+  "errors"
+  "strings"
+  "strconv"
+  "net/http"
+)
+
+`
+
+// interpret runs a handler with the given body, after the given top-level
+// declarations, and returns what it wrote, or the error that stopped it.
+func interpret(t *testing.T, decls, body string) (string, *previewError) {
+  t.Helper()
+  code := previewImports + decls + "\n\nfunc Handler(w http.ResponseWriter, " +
+      "r *http.Request) {\n" + body + "\n}\n"
+  fileSet := token.NewFileSet()
+  file, err := parser.ParseFile(fileSet, "page.go", code, 0)
+  if err != nil {
+    t.Fatalf("%s\n%s", err.Error(), code)
+  }
+  in := &interpreter{ fileSet: fileSet, ctx: context.Background(),
+      imports: map[string]string{}, globals: newScope(nil) }
+  recorder := httptest.NewRecorder()
+  failure := in.run(file, recorder, httptest.NewRequest("GET", "/", nil))
+  return recorder.Body.String(), failure
+}
+
+// previewCase is code that a preview runs, with the output it must write.
+type previewCase struct {
+  name, decls, body, want string
+}
+
+// runPreviewCases interprets each case and checks its output.
+func runPreviewCases(t *testing.T, cases []previewCase) {
+  t.Helper()
+  for _, c := range cases {
+    output, failure := interpret(t, c.decls, c.body)
+    if failure != nil {
+      t.Errorf("%s: %s", c.name, failure.message)
+    } else if output != c.want {
+      t.Errorf("%s: wrote %q, want %q", c.name, output, c.want)
+    }
+  }
+}
+
+// TestPreviewExpressions checks the operators, literals, conversions, and
+// builtins of the interpreter.
+func TestPreviewExpressions(t *testing.T) {
+  runPreviewCases(t, []previewCase{
+    { "arithmetic", "", `fmt.Fprint(w, 1+2*3, 7/2, 7%3, -7>>1, 1<<4)`,
+        "7 3 1 -4 16" },
+    { "floats", "", `fmt.Fprint(w, 1.5*2, 7/2.0, float64(3)/2)`,
+        "3 3.5 1.5" },
+    { "mixed", "",
+        `n := 3; fmt.Fprint(w, n*2.0, time.Duration(n)*time.Second)`,
+        "6 3s" },
+    { "comparison", "",
+        `fmt.Fprint(w, 1 < 2 && "a" != "b", !true || 2 >= 3, "ab" < "b")`,
+        "true false true" },
+    { "strings", "",
+        `s := "héllo"; s += "!"; ` +
+        `fmt.Fprint(w, len(s), s[1:3], string(s[0]), string(rune(233)), ` +
+        `[]byte(s)[0])`,
+        "7éhé104" },
+    { "constants", "const (\n  a = iota * 10\n  b\n  c\n)\nconst name = \"x\"",
+        `fmt.Fprint(w, a, b, c, name)`, "0 10 20x" },
+    { "slices", "",
+        `xs := []int{3, 1, 2}; xs = append(xs, 0); sort.Ints(xs); ` +
+        `ys := make([]int, 2, 5); copy(ys, xs[2:]); ` +
+        `fmt.Fprint(w, xs, ys, len(ys), cap(ys), xs[1:3])`,
+        "[0 1 2 3] [2 3] 2 5 [1 2]" },
+    { "maps", "",
+        `m := map[string]int{"a": 1}; m["b"] += 2; v, ok := m["c"]; ` +
+        `delete(m, "a"); fmt.Fprint(w, len(m), m["b"], v, ok)`,
+        "1 2 0 false" },
+    { "structs", "type point struct {\n  X, Y int\n  Label string\n}",
+        `p := point{X: 1}; q := &p; q.Y = 2; ps := []point{{3, 4, "c"}}; ` +
+        `fmt.Fprintf(w, "%d %d %+v", p.X, p.Y, ps[0])`,
+        "1 2 {X:3 Y:4 Label:c}" },
+    { "pointers", "", `n := new(int); *n = 4; m := n; *m++; fmt.Fprint(w, *n)`,
+        "5" },
+    { "interfaces", "",
+        `var x interface{} = 3; n, ok := x.(int); _, bad := x.(string); ` +
+        `fmt.Fprint(w, n, ok, bad)`, "3 true false" },
+  })
+}
+
+// TestPreviewStatements checks control flow, closures, and function
+// declarations.
+func TestPreviewStatements(t *testing.T) {
+  runPreviewCases(t, []previewCase{
+    { "for", "",
+        `sum := 0; for i := 0; i < 10; i++ { if i%2 == 0 { continue }; ` +
+        `if i > 7 { break }; sum += i }; fmt.Fprint(w, sum)`, "16" },
+    { "labels", "",
+        "n := 0\nouter:\nfor i := 0; i < 3; i++ {\n  for j := 0; j < 3; " +
+        "j++ {\n    if j == 2 { continue outer }\n    if i == 2 { break " +
+        "outer }\n    n++\n  }\n}\nfmt.Fprint(w, n)", "4" },
+    { "range", "",
+        `for i, r := range "aé" { fmt.Fprint(w, i, string(r), " ") }; ` +
+        `m := map[string]int{"x": 1, "y": 2}; keys := []string{}; ` +
+        `for k := range m { keys = append(keys, k) }; sort.Strings(keys); ` +
+        `for i := range 2 { fmt.Fprint(w, i) }; fmt.Fprint(w, keys)`,
+        "0a 1é 01[x y]" },
+    { "switch", "",
+        `for _, n := range []int{1, 2, 5} { switch { case n < 2: ` +
+        `fmt.Fprint(w, "low "); fallthrough; case n < 3: ` +
+        `fmt.Fprint(w, "mid "); default: fmt.Fprint(w, "high ") } }`,
+        "low mid mid high " },
+    { "type switch", "",
+        `for _, x := range []interface{}{1, "a", nil, 2.5} { ` +
+        `switch v := x.(type) { case int: fmt.Fprint(w, "int", v); ` +
+        `case string, float64: fmt.Fprint(w, "other"); ` +
+        `case nil: fmt.Fprint(w, "nil") } }`, "int1othernilother" },
+    { "closures", "",
+        `n := 0; inc := func() int { n++; return n }; inc(); ` +
+        `fmt.Fprint(w, inc(), n)`, "2 2" },
+    { "functions",
+        "func divide(a, b int) (q, r int) {\n  q = a / b\n  r = a % b\n" +
+        "  return\n}\n\nfunc sum(xs ...int) int {\n  t := 0\n  for _, x := " +
+        "range xs {\n    t += x\n  }\n  return t\n}",
+        `q, rem := divide(7, 2); fmt.Fprint(w, q, rem, sum(), sum(1, 2), ` +
+        `sum([]int{3, 4}...))`, "3 1 0 3 7" },
+    { "recursion", "func fib(n int) int {\n  if n < 2 {\n    return n\n" +
+        "  }\n  return fib(n-1) + fib(n-2)\n}", `fmt.Fprint(w, fib(15))`,
+        "610" },
+    { "defer", "", `defer fmt.Fprint(w, "a"); defer fmt.Fprint(w, "b"); ` +
+        `fmt.Fprint(w, "c")`, "cba" },
+    { "recover",
+        "func safe(xs []int, i int) (v int, err error) {\n  defer func() " +
+        "{\n    if r := recover(); r != nil {\n      err = fmt.Errorf(" +
+        "\"recovered\")\n    }\n  }()\n  return xs[i], nil\n}",
+        `_, err := safe([]int{1}, 3); v, _ := safe([]int{1}, 0); ` +
+        `fmt.Fprint(w, err, v)`, "recovered 1" },
+    { "init", "var greeting string\n\nfunc init() {\n  greeting = \"hi\"\n}",
+        `fmt.Fprint(w, greeting)`, "hi" },
+  })
+}
+
+// TestPreviewLibrary checks calls into the packages that previews allow.
+func TestPreviewLibrary(t *testing.T) {
+  runPreviewCases(t, []previewCase{
+    { "strings", "", `fmt.Fprint(w, strings.ToUpper("a"), ` +
+        `strings.Join(strings.Split("a,b", ","), "+"), ` +
+        `strings.Repeat("-", 3))`, "Aa+b---" },
+    { "strconv", "", `n, err := strconv.Atoi("12"); _, bad := ` +
+        `strconv.Atoi("x"); fmt.Fprint(w, n+1, err, bad != nil, ` +
+        `strconv.Itoa(5))`, "13 <nil> true5" },
+    { "errors", "", `e := errors.New("x"); w2 := fmt.Errorf("y: %w", e); ` +
+        `fmt.Fprint(w, errors.Is(w2, e), w2)`, "true y: x" },
+    { "types", "", `var b strings.Builder; b.WriteString("ok"); ` +
+        `d := 90 * time.Minute; fmt.Fprint(w, b.String(), d)`, "ok1h30m0s" },
+    { "request", "", `w.Header().Set("X-Page", r.URL.Path); ` +
+        `fmt.Fprint(w, r.Method, w.Header().Get("X-Page"))`, "GET/" },
+  })
+}
+
+// TestPreviewRejects checks that code that previews cannot run stops the
+// preview with an error rather than running wrongly.
+func TestPreviewRejects(t *testing.T) {
+  cases := []struct {
+    name, decls, body, message string
+  }{
+    { "goroutine", "", `go fmt.Sprint()`, "a go statement cannot be " +
+        "previewed" },
+    { "channel", "", `ch := make(chan int); _ = ch`, "a channel" },
+    { "method", "type t int\n\nfunc (t) m() {}", ``, "a method" },
+    { "generic", "func id[T any](x T) T {\n  return x\n}", ``,
+        "a generic function" },
+    { "package", "", `os.Exit(1)`, "os.Exit is not available in previews" },
+    { "function", "", `strings.NewReader("x")`, "not available" },
+    { "undefined", "", `fmt.Fprint(w, missing)`, "undefined: missing" },
+    { "goto", "", "goto end\nend:", "goto" },
+    { "panic", "", `panic("boom")`, "panic: boom" },
+    { "arguments", "func f(a int) {}", `f(1, 2)`, "takes 1 arguments" },
+  }
+  for _, c := range cases {
+    _, failure := interpret(t, c.decls, c.body)
+    if failure == nil {
+      t.Errorf("%s: no error", c.name)
+    } else if !strings.Contains(failure.message, c.message) {
+      t.Errorf("%s: error %q, want %q", c.name, failure.message, c.message)
+    }
+  }
+}
+
+// TestPreviewErrorLine checks that an error of a preview is placed at the
+// line of the template, not of the generated code.
+func TestPreviewErrorLine(t *testing.T) {
+  savedRoot, savedName := siteRoot, binaryName
+  savedNameTemplate := binaryNameTemplate
+  defer func() {
+    siteRoot, binaryName = savedRoot, savedName
+    binaryNameTemplate = savedNameTemplate
+  }()
+  siteRoot, binaryName = t.TempDir(), defaultBinaryName
+  if err := parseBinaryName(); err != nil {
+    t.Fatal(err)
+  }
+  templatePath := filepath.Join(siteRoot, "page.html")
+  template := "<?code\n  package main\n\n  func main() {\n?>\n<p>Hi</p>\n" +
+      "<?code\n    n := missing\n    _ = n\n  }\n?>\n"
+  if err := os.WriteFile(templatePath, []byte(template), 0644); err != nil {
+    t.Fatal(err)
+  }
+  report := previewTemplate(httptest.NewRecorder(),
+      httptest.NewRequest("GET", "/page", nil), templatePath)
+  if report == nil || len(report.Errors) == 0 {
+    t.Fatalf("the preview did not fail")
+  }
+  e := report.Errors[0]
+  if e.File != templatePath || e.Line != 8 ||
+      !strings.Contains(e.Message, "undefined: missing") {
+    t.Errorf("error at %s:%d: %s, want %s:8", e.File, e.Line, e.Message,
+        templatePath)
+  }
+}
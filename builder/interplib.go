@@ -0,0 +1,281 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "github.com/michaellaszlo/boomerang/runtime"
+  "github.com/michaellaszlo/boomerang/runtime/helpers"
+  "fmt"
+  "html"
+  "bytes"
+  "math"
+  "sort"
+  "time"
+  "errors"
+  "reflect"
+  "strconv"
+  "strings"
+  "unicode"
+  "net/url"
+  "net/http"
+  "unicode/utf8"
+)
+
+// previewPackages holds the functions, constants, and variables that
+// previews can use, by import path. A vendored runtime is looked up under
+// the usual path. Variables are addressable, so that a template can set
+// them.
+var previewPackages = map[string]map[string]reflect.Value{
+  "fmt": {
+    "Fprint": reflect.ValueOf(fmt.Fprint),
+    "Fprintf": reflect.ValueOf(fmt.Fprintf),
+    "Fprintln": reflect.ValueOf(fmt.Fprintln),
+    "Sprint": reflect.ValueOf(fmt.Sprint),
+    "Sprintf": reflect.ValueOf(fmt.Sprintf),
+    "Sprintln": reflect.ValueOf(fmt.Sprintln),
+    "Errorf": reflect.ValueOf(fmt.Errorf),
+  },
+  "strings": {
+    "Contains": reflect.ValueOf(strings.Contains),
+    "ContainsAny": reflect.ValueOf(strings.ContainsAny),
+    "ContainsRune": reflect.ValueOf(strings.ContainsRune),
+    "Count": reflect.ValueOf(strings.Count),
+    "Cut": reflect.ValueOf(strings.Cut),
+    "EqualFold": reflect.ValueOf(strings.EqualFold),
+    "Fields": reflect.ValueOf(strings.Fields),
+    "HasPrefix": reflect.ValueOf(strings.HasPrefix),
+    "HasSuffix": reflect.ValueOf(strings.HasSuffix),
+    "Index": reflect.ValueOf(strings.Index),
+    "Join": reflect.ValueOf(strings.Join),
+    "LastIndex": reflect.ValueOf(strings.LastIndex),
+    "NewReplacer": reflect.ValueOf(strings.NewReplacer),
+    "Repeat": reflect.ValueOf(strings.Repeat),
+    "Replace": reflect.ValueOf(strings.Replace),
+    "ReplaceAll": reflect.ValueOf(strings.ReplaceAll),
+    "Split": reflect.ValueOf(strings.Split),
+    "SplitN": reflect.ValueOf(strings.SplitN),
+    "ToLower": reflect.ValueOf(strings.ToLower),
+    "ToTitle": reflect.ValueOf(strings.ToTitle),
+    "ToUpper": reflect.ValueOf(strings.ToUpper),
+    "Trim": reflect.ValueOf(strings.Trim),
+    "TrimLeft": reflect.ValueOf(strings.TrimLeft),
+    "TrimPrefix": reflect.ValueOf(strings.TrimPrefix),
+    "TrimRight": reflect.ValueOf(strings.TrimRight),
+    "TrimSpace": reflect.ValueOf(strings.TrimSpace),
+    "TrimSuffix": reflect.ValueOf(strings.TrimSuffix),
+  },
+  "strconv": {
+    "Atoi": reflect.ValueOf(strconv.Atoi),
+    "FormatBool": reflect.ValueOf(strconv.FormatBool),
+    "FormatFloat": reflect.ValueOf(strconv.FormatFloat),
+    "FormatInt": reflect.ValueOf(strconv.FormatInt),
+    "Itoa": reflect.ValueOf(strconv.Itoa),
+    "ParseBool": reflect.ValueOf(strconv.ParseBool),
+    "ParseFloat": reflect.ValueOf(strconv.ParseFloat),
+    "ParseInt": reflect.ValueOf(strconv.ParseInt),
+    "Quote": reflect.ValueOf(strconv.Quote),
+  },
+  "bytes": {
+    "Contains": reflect.ValueOf(bytes.Contains),
+    "Equal": reflect.ValueOf(bytes.Equal),
+    "HasPrefix": reflect.ValueOf(bytes.HasPrefix),
+    "ReplaceAll": reflect.ValueOf(bytes.ReplaceAll),
+    "ToLower": reflect.ValueOf(bytes.ToLower),
+    "ToUpper": reflect.ValueOf(bytes.ToUpper),
+    "TrimSpace": reflect.ValueOf(bytes.TrimSpace),
+  },
+  "html": {
+    "EscapeString": reflect.ValueOf(html.EscapeString),
+    "UnescapeString": reflect.ValueOf(html.UnescapeString),
+  },
+  "net/url": {
+    "PathEscape": reflect.ValueOf(url.PathEscape),
+    "PathUnescape": reflect.ValueOf(url.PathUnescape),
+    "QueryEscape": reflect.ValueOf(url.QueryEscape),
+    "QueryUnescape": reflect.ValueOf(url.QueryUnescape),
+  },
+  "math": {
+    "Abs": reflect.ValueOf(math.Abs),
+    "Ceil": reflect.ValueOf(math.Ceil),
+    "Floor": reflect.ValueOf(math.Floor),
+    "Max": reflect.ValueOf(math.Max),
+    "Min": reflect.ValueOf(math.Min),
+    "Mod": reflect.ValueOf(math.Mod),
+    "Pow": reflect.ValueOf(math.Pow),
+    "Round": reflect.ValueOf(math.Round),
+    "Sqrt": reflect.ValueOf(math.Sqrt),
+    "Trunc": reflect.ValueOf(math.Trunc),
+    "Pi": reflect.ValueOf(math.Pi),
+    "MaxInt": reflect.ValueOf(math.MaxInt),
+    "MinInt": reflect.ValueOf(math.MinInt),
+  },
+  "sort": {
+    "Float64s": reflect.ValueOf(sort.Float64s),
+    "Ints": reflect.ValueOf(sort.Ints),
+    "Slice": reflect.ValueOf(sort.Slice),
+    "SliceStable": reflect.ValueOf(sort.SliceStable),
+    "Strings": reflect.ValueOf(sort.Strings),
+  },
+  "time": {
+    "Date": reflect.ValueOf(time.Date),
+    "Now": reflect.ValueOf(time.Now),
+    "Parse": reflect.ValueOf(time.Parse),
+    "ParseDuration": reflect.ValueOf(time.ParseDuration),
+    "Since": reflect.ValueOf(time.Since),
+    "Sleep": reflect.ValueOf(time.Sleep),
+    "Unix": reflect.ValueOf(time.Unix),
+    "Nanosecond": reflect.ValueOf(time.Nanosecond),
+    "Microsecond": reflect.ValueOf(time.Microsecond),
+    "Millisecond": reflect.ValueOf(time.Millisecond),
+    "Second": reflect.ValueOf(time.Second),
+    "Minute": reflect.ValueOf(time.Minute),
+    "Hour": reflect.ValueOf(time.Hour),
+    "UTC": reflect.ValueOf(time.UTC),
+    "Local": reflect.ValueOf(time.Local),
+    "DateOnly": reflect.ValueOf(time.DateOnly),
+    "DateTime": reflect.ValueOf(time.DateTime),
+    "Kitchen": reflect.ValueOf(time.Kitchen),
+    "RFC1123": reflect.ValueOf(time.RFC1123),
+    "RFC3339": reflect.ValueOf(time.RFC3339),
+  },
+  "unicode": {
+    "IsDigit": reflect.ValueOf(unicode.IsDigit),
+    "IsLetter": reflect.ValueOf(unicode.IsLetter),
+    "IsLower": reflect.ValueOf(unicode.IsLower),
+    "IsSpace": reflect.ValueOf(unicode.IsSpace),
+    "IsUpper": reflect.ValueOf(unicode.IsUpper),
+    "ToLower": reflect.ValueOf(unicode.ToLower),
+    "ToUpper": reflect.ValueOf(unicode.ToUpper),
+  },
+  "unicode/utf8": {
+    "RuneCountInString": reflect.ValueOf(utf8.RuneCountInString),
+    "ValidString": reflect.ValueOf(utf8.ValidString),
+  },
+  "errors": {
+    "Is": reflect.ValueOf(errors.Is),
+    "New": reflect.ValueOf(errors.New),
+  },
+  "net/http": {
+    "MethodGet": reflect.ValueOf(http.MethodGet),
+    "MethodPost": reflect.ValueOf(http.MethodPost),
+    "StatusOK": reflect.ValueOf(http.StatusOK),
+    "StatusMovedPermanently": reflect.ValueOf(http.StatusMovedPermanently),
+    "StatusFound": reflect.ValueOf(http.StatusFound),
+    "StatusSeeOther": reflect.ValueOf(http.StatusSeeOther),
+    "StatusBadRequest": reflect.ValueOf(http.StatusBadRequest),
+    "StatusForbidden": reflect.ValueOf(http.StatusForbidden),
+    "StatusNotFound": reflect.ValueOf(http.StatusNotFound),
+    "StatusInternalServerError":
+        reflect.ValueOf(http.StatusInternalServerError),
+    "StatusText": reflect.ValueOf(http.StatusText),
+    "SameSiteDefaultMode": reflect.ValueOf(http.SameSiteDefaultMode),
+    "SameSiteLaxMode": reflect.ValueOf(http.SameSiteLaxMode),
+    "SameSiteStrictMode": reflect.ValueOf(http.SameSiteStrictMode),
+    "SameSiteNoneMode": reflect.ValueOf(http.SameSiteNoneMode),
+  },
+  apptemplate.RuntimePath: {
+    "Asset": reflect.ValueOf(runtime.Asset),
+    "AssetURL": reflect.ValueOf(runtime.AssetURL),
+    "CheckPassword": reflect.ValueOf(runtime.CheckPassword),
+    "Current": reflect.ValueOf(runtime.Current),
+    "Deadline": reflect.ValueOf(runtime.Deadline),
+    "EscapeAttr": reflect.ValueOf(runtime.EscapeAttr),
+    "EscapeHTML": reflect.ValueOf(runtime.EscapeHTML),
+    "EscapeJS": reflect.ValueOf(runtime.EscapeJS),
+    "EscapeURL": reflect.ValueOf(runtime.EscapeURL),
+    "NewContext": reflect.ValueOf(runtime.NewContext),
+    "RegisterFilter": reflect.ValueOf(runtime.RegisterFilter),
+    "TempDir": reflect.ValueOf(runtime.TempDir),
+    "Truth": reflect.ValueOf(runtime.Truth),
+    "AutoOutput": reflect.ValueOf(runtime.AutoOutput),
+    "CGIOutput": reflect.ValueOf(runtime.CGIOutput),
+    "NPHOutput": reflect.ValueOf(runtime.NPHOutput),
+    "CSRFCookie": reflect.ValueOf(runtime.CSRFCookie),
+    "CSRFField": reflect.ValueOf(runtime.CSRFField),
+    "CSRFHeader": reflect.ValueOf(runtime.CSRFHeader),
+    "DefaultLocale": reflect.ValueOf(&runtime.DefaultLocale).Elem(),
+    "TrustForwarded": reflect.ValueOf(&runtime.TrustForwarded).Elem(),
+    "RequestIDHeader": reflect.ValueOf(&runtime.RequestIDHeader).Elem(),
+    "PageParam": reflect.ValueOf(&runtime.PageParam).Elem(),
+    "PaginationTemplate":
+        reflect.ValueOf(&runtime.PaginationTemplate).Elem(),
+    "MaxUploadSize": reflect.ValueOf(&runtime.MaxUploadSize).Elem(),
+    "UploadMemory": reflect.ValueOf(&runtime.UploadMemory).Elem(),
+    "ErrCSRF": reflect.ValueOf(&runtime.ErrCSRF).Elem(),
+    "ErrForbidden": reflect.ValueOf(&runtime.ErrForbidden).Elem(),
+    "ErrNotWritable": reflect.ValueOf(&runtime.ErrNotWritable).Elem(),
+    "DefaultSecurityPolicy":
+        reflect.ValueOf(&runtime.DefaultSecurityPolicy).Elem(),
+  },
+  apptemplate.HelpersPath: {
+    "Ago": reflect.ValueOf(helpers.Ago),
+    "Currency": reflect.ValueOf(helpers.Currency),
+    "Date": reflect.ValueOf(helpers.Date),
+    "Nl2br": reflect.ValueOf(helpers.Nl2br),
+    "Number": reflect.ValueOf(helpers.Number),
+    "Plural": reflect.ValueOf(helpers.Plural),
+    "Slugify": reflect.ValueOf(helpers.Slugify),
+    "Truncate": reflect.ValueOf(helpers.Truncate),
+  },
+}
+
+// previewTypes holds the types that previews can name, by import path.
+var previewTypes = map[string]map[string]reflect.Type{
+  "bytes": {
+    "Buffer": reflect.TypeOf(bytes.Buffer{}),
+  },
+  "strings": {
+    "Builder": reflect.TypeOf(strings.Builder{}),
+  },
+  "time": {
+    "Duration": reflect.TypeOf(time.Duration(0)),
+    "Month": reflect.TypeOf(time.Month(0)),
+    "Time": reflect.TypeOf(time.Time{}),
+  },
+  "net/http": {
+    "Cookie": reflect.TypeOf(http.Cookie{}),
+    "Header": reflect.TypeOf(http.Header{}),
+    "SameSite": reflect.TypeOf(http.SameSiteDefaultMode),
+    "Request": reflect.TypeOf(http.Request{}),
+    "ResponseWriter": reflect.TypeOf((*http.ResponseWriter)(nil)).Elem(),
+  },
+  apptemplate.RuntimePath: {
+    "AuthError": reflect.TypeOf(runtime.AuthError{}),
+    "Authorizer": reflect.TypeOf((*runtime.Authorizer)(nil)).Elem(),
+    "AuthorizerFunc": reflect.TypeOf(runtime.AuthorizerFunc(nil)),
+    "BasicAuth": reflect.TypeOf(runtime.BasicAuth{}),
+    "Context": reflect.TypeOf(runtime.Context{}),
+    "CookieOptions": reflect.TypeOf(runtime.CookieOptions{}),
+    "Feed": reflect.TypeOf(runtime.Feed{}),
+    "FeedItem": reflect.TypeOf(runtime.FeedItem{}),
+    "Filter": reflect.TypeOf(runtime.Filter(nil)),
+    "OutputMode": reflect.TypeOf(runtime.AutoOutput),
+    "PageLink": reflect.TypeOf(runtime.PageLink{}),
+    "PageRequest": reflect.TypeOf(runtime.PageRequest{}),
+    "Paginator": reflect.TypeOf(runtime.Paginator{}),
+    "SafeHTML": reflect.TypeOf(runtime.SafeHTML("")),
+    "SecurityPolicy": reflect.TypeOf(runtime.SecurityPolicy{}),
+    "Upload": reflect.TypeOf(runtime.Upload{}),
+  },
+}
+
+// basicTypes are the predeclared types that previews can name.
+var basicTypes = map[string]reflect.Type{
+  "bool": reflect.TypeOf(false),
+  "string": reflect.TypeOf(""),
+  "int": reflect.TypeOf(0),
+  "int8": reflect.TypeOf(int8(0)),
+  "int16": reflect.TypeOf(int16(0)),
+  "int32": reflect.TypeOf(int32(0)),
+  "rune": reflect.TypeOf(rune(0)),
+  "int64": reflect.TypeOf(int64(0)),
+  "uint": reflect.TypeOf(uint(0)),
+  "uint8": reflect.TypeOf(uint8(0)),
+  "byte": reflect.TypeOf(byte(0)),
+  "uint16": reflect.TypeOf(uint16(0)),
+  "uint32": reflect.TypeOf(uint32(0)),
+  "uint64": reflect.TypeOf(uint64(0)),
+  "float32": reflect.TypeOf(float32(0)),
+  "float64": reflect.TypeOf(float64(0)),
+  "error": reflect.TypeOf((*error)(nil)).Elem(),
+  "any": reflect.TypeOf((*interface{})(nil)).Elem(),
+}
@@ -0,0 +1,49 @@
+package builder
+
+import (
+  "os"
+  "context"
+  "syscall"
+  "os/signal"
+)
+
+// interruptedStatus is the exit code of a command that was interrupted,
+// by the shell's convention of 128 plus the signal number of SIGINT.
+const interruptedStatus = 130
+
+// interruptContext returns a context that is canceled when buildapp
+// receives SIGINT or SIGTERM. The template being built is then abandoned
+// and its partial outputs are removed. After the first signal, the default
+// behavior is restored, so that a second one stops buildapp at once.
+func interruptContext() (context.Context, context.CancelFunc) {
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt,
+      syscall.SIGTERM)
+  go func() {
+    <-ctx.Done()
+    stop()
+  }()
+  return ctx, stop
+}
+
+// removePartialOutputs deletes the files that an interrupted build of a
+// template generated: the .go file, the files that embed its assets, and
+// its source map.
+// A binary from an earlier build is left in place.
+func removePartialOutputs(goCodePath string, log *templateLog) {
+  if buildPhase == "compile" {
+    return  // The .go files were not made by this build.
+  }
+  err := os.Remove(goCodePath)
+  if err == nil {
+    log.inform("removed %s\n", goCodePath)
+  }
+  if err == nil || os.IsNotExist(err) {
+    err = removeEmbedding(goCodePath)
+  }
+  if err == nil {
+    err = removeSourceMap(goCodePath)
+  }
+  if err != nil {
+    log.errorf("%s\n", err.Error())
+  }
+}
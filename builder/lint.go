@@ -0,0 +1,546 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "io"
+  "fmt"
+  "sort"
+  "bufio"
+  "bytes"
+  "errors"
+  "regexp"
+  "strings"
+  "strconv"
+  "io/fs"
+  "path/filepath"
+  "go/ast"
+  "go/token"
+  "go/parser"
+)
+
+// lintCommand implements "buildapp lint", which checks templates for
+// common problems. Each template is generated in memory, and the syntax
+// tree of the generated code is inspected, with findings traced back to
+// template lines through the source map. Every rule has a severity of
+// error, warning, or off, set with -severity or the lint section of the
+// configuration. The exit code is 1 if there is any finding of error
+// severity.
+func lintCommand(args []string) int {
+  flags := newFlagSet("lint")
+  addSelectionFlags(flags)
+  var severityFlags stringList
+  flags.Var(&severityFlags, "severity",
+      "rule=level, where level is error, warning, or off (repeatable)")
+  flags.IntVar(&lintMaxStatic, "maxstatic", 0,
+      "the most bytes of static text in a row before long-static applies "+
+      "(default 8192)")
+  flags.Parse(args)
+
+  err := resolveGlobals()
+  if err == nil {
+    err = resolveLintSettings(severityFlags)
+  }
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  findings := []lintFinding{}
+  checked := 0
+  forEachTemplate(flags.Args(), true, func (path string) {
+    checked++
+    findings = append(findings, lintTemplate(path)...)
+  })
+  errorCount, warningCount := 0, 0
+  for _, finding := range findings {
+    fmt.Fprintf(os.Stdout, "%s\n", finding)
+    if finding.Severity == "error" {
+      errorCount++
+    } else {
+      warningCount++
+    }
+  }
+  inform("%d templates: %d errors, %d warnings\n", checked, errorCount,
+      warningCount)
+  if errorCount != 0 {
+    return 1
+  }
+  return 0
+}
+
+// Lint is the lint section of the configuration. Severities maps rule
+// names to error, warning, or off, and MaxStatic is the default of
+// -maxstatic.
+type Lint struct {
+  Severities map[string]string  `json:"severities,omitempty"`
+  MaxStatic int                 `json:"maxStatic,omitempty"`
+}
+
+// lintRules maps the names of the rules to their default severities.
+var lintRules = map[string]string{
+  "unknown-insert": "error",      // A tag names a file that does not exist.
+  "unreachable-insert": "warning",  // An insert comes after a return.
+  "unescaped-output": "warning",  // A variable is printed without escaping.
+  "missing-printcgi": "error",    // PrintCGI does not run on every path.
+  "mixed-indent": "warning",      // Code mixes tabs and spaces.
+  "long-static": "warning",       // Static text runs too long in a row.
+}
+
+// lintSeverities holds the severity of each rule after the configuration
+// and -severity flags are applied.
+var lintSeverities map[string]string
+
+// lintMaxStatic is set by -maxstatic or the maxStatic setting of the lint
+// section.
+var lintMaxStatic int
+
+// resolveLintSettings works out the severity of each rule and the limit
+// of long-static, checking the names of rules and levels.
+func resolveLintSettings(severityFlags []string) error {
+  lintSeverities = map[string]string{}
+  for rule, severity := range lintRules {
+    lintSeverities[rule] = severity
+  }
+  settings := []string{}
+  for rule, severity := range config.Lint.Severities {
+    settings = append(settings, rule+"="+severity)
+  }
+  sort.Strings(settings)
+  for _, setting := range append(settings, severityFlags...) {
+    for _, pair := range strings.Split(setting, ",") {
+      rule, severity, found := strings.Cut(strings.TrimSpace(pair), "=")
+      if _, known := lintRules[rule]; !found || !known {
+        return fmt.Errorf("unknown lint rule in %q", pair)
+      }
+      if severity != "error" && severity != "warning" && severity != "off" {
+        return fmt.Errorf("lint severity of %s must be error, warning, or "+
+            "off, not %q", rule, severity)
+      }
+      lintSeverities[rule] = severity
+    }
+  }
+  if lintMaxStatic == 0 {
+    lintMaxStatic = config.Lint.MaxStatic
+  }
+  if lintMaxStatic == 0 {
+    lintMaxStatic = 8192
+  }
+  return nil
+}
+
+// lintFinding is a problem found in a template.
+type lintFinding struct {
+  Path string
+  Line int
+  Rule, Severity, Message string
+}
+
+// String formats a finding as path:line: severity: message [rule].
+func (f lintFinding) String() string {
+  position := sitePath(f.Path)
+  if f.Line != 0 {
+    position += ":" + strconv.Itoa(f.Line)
+  }
+  return fmt.Sprintf("%s: %s: %s [%s]", position, f.Severity, f.Message,
+      f.Rule)
+}
+
+// linter collects the findings about one template.
+type linter struct {
+  findings []lintFinding
+  seen map[string]bool  // Findings already made, so as not to repeat them.
+}
+
+// report adds a finding unless its rule is off or it was made before.
+func (l *linter) report(rule, path string, line int, format string,
+    a ...interface{}) {
+  severity := lintSeverities[rule]
+  if severity == "off" {
+    return
+  }
+  finding := lintFinding{ path, line, rule, severity,
+      fmt.Sprintf(format, a...) }
+  if key := finding.String(); !l.seen[key] {
+    l.seen[key] = true
+    l.findings = append(l.findings, finding)
+  }
+}
+
+// lintTemplate generates a template in memory and checks it.
+func lintTemplate(path string) []lintFinding {
+  l := &linter{ seen: map[string]bool{} }
+  absPath, _ := filepath.Abs(path)
+  var code bytes.Buffer
+  writer := bufio.NewWriter(&code)
+  options := templateOptions(globalLog)
+  options.Errors = io.Discard  // Failures become findings.
+  result, err := apptemplate.Process(siteRoot, path, writer, options)
+  writer.Flush()
+  if err != nil {
+    var templateError *apptemplate.Error
+    switch {
+    case errors.Is(err, fs.ErrNotExist) && errors.As(err, &templateError):
+      l.report("unknown-insert", templateError.Path, templateError.Line,
+          "%s", templateError.Err)
+    case errors.As(err, &templateError):
+      l.findings = append(l.findings, lintFinding{ templateError.Path,
+          templateError.Line, "parse", "error", templateError.Err.Error() })
+    default:
+      l.findings = append(l.findings, lintFinding{ absPath, 0, "parse",
+          "error", err.Error() })
+    }
+    return l.findings
+  }
+  for _, templatePath := range result.Templates {
+    l.checkIndentation(templatePath)
+  }
+  fileSet := token.NewFileSet()
+  file, err := parser.ParseFile(fileSet, "generated", code.Bytes(), 0)
+  if err != nil {
+    l.findings = append(l.findings, lintFinding{ absPath, 0, "parse",
+        "error", err.Error() })
+    return l.findings
+  }
+  // position traces a node of the generated code to a template line.
+  position := func(pos token.Pos) (apptemplate.Position, bool) {
+    return result.SourceMap.Lookup(fileSet.Position(pos).Line)
+  }
+  for _, decl := range file.Decls {
+    funcDecl, ok := decl.(*ast.FuncDecl)
+    if !ok || funcDecl.Body == nil || funcDecl.Recv != nil {
+      continue
+    }
+    if funcDecl.Name.Name == "main" {
+      l.checkPrintCGI(funcDecl, position)
+    }
+    l.checkOutput(funcDecl, runtimeNames(file), position)
+    l.checkStaticLength(funcDecl, position)
+    l.checkUnreachable(funcDecl, result, position)
+  }
+  return l.findings
+}
+
+// codeSection matches the code sections of a template.
+var codeSection = regexp.MustCompile(`(?s)<\?code(.*?)\?>`)
+
+// checkIndentation reports code sections that indent some lines with tabs
+// and others with spaces, or mix the two in one indentation.
+func (l *linter) checkIndentation(templatePath string) {
+  data, err := os.ReadFile(templatePath)
+  if err != nil {
+    return
+  }
+  text := string(data)
+  for _, match := range codeSection.FindAllStringSubmatchIndex(text, -1) {
+    firstLine := 1 + strings.Count(text[:match[2]], "\n")
+    lines := strings.Split(text[match[2]:match[3]], "\n")
+    usesTabs, usesSpaces := false, false
+    for i, line := range lines {
+      if i == 0 || strings.TrimSpace(line) == "" {
+        continue  // The first line follows the tag.
+      }
+      indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+      hasTab := strings.Contains(indent, "\t")
+      hasSpace := strings.Contains(indent, " ")
+      usesTabs, usesSpaces = usesTabs || hasTab, usesSpaces || hasSpace
+      if (hasTab && hasSpace) || (usesTabs && usesSpaces) {
+        l.report("mixed-indent", templatePath, firstLine+i,
+            "code section mixes tabs and spaces in indentation")
+        break
+      }
+    }
+  }
+}
+
+// runtimeNames returns the names by which the generated code can call the
+// runtime's output functions: the runtime context, the name of the
+// runtime's import, and fmt. A dot import of the runtime adds "".
+func runtimeNames(file *ast.File) map[string]bool {
+  names := map[string]bool{ apptemplate.ContextName: true, "fmt": true }
+  for _, importSpec := range file.Imports {
+    importPath, _ := strconv.Unquote(importSpec.Path.Value)
+    if importPath != runtimeImport {
+      continue
+    }
+    switch {
+    case importSpec.Name == nil:
+      names["runtime"] = true
+    case importSpec.Name.Name == ".":
+      names[""] = true
+    default:
+      names[importSpec.Name.Name] = true
+    }
+  }
+  return names
+}
+
+// callName returns the name of the function that a call calls and the
+// name of the package or variable it is selected from, if any.
+func callName(call *ast.CallExpr) (string, string) {
+  switch fun := call.Fun.(type) {
+  case *ast.Ident:
+    return fun.Name, ""
+  case *ast.SelectorExpr:
+    if x, ok := fun.X.(*ast.Ident); ok {
+      return fun.Sel.Name, x.Name
+    }
+    return fun.Sel.Name, "?"
+  }
+  return "", "?"
+}
+
+// unescapedCalls are the output functions that write their arguments as
+// they are.
+var unescapedCalls = map[string]bool{
+  "Print": true, "Println": true, "Printf": true, "WriteString": true,
+}
+
+// safeCalls are functions whose results can be written without escaping:
+// escaping functions, and functions that return markup or plain numbers.
+var safeCalls = map[string]bool{
+  "EscapeHTML": true, "EscapeAttr": true, "EscapeJS": true,
+  "EscapeURL": true, "SafeHTML": true, "AssetURL": true, "CSRFInput": true,
+  "CSRFToken": true, "EndCapture": true, "T": true, "Itoa": true,
+  "FormatInt": true, "FormatFloat": true, "FormatBool": true,
+  "EscapeString": true, "HTMLEscapeString": true, "QueryEscape": true,
+  "PathEscape": true,
+}
+
+// checkOutput reports calls of output functions that write values other
+// than constants and the results of escaping functions.
+func (l *linter) checkOutput(funcDecl *ast.FuncDecl, names map[string]bool,
+    position func(token.Pos) (apptemplate.Position, bool)) {
+  ast.Inspect(funcDecl.Body, func (node ast.Node) bool {
+    call, ok := node.(*ast.CallExpr)
+    if !ok {
+      return true
+    }
+    name, from := callName(call)
+    if !unescapedCalls[name] || !names[from] {
+      return true
+    }
+    args := call.Args
+    if name == "Printf" && len(args) != 0 {
+      args = args[1:]  // The format is written, but it is the author's.
+    }
+    for _, arg := range args {
+      if safeOutput(arg) {
+        continue
+      }
+      if pos, ok := position(arg.Pos()); ok {
+        l.report("unescaped-output", pos.Path, pos.Line,
+            "%s writes a value without escaping; use PrintEscaped or an "+
+            "Escape function", name)
+      }
+      break
+    }
+    return true
+  })
+}
+
+// safeOutput reports whether an expression is a constant or the result of
+// a function whose output needs no escaping.
+func safeOutput(expr ast.Expr) bool {
+  switch e := expr.(type) {
+  case *ast.BasicLit:
+    return true
+  case *ast.ParenExpr:
+    return safeOutput(e.X)
+  case *ast.BinaryExpr:
+    return safeOutput(e.X) && safeOutput(e.Y)
+  case *ast.CallExpr:
+    name, _ := callName(e)
+    return safeCalls[name]
+  }
+  return false
+}
+
+// checkStaticLength reports runs of static text longer than
+// lintMaxStatic at the longest line of the run. Static text is written by
+// consecutive calls of the context's WriteString with literals, and one
+// literal can hold the text of several templates.
+func (l *linter) checkStaticLength(funcDecl *ast.FuncDecl,
+    position func(token.Pos) (apptemplate.Position, bool)) {
+  ast.Inspect(funcDecl.Body, func (node ast.Node) bool {
+    block, ok := node.(*ast.BlockStmt)
+    if !ok {
+      return true
+    }
+    var longest token.Pos
+    length, longestLength := 0, 0
+    flush := func() {
+      if longest.IsValid() && length > lintMaxStatic {
+        if pos, ok := position(longest); ok {
+          l.report("long-static", pos.Path, pos.Line,
+              "%d bytes of static text in a row; consider include-static "+
+              "or a static file", length)
+        }
+      }
+      longest, length, longestLength = token.NoPos, 0, 0
+    }
+    for _, stmt := range block.List {
+      literal, ok := staticLiteral(stmt)
+      if !ok {
+        flush()
+        continue
+      }
+      offset := 0
+      for _, line := range strings.SplitAfter(literal.Value, "\n") {
+        if len(line) > longestLength {
+          longest, longestLength = literal.Pos()+token.Pos(offset), len(line)
+        }
+        offset += len(line)
+      }
+      length += len(literal.Value)-2  // The quotes are not written.
+    }
+    flush()
+    return true
+  })
+}
+
+// staticLiteral returns the literal that a statement writes with the
+// context's WriteString, if it writes one.
+func staticLiteral(stmt ast.Stmt) (*ast.BasicLit, bool) {
+  exprStmt, ok := stmt.(*ast.ExprStmt)
+  if !ok {
+    return nil, false
+  }
+  call, ok := exprStmt.X.(*ast.CallExpr)
+  if !ok || len(call.Args) != 1 {
+    return nil, false
+  }
+  name, from := callName(call)
+  literal, ok := call.Args[0].(*ast.BasicLit)
+  if name != "WriteString" || from != apptemplate.ContextName || !ok ||
+      literal.Kind != token.STRING {
+    return nil, false
+  }
+  return literal, true
+}
+
+// checkPrintCGI reports a main function that calls PrintCGI itself, so
+// that none is added, but only in some branch, or that writes output after
+// calling it.
+func (l *linter) checkPrintCGI(funcDecl *ast.FuncDecl,
+    position func(token.Pos) (apptemplate.Position, bool)) {
+  calls := []*ast.CallExpr{}
+  ast.Inspect(funcDecl.Body, func (node ast.Node) bool {
+    if call, ok := node.(*ast.CallExpr); ok {
+      if name, _ := callName(call); name == "PrintCGI" {
+        if _, fromTemplate := position(call.Pos()); fromTemplate {
+          calls = append(calls, call)
+        }
+      }
+    }
+    return true
+  })
+  if len(calls) == 0 {
+    return  // The generator adds a deferred call.
+  }
+  for i, stmt := range funcDecl.Body.List {
+    var call ast.Expr
+    switch s := stmt.(type) {
+    case *ast.DeferStmt:
+      call = s.Call
+    case *ast.ExprStmt:
+      call = s.X
+    }
+    found := false
+    for _, printCall := range calls {
+      found = found || call == printCall
+    }
+    if !found {
+      continue
+    }
+    if _, deferred := stmt.(*ast.DeferStmt); !deferred {
+      for _, later := range funcDecl.Body.List[i+1:] {
+        if pos, ok := position(later.Pos()); ok {
+          l.report("missing-printcgi", pos.Path, pos.Line,
+              "output after PrintCGI is not sent")
+          break
+        }
+      }
+    }
+    return
+  }
+  if pos, ok := position(calls[0].Pos()); ok {
+    l.report("missing-printcgi", pos.Path, pos.Line,
+        "PrintCGI is called only in a branch, and no call is added for "+
+        "the other paths; defer it at the top of main")
+  }
+}
+
+// checkUnreachable reports inserted templates whose output follows a
+// return, a panic, or an exit in the same block.
+func (l *linter) checkUnreachable(funcDecl *ast.FuncDecl,
+    result *apptemplate.Result,
+    position func(token.Pos) (apptemplate.Position, bool)) {
+  ast.Inspect(funcDecl.Body, func (node ast.Node) bool {
+    block, ok := node.(*ast.BlockStmt)
+    if !ok {
+      return true
+    }
+    for i, stmt := range block.List {
+      if !terminates(stmt) {
+        continue
+      }
+      end, _ := position(stmt.Pos())
+      for _, later := range block.List[i+1:] {
+        pos, ok := position(later.Pos())
+        if !ok || pos.Path == end.Path {
+          continue
+        }
+        insertion, found := insertionOf(result, pos.Path, end)
+        if found {
+          l.report("unreachable-insert", insertion.Parent, insertion.Line,
+              "the insert of %s is unreachable after line %d",
+              sitePath(insertion.Child), end.Line)
+        }
+      }
+      break
+    }
+    return true
+  })
+}
+
+// terminates reports whether a statement ends the function: a return, or
+// a call of panic, os.Exit, or the runtime's Halt.
+func terminates(stmt ast.Stmt) bool {
+  switch s := stmt.(type) {
+  case *ast.ReturnStmt:
+    return true
+  case *ast.ExprStmt:
+    if call, ok := s.X.(*ast.CallExpr); ok {
+      name, from := callName(call)
+      return (name == "panic" && from == "") ||
+          (name == "Exit" && from == "os") || name == "Halt"
+    }
+  }
+  return false
+}
+
+// insertionOf finds the insertion that brought a template into the
+// template of a position, after that position, following nested inserts
+// up to it if need be.
+func insertionOf(result *apptemplate.Result, child string,
+    after apptemplate.Position) (apptemplate.Insertion, bool) {
+  for range result.Insertions {  // Each step climbs one level.
+    var parent *apptemplate.Insertion
+    for i, insertion := range result.Insertions {
+      if insertion.Child != child {
+        continue
+      }
+      if insertion.Parent == after.Path && insertion.Line >= after.Line {
+        return insertion, true
+      }
+      if parent == nil {
+        parent = &result.Insertions[i]
+      }
+    }
+    if parent == nil {
+      break
+    }
+    child = parent.Parent
+  }
+  return apptemplate.Insertion{}, false
+}
@@ -0,0 +1,101 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+  "flag"
+  "time"
+  "strings"
+  "path/filepath"
+)
+
+// lockWait is how long, set by -wait, a command waits for another run of
+// buildapp on the same site to release the site lock. With zero, it gives
+// up at once.
+var lockWait time.Duration
+
+// lockPollInterval is the time between attempts to take a held lock.
+const lockPollInterval = 200*time.Millisecond
+
+// addLockFlags registers the flags of commands that take the site lock.
+func addLockFlags(flags *flag.FlagSet) {
+  flags.DurationVar(&lockWait, "wait", 0,
+      "how long to wait for another buildapp run on the site to finish")
+}
+
+// lockSite takes an advisory lock on the file named lock in the state
+// directory, which commands that write to the site hold while they run, so
+// that overlapping runs cannot corrupt each other's outputs. The lock file
+// holds the process ID of the holder for the error message. The returned
+// function releases the lock.
+func lockSite() (func(), error) {
+  path := filepath.Join(stateDir, "lock")
+  err := os.MkdirAll(stateDir, 0755)
+  if err != nil {
+    return nil, err
+  }
+  file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+  if err != nil {
+    return nil, err
+  }
+  deadline := time.Now().Add(lockWait)
+  announced := false
+  for {
+    locked, err := tryLock(file)
+    if err != nil {
+      file.Close()
+      return nil, err
+    }
+    if locked {
+      break
+    }
+    if !time.Now().Before(deadline) {
+      file.Close()
+      return nil, fmt.Errorf("another buildapp run%s holds the lock on "+
+          "%s; use -wait to wait for it", lockHolder(path), path)
+    }
+    if !announced {
+      inform("waiting for another buildapp run%s to finish\n",
+          lockHolder(path))
+      announced = true
+    }
+    time.Sleep(lockPollInterval)
+  }
+  file.Truncate(0)
+  fmt.Fprintf(file, "%d\n", os.Getpid())
+  return func() {
+    file.Truncate(0)
+    unlock(file)
+    file.Close()
+  }, nil
+}
+
+// lockHolder describes the process that holds the lock, if it is known.
+func lockHolder(path string) string {
+  data, err := os.ReadFile(path)
+  if pid := strings.TrimSpace(string(data)); err == nil && pid != "" {
+    return " (process " + pid + ")"
+  }
+  return ""
+}
+
+// openManifestLocked is openManifest for commands that write to the site.
+// It takes the site lock before the manifest is loaded, so that the
+// manifest reflects every run that finished before, and returns the
+// function that releases the lock.
+func openManifestLocked() (func(), error) {
+  err := resolveGlobals()
+  if err != nil {
+    return nil, err
+  }
+  unlock, err := lockSite()
+  if err != nil {
+    return nil, err
+  }
+  manifest, err = loadManifest(manifestPath)
+  if err != nil {
+    unlock()
+    return nil, err
+  }
+  return unlock, nil
+}
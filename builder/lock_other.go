@@ -0,0 +1,17 @@
+//go:build !unix
+
+package builder
+
+import (
+  "os"
+)
+
+// tryLock always succeeds on systems without flock, where runs of buildapp
+// are not kept apart.
+func tryLock(file *os.File) (bool, error) {
+  return true, nil
+}
+
+// unlock releases a lock taken by tryLock.
+func unlock(file *os.File) {
+}
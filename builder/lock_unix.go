@@ -0,0 +1,24 @@
+//go:build unix
+
+package builder
+
+import (
+  "os"
+  "errors"
+  "syscall"
+)
+
+// tryLock takes an exclusive flock on a file without blocking and reports
+// whether it succeeded.
+func tryLock(file *os.File) (bool, error) {
+  err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+  if errors.Is(err, syscall.EWOULDBLOCK) {
+    return false, nil
+  }
+  return err == nil, err
+}
+
+// unlock releases a lock taken by tryLock.
+func unlock(file *os.File) {
+  syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
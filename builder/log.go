@@ -0,0 +1,140 @@
+package builder
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "strings"
+  "encoding/json"
+)
+
+// logFormat is "text" or, with -log json, "json", which prints each
+// message as a JSON object on a line of its own.
+var logFormat = "text"
+
+// prefixLogs is set when templates are built concurrently. The messages
+// about a template are then collected and printed together, with the
+// template's path as a prefix.
+var prefixLogs bool
+
+// logMutex keeps the lines of concurrent logs from interleaving.
+var logMutex sync.Mutex
+
+// Message levels. Results, errors, and warnings are printed at every
+// verbosity level.
+const (
+  resultMessage = "result"
+  errorMessage = "error"
+  warningMessage = "warning"
+  infoMessage = "info"
+  detailMessage = "detail"
+)
+
+// logLine is a line of a message.
+type logLine struct {
+  level, text string
+}
+
+// templateLog collects the messages about one template. A log is not safe
+// for concurrent use, but separate logs are.
+type templateLog struct {
+  template string      // The template, or "" for messages about the run.
+  buffered bool        // Lines are held back until flush.
+  lines []logLine
+  partial []byte       // The unfinished last line written through Write.
+}
+
+// globalLog carries the messages that do not concern a single template.
+var globalLog = &templateLog{}
+
+// newTemplateLog makes a log for a template, which is buffered if the
+// messages of several templates must be kept apart.
+func newTemplateLog(template string) *templateLog {
+  return &templateLog{ template: template, buffered: prefixLogs &&
+      logFormat == "text" }
+}
+
+// printf adds a message at a level if the verbosity level allows it.
+func (log *templateLog) printf(level, format string, a ...interface{}) {
+  switch {
+  case level == infoMessage && verbosity < normalLevel,
+      level == detailMessage && verbosity < verboseLevel:
+    return
+  }
+  message := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+  for _, text := range strings.Split(message, "\n") {
+    log.lines = append(log.lines, logLine{ level, text })
+  }
+  if !log.buffered {
+    log.flush()
+  }
+}
+
+// result adds a message that answers the user's request.
+func (log *templateLog) result(format string, a ...interface{}) {
+  log.printf(resultMessage, format, a...)
+}
+
+// errorf adds an error message.
+func (log *templateLog) errorf(format string, a ...interface{}) {
+  log.printf(errorMessage, format, a...)
+}
+
+// warnf adds a warning about a problem that did not stop the build.
+func (log *templateLog) warnf(format string, a ...interface{}) {
+  log.printf(warningMessage, "warning: "+format, a...)
+}
+
+// inform adds a message unless the verbosity level is quiet.
+func (log *templateLog) inform(format string, a ...interface{}) {
+  log.printf(infoMessage, format, a...)
+}
+
+// detail adds a message at the verbose level.
+func (log *templateLog) detail(format string, a ...interface{}) {
+  log.printf(detailMessage, format, a...)
+}
+
+// Write implements io.Writer so that the output of other code, such as
+// the template parser and hook commands, goes into the log as errors.
+func (log *templateLog) Write(p []byte) (int, error) {
+  log.partial = append(log.partial, p...)
+  if end := strings.LastIndex(string(log.partial), "\n"); end != -1 {
+    log.errorf("%s", log.partial[:end])
+    log.partial = log.partial[end+1:]
+  }
+  return len(p), nil
+}
+
+// finish prints whatever remains in the log, including an unfinished line
+// written through Write.
+func (log *templateLog) finish() {
+  if len(log.partial) != 0 {
+    log.lines = append(log.lines, logLine{ errorMessage, string(log.partial) })
+    log.partial = nil
+  }
+  log.flush()
+}
+
+// flush prints the lines collected so far in one piece.
+func (log *templateLog) flush() {
+  logMutex.Lock()
+  defer logMutex.Unlock()
+  for _, line := range log.lines {
+    if logFormat == "json" {
+      data, _ := json.Marshal(struct {
+        Time string      `json:"time"`
+        Level string     `json:"level"`
+        Template string  `json:"template,omitempty"`
+        Message string   `json:"message"`
+      }{ time.Now().UTC().Format(time.RFC3339Nano), line.level, log.template,
+          line.text })
+      fmt.Fprintf(messageFile, "%s\n", data)
+    } else if prefixLogs && log.template != "" {
+      fmt.Fprintf(messageFile, "[%s] %s\n", log.template, line.text)
+    } else {
+      fmt.Fprintf(messageFile, "%s\n", line.text)
+    }
+  }
+  log.lines = nil
+}
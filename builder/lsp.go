@@ -0,0 +1,434 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "io"
+  "os"
+  "fmt"
+  "flag"
+  "bufio"
+  "errors"
+  "regexp"
+  "strings"
+  "strconv"
+  "net/url"
+  "unicode/utf16"
+  "unicode/utf8"
+  "path/filepath"
+  "encoding/json"
+)
+
+// lspCommand implements "buildapp lsp", a language server for templates
+// that editors run with the Language Server Protocol on stdin and stdout.
+// It reports the errors and warnings of the template parser as the text
+// changes, goes to the files named by insert, asset, and similar tags,
+// completes and describes the functions of the runtime in code sections,
+// and describes tags. The site root is -root if it is given, or else the
+// root of the editor's workspace. The build flags that affect parsing,
+// such as -env and -tags, apply.
+func lspCommand(args []string) int {
+  flags := newFlagSet("lsp")
+  addBuildFlags(flags)
+  flags.Parse(args)
+  rootGiven := false
+  flags.Visit(func (f *flag.Flag) {
+    rootGiven = rootGiven || f.Name == "root"
+  })
+  server := &lspServer{ in: bufio.NewReader(os.Stdin), out: os.Stdout,
+      documents: map[string]string{}, rootGiven: rootGiven }
+  return server.run()
+}
+
+// lspServer holds the state of a language server session.
+type lspServer struct {
+  in *bufio.Reader
+  out io.Writer
+  documents map[string]string  // The text of the open documents by URI.
+  rootGiven bool               // The site root was given with -root.
+  shutdown bool                // A shutdown request has been received.
+  runtime *runtimeIndex        // Loaded when first needed.
+}
+
+// lspMessage is a JSON-RPC request or notification. Notifications have no
+// ID.
+type lspMessage struct {
+  JSONRPC string          `json:"jsonrpc"`
+  ID json.RawMessage      `json:"id"`
+  Method string           `json:"method"`
+  Params json.RawMessage  `json:"params"`
+}
+
+// lspResponse is the response to a request that succeeded. Its result may
+// be null.
+type lspResponse struct {
+  JSONRPC string       `json:"jsonrpc"`
+  ID json.RawMessage   `json:"id"`
+  Result interface{}   `json:"result"`
+}
+
+// lspErrorResponse is the response to a request that failed.
+type lspErrorResponse struct {
+  JSONRPC string       `json:"jsonrpc"`
+  ID json.RawMessage   `json:"id"`
+  Error *lspError      `json:"error"`
+}
+
+// lspError is the error of a response.
+type lspError struct {
+  Code int        `json:"code"`
+  Message string  `json:"message"`
+}
+
+// JSON-RPC error codes.
+const (
+  lspMethodNotFound = -32601
+  lspInvalidParams = -32602
+  lspRequestFailed = -32803
+)
+
+// lspPosition is a position in a document: a line and a character offset
+// in UTF-16 code units, both counted from zero.
+type lspPosition struct {
+  Line int       `json:"line"`
+  Character int  `json:"character"`
+}
+
+type lspRange struct {
+  Start lspPosition  `json:"start"`
+  End lspPosition    `json:"end"`
+}
+
+type lspLocation struct {
+  URI string       `json:"uri"`
+  Range lspRange   `json:"range"`
+}
+
+// lspDiagnostic is a problem reported in a document. Severity is 1 for
+// errors and 2 for warnings.
+type lspDiagnostic struct {
+  Range lspRange   `json:"range"`
+  Severity int     `json:"severity"`
+  Source string    `json:"source"`
+  Message string   `json:"message"`
+}
+
+// lspDocumentPosition holds the parameters of requests about a position.
+type lspDocumentPosition struct {
+  TextDocument struct { URI string `json:"uri"` }  `json:"textDocument"`
+  Position lspPosition                           `json:"position"`
+}
+
+// run reads and handles messages until the client exits or the input ends.
+// The exit code is 0 if the client asked for a shutdown first.
+func (s *lspServer) run() int {
+  for {
+    message, err := s.read()
+    if err == io.EOF {
+      return 1
+    }
+    if err != nil {
+      globalLog.errorf("lsp: %s\n", err.Error())
+      return 1
+    }
+    if message.Method == "exit" {
+      if s.shutdown {
+        return 0
+      }
+      return 1
+    }
+    result, rpcErr := s.handle(message)
+    if message.ID == nil {
+      continue  // Notifications get no response.
+    }
+    var response interface{} = lspResponse{ "2.0", message.ID, result }
+    if rpcErr != nil {
+      response = lspErrorResponse{ "2.0", message.ID, rpcErr }
+    }
+    if err := s.write(response); err != nil {
+      globalLog.errorf("lsp: %s\n", err.Error())
+      return 1
+    }
+  }
+}
+
+// read reads a message, which is preceded by a Content-Length header.
+func (s *lspServer) read() (*lspMessage, error) {
+  length := -1
+  for {
+    line, err := s.in.ReadString('\n')
+    if err != nil {
+      return nil, err
+    }
+    line = strings.TrimRight(line, "\r\n")
+    if line == "" {
+      break
+    }
+    name, value, found := strings.Cut(line, ":")
+    if found && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+      length, err = strconv.Atoi(strings.TrimSpace(value))
+      if err != nil {
+        return nil, fmt.Errorf("bad Content-Length %q", value)
+      }
+    }
+  }
+  if length < 0 {
+    return nil, errors.New("message without Content-Length")
+  }
+  body := make([]byte, length)
+  if _, err := io.ReadFull(s.in, body); err != nil {
+    return nil, err
+  }
+  message := &lspMessage{}
+  if err := json.Unmarshal(body, message); err != nil {
+    return nil, err
+  }
+  return message, nil
+}
+
+// write sends a message with its Content-Length header.
+func (s *lspServer) write(message interface{}) error {
+  body, err := json.Marshal(message)
+  if err != nil {
+    return err
+  }
+  _, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body),
+      body)
+  return err
+}
+
+// notify sends a notification to the client.
+func (s *lspServer) notify(method string, params interface{}) {
+  err := s.write(struct {
+    JSONRPC string       `json:"jsonrpc"`
+    Method string        `json:"method"`
+    Params interface{}   `json:"params"`
+  }{ "2.0", method, params })
+  if err != nil {
+    globalLog.errorf("lsp: %s\n", err.Error())
+  }
+}
+
+// handle carries out a request or notification and returns the result
+// of a request.
+func (s *lspServer) handle(message *lspMessage) (interface{}, *lspError) {
+  switch message.Method {
+  case "initialize":
+    return s.initialize(message.Params)
+  case "shutdown":
+    s.shutdown = true
+    return nil, nil
+  case "textDocument/didOpen":
+    var params struct {
+      TextDocument struct {
+        URI string   `json:"uri"`
+        Text string  `json:"text"`
+      } `json:"textDocument"`
+    }
+    if json.Unmarshal(message.Params, &params) == nil {
+      s.documents[params.TextDocument.URI] = params.TextDocument.Text
+      s.publishDiagnostics(params.TextDocument.URI)
+    }
+  case "textDocument/didChange":
+    var params struct {
+      TextDocument struct { URI string `json:"uri"` }  `json:"textDocument"`
+      ContentChanges []struct {
+        Text string  `json:"text"`
+      } `json:"contentChanges"`
+    }
+    if json.Unmarshal(message.Params, &params) == nil &&
+        len(params.ContentChanges) != 0 {
+      uri := params.TextDocument.URI
+      changes := params.ContentChanges
+      s.documents[uri] = changes[len(changes)-1].Text
+      s.publishDiagnostics(uri)
+    }
+  case "textDocument/didSave":
+    // The saved file may be inserted by other open documents.
+    for uri := range s.documents {
+      s.publishDiagnostics(uri)
+    }
+  case "textDocument/didClose":
+    var params lspDocumentPosition
+    if json.Unmarshal(message.Params, &params) == nil {
+      delete(s.documents, params.TextDocument.URI)
+      s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+        "uri": params.TextDocument.URI,
+        "diagnostics": []lspDiagnostic{},
+      })
+    }
+  case "textDocument/definition", "textDocument/hover",
+      "textDocument/completion":
+    var params lspDocumentPosition
+    if err := json.Unmarshal(message.Params, &params); err != nil {
+      return nil, &lspError{ lspInvalidParams, err.Error() }
+    }
+    text, found := s.documents[params.TextDocument.URI]
+    if !found {
+      return nil, nil
+    }
+    offset := positionOffset(text, params.Position)
+    switch message.Method {
+    case "textDocument/definition":
+      return s.definition(params.TextDocument.URI, text, offset), nil
+    case "textDocument/hover":
+      return s.hover(text, offset), nil
+    default:
+      return s.completion(text, offset), nil
+    }
+  default:
+    if message.ID != nil && !strings.HasPrefix(message.Method, "$/") {
+      return nil, &lspError{ lspMethodNotFound,
+          "unsupported method " + message.Method }
+    }
+  }
+  return nil, nil
+}
+
+// initialize takes the site root from the workspace unless -root was
+// given, resolves the settings, and describes what the server can do.
+func (s *lspServer) initialize(params json.RawMessage) (interface{},
+    *lspError) {
+  var init struct {
+    RootURI string   `json:"rootUri"`
+    RootPath string  `json:"rootPath"`
+  }
+  json.Unmarshal(params, &init)
+  if !s.rootGiven {
+    if path := uriPath(init.RootURI); path != "" {
+      siteRoot = path
+    } else if init.RootPath != "" {
+      siteRoot = init.RootPath
+    }
+  }
+  if err := resolveGlobals(); err != nil {
+    return nil, &lspError{ lspRequestFailed, err.Error() }
+  }
+  return map[string]interface{}{
+    "capabilities": map[string]interface{}{
+      "textDocumentSync": map[string]interface{}{
+        "openClose": true,
+        "change": 1,  // Full text.
+        "save": true,
+      },
+      "definitionProvider": true,
+      "hoverProvider": true,
+      "completionProvider": map[string]interface{}{
+        "triggerCharacters": []string{ ".", "?" },
+      },
+    },
+    "serverInfo": map[string]string{ "name": "boomerang" },
+  }, nil
+}
+
+// publishDiagnostics parses a document, with the text of the open
+// documents in place of their files, and sends the errors and warnings.
+// A file that is not a template, such as an inserted one, is parsed on its
+// own, so errors of its Go code are not reported, only those of its tags.
+func (s *lspServer) publishDiagnostics(uri string) {
+  path := uriPath(uri)
+  if path == "" {
+    return
+  }
+  path = filepath.Clean(path)
+  options := templateOptions(globalLog)
+  options.Errors = io.Discard
+  options.Overlay = map[string][]byte{}
+  for openURI, text := range s.documents {
+    if openPath := uriPath(openURI); openPath != "" {
+      options.Overlay[filepath.Clean(openPath)] = []byte(text)
+    }
+  }
+  writer := bufio.NewWriter(io.Discard)
+  result, err := apptemplate.Process(siteRoot, path, writer, options)
+  diagnostics := []lspDiagnostic{}
+  add := func(templateError *apptemplate.Error, severity int) {
+    line, message := 0, templateError.Err.Error()
+    if templateError.Path == path {
+      line = templateError.Line-1
+    } else {
+      message = fmt.Sprintf("%s:%d: %s", sitePath(templateError.Path),
+          templateError.Line, message)
+    }
+    if line < 0 {
+      line = 0
+    }
+    diagnostics = append(diagnostics, lspDiagnostic{
+      Range: lspRange{ lspPosition{ line, 0 }, lspPosition{ line+1, 0 } },
+      Severity: severity, Source: "boomerang", Message: message })
+  }
+  var templateError *apptemplate.Error
+  switch {
+  case err == nil:
+    for _, warning := range result.Warnings {
+      add(warning, 2)
+    }
+  case errors.As(err, &templateError):
+    add(templateError, 1)
+  case templateExtension(path) != "":
+    add(&apptemplate.Error{ Path: path, Line: 1, Err: err }, 1)
+  }
+  s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+    "uri": uri,
+    "diagnostics": diagnostics,
+  })
+}
+
+// fileTag matches the tags that name files.
+var fileTag = regexp.MustCompile(`<\?(insert-markdown|include-static|` +
+    `insert|asset|img)\s+([^\s?]+)`)
+
+// definition returns the location of the file named by the tag at an
+// offset, resolved as the parser resolves it, or nil.
+func (s *lspServer) definition(uri, text string, offset int) interface{} {
+  for _, match := range fileTag.FindAllStringSubmatchIndex(text, -1) {
+    if offset < match[0] || offset > match[5] {
+      continue
+    }
+    givenPath := text[match[4]:match[5]]
+    hardDir := filepath.Dir(uriPath(uri))
+    if strings.HasPrefix(givenPath, "/") {
+      hardDir = siteRoot
+    }
+    hardPath := filepath.Join(hardDir, givenPath)
+    if _, err := os.Stat(hardPath); err != nil {
+      return nil
+    }
+    return lspLocation{ URI: pathURI(hardPath) }
+  }
+  return nil
+}
+
+// uriPath returns the file-system path of a file URI, or "".
+func uriPath(uri string) string {
+  parsed, err := url.Parse(uri)
+  if err != nil || parsed.Scheme != "file" {
+    return ""
+  }
+  return filepath.FromSlash(parsed.Path)
+}
+
+// pathURI returns the file URI of a path.
+func pathURI(path string) string {
+  return (&url.URL{ Scheme: "file", Path: filepath.ToSlash(path) }).String()
+}
+
+// positionOffset converts a position in a document to a byte offset.
+func positionOffset(text string, position lspPosition) int {
+  offset := 0
+  for line := 0; line < position.Line; line++ {
+    newline := strings.IndexByte(text[offset:], '\n')
+    if newline == -1 {
+      return len(text)
+    }
+    offset += newline+1
+  }
+  for units := 0; units < position.Character && offset < len(text); {
+    r, size := utf8.DecodeRuneInString(text[offset:])
+    if r == '\n' {
+      break
+    }
+    units += len(utf16.Encode([]rune{ r }))
+    offset += size
+  }
+  return offset
+}
@@ -0,0 +1,293 @@
+package builder
+
+import (
+  "sort"
+  "bytes"
+  "errors"
+  "regexp"
+  "strings"
+  "go/ast"
+  "go/doc"
+  "go/token"
+  "go/parser"
+  "go/printer"
+  "path/filepath"
+)
+
+// runtimeIndex describes the exported identifiers of the runtime package
+// for completion and hover.
+type runtimeIndex struct {
+  entries map[string]*runtimeEntry
+  names []string  // The names of the entries in sorted order.
+}
+
+// runtimeEntry describes an identifier of the runtime package.
+type runtimeEntry struct {
+  name string
+  kind int           // An LSP CompletionItemKind.
+  signature string   // The declaration, without a body.
+  doc string
+}
+
+// LSP completion item kinds.
+const (
+  lspFunctionKind = 3
+  lspVariableKind = 6
+  lspClassKind = 7
+  lspKeywordKind = 14
+  lspConstantKind = 21
+)
+
+// loadRuntime returns the index of the runtime package, which is built
+// the first time it is needed. If the runtime source cannot be found, the
+// reason is logged once and the index is empty.
+func (s *lspServer) loadRuntime() *runtimeIndex {
+  if s.runtime != nil {
+    return s.runtime
+  }
+  s.runtime = &runtimeIndex{ entries: map[string]*runtimeEntry{} }
+  dir, err := runtimeSourceDir()
+  if err == nil {
+    err = s.runtime.load(dir)
+  }
+  if err != nil {
+    globalLog.errorf("lsp: runtime: %s\n", err.Error())
+  }
+  return s.runtime
+}
+
+// runtimeSourceDir returns the directory of the runtime source: the one
+// given by -runtimedir or -runtimeversion, or else the one that the module
+// of the site resolves the runtime to.
+func runtimeSourceDir() (string, error) {
+  if runtimeDir != "" || runtimeVersion != "" {
+    return runtimeSource()
+  }
+  moduleRoot = findModuleRoot(siteRoot)
+  if moduleRoot == "" {
+    return "", errors.New("the site is not in a module; give -runtimedir " +
+        "or -runtimeversion to find the runtime source")
+  }
+  output, err := runGo("list", "-f", "{{.Dir}}", runtimeImport)
+  if err != nil {
+    return "", err
+  }
+  return strings.TrimSpace(output), nil
+}
+
+// load parses the Go files of the runtime package in a directory and adds
+// its exported functions, types, variables, and constants.
+func (index *runtimeIndex) load(dir string) error {
+  names, err := filepath.Glob(filepath.Join(dir, "*.go"))
+  if err != nil {
+    return err
+  }
+  fileSet := token.NewFileSet()
+  files := []*ast.File{}
+  for _, name := range names {
+    if strings.HasSuffix(name, "_test.go") {
+      continue
+    }
+    file, err := parser.ParseFile(fileSet, name, nil, parser.ParseComments)
+    if err != nil {
+      return err
+    }
+    files = append(files, file)
+  }
+  if len(files) == 0 {
+    return errors.New("no Go files in " + dir)
+  }
+  pkg, err := doc.NewFromFiles(fileSet, files, runtimeImport)
+  if err != nil {
+    return err
+  }
+  addFunc := func(f *doc.Func) {
+    decl := *f.Decl
+    decl.Doc, decl.Body = nil, nil
+    index.add(f.Name, lspFunctionKind, printNode(fileSet, &decl), f.Doc)
+  }
+  addValues := func(values []*doc.Value, kind int, keyword string) {
+    for _, value := range values {
+      for _, name := range value.Names {
+        index.add(name, kind, keyword+" "+name, value.Doc)
+      }
+    }
+  }
+  for _, f := range pkg.Funcs {
+    addFunc(f)
+  }
+  addValues(pkg.Consts, lspConstantKind, "const")
+  addValues(pkg.Vars, lspVariableKind, "var")
+  for _, t := range pkg.Types {
+    index.add(t.Name, lspClassKind, "type "+t.Name, t.Doc)
+    for _, f := range t.Funcs {  // Constructors.
+      addFunc(f)
+    }
+    addValues(t.Consts, lspConstantKind, "const")
+    addValues(t.Vars, lspVariableKind, "var")
+  }
+  sort.Strings(index.names)
+  return nil
+}
+
+// add adds an entry unless there is one of the same name, as there is
+// when files for different systems declare the same function.
+func (index *runtimeIndex) add(name string, kind int, signature, doc string) {
+  if _, found := index.entries[name]; found || !ast.IsExported(name) {
+    return
+  }
+  index.entries[name] = &runtimeEntry{ name, kind, signature,
+      strings.TrimSpace(doc) }
+  index.names = append(index.names, name)
+}
+
+// printNode returns the source text of a declaration.
+func printNode(fileSet *token.FileSet, node interface{}) string {
+  var buffer bytes.Buffer
+  if err := printer.Fprint(&buffer, fileSet, node); err != nil {
+    return ""
+  }
+  return buffer.String()
+}
+
+// tagDocs are the hover texts of the built-in tags.
+var tagDocs = map[string]string{
+  "code": "Go code that runs in the main function of the page.",
+  "insert": "Inserts another template, parsed as part of this one.",
+  "insert-markdown": "Inserts a Markdown file, rendered as HTML when the " +
+      "page is built.",
+  "include-static": "Inserts a file as it is, without parsing it.",
+  "meta": "Declares key: value pairs that are recorded in the manifest.",
+  "asset": "Outputs the URL of a static file, fingerprinted if " +
+      "-fingerprint is set.",
+  "img": "Outputs an img element with the width and height of the image.",
+  "yield": "Marks where the output of content-for sections of a region " +
+      "is written.",
+  "content-for": "Adds the output up to <?end?> to a region.",
+  "if": "Keeps the text up to <?else?> or <?end?> if an environment or " +
+      "build tag holds when the page is built.",
+  "else": "Begins the text kept if the condition of <?if?> does not hold.",
+  "end": "Ends an if or content-for section.",
+}
+
+// partialTag matches a tag name being typed at the end of text.
+var partialTag = regexp.MustCompile(`<\?([A-Za-z-]*)$`)
+
+// partialSelector matches a qualified identifier being typed at the end of
+// text, such as runtime.Esc.
+var partialSelector = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)\.` +
+    `([A-Za-z0-9_]*)$`)
+
+// completion returns the completion items at an offset: tag names after
+// <?, and the identifiers of the runtime after its package name in code
+// sections.
+func (s *lspServer) completion(text string, offset int) interface{} {
+  items := []map[string]interface{}{}
+  before := text[:offset]
+  if match := partialTag.FindStringSubmatch(before); match != nil &&
+      !inCodeSection(text, offset) {
+    for _, name := range tagNames() {
+      if strings.HasPrefix(name, match[1]) {
+        items = append(items, map[string]interface{}{ "label": name,
+            "kind": lspKeywordKind, "documentation": tagDocs[name] })
+      }
+    }
+    return items
+  }
+  match := partialSelector.FindStringSubmatch(before)
+  if match == nil || !inCodeSection(text, offset) ||
+      match[1] != runtimeName(text) {
+    return items
+  }
+  index := s.loadRuntime()
+  for _, name := range index.names {
+    if strings.HasPrefix(name, match[2]) {
+      entry := index.entries[name]
+      items = append(items, map[string]interface{}{ "label": name,
+          "kind": entry.kind, "detail": entry.signature,
+          "documentation": entry.doc })
+    }
+  }
+  return items
+}
+
+// hover returns the description of the tag name or runtime identifier at
+// an offset, or nil.
+func (s *lspServer) hover(text string, offset int) interface{} {
+  start, end := offset, offset
+  for start > 0 && isWordByte(text[start-1]) {
+    start--
+  }
+  for end < len(text) && isWordByte(text[end]) {
+    end++
+  }
+  if start == end {
+    return nil
+  }
+  word := text[start:end]
+  var contents string
+  switch {
+  case start >= 2 && text[start-2:start] == "<?":
+    if tagDocs[word] == "" {
+      return nil
+    }
+    contents = "**<?" + word + "?>**\n\n" + tagDocs[word]
+  case inCodeSection(text, offset):
+    match := partialSelector.FindStringSubmatch(text[:start])
+    if match == nil || match[2] != "" || match[1] != runtimeName(text) {
+      return nil
+    }
+    entry := s.loadRuntime().entries[word]
+    if entry == nil {
+      return nil
+    }
+    contents = "```go\n" + entry.signature + "\n```"
+    if entry.doc != "" {
+      contents += "\n\n" + entry.doc
+    }
+  default:
+    return nil
+  }
+  return map[string]interface{}{
+    "contents": map[string]string{ "kind": "markdown", "value": contents },
+  }
+}
+
+// tagNames returns the names of the built-in tags in sorted order.
+func tagNames() []string {
+  names := []string{}
+  for name := range tagDocs {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// isWordByte reports whether a byte may be part of an identifier or tag
+// name.
+func isWordByte(b byte) bool {
+  return b == '_' || b == '-' || b >= '0' && b <= '9' ||
+      b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z'
+}
+
+// inCodeSection reports whether an offset is inside a code section, that
+// is, after a <?code that has not been closed.
+func inCodeSection(text string, offset int) bool {
+  open := strings.LastIndex(text[:offset], "<?code")
+  return open != -1 && !strings.Contains(text[open:offset], "?>")
+}
+
+// runtimeImportSpec matches the import of the runtime, with its name if
+// it is given one.
+var runtimeImportSpec = regexp.MustCompile(`(?:([A-Za-z_][A-Za-z0-9_]*)` +
+    `\s+)?"` + regexp.QuoteMeta(runtimeImport) + `"`)
+
+// runtimeName returns the name by which a template refers to the runtime
+// package.
+func runtimeName(text string) string {
+  if match := runtimeImportSpec.FindStringSubmatch(text); match != nil &&
+      match[1] != "" && match[1] != "import" {
+    return match[1]
+  }
+  return "runtime"
+}
@@ -0,0 +1,154 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "sort"
+  "sync"
+  "strings"
+  "time"
+  "encoding/json"
+  "path/filepath"
+)
+
+// Manifest records the artifacts that buildapp generated for each template.
+// Later runs of buildapp consult it to find out what exists on the site.
+// Assets maps each exported asset to the file it was copied or linked from.
+type Manifest struct {
+  Entries map[string]*ManifestEntry `json:"entries"`
+  Assets map[string]string          `json:"assets,omitempty"`
+
+  mutex sync.Mutex  // Guards Entries and Assets while templates are built.
+}
+
+// ManifestEntry describes the outputs of one template. Paths are absolute
+// file-system paths. Route is the URL path of the binary under the site
+// root, or "" if the binary lies outside the site root. EmbedDir and
+// EmbedFile are the outputs of -embed, if any, and MapFile is the output
+// of -sourcemap. Inputs lists the templates
+// and embedded assets that went into the outputs, and Settings is a hash
+// of the build settings; together with Built and Failed, they tell whether
+// the outputs are up to date. InputHash and BinaryHash are hashes of the
+// contents of the inputs and of the binary as built.
+type ManifestEntry struct {
+  Template string           `json:"template"`
+  GoFile string             `json:"goFile"`
+  Binary string             `json:"binary"`
+  Route string              `json:"route,omitempty"`
+  Meta apptemplate.Meta     `json:"meta,omitempty"`
+  EmbedDir string           `json:"embedDir,omitempty"`
+  EmbedFile string          `json:"embedFile,omitempty"`
+  MapFile string            `json:"mapFile,omitempty"`
+  Inputs []string           `json:"inputs,omitempty"`
+  Settings string           `json:"settings,omitempty"`
+  Failed bool               `json:"failed,omitempty"`
+  InputHash string          `json:"inputHash,omitempty"`
+  BinaryHash string         `json:"binaryHash,omitempty"`
+  Built time.Time           `json:"built"`
+}
+
+// loadManifest reads a manifest file. A missing file yields an empty
+// manifest so that the first build on a site starts from scratch.
+func loadManifest(path string) (*Manifest, error) {
+  manifest := &Manifest{
+    Entries: map[string]*ManifestEntry{},
+    Assets: map[string]string{},
+  }
+  data, err := os.ReadFile(path)
+  if os.IsNotExist(err) {
+    return manifest, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  err = json.Unmarshal(data, manifest)
+  if err != nil {
+    return nil, err
+  }
+  if manifest.Entries == nil {
+    manifest.Entries = map[string]*ManifestEntry{}
+  }
+  if manifest.Assets == nil {
+    manifest.Assets = map[string]string{}
+  }
+  return manifest, nil
+}
+
+// save writes the manifest atomically by way of a temporary file.
+func (manifest *Manifest) save(path string) error {
+  data, err := json.MarshalIndent(manifest, "", "  ")
+  if err != nil {
+    return err
+  }
+  err = os.MkdirAll(filepath.Dir(path), 0755)
+  if err != nil {
+    return err
+  }
+  tempPath := path + ".tmp"
+  err = os.WriteFile(tempPath, append(data, '\n'), 0644)
+  if err != nil {
+    return err
+  }
+  return os.Rename(tempPath, path)
+}
+
+// entry returns the entry of a template, or nil if there is none.
+func (manifest *Manifest) entry(templatePath string) *ManifestEntry {
+  absPath, _ := filepath.Abs(templatePath)
+  manifest.mutex.Lock()
+  defer manifest.mutex.Unlock()
+  return manifest.Entries[absPath]
+}
+
+// setEntry adds or replaces the entry of a template.
+func (manifest *Manifest) setEntry(entry *ManifestEntry) {
+  manifest.mutex.Lock()
+  defer manifest.mutex.Unlock()
+  manifest.Entries[entry.Template] = entry
+}
+
+// setAsset records an asset that was copied or linked from a source file.
+func (manifest *Manifest) setAsset(targetPath, sourcePath string) {
+  manifest.mutex.Lock()
+  defer manifest.mutex.Unlock()
+  manifest.Assets[targetPath] = sourcePath
+}
+
+// update calls fn on the entry of a template, if there is one, while
+// other templates cannot change the manifest.
+func (manifest *Manifest) update(templatePath string,
+    fn func(entry *ManifestEntry)) {
+  absPath, _ := filepath.Abs(templatePath)
+  manifest.mutex.Lock()
+  defer manifest.mutex.Unlock()
+  if entry := manifest.Entries[absPath]; entry != nil {
+    fn(entry)
+  }
+}
+
+// sortedEntries returns the entries ordered by template path.
+func (manifest *Manifest) sortedEntries() []*ManifestEntry {
+  entries := []*ManifestEntry{}
+  for _, entry := range manifest.Entries {
+    entries = append(entries, entry)
+  }
+  sort.Slice(entries, func (i, j int) bool {
+    return entries[i].Template < entries[j].Template
+  })
+  return entries
+}
+
+// routeFor works out the URL path at which a binary is served. A binary
+// named index.cgi is served as its directory.
+func routeFor(root, binaryPath string) string {
+  relPath, err := filepath.Rel(root, binaryPath)
+  if err != nil || relPath == ".." ||
+      strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+    return ""
+  }
+  route := "/" + filepath.ToSlash(relPath)
+  if filepath.Base(relPath) == "index.cgi" {
+    return strings.TrimSuffix(route, "index.cgi")
+  }
+  return route
+}
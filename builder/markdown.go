@@ -0,0 +1,34 @@
+package builder
+
+import (
+  "os/exec"
+  "fmt"
+  "bytes"
+  "errors"
+  "strings"
+)
+
+// markdownCommand is set by -markdown or the markdown setting. It is a
+// shell command, such as "pandoc -f gfm", that reads Markdown on stdin and
+// writes HTML on stdout, and renders the files of insert-markdown tags in
+// place of the built-in renderer.
+var markdownCommand string
+
+// commandMarkdown renders Markdown with markdownCommand, which runs in the
+// site root. The command's error output is included in the error if it
+// fails.
+func commandMarkdown(source []byte) ([]byte, error) {
+  cmd := exec.Command("sh", "-c", markdownCommand)
+  cmd.Dir = siteRoot
+  cmd.Stdin = bytes.NewReader(source)
+  output, err := cmd.Output()
+  var exitError *exec.ExitError
+  if errors.As(err, &exitError) && len(exitError.Stderr) != 0 {
+    return nil, fmt.Errorf("%s: %s: %s", markdownCommand, err.Error(),
+        strings.TrimSpace(string(exitError.Stderr)))
+  }
+  if err != nil {
+    return nil, fmt.Errorf("%s: %s", markdownCommand, err.Error())
+  }
+  return output, nil
+}
@@ -0,0 +1,197 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "io"
+  "fmt"
+  "sort"
+  "bytes"
+  "bufio"
+  "strconv"
+  "strings"
+  "go/ast"
+  "go/token"
+  "go/parser"
+  "path/filepath"
+  "encoding/json"
+)
+
+// messagesCommand implements "buildapp messages", which extracts the keys
+// of the messages that the selected templates translate with runtime.T
+// and writes them as a catalog skeleton. Without -o, a JSON catalog is
+// printed. With -o naming a .json file, the keys are merged into the
+// catalog there, keeping its translations. With -o naming a .pot file, a
+// gettext template is written, with a reference to the templates of each
+// message. Keys that are not string literals cannot be extracted and are
+// reported.
+func messagesCommand(args []string) int {
+  flags := newFlagSet("messages")
+  addSelectionFlags(flags)
+  var outPath string
+  flags.StringVar(&outPath, "o", "",
+      "the catalog to write: a .json catalog to merge into or a .pot file")
+  flags.Parse(args)
+
+  extension := filepath.Ext(outPath)
+  if outPath != "" && extension != ".json" && extension != ".pot" {
+    fmt.Fprintf(messageFile, "messages: -o must name a .json or .pot file\n")
+    return 2
+  }
+  err := resolveGlobals()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  keys := map[string][]string{}  // The templates that use each key.
+  status := 0
+  forEachTemplate(flags.Args(), true, func (path string) {
+    var code bytes.Buffer
+    writer := bufio.NewWriter(&code)
+    _, err := apptemplate.Process(siteRoot, path, writer,
+        templateOptions(globalLog))
+    writer.Flush()
+    if err == nil {
+      err = extractMessages(code.Bytes(), sitePath(path), keys)
+    }
+    if err != nil {
+      fmt.Fprintf(messageFile, "FAIL %s: %s\n", path, err.Error())
+      status = 1
+    }
+  })
+  if extension == ".pot" {
+    err = writeMessageTemplate(outPath, keys)
+  } else {
+    err = writeMessageCatalog(outPath, keys)
+  }
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  if outPath != "" {
+    globalLog.result("wrote %d messages to %s\n", len(keys), outPath)
+  }
+  return status
+}
+
+// extractMessages adds the keys of the runtime.T calls in generated code
+// to a map from keys to the templates that use them. Calls through the
+// context, as boomerang.T, and under a dot import are found as well.
+func extractMessages(code []byte, template string,
+    keys map[string][]string) error {
+  fileSet := token.NewFileSet()
+  file, err := parser.ParseFile(fileSet, "", code, 0)
+  if err != nil {
+    return err
+  }
+  receivers := map[string]bool{ apptemplate.ContextName: true }
+  dotImport := false
+  for _, spec := range file.Imports {
+    if importPath, _ := strconv.Unquote(spec.Path.Value);
+        importPath != runtimeImport {
+      continue
+    }
+    switch {
+    case spec.Name == nil:
+      receivers["runtime"] = true
+    case spec.Name.Name == ".":
+      dotImport = true
+    default:
+      receivers[spec.Name.Name] = true
+    }
+  }
+  ast.Inspect(file, func (node ast.Node) bool {
+    call, ok := node.(*ast.CallExpr)
+    if !ok || len(call.Args) == 0 {
+      return true
+    }
+    isT := false
+    switch fun := call.Fun.(type) {
+    case *ast.SelectorExpr:
+      receiver, ok := fun.X.(*ast.Ident)
+      isT = ok && receivers[receiver.Name] && fun.Sel.Name == "T"
+    case *ast.Ident:
+      isT = dotImport && fun.Name == "T"
+    }
+    if !isT {
+      return true
+    }
+    literal, ok := call.Args[0].(*ast.BasicLit)
+    if !ok || literal.Kind != token.STRING {
+      inform("%s: skipping a message key that is not a string literal\n",
+          template)
+      return true
+    }
+    key, _ := strconv.Unquote(literal.Value)  // The parser has checked it.
+    list := keys[key]
+    if len(list) == 0 || list[len(list)-1] != template {
+      keys[key] = append(list, template)
+    }
+    return true
+  })
+  return nil
+}
+
+// writeMessageCatalog writes the keys as a JSON catalog with empty texts,
+// to stdout if the path is "". An existing catalog at the path keeps its
+// messages, including those no template uses any more.
+func writeMessageCatalog(path string, keys map[string][]string) error {
+  catalog := map[string]interface{}{}
+  if path != "" {
+    data, err := os.ReadFile(path)
+    if err == nil {
+      err = json.Unmarshal(data, &catalog)
+    }
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+  }
+  for key := range keys {
+    if _, found := catalog[key]; !found {
+      catalog[key] = ""
+    }
+  }
+  data, err := json.MarshalIndent(catalog, "", "  ")  // Keys are sorted.
+  if err != nil {
+    return err
+  }
+  data = append(data, '\n')
+  if path == "" {
+    _, err = os.Stdout.Write(data)
+    return err
+  }
+  return os.WriteFile(path, data, 0644)
+}
+
+// writeMessageTemplate writes the keys as a gettext template, in which
+// each entry names the templates that use it.
+func writeMessageTemplate(path string, keys map[string][]string) error {
+  file, err := os.Create(path)
+  if err != nil {
+    return err
+  }
+  out := bufio.NewWriter(file)
+  io.WriteString(out, "msgid \"\"\nmsgstr \"\"\n"+
+      "\"Content-Type: text/plain; charset=UTF-8\\n\"\n")
+  sorted := make([]string, 0, len(keys))
+  for key := range keys {
+    sorted = append(sorted, key)
+  }
+  sort.Strings(sorted)
+  for _, key := range sorted {
+    fmt.Fprintf(out, "\n#: %s\nmsgid %s\nmsgstr \"\"\n",
+        strings.Join(keys[key], " "), poQuote(key))
+  }
+  err = out.Flush()
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  return err
+}
+
+// poQuote quotes a string for a gettext catalog, whose escapes are those
+// of C.
+func poQuote(s string) string {
+  return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`,
+      "\t", `\t`).Replace(s) + `"`
+}
@@ -0,0 +1,146 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "os/exec"
+  "fmt"
+  "strings"
+  "path/filepath"
+  "runtime/debug"
+)
+
+// The generated programs are compiled in module mode. If the generated
+// files lie within a module, they are built there; otherwise a go.mod is
+// made at the root of the generated tree. The module then requires the
+// Boomerang runtime at runtimeVersion, or uses the source in runtimeDir.
+//   runtimeVersion  defaults to the version that buildapp was built with
+//   runtimeDir      is a local copy of the Boomerang module (replace)
+//   moduleRoot      is the directory of the go.mod, set by prepareModule
+//   modulePath      is the path of that module, also set by prepareModule
+var runtimeVersion, runtimeDir, moduleRoot, modulePath string
+
+// boomerangModule is the module path of the runtime.
+var boomerangModule = strings.TrimSuffix(apptemplate.RuntimePath, "/runtime")
+
+// defaultModulePath names the module that buildapp creates for a site.
+const defaultModulePath = "site"
+
+// resolveModuleSettings fills in the runtime settings from the
+// configuration and from the build information of buildapp itself.
+func resolveModuleSettings() error {
+  if runtimeVersion == "" {
+    runtimeVersion = config.RuntimeVersion
+  }
+  if runtimeVersion == "" {
+    runtimeVersion = ownVersion()
+  }
+  if runtimeDir == "" {
+    runtimeDir = siteRelative(config.RuntimeDir)
+  }
+  if runtimeDir != "" {
+    absDir, err := filepath.Abs(runtimeDir)
+    if err != nil {
+      return err
+    }
+    runtimeDir = absDir
+  }
+  return nil
+}
+
+// ownVersion returns the version of the Boomerang module that buildapp
+// was built from, or "" if it is unknown, as in a development build.
+func ownVersion() string {
+  info, ok := debug.ReadBuildInfo()
+  if !ok {
+    return ""
+  }
+  modules := append([]*debug.Module{ &info.Main }, info.Deps...)
+  for _, module := range modules {
+    if module.Path == boomerangModule && module.Version != "(devel)" {
+      return module.Version
+    }
+  }
+  return ""
+}
+
+// findModuleRoot returns the nearest directory at or above dir that
+// contains a go.mod, or "" if there is none.
+func findModuleRoot(dir string) string {
+  for {
+    if info, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil &&
+        !info.IsDir() {
+      return dir
+    }
+    parent := filepath.Dir(dir)
+    if parent == dir {
+      return ""
+    }
+    dir = parent
+  }
+}
+
+// prepareModule finds or creates the module in which generated files are
+// compiled and makes it require the runtime, or copies the runtime into it
+// with -vendorruntime.
+func prepareModule() error {
+  err := makeGoDirectories()
+  if err != nil {
+    return err
+  }
+  dir := genDir
+  if dir == "" {
+    dir = siteRoot
+  }
+  moduleRoot = findModuleRoot(dir)
+  if moduleRoot == "" {
+    moduleRoot = dir
+    err = os.MkdirAll(moduleRoot, 0755)
+    if err != nil {
+      return err
+    }
+    inform("creating %s\n", filepath.Join(moduleRoot, "go.mod"))
+    _, err = runGo("mod", "init", defaultModulePath)
+    if err != nil {
+      return err
+    }
+  }
+  detail("building in module %s\n", moduleRoot)
+  output, err := runGo("list", "-m")
+  if err != nil {
+    return err
+  }
+  modulePath = strings.TrimSpace(output)
+  if vendorRuntime {
+    return copyRuntime(modulePath)
+  }
+  // Inside the Boomerang module, the runtime is already at hand.
+  if modulePath == boomerangModule {
+    return nil
+  }
+  edits := []string{ "mod", "edit" }
+  if runtimeVersion != "" {
+    edits = append(edits, "-require="+boomerangModule+"@"+runtimeVersion)
+  }
+  if runtimeDir != "" {
+    edits = append(edits, "-replace="+boomerangModule+"="+runtimeDir)
+  }
+  if len(edits) == 2 {
+    return nil
+  }
+  _, err = runGo(edits...)
+  return err
+}
+
+// runGo runs the go command in the module root and returns its output.
+func runGo(args ...string) (string, error) {
+  cmd := exec.Command(GoPath, args...)
+  cmd.Dir = moduleRoot
+  cmd.Env = buildEnv()
+  output, err := cmd.CombinedOutput()
+  if err != nil {
+    return "", fmt.Errorf("go %s: %s\n%s", strings.Join(args, " "),
+        err.Error(), strings.TrimSpace(string(output)))
+  }
+  return string(output), nil
+}
@@ -0,0 +1,175 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "fmt"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+  "path/filepath"
+  "text/template"
+)
+
+// Scaffold is the section of the configuration that shapes new templates.
+// Dir holds user-defined skeletons, named <skeleton>.boo; a skeleton named
+// default replaces the built-in one. Header and Footer are inserted by the
+// built-in skeleton if they are set.
+type Scaffold struct {
+  Dir string     `json:"dir,omitempty"`
+  Header string  `json:"header,omitempty"`
+  Footer string  `json:"footer,omitempty"`
+}
+
+// skeletonData supplies the fields of a skeleton, which is a text/template.
+type skeletonData struct {
+  Name string         // The file name of the new template.
+  Title string        // A title made from the file name.
+  Path string         // The slash-separated path under the site root.
+  Header string       // The path of the header to insert, if any.
+  Footer string       // The path of the footer to insert, if any.
+  RuntimePath string  // The import path of the runtime package.
+}
+
+// defaultSkeleton is the built-in skeleton of a new template.
+const defaultSkeleton = `<?code
+  package main
+
+  import (
+    "{{.RuntimePath}}"
+  )
+
+  func main() {
+    defer runtime.PrintCGI()
+?>
+{{- if .Header}}
+<?insert {{.Header}} ?>
+{{- end}}
+
+<h1> {{.Title}} </h1>
+{{if .Footer}}
+<?insert {{.Footer}} ?>
+{{- end}}
+<?code
+  }
+?>
+`
+
+// newCommand implements "buildapp new", which creates templates from a
+// skeleton so that new pages start out alike. A path without a template
+// extension gets the first one. Existing files are left alone unless -f is
+// given.
+func newCommand(args []string) int {
+  flags := newFlagSet("new")
+  var skeleton, header, footer string
+  var overwrite bool
+  flags.StringVar(&skeleton, "skeleton", "default",
+      "the name of the skeleton in the skeleton directory")
+  flags.StringVar(&header, "header", "",
+      "the path of a header for the built-in skeleton to insert")
+  flags.StringVar(&footer, "footer", "",
+      "the path of a footer for the built-in skeleton to insert")
+  flags.BoolVar(&overwrite, "f", false, "overwrite existing files")
+  flags.Parse(args)
+
+  err := resolveGlobals()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  if flags.NArg() == 0 {
+    fmt.Fprintf(messageFile, "usage: buildapp new [flags] path ...\n")
+    return 2
+  }
+  tmpl, err := loadSkeleton(skeleton)
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  if header == "" {
+    header = config.Scaffold.Header
+  }
+  if footer == "" {
+    footer = config.Scaffold.Footer
+  }
+  status := 0
+  for _, path := range flags.Args() {
+    if templateExtension(path) == "" {
+      path += extensions[0]
+    }
+    data := skeletonData{ Name: filepath.Base(path), Header: header,
+        Footer: footer, RuntimePath: apptemplate.RuntimePath }
+    data.Title = pageTitle(data.Name)
+    data.Path = "/" + sitePath(absolutePath(path))
+    err := writeSkeleton(tmpl, path, data, overwrite)
+    if err != nil {
+      fmt.Fprintf(messageFile, "%s\n", err.Error())
+      status = 1
+      continue
+    }
+    inform("created %s\n", path)
+  }
+  return status
+}
+
+// loadSkeleton parses a skeleton from the skeleton directory. The default
+// skeleton is built in, but it can be replaced there.
+func loadSkeleton(name string) (*template.Template, error) {
+  dir := siteRelative(config.Scaffold.Dir)
+  if dir == "" {
+    dir = filepath.Join(stateDir, "skeletons")
+  }
+  data, err := os.ReadFile(filepath.Join(dir, name + ".boo"))
+  if os.IsNotExist(err) && name == "default" {
+    data, err = []byte(defaultSkeleton), nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  return template.New(name).Option("missingkey=error").Parse(string(data))
+}
+
+// writeSkeleton writes a new template from a skeleton.
+func writeSkeleton(tmpl *template.Template, path string, data skeletonData,
+    overwrite bool) error {
+  flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+  if overwrite {
+    flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+  }
+  err := os.MkdirAll(filepath.Dir(path), 0755)
+  if err != nil {
+    return err
+  }
+  file, err := os.OpenFile(path, flag, 0644)
+  if err != nil {
+    return err
+  }
+  err = tmpl.Execute(file, data)
+  closeErr := file.Close()
+  if err != nil {
+    os.Remove(path)
+    return err
+  }
+  return closeErr
+}
+
+// pageTitle makes a title from a file name: "about-us.boo" becomes
+// "About us".
+func pageTitle(name string) string {
+  name = strings.TrimSuffix(name, templateExtension(name))
+  title := strings.NewReplacer("-", " ", "_", " ").Replace(name)
+  first, size := utf8.DecodeRuneInString(title)
+  if size == 0 {
+    return title
+  }
+  return string(unicode.ToUpper(first)) + title[size:]
+}
+
+// absolutePath returns an absolute version of a path, or the path itself
+// if that fails.
+func absolutePath(path string) string {
+  if absPath, err := filepath.Abs(path); err == nil {
+    return absPath
+  }
+  return path
+}
@@ -0,0 +1,57 @@
+package builder
+
+import (
+  "context"
+  "sync"
+  "sync/atomic"
+  goruntime "runtime"
+)
+
+// jobs is the number of templates that are built at once, set by -j.
+var jobs = 1
+
+// buildTemplates builds templates, up to jobs of them at once, and returns
+// their reports in the order of the paths. With failFast, no template is
+// started after one has failed, and the reports cover only the templates
+// that were attempted. The same holds once the context is canceled. The
+// messages about each template are kept together.
+func buildTemplates(ctx context.Context, paths []string, dryRun,
+    failFast bool, meter *progressMeter) []*TemplateReport {
+  if jobs <= 0 {
+    jobs = goruntime.NumCPU()
+  }
+  prefixLogs = jobs > 1
+  results := make([]*TemplateReport, len(paths))
+  slots := make(chan bool, jobs)
+  var wait sync.WaitGroup
+  var failed atomic.Bool
+  for i, path := range paths {
+    slots <- true
+    if (failFast && failed.Load()) || ctx.Err() != nil {
+      break
+    }
+    if meter != nil {
+      meter.step(path)
+    }
+    wait.Add(1)
+    go func(i int, path string) {
+      defer wait.Done()
+      log := newTemplateLog(path)
+      report := buildTemplate(ctx, path, dryRun, log)
+      log.finish()
+      if report.failed() {
+        failed.Store(true)
+      }
+      results[i] = report
+      <-slots
+    }(i, path)
+  }
+  wait.Wait()
+  reports := []*TemplateReport{}
+  for _, report := range results {
+    if report != nil {
+      reports = append(reports, report)
+    }
+  }
+  return reports
+}
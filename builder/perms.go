@@ -0,0 +1,139 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+  "strconv"
+  "os/user"
+)
+
+// Permissions says what mode bits and ownership generated files get. Modes
+// are octal strings such as "0755". Owner and Group are names or numeric
+// IDs; changing them usually requires running buildapp as root. Settings
+// left empty keep whatever the file was created with.
+type Permissions struct {
+  GoMode string      `json:"goMode,omitempty"`
+  BinaryMode string  `json:"binaryMode,omitempty"`
+  AssetMode string   `json:"assetMode,omitempty"`
+  Owner string       `json:"owner,omitempty"`
+  Group string       `json:"group,omitempty"`
+}
+
+// permissionFlags holds the command-line settings, which override those
+// of the configuration file.
+var permissionFlags Permissions
+
+// The resolved settings. An ID of -1 leaves ownership unchanged, as does
+// a mode of 0.
+var goMode, binaryMode, assetMode os.FileMode
+var ownerID, groupID = -1, -1
+
+// resolvePermissions merges the flags with the configuration and looks up
+// the owner and group.
+func resolvePermissions() error {
+  settings := config.Permissions
+  for _, pair := range []struct{ flag string; setting *string }{
+    { permissionFlags.GoMode, &settings.GoMode },
+    { permissionFlags.BinaryMode, &settings.BinaryMode },
+    { permissionFlags.AssetMode, &settings.AssetMode },
+    { permissionFlags.Owner, &settings.Owner },
+    { permissionFlags.Group, &settings.Group },
+  } {
+    if pair.flag != "" {
+      *pair.setting = pair.flag
+    }
+  }
+  var err error
+  for _, pair := range []struct{ text string; mode *os.FileMode }{
+    { settings.GoMode, &goMode },
+    { settings.BinaryMode, &binaryMode },
+    { settings.AssetMode, &assetMode },
+  } {
+    *pair.mode, err = parseMode(pair.text)
+    if err != nil {
+      return err
+    }
+  }
+  ownerID, groupID = -1, -1
+  if settings.Owner != "" {
+    ownerID, err = lookupID(settings.Owner, true)
+    if err != nil {
+      return err
+    }
+  }
+  if settings.Group != "" {
+    groupID, err = lookupID(settings.Group, false)
+  }
+  return err
+}
+
+// parseMode interprets an octal permission string.
+func parseMode(text string) (os.FileMode, error) {
+  if text == "" {
+    return 0, nil
+  }
+  bits, err := strconv.ParseUint(text, 8, 32)
+  if err != nil || bits > 07777 {
+    return 0, fmt.Errorf("invalid file mode %q", text)
+  }
+  return os.FileMode(bits & 0777) | specialBits(bits), nil
+}
+
+// specialBits converts the setuid, setgid, and sticky bits of a numeric
+// mode to their os.FileMode equivalents.
+func specialBits(bits uint64) os.FileMode {
+  var mode os.FileMode
+  if bits & 04000 != 0 {
+    mode |= os.ModeSetuid
+  }
+  if bits & 02000 != 0 {
+    mode |= os.ModeSetgid
+  }
+  if bits & 01000 != 0 {
+    mode |= os.ModeSticky
+  }
+  return mode
+}
+
+// lookupID resolves a user or group name to a numeric ID. Numbers are
+// accepted as they are.
+func lookupID(name string, isUser bool) (int, error) {
+  if id, err := strconv.Atoi(name); err == nil {
+    return id, nil
+  }
+  var id string
+  if isUser {
+    account, err := user.Lookup(name)
+    if err != nil {
+      return -1, err
+    }
+    id = account.Uid
+  } else {
+    group, err := user.LookupGroup(name)
+    if err != nil {
+      return -1, err
+    }
+    id = group.Gid
+  }
+  return strconv.Atoi(id)
+}
+
+// setPermissions applies a mode, if it is not zero, and the configured
+// ownership to a generated file. Symbolic links are not followed.
+func setPermissions(path string, mode os.FileMode) error {
+  info, err := os.Lstat(path)
+  if err != nil {
+    return err
+  }
+  isLink := info.Mode() & os.ModeSymlink != 0
+  if mode != 0 && !isLink {
+    err = os.Chmod(path, mode)
+    if err != nil {
+      return err
+    }
+  }
+  if ownerID != -1 || groupID != -1 {
+    return os.Lchown(path, ownerID, groupID)
+  }
+  return nil
+}
@@ -0,0 +1,75 @@
+package builder
+
+import (
+  "os"
+  "sort"
+  "runtime/pprof"
+)
+
+// profileTop is the number of slowest templates that -profile lists at the
+// end of a build, or 0 if no profile is printed.
+var profileTop int
+
+// cpuProfilePath names the file to which -cpuprofile writes a pprof CPU
+// profile of buildapp itself.
+var cpuProfilePath string
+
+// startCPUProfile starts profiling buildapp if -cpuprofile is given and
+// returns a function that stops it.
+func startCPUProfile() (func(), error) {
+  if cpuProfilePath == "" {
+    return func() {}, nil
+  }
+  file, err := os.Create(cpuProfilePath)
+  if err != nil {
+    return nil, err
+  }
+  err = pprof.StartCPUProfile(file)
+  if err != nil {
+    file.Close()
+    return nil, err
+  }
+  return func() {
+    pprof.StopCPUProfile()
+    file.Close()
+    inform("wrote CPU profile to %s\n", cpuProfilePath)
+  }, nil
+}
+
+// printProfile lists the templates that took longest to build, with the
+// time spent parsing, generating code, and compiling, followed by the
+// totals of the build.
+func printProfile(reports []*TemplateReport) {
+  built := []*TemplateReport{}
+  var parse, codegen, compile float64
+  for _, report := range reports {
+    if report.GenerateSeconds == 0 && report.CompileSeconds == 0 {
+      continue  // The template was not built.
+    }
+    built = append(built, report)
+    parse += report.ParseSeconds
+    codegen += report.CodegenSeconds
+    compile += report.CompileSeconds
+  }
+  sort.SliceStable(built, func (i, j int) bool {
+    return built[i].totalSeconds() > built[j].totalSeconds()
+  })
+  count := len(built)
+  if len(built) > profileTop {
+    built = built[:profileTop]
+  }
+  globalLog.result("%8s %8s %8s %8s  %s\n", "total", "parse", "codegen",
+      "compile", "template")
+  for _, report := range built {
+    globalLog.result("%8.3f %8.3f %8.3f %8.3f  %s\n", report.totalSeconds(),
+        report.ParseSeconds, report.CodegenSeconds, report.CompileSeconds,
+        report.Template)
+  }
+  globalLog.result("%8.3f %8.3f %8.3f %8.3f  (all %d templates built)\n",
+      parse + codegen + compile, parse, codegen, compile, count)
+}
+
+// totalSeconds is the time spent building a template.
+func (report *TemplateReport) totalSeconds() float64 {
+  return report.GenerateSeconds + report.CompileSeconds
+}
@@ -0,0 +1,44 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+)
+
+// progressMeter counts off templates as a build goes through them. On a
+// terminal in quiet mode, the counter is redrawn in place. Otherwise a
+// line is printed for each template.
+type progressMeter struct {
+  total, done int
+  inPlace bool
+}
+
+// newProgressMeter makes a meter for a build of total templates.
+func newProgressMeter(total int) *progressMeter {
+  meter := &progressMeter{ total: total }
+  if file, ok := messageFile.(*os.File); ok {
+    if info, err := file.Stat(); err == nil {
+      isTerminal := info.Mode() & os.ModeCharDevice != 0
+      meter.inPlace = isTerminal && verbosity == quietLevel
+    }
+  }
+  return meter
+}
+
+// step announces that work on a template is starting.
+func (meter *progressMeter) step(path string) {
+  meter.done++
+  if meter.inPlace {
+    fmt.Fprintf(messageFile, "\r\033[K[%d/%d] %s", meter.done, meter.total,
+        path)
+  } else {
+    fmt.Fprintf(messageFile, "[%d/%d] %s\n", meter.done, meter.total, path)
+  }
+}
+
+// finish ends the line of an in-place counter.
+func (meter *progressMeter) finish() {
+  if meter.inPlace && meter.done != 0 {
+    fmt.Fprintf(messageFile, "\n")
+  }
+}
@@ -0,0 +1,232 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "io"
+  "fmt"
+  "sync"
+  "time"
+  "bufio"
+  "bytes"
+  "strings"
+  "net/http"
+)
+
+// reloadPath is the URL path of the stream of events that tells pages to
+// reload, and reloadScriptPath is that of the script that listens to it.
+// The script is not inlined so that it runs under a Content-Security-Policy
+// that allows only the site's own scripts.
+const (
+  reloadPath = "/__boomerang/reload"
+  reloadScriptPath = "/__boomerang/reload.js"
+)
+
+// reloadInterval is the time between checks for modified templates.
+const reloadInterval = time.Second
+
+// reloadScript reloads the page when the server sends a reload event. An
+// EventSource reconnects by itself when the server restarts.
+const reloadScript = `(function () {
+  var source = new EventSource("` + reloadPath + `");
+  source.addEventListener("reload", function () {
+    location.reload();
+  });
+})();
+`
+
+// reloadTag loads the script. It is injected into HTML responses.
+const reloadTag = `<script src="` + reloadScriptPath + `"></script>`
+
+// reloader tells the pages open in browsers to reload when a template
+// changes, for serve -reload. With -build, a changed template is rebuilt
+// before the pages are told; without -build or -preview, pages reload when
+// binaries change, as when buildapp watch rebuilds them.
+type reloader struct {
+  args []string                // The templates to watch, or none for a walk.
+  builder *requestBuilder      // The builder of serve -build or -preview.
+  mutex sync.Mutex             // Guards clients.
+  clients map[chan string]bool // Each listening page gets reload events.
+}
+
+// newReloader makes a reloader and starts it watching the templates.
+func newReloader(args []string, builder *requestBuilder) *reloader {
+  rl := &reloader{ args: args, builder: builder,
+      clients: map[chan string]bool{} }
+  go rl.watch()
+  return rl
+}
+
+// ServeHTTP serves the script and the stream of reload events. The stream
+// sends an event named reload, whose data is the template that changed.
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  if r.URL.Path == reloadScriptPath {
+    w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    io.WriteString(w, reloadScript)
+    return
+  }
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+    return
+  }
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.WriteHeader(http.StatusOK)
+  flusher.Flush()
+  events := make(chan string, 1)
+  rl.mutex.Lock()
+  rl.clients[events] = true
+  rl.mutex.Unlock()
+  defer func() {
+    rl.mutex.Lock()
+    delete(rl.clients, events)
+    rl.mutex.Unlock()
+  }()
+  for {
+    select {
+    case <-r.Context().Done():
+      return
+    case path := <-events:
+      fmt.Fprintf(w, "event: reload\ndata: %s\n\n", path)
+      flusher.Flush()
+    }
+  }
+}
+
+// broadcast tells every listening page that a template has changed. A
+// page that has yet to take the last event need not take another.
+func (rl *reloader) broadcast(path string) {
+  rl.mutex.Lock()
+  defer rl.mutex.Unlock()
+  for events := range rl.clients {
+    select {
+    case events <- path:
+    default:
+    }
+  }
+}
+
+// watch polls the templates, as buildapp watch does, along with the files
+// that each of them reads, and tells the pages to reload when one of them
+// changes. Templates seen for the first time are only noted.
+func (rl *reloader) watch() {
+  type watchState struct {
+    files []string
+    modTime time.Time
+  }
+  watched := map[string]*watchState{}
+  for {
+    paths := []string{}
+    if rl.builder != nil {
+      rl.builder.mutex.Lock()  // The builder walks the site too.
+    }
+    forEachTemplate(rl.args, false, func (path string) {
+      paths = append(paths, path)
+    })
+    if rl.builder != nil {
+      rl.builder.mutex.Unlock()
+    }
+    for _, path := range paths {
+      state := watched[path]
+      if state != nil && !latestModTime(state.files).After(state.modTime) {
+        continue
+      }
+      files := rl.sources(path)
+      watched[path] = &watchState{ files: files,
+          modTime: latestModTime(files) }
+      if state == nil {
+        continue
+      }
+      if rl.builder != nil && !rl.builder.previews {
+        rl.builder.mutex.Lock()
+        rl.builder.build(path)
+        rl.builder.mutex.Unlock()
+      }
+      inform("reloading pages after a change to %s\n", path)
+      rl.broadcast(path)
+    }
+    time.Sleep(reloadInterval)
+  }
+}
+
+// sources returns the files whose changes reload the pages of a template:
+// the templates that it reads and the assets that it names or, when
+// templates are neither built nor previewed by serve, its binary.
+func (rl *reloader) sources(path string) []string {
+  if rl.builder == nil {
+    _, binaryPath, err := outputPaths(path)
+    if err != nil {
+      return nil
+    }
+    return []string{ binaryPath }
+  }
+  options := templateOptions(globalLog)
+  options.Errors, options.Log = io.Discard, nil
+  result, err := apptemplate.Process(siteRoot, path,
+      bufio.NewWriter(io.Discard), options)
+  if err != nil {
+    return []string{ path }  // The template is watched until it is fixed.
+  }
+  return append(append([]string{}, result.Templates...), result.Assets...)
+}
+
+// reloadWriter injects the reload script into an HTML response. The body
+// of an HTML response is held until the response is finished, and other
+// responses, such as event streams, pass through as they are written.
+type reloadWriter struct {
+  http.ResponseWriter
+  status int          // The status, once the header has been written.
+  held bool           // The body is held to have the script injected.
+  body bytes.Buffer
+}
+
+func (rw *reloadWriter) WriteHeader(status int) {
+  if rw.status != 0 {
+    return
+  }
+  rw.status = status
+  contentType := rw.Header().Get("Content-Type")
+  rw.held = strings.HasPrefix(contentType, "text/html") &&
+      rw.Header().Get("Content-Encoding") == "" &&
+      status != http.StatusNoContent && status != http.StatusNotModified &&
+      status != http.StatusPartialContent
+  if !rw.held {
+    rw.ResponseWriter.WriteHeader(status)
+  }
+}
+
+func (rw *reloadWriter) Write(data []byte) (int, error) {
+  rw.WriteHeader(http.StatusOK)
+  if rw.held {
+    return rw.body.Write(data)
+  }
+  return rw.ResponseWriter.Write(data)
+}
+
+func (rw *reloadWriter) Flush() {
+  if flusher, ok := rw.ResponseWriter.(http.Flusher); ok && !rw.held {
+    flusher.Flush()
+  }
+}
+
+// finish writes a held response with the script before the closing body
+// tag, or at the end if there is none.
+func (rw *reloadWriter) finish() {
+  if !rw.held {
+    return
+  }
+  body := rw.body.Bytes()
+  at := bytes.LastIndex(body, []byte("</body>"))
+  if at == -1 {
+    at = bytes.LastIndex(body, []byte("</BODY>"))
+  }
+  if at == -1 {
+    at = len(body)
+  }
+  injected := append(append(append([]byte{}, body[:at]...), reloadTag...),
+      body[at:]...)
+  rw.Header().Set("Content-Length", fmt.Sprint(len(injected)))
+  rw.ResponseWriter.WriteHeader(rw.status)
+  rw.ResponseWriter.Write(injected)
+}
@@ -0,0 +1,495 @@
+package builder
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "sort"
+  "slices"
+  "sync"
+  "sync/atomic"
+  "time"
+  "bytes"
+  "errors"
+  "strings"
+  "net/url"
+  "net/http"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "path/filepath"
+)
+
+// remoteCacheURL is set by -remotecache or the remoteCache setting. It
+// names a cache of compiled binaries that several machines share, such as
+// those of developers and of continuous integration: an HTTP server that
+// answers GET and PUT, or an S3 bucket given as s3://bucket/prefix.
+// remoteCacheMode is "readwrite" or, to only fetch binaries, "read".
+var remoteCacheURL, remoteCacheMode string
+
+// remoteCacheTimeout limits each request to the remote cache.
+const remoteCacheTimeout = 30 * time.Second
+
+// remoteStore is the interface of a remote cache. get returns nil data
+// for a key that is not in the cache.
+type remoteStore interface {
+  get(key string) ([]byte, error)
+  put(key string, data []byte) error
+}
+
+// remoteCache is the remote cache of a run, or nil if there is none. Its
+// toolchain hash is computed when it is first needed.
+var remoteCache *sharedCache
+
+// sharedCache looks up compiled binaries in a remote store. After a request
+// fails, the store is not used for the rest of the run. A binary is keyed
+// by a hash of the inputs of its template, named by their site paths, the
+// build settings, the version of the builder that generates the code, the
+// go command's target and version, and the module and runtime source that
+// the code is compiled with, so the key is the same on every machine that
+// builds the same site. Beside each binary, the store holds its SHA-256
+// digest, which a fetched binary must match before it is installed. The
+// digest catches a binary that was corrupted on its way, but not one that
+// was replaced on purpose, since whoever can write the binary can write
+// its digest too: the store must only be writable by trusted builders.
+// Only binaries are shared. The .go files are generated on each machine,
+// since generating them is quick and the key is only known once the last
+// local build has named the inputs of the template.
+type sharedCache struct {
+  store remoteStore
+  push bool
+  broken atomic.Bool
+  toolchainOnce sync.Once
+  toolchain string
+  toolchainErr error
+}
+
+// resolveRemoteCache sets up the remote cache of the run from the flags
+// and settings.
+func resolveRemoteCache() error {
+  remoteCache = nil
+  if remoteCacheURL == "" {
+    remoteCacheURL = config.RemoteCache
+  }
+  if remoteCacheMode == "" {
+    remoteCacheMode = config.RemoteCacheMode
+  }
+  if remoteCacheMode == "" {
+    remoteCacheMode = "readwrite"
+  }
+  if remoteCacheMode != "readwrite" && remoteCacheMode != "read" {
+    return fmt.Errorf("unknown remote cache mode %q", remoteCacheMode)
+  }
+  if remoteCacheURL == "" {
+    return nil
+  }
+  target, err := url.Parse(remoteCacheURL)
+  if err != nil {
+    return fmt.Errorf("-remotecache: %s", err.Error())
+  }
+  var store remoteStore
+  switch target.Scheme {
+  case "http", "https":
+    store = &httpStore{ base: strings.TrimSuffix(remoteCacheURL, "/"),
+        token: os.Getenv("BOOMERANG_CACHE_TOKEN") }
+  case "s3":
+    store, err = newS3Store(target.Host, strings.Trim(target.Path, "/"))
+    if err != nil {
+      return err
+    }
+  default:
+    return fmt.Errorf("-remotecache %q is not an http, https, or s3 URL",
+        remoteCacheURL)
+  }
+  remoteCache = &sharedCache{ store: store,
+      push: remoteCacheMode == "readwrite" }
+  return nil
+}
+
+// key returns the cache key of the binary of a template, or "" if the
+// manifest records no inputs for it, as when -compile-only finds code that
+// this site never generated, or if the inputs have changed since the code
+// was generated. The inputs are the template, the files that it inserts,
+// and the assets that it embeds.
+func (cache *sharedCache) key(templatePath string) (string, error) {
+  cache.toolchainOnce.Do(func() {
+    cache.toolchain, cache.toolchainErr = toolchainHash()
+  })
+  if cache.toolchainErr != nil {
+    return "", cache.toolchainErr
+  }
+  entry := manifest.entry(templatePath)
+  if entry == nil || len(entry.Inputs) == 0 {
+    return "", nil
+  }
+  if inputHash, err := hashFiles(entry.Inputs...); err != nil ||
+      inputHash != entry.InputHash {
+    return "", err
+  }
+  hash := sha256.New()
+  fmt.Fprintf(hash, "boomerang binary 2\n%s\n%s\n%s\n", settingsHash(),
+      cache.toolchain, sitePath(entry.Template))
+  for _, input := range entry.Inputs {
+    fileHash, err := hashFile(input)
+    if err != nil {
+      return "", err
+    }
+    fmt.Fprintf(hash, "%s\x00%s\n", sitePath(input), fileHash)
+  }
+  return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// builderVersion identifies the code generator: the version of the
+// Boomerang module that buildapp was built from or, in a development
+// build, which has no version, a hash of the running executable.
+func builderVersion() (string, error) {
+  if version := ownVersion(); version != "" {
+    return version, nil
+  }
+  executable, err := os.Executable()
+  if err != nil {
+    return "", err
+  }
+  hash, err := hashFile(executable)
+  if err != nil {
+    return "", err
+  }
+  return "devel " + hash, nil
+}
+
+// toolchainHash summarizes what generates the code and what the go
+// command compiles it with: the version of the builder, the go command's
+// version and target, the module's requirements, and the source of the
+// runtime package.
+func toolchainHash() (string, error) {
+  version, err := builderVersion()
+  if err != nil {
+    return "", err
+  }
+  env, err := runGo("env", "GOVERSION", "GOOS", "GOARCH", "GOAMD64",
+      "GOARM", "GOARM64", "GOEXPERIMENT", "CGO_ENABLED")
+  if err != nil {
+    return "", err
+  }
+  dir, err := runGo("list", "-mod=mod", "-f", "{{.Dir}}", runtimeImport)
+  if err != nil {
+    return "", err
+  }
+  paths, err := filepath.Glob(filepath.Join(strings.TrimSpace(dir), "*.go"))
+  if err != nil {
+    return "", err
+  }
+  sort.Strings(paths)
+  for _, name := range []string{ "go.mod", "go.sum" } {
+    path := filepath.Join(moduleRoot, name)
+    if _, err := os.Stat(path); err == nil {
+      paths = append(paths, path)
+    }
+  }
+  hash := sha256.New()
+  fmt.Fprintf(hash, "%s\n%s\n", version, env)
+  for _, path := range paths {
+    fileHash, err := hashFile(path)
+    if err != nil {
+      return "", err
+    }
+    fmt.Fprintf(hash, "%s\x00%s\n", filepath.Base(path), fileHash)
+  }
+  return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fetch writes the binary of a template from the cache and reports
+// whether it was found. A binary that does not match its digest is not
+// installed. Failures of the cache are warnings, after which the binary is
+// compiled as usual.
+func (cache *sharedCache) fetch(templatePath, binaryPath string,
+    report *TemplateReport, log *templateLog) bool {
+  if cache.broken.Load() {
+    return false
+  }
+  key, err := cache.key(templatePath)
+  if err == nil && key == "" {
+    return false
+  }
+  var digest, data []byte
+  if err == nil {
+    digest, err = cache.store.get(key + ".sha256")
+  }
+  if err == nil && digest != nil {
+    data, err = cache.store.get(key)
+  }
+  if err != nil {
+    cache.fail(err, log)
+    return false
+  }
+  if digest == nil || data == nil {
+    log.detail("%s is not in the remote cache\n", binaryPath)
+    return false
+  }
+  sum := sha256.Sum256(data)
+  if hex.EncodeToString(sum[:]) != strings.TrimSpace(string(digest)) {
+    log.warnf("remote cache: the binary of %s does not match its " +
+        "digest; compiling it instead\n", binaryPath)
+    return false
+  }
+  err = writeFileAtomically(binaryPath, data, 0755)
+  if err == nil {
+    err = setPermissions(binaryPath, binaryMode)
+  }
+  if err != nil {
+    cache.fail(err, log)
+    return false
+  }
+  log.inform("fetched %s from the remote cache\n", binaryPath)
+  report.Cached = true
+  return true
+}
+
+// save uploads a compiled binary and then its digest, unless the cache is
+// read-only. A failure is a warning.
+func (cache *sharedCache) save(templatePath, binaryPath string,
+    log *templateLog) {
+  if !cache.push || cache.broken.Load() {
+    return
+  }
+  key, err := cache.key(templatePath)
+  if err == nil && key == "" {
+    return
+  }
+  var data []byte
+  if err == nil {
+    data, err = os.ReadFile(binaryPath)
+  }
+  if err == nil {
+    err = cache.store.put(key, data)
+  }
+  if err == nil {
+    sum := sha256.Sum256(data)
+    err = cache.store.put(key+".sha256",
+        []byte(hex.EncodeToString(sum[:])+"\n"))
+  }
+  if err != nil {
+    cache.fail(err, log)
+    return
+  }
+  log.detail("stored %s in the remote cache\n", binaryPath)
+}
+
+// fail gives up on the cache for the rest of the run, with a warning the
+// first time.
+func (cache *sharedCache) fail(err error, log *templateLog) {
+  if cache.broken.CompareAndSwap(false, true) {
+    log.warnf("remote cache: %s; building without it\n", err.Error())
+  }
+}
+
+// writeFileAtomically writes a file by way of a temporary file in the same
+// directory, so that a binary is never seen half written.
+func writeFileAtomically(path string, data []byte, mode os.FileMode) error {
+  temp, err := os.CreateTemp(filepath.Dir(path), ".buildapp-*")
+  if err != nil {
+    return err
+  }
+  _, err = temp.Write(data)
+  if closeErr := temp.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Chmod(temp.Name(), mode)
+  }
+  if err == nil {
+    err = os.Rename(temp.Name(), path)
+  }
+  if err != nil {
+    os.Remove(temp.Name())
+  }
+  return err
+}
+
+// httpStore is a remote cache on an HTTP server. A key is stored at the
+// base URL followed by a slash and the key. If the BOOMERANG_CACHE_TOKEN
+// environment variable is set, requests carry it as a bearer token.
+type httpStore struct {
+  base, token string
+}
+
+func (store *httpStore) get(key string) ([]byte, error) {
+  return store.do(http.MethodGet, key, nil)
+}
+
+func (store *httpStore) put(key string, data []byte) error {
+  _, err := store.do(http.MethodPut, key, data)
+  return err
+}
+
+// do sends a request for a key and returns the body of the response, or
+// nil if the key is not found.
+func (store *httpStore) do(method, key string, data []byte) ([]byte, error) {
+  request, err := http.NewRequest(method, store.base+"/"+key,
+      bytes.NewReader(data))
+  if err != nil {
+    return nil, err
+  }
+  if store.token != "" {
+    request.Header.Set("Authorization", "Bearer "+store.token)
+  }
+  return sendCacheRequest(request, http.StatusNotFound)
+}
+
+// sendCacheRequest sends a request to a remote cache and returns the body
+// of the response, or nil if the request was a GET and the response has
+// one of the statuses that mean the key is missing.
+func sendCacheRequest(request *http.Request, missing ...int) ([]byte,
+    error) {
+  client := &http.Client{ Timeout: remoteCacheTimeout }
+  response, err := client.Do(request)
+  if err != nil {
+    return nil, err
+  }
+  defer response.Body.Close()
+  body, err := io.ReadAll(response.Body)
+  switch {
+  case err != nil:
+    return nil, err
+  case request.Method == http.MethodGet &&
+      slices.Contains(missing, response.StatusCode):
+    return nil, nil
+  case response.StatusCode/100 != 2:
+    return nil, fmt.Errorf("%s %s: %s", request.Method,
+        request.URL.Redacted(), response.Status)
+  }
+  if body == nil {
+    body = []byte{}
+  }
+  return body, nil
+}
+
+// s3Store is a remote cache in an S3 bucket, or a store with the S3 API.
+// Keys are objects under the prefix. Requests are signed with the
+// credentials in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// AWS_SESSION_TOKEN for the region in AWS_REGION or AWS_DEFAULT_REGION.
+// AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL names another endpoint, which is
+// addressed with the bucket in the path.
+type s3Store struct {
+  endpoint *url.URL
+  bucket, prefix, region string
+  accessKey, secretKey, sessionToken string
+  pathStyle bool
+}
+
+// newS3Store makes the store of a bucket from the environment.
+func newS3Store(bucket, prefix string) (*s3Store, error) {
+  store := &s3Store{ bucket: bucket, prefix: prefix,
+      region: os.Getenv("AWS_REGION"),
+      accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+      secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+      sessionToken: os.Getenv("AWS_SESSION_TOKEN") }
+  if store.region == "" {
+    store.region = os.Getenv("AWS_DEFAULT_REGION")
+  }
+  if store.region == "" {
+    store.region = "us-east-1"
+  }
+  if bucket == "" {
+    return nil, errors.New("-remotecache: the s3 URL names no bucket")
+  }
+  if store.accessKey == "" || store.secretKey == "" {
+    return nil, errors.New("-remotecache: AWS_ACCESS_KEY_ID and " +
+        "AWS_SECRET_ACCESS_KEY must be set for an s3 cache")
+  }
+  endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+  if endpoint == "" {
+    endpoint = os.Getenv("AWS_ENDPOINT_URL")
+  }
+  store.pathStyle = endpoint != ""
+  if endpoint == "" {
+    endpoint = "https://" + bucket + ".s3." + store.region + ".amazonaws.com"
+  }
+  var err error
+  store.endpoint, err = url.Parse(endpoint)
+  if err != nil {
+    return nil, fmt.Errorf("S3 endpoint: %s", err.Error())
+  }
+  return store, nil
+}
+
+func (store *s3Store) get(key string) ([]byte, error) {
+  return store.do(http.MethodGet, key, nil)
+}
+
+func (store *s3Store) put(key string, data []byte) error {
+  _, err := store.do(http.MethodPut, key, data)
+  return err
+}
+
+// do sends a signed request for the object of a key.
+func (store *s3Store) do(method, key string, data []byte) ([]byte, error) {
+  objectPath := "/" + key
+  if store.prefix != "" {
+    objectPath = "/" + store.prefix + objectPath
+  }
+  if store.pathStyle {
+    objectPath = "/" + store.bucket + objectPath
+  }
+  target := *store.endpoint
+  target.Path = strings.TrimSuffix(target.Path, "/") + objectPath
+  request, err := http.NewRequest(method, target.String(),
+      bytes.NewReader(data))
+  if err != nil {
+    return nil, err
+  }
+  store.sign(request, data, time.Now().UTC())
+  // Without permission to list the bucket, S3 answers 403 Forbidden for a
+  // missing object.
+  return sendCacheRequest(request, http.StatusNotFound, http.StatusForbidden)
+}
+
+// sign adds the headers of AWS Signature Version 4 to a request.
+func (store *s3Store) sign(request *http.Request, payload []byte,
+    now time.Time) {
+  sum := sha256.Sum256(payload)
+  payloadHash := hex.EncodeToString(sum[:])
+  stamp := now.Format("20060102T150405Z")
+  day := stamp[:8]
+  request.Header.Set("X-Amz-Date", stamp)
+  request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+  if store.sessionToken != "" {
+    request.Header.Set("X-Amz-Security-Token", store.sessionToken)
+  }
+  names := []string{ "host" }
+  for name := range request.Header {
+    names = append(names, strings.ToLower(name))
+  }
+  sort.Strings(names)
+  canonicalHeaders := &strings.Builder{}
+  for _, name := range names {
+    value := request.Header.Get(name)
+    if name == "host" {
+      value = request.URL.Host
+    }
+    fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+  }
+  signedHeaders := strings.Join(names, ";")
+  canonicalRequest := strings.Join([]string{ request.Method,
+      request.URL.EscapedPath(), request.URL.RawQuery,
+      canonicalHeaders.String(), signedHeaders, payloadHash }, "\n")
+  scope := day + "/" + store.region + "/s3/aws4_request"
+  requestHash := sha256.Sum256([]byte(canonicalRequest))
+  stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" +
+      hex.EncodeToString(requestHash[:])
+  key := []byte("AWS4" + store.secretKey)
+  for _, part := range []string{ day, store.region, "s3", "aws4_request" } {
+    key = hmacSHA256(key, part)
+  }
+  signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+  request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" +
+      store.accessKey + "/" + scope + ", SignedHeaders=" + signedHeaders +
+      ", Signature=" + signature)
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of a message.
+func hmacSHA256(key []byte, message string) []byte {
+  mac := hmac.New(sha256.New, key)
+  mac.Write([]byte(message))
+  return mac.Sum(nil)
+}
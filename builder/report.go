@@ -0,0 +1,247 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "fmt"
+  "errors"
+  "regexp"
+  "strconv"
+  "strings"
+  "encoding/json"
+  "go/scanner"
+  "path/filepath"
+)
+
+// TemplateReport describes what happened to one template during a build.
+// Status is "ok", "failed", "up to date", or, in a dry run, "would build".
+// Reason tells why a template was built. When a template fails, Stage
+// names the step that failed: "create", "generate", "permissions",
+// "compile", "vet", "interrupted", or, in serve -preview, "preview".
+// Cached is true if the binary came from the remote cache instead of being
+// compiled. Durations are given in seconds; the generation time is divided
+// into the time spent parsing the templates and the time spent making the
+// Go code. Sizes gives the byte, rune, and line counts of the template and
+// of each template that it inserts, by path, once it has been generated.
+type TemplateReport struct {
+  Template string            `json:"template"`
+  GoFile string              `json:"goFile,omitempty"`
+  Binary string              `json:"binary,omitempty"`
+  Status string              `json:"status"`
+  Reason string              `json:"reason,omitempty"`
+  Stage string               `json:"stage,omitempty"`
+  Errors []BuildError        `json:"errors,omitempty"`
+  Warnings []BuildError      `json:"warnings,omitempty"`
+  Cached bool                `json:"cached,omitempty"`
+  GenerateSeconds float64    `json:"generateSeconds"`
+  ParseSeconds float64       `json:"parseSeconds"`
+  CodegenSeconds float64     `json:"codegenSeconds"`
+  CompileSeconds float64     `json:"compileSeconds"`
+  Sizes map[string]apptemplate.TemplateSize  `json:"sizes,omitempty"`
+
+  result *apptemplate.Result  // The result of generation, if it succeeded.
+  insertions []apptemplate.Insertion  // Those parsed before a failure.
+}
+
+// BuildError is an error message with the position it refers to, if known.
+type BuildError struct {
+  File string     `json:"file,omitempty"`
+  Line int        `json:"line,omitempty"`
+  Column int      `json:"column,omitempty"`
+  Message string  `json:"message"`
+}
+
+// Report summarizes a build. Build returns it, and build -json prints it
+// on stdout.
+type Report struct {
+  Templates []*TemplateReport  `json:"templates"`
+  Succeeded int                `json:"succeeded"`
+  Failed int                   `json:"failed"`
+  Skipped int                  `json:"skipped"`
+}
+
+// fail marks a template as failed at a stage with the given errors.
+func (report *TemplateReport) fail(stage string, errs ...BuildError) {
+  report.Status = "failed"
+  report.Stage = stage
+  report.Errors = append(report.Errors, errs...)
+}
+
+// failGeneration marks a template as failed at the generate stage with the
+// errors of apptemplate.Process, keeping the insertions that it parsed.
+func (report *TemplateReport) failGeneration(err error, goCodePath string) {
+  var processError *apptemplate.ProcessError
+  if errors.As(err, &processError) {
+    report.insertions = processError.Insertions
+  }
+  report.fail("generate", generationErrors(err, goCodePath)...)
+}
+
+// insertionStack returns the insertions that lead from the template of the
+// report to the template at path.
+func (report *TemplateReport) insertionStack(
+    path string) []apptemplate.Insertion {
+  insertions := report.insertions
+  if report.result != nil {
+    insertions = report.result.Insertions
+  }
+  return apptemplate.InsertionStack(insertions, path)
+}
+
+// failed reports whether the template failed.
+func (report *TemplateReport) failed() bool {
+  return report.Status == "failed"
+}
+
+// printFailureSummary lists the templates that failed, if any, with the
+// stage and first error of each. Templates that were never attempted, as
+// after -failfast or an interrupt, are counted, and stopped says why.
+func printFailureSummary(reports []*TemplateReport, total int,
+    stopped string) {
+  failed := []*TemplateReport{}
+  for _, report := range reports {
+    if report.failed() {
+      failed = append(failed, report)
+    }
+  }
+  if len(failed) == 0 {
+    return
+  }
+  globalLog.errorf("%d of %d templates failed:\n", len(failed), total)
+  for _, report := range failed {
+    message := "unknown error"
+    if len(report.Errors) != 0 {
+      message = report.Errors[0].String()
+    }
+    globalLog.errorf("  %s (%s): %s\n", report.Template, report.Stage,
+        message)
+  }
+  if skipped := total - len(reports); skipped != 0 {
+    globalLog.errorf("%s; %d templates were not attempted\n", stopped,
+        skipped)
+  }
+}
+
+// String formats a build error as file:line:column: message, leaving out
+// the parts of the position that are unknown.
+func (e BuildError) String() string {
+  position := e.File
+  if e.Line != 0 {
+    position += fmt.Sprintf(":%d", e.Line)
+    if e.Column != 0 {
+      position += fmt.Sprintf(":%d", e.Column)
+    }
+  }
+  if position == "" {
+    return e.Message
+  }
+  return position + ": " + e.Message
+}
+
+// generationErrors converts an error from apptemplate.Process into build
+// errors. Syntax errors in the Go code refer to template lines where
+// Process could place them, and otherwise to lines of goCodePath, which
+// holds the code that failed to parse.
+func generationErrors(err error, goCodePath string) []BuildError {
+  var templateError *apptemplate.Error
+  if errors.As(err, &templateError) {
+    return []BuildError{ {
+      File: templateError.Path,
+      Line: templateError.Line,
+      Message: templateError.Err.Error(),
+    } }
+  }
+  var syntaxErrors scanner.ErrorList
+  if errors.As(err, &syntaxErrors) {
+    errs := []BuildError{}
+    for _, syntaxError := range syntaxErrors {
+      file := goCodePath
+      if filepath.IsAbs(syntaxError.Pos.Filename) {
+        file = syntaxError.Pos.Filename
+      }
+      errs = append(errs, BuildError{
+        File: file,
+        Line: syntaxError.Pos.Line,
+        Column: syntaxError.Pos.Column,
+        Message: syntaxError.Msg,
+      })
+    }
+    return errs
+  }
+  return []BuildError{ { Message: err.Error() } }
+}
+
+// noteWarnings logs the warnings of a template's generation and adds them
+// to the report.
+func (report *TemplateReport) noteWarnings(result *apptemplate.Result,
+    log *templateLog) {
+  for _, warning := range result.Warnings {
+    log.warnf("%s\n", warning.Error())
+    report.Warnings = append(report.Warnings, BuildError{
+      File: warning.Path,
+      Line: warning.Line,
+      Message: warning.Err.Error(),
+    })
+  }
+}
+
+// compilerMessage matches a line of compiler output that has a position.
+var compilerMessage = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?: (.*)$`)
+
+// compilerErrors extracts positioned messages from the output of the go
+// command. Relative file names are resolved against dir. If no line has a
+// position, the whole output becomes one message.
+func compilerErrors(output, dir string) []BuildError {
+  errs := []BuildError{}
+  for _, line := range strings.Split(output, "\n") {
+    match := compilerMessage.FindStringSubmatch(line)
+    if match == nil || strings.HasPrefix(line, "#") {
+      continue
+    }
+    file := match[1]
+    if !filepath.IsAbs(file) {
+      file = filepath.Join(dir, file)
+    }
+    lineNumber, _ := strconv.Atoi(match[2])
+    column, _ := strconv.Atoi(match[3])
+    errs = append(errs, BuildError{
+      File: file,
+      Line: lineNumber,
+      Column: column,
+      Message: match[4],
+    })
+  }
+  if len(errs) == 0 {
+    errs = append(errs, BuildError{ Message: strings.TrimSpace(output) })
+  }
+  return errs
+}
+
+// writeJSONReport prints a build report on stdout.
+func writeJSONReport(reports []*TemplateReport) error {
+  data, err := json.MarshalIndent(newReport(reports), "", "  ")
+  if err != nil {
+    return err
+  }
+  _, err = os.Stdout.Write(append(data, '\n'))
+  return err
+}
+
+// newReport counts the outcomes of the templates of a build.
+func newReport(reports []*TemplateReport) *Report {
+  summary := &Report{ Templates: reports }
+  for _, report := range reports {
+    switch report.Status {
+    case "ok":
+      summary.Succeeded++
+    case "failed":
+      summary.Failed++
+    default:
+      summary.Skipped++
+    }
+  }
+  if summary.Templates == nil {
+    summary.Templates = []*TemplateReport{}
+  }
+  return summary
+}
@@ -0,0 +1,287 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/runtime"
+  "os"
+  "fmt"
+  "path"
+  "sync"
+  "time"
+  "strings"
+  "context"
+  "os/exec"
+  "net/http"
+  "net/http/cgi"
+  "net/http/httptest"
+  "path/filepath"
+)
+
+// serveCommand implements "buildapp serve", a development web server for
+// the site root. It runs .cgi binaries, including index.cgi in place of a
+// directory listing, and serves other files as they are. With -build, the
+// template of a requested binary is built first if it is out of date, and
+// errors are shown in the browser. With -preview, or with -build when the
+// Go toolchain cannot be found, templates are interpreted instead. With
+// -reload, pages reload in the browser when their templates change.
+func serveCommand(args []string) int {
+  flags := newFlagSet("serve")
+  addSelectionFlags(flags)
+  addBuildFlags(flags)
+  var address string
+  var build, preview, reload bool
+  flags.StringVar(&address, "addr", "localhost:8080",
+      "the address on which to listen for HTTP requests")
+  flags.BoolVar(&build, "build", false,
+      "build templates when they are requested and show errors in the browser")
+  flags.BoolVar(&preview, "preview", false,
+      "interpret templates when they are requested instead of building them")
+  flags.BoolVar(&reload, "reload", false,
+      "reload pages in the browser when their templates change")
+  addLockFlags(flags)
+  flags.Parse(args)
+
+  err := resolveGlobals()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  handler := &siteHandler{ root: siteRoot, binRoot: binaryRoot() }
+  if build && !preview {
+    if _, err := exec.LookPath(GoPath); err != nil {
+      inform("%s is not available; previewing templates instead of " +
+          "building them\n", GoPath)
+      preview = true
+    }
+  }
+  if preview {
+    handler.builder = &requestBuilder{ args: flags.Args(), previews: true }
+  } else if build {
+    unlock, err := openManifestLocked()
+    if err == nil {
+      defer unlock()
+      err = prepareModule()
+    }
+    if err != nil {
+      fmt.Fprintf(messageFile, "%s\n", err.Error())
+      return 1
+    }
+    handler.builder = &requestBuilder{ args: flags.Args() }
+  }
+  if reload {
+    handler.reloader = newReloader(flags.Args(), handler.builder)
+  }
+  inform("serving %s at http://%s/\n", siteRoot, address)
+  err = http.ListenAndServe(address, handler)
+  fmt.Fprintf(messageFile, "%s\n", err.Error())
+  return 1
+}
+
+// siteHandler serves a site directory the way a CGI-enabled web server
+// would. Binaries are looked up under binRoot. If builder is not nil,
+// templates are built or previewed on request. If reloader is not nil, it
+// serves its own paths, and HTML responses load its script.
+type siteHandler struct {
+  root string
+  binRoot string
+  builder *requestBuilder
+  reloader *reloader
+}
+
+func (handler *siteHandler) ServeHTTP(w http.ResponseWriter,
+    r *http.Request) {
+  detail("%s %s\n", r.Method, r.URL.Path)
+  urlPath := path.Clean("/" + r.URL.Path)
+  if handler.reloader != nil {
+    if urlPath == reloadPath || urlPath == reloadScriptPath {
+      handler.reloader.ServeHTTP(w, r)
+      return
+    }
+    if r.Method != http.MethodHead {
+      injector := &reloadWriter{ ResponseWriter: w }
+      defer injector.finish()
+      w = injector
+    }
+  }
+  if handler.builder != nil && handler.builder.previews {
+    if !handler.builder.preview(w, r, urlPath) {
+      return  // The page was previewed.
+    }
+  } else if handler.builder != nil && !handler.builder.serve(w, urlPath) {
+    return  // An error page was served instead.
+  }
+
+  // Look for a binary among the leading components of the URL path. The
+  // rest of the path is passed to the binary as PATH_INFO.
+  parts := strings.Split(urlPath, "/")
+  for i := 2; i <= len(parts); i++ {
+    scriptName := strings.Join(parts[:i], "/")
+    if strings.HasSuffix(scriptName, ".cgi") {
+      binary := filepath.Join(handler.binRoot, filepath.FromSlash(scriptName))
+      if info, err := os.Stat(binary); err == nil && info.Mode().IsRegular() {
+        runCGI(w, r, binary, scriptName, false)
+        return
+      }
+    }
+  }
+
+  // A directory with an index.cgi binary is served by the binary.
+  filePath := filepath.Join(handler.root, filepath.FromSlash(urlPath))
+  info, err := os.Stat(filePath)
+  if err == nil && info.IsDir() {
+    binary := filepath.Join(handler.binRoot, filepath.FromSlash(urlPath),
+        "index.cgi")
+    if _, err := os.Stat(binary); err == nil {
+      runCGI(w, r, binary, path.Join(urlPath, "index.cgi"), true)
+      return
+    }
+  }
+  http.FileServer(http.Dir(handler.root)).ServeHTTP(w, r)
+}
+
+// runCGI executes a binary as a CGI script. If the binary stands in for a
+// directory, the request path is not passed on as PATH_INFO.
+func runCGI(w http.ResponseWriter, r *http.Request, binary,
+    scriptName string, isIndex bool) {
+  cgiHandler := &cgi.Handler{
+    Path: binary,
+    Root: scriptName,
+    Dir: filepath.Dir(binary),
+    Stderr: messageFile,
+  }
+  if isIndex {
+    cgiHandler.Env = []string{ "PATH_INFO=" }
+  }
+  cgiHandler.ServeHTTP(w, r)
+}
+
+// requestBuilder builds the templates of requested binaries for serve
+// -build, or previews them for serve -preview. It maps routes to templates
+// by a walk of the site, which is repeated when a request names an unknown
+// route, in case a template has been added.
+type requestBuilder struct {
+  args []string                // The templates to serve, or none for a walk.
+  previews bool                // Templates are previewed, not built.
+  mutex sync.Mutex             // Builds and walks happen one at a time.
+  routes map[string]string     // Maps routes to template paths.
+  walked time.Time             // The time of the last walk.
+}
+
+// routeWalkInterval limits how often unknown routes cause a walk.
+const routeWalkInterval = 2*time.Second
+
+// serve builds the template whose binary serves a URL path if the binary
+// is out of date. It reports whether the request can go on to the binary
+// or file; if the build fails, it writes an error page and returns false.
+func (builder *requestBuilder) serve(w http.ResponseWriter,
+    urlPath string) bool {
+  builder.mutex.Lock()
+  defer builder.mutex.Unlock()
+  _, templatePath := builder.route(urlPath)
+  if templatePath == "" {
+    return true
+  }
+  if report := builder.build(templatePath); report != nil {
+    writeErrorPage(w, report)
+    return false
+  }
+  return true
+}
+
+// build builds a template if its binary is out of date, and returns the
+// report of the build if it failed, or nil. The mutex must be held.
+func (builder *requestBuilder) build(templatePath string) *TemplateReport {
+  goCodePath, binaryPath, err := outputPaths(templatePath)
+  if err == nil && rebuildReason(templatePath, goCodePath, binaryPath) == "" {
+    return nil
+  }
+  log := newTemplateLog(templatePath)
+  report := processTemplate(context.Background(), templatePath, log)
+  log.finish()
+  if err := manifest.save(manifestPath); err != nil {
+    globalLog.errorf("%s\n", err.Error())
+  }
+  if !report.failed() {
+    return nil
+  }
+  return report
+}
+
+// preview serves a URL path with the template whose binary would serve
+// it, interpreting the template instead of building it. The page runs at
+// its route with the deadline, as in the single server. It reports whether
+// the request can go on to a file, as when no template serves the path; if
+// the preview fails, it writes an error page and returns false.
+func (builder *requestBuilder) preview(w http.ResponseWriter,
+    r *http.Request, urlPath string) bool {
+  builder.mutex.Lock()
+  route, templatePath := builder.route(urlPath)
+  builder.mutex.Unlock()
+  if templatePath == "" {
+    return true
+  }
+  reports := make(chan *TemplateReport, 1)
+  mux := http.NewServeMux()
+  runtime.HandlePage(mux, route, func (w http.ResponseWriter,
+      r *http.Request) {
+    reports <- previewTemplate(w, r, templatePath)
+  })
+  recorder := httptest.NewRecorder()
+  mux.ServeHTTP(recorder, r)
+  select {
+  case report := <-reports:
+    if report != nil {
+      writeErrorPage(w, report)
+      return false
+    }
+  default:  // The page ran past its deadline.
+  }
+  for name, values := range recorder.Header() {
+    w.Header()[name] = values
+  }
+  w.WriteHeader(recorder.Code)
+  w.Write(recorder.Body.Bytes())
+  return false
+}
+
+// route returns the route and the template of the binary that serves a
+// URL path, walking the site again if the path is unknown. The mutex must
+// be held.
+func (builder *requestBuilder) route(urlPath string) (string, string) {
+  route, templatePath := builder.template(urlPath)
+  if templatePath == "" && time.Since(builder.walked) > routeWalkInterval {
+    builder.walk()
+    route, templatePath = builder.template(urlPath)
+  }
+  return route, templatePath
+}
+
+// template returns the route and the template of the binary that serves a
+// URL path, or "" if there is none. The binary may be named by a leading
+// part of the path, as it is given PATH_INFO, or stand in for a directory.
+func (builder *requestBuilder) template(urlPath string) (string, string) {
+  parts := strings.Split(urlPath, "/")
+  for i := 2; i <= len(parts); i++ {
+    route := strings.Join(parts[:i], "/")
+    if templatePath := builder.routes[route]; templatePath != "" {
+      return route, templatePath
+    }
+  }
+  route := strings.TrimSuffix(urlPath, "/") + "/"
+  return route, builder.routes[route]
+}
+
+// walk finds the routes of the templates.
+func (builder *requestBuilder) walk() {
+  builder.routes = map[string]string{}
+  builder.walked = time.Now()
+  forEachTemplate(builder.args, false, func (templatePath string) {
+    _, binaryPath, err := outputPaths(templatePath)
+    if err != nil {
+      return
+    }
+    absPath, _ := filepath.Abs(binaryPath)
+    if route := routeFor(binaryRoot(), absPath); route != "" {
+      builder.routes[route] = templatePath
+    }
+  })
+}
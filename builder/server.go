@@ -0,0 +1,309 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "os/exec"
+  "fmt"
+  "bufio"
+  "regexp"
+  "strings"
+  "path/filepath"
+  "text/template"
+)
+
+// serverCommand implements "buildapp server", which compiles the whole site
+// into one Go program that serves every page from a single process. Each
+// template becomes a package under <dir>/pages whose Handler function
+// serves the page with a runtime context of its own, and <dir>/main.go
+// routes the URL path that the page's CGI binary would have to that
+// handler. Other files are served from the directory given to the
+// server's -root flag. The pages directory is regenerated on every run.
+// Assets cannot be embedded in the server, and -fastcgi, -lambda, and
+// -wasi do not apply.
+func serverCommand(args []string) int {
+  flags := newFlagSet("server")
+  addSelectionFlags(flags)
+  addBuildFlags(flags)
+  var serverDir, serverBinary string
+  flags.StringVar(&serverDir, "dir", "",
+      "the directory of the server's Go code (default <module root>/server)")
+  flags.StringVar(&serverBinary, "o", "",
+      "the path of the server binary (default <dir>/site-server)")
+  addLockFlags(flags)
+  flags.Parse(args)
+
+  unlock, err := openManifestLocked()
+  if err == nil {
+    defer unlock()
+    switch {
+    case embedAssets:
+      err = fmt.Errorf("the server cannot embed assets; drop -embed")
+    case fastCGI:
+      err = fmt.Errorf("the server does not run under FastCGI; drop -fastcgi")
+    case lambdaTarget:
+      err = fmt.Errorf("the server does not run on Lambda; drop -lambda")
+    case wasiTarget:
+      err = fmt.Errorf("the server does not run under WASI; drop -wasi")
+    default:
+      err = prepareModule()
+    }
+  }
+  if err == nil {
+    serverDir, err = resolveServerDir(serverDir)
+  }
+  if err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return 1
+  }
+  if serverBinary == "" {
+    serverBinary = filepath.Join(serverDir, "site-server")
+  }
+  pagesDir := filepath.Join(serverDir, "pages")
+  if err := os.RemoveAll(pagesDir); err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return 1
+  }
+  ctx, stop := interruptContext()
+  defer stop()
+
+  paths := []string{}
+  forEachFile(flags.Args(), true, func (path string) {
+    paths = append(paths, path)
+  }, exportAsset)
+  reports := []*TemplateReport{}
+  pages := []serverPage{}
+  for _, path := range paths {
+    if ctx.Err() != nil {
+      break
+    }
+    log := newTemplateLog(path)
+    report, page := generatePage(path, pagesDir, log)
+    log.finish()
+    reports = append(reports, report)
+    if !report.failed() {
+      pages = append(pages, page)
+    }
+  }
+  if ctx.Err() != nil {
+    printFailureSummary(reports, len(paths), "interrupted")
+    return interruptedStatus
+  }
+  printFailureSummary(reports, len(paths), "")
+  for _, report := range reports {
+    if report.failed() {
+      return 1
+    }
+  }
+  if err := writeServerMain(serverDir, pages); err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return 1
+  }
+  inform("compiling %s\n", serverBinary)
+  cmd := exec.CommandContext(ctx, GoPath, goBuildArgs(serverBinary, ".")...)
+  cmd.Dir = serverDir
+  cmd.Env = buildEnv()
+  output, err := cmd.CombinedOutput()
+  if ctx.Err() != nil {
+    return interruptedStatus
+  }
+  if err != nil {
+    globalLog.errorf("compilation error: %s\n", err)
+    for _, e := range compilerErrors(string(output), serverDir) {
+      for _, page := range pages {
+        e = templatePosition(e, page.goFile, page.sourceMap)
+      }
+      globalLog.errorf("  %s\n", e.String())
+    }
+    return 1
+  }
+  if err := setPermissions(serverBinary, binaryMode); err != nil {
+    globalLog.errorf("%s\n", err.Error())
+    return 1
+  }
+  globalLog.result("wrote %s with %d pages\n", serverBinary, len(pages))
+  return 0
+}
+
+// serverPage is a template compiled into a package of the server.
+type serverPage struct {
+  Route string        // The URL path at which the page is served.
+  ImportPath string   // The import path of the page's package.
+  goFile string       // The generated file of the package.
+  sourceMap *apptemplate.SourceMap
+}
+
+// resolveServerDir makes the server directory absolute, defaulting to
+// a directory in the module root. The server must lie within the module
+// so that it can import its pages.
+func resolveServerDir(dir string) (string, error) {
+  if dir == "" {
+    dir = filepath.Join(moduleRoot, "server")
+  }
+  dir, err := filepath.Abs(dir)
+  if err != nil {
+    return "", err
+  }
+  rel, err := filepath.Rel(moduleRoot, dir)
+  if err != nil || rel == ".." ||
+      strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+    return "", fmt.Errorf("-dir %s is outside the module in %s", dir,
+        moduleRoot)
+  }
+  return dir, nil
+}
+
+// unsafePathChars matches the characters that are replaced in the package
+// directories of pages so that every directory is a valid import path
+// element.
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// pageDir returns the package directory of a template: its path relative
+// to the site root, without the template extension, under the pages
+// directory.
+func pageDir(path, pagesDir string) (string, error) {
+  absPath, err := filepath.Abs(path)
+  if err != nil {
+    return "", err
+  }
+  rel, err := filepath.Rel(siteRoot, absPath)
+  if err != nil || strings.HasPrefix(rel, "..") {
+    return "", fmt.Errorf("%s is outside the site root", path)
+  }
+  rel = strings.TrimSuffix(rel, templateExtension(rel))
+  elements := strings.Split(filepath.ToSlash(rel), "/")
+  for i, element := range elements {
+    elements[i] = unsafePathChars.ReplaceAllString(element, "_")
+  }
+  return filepath.Join(pagesDir, filepath.Join(elements...)), nil
+}
+
+// generatePage writes the package of a template for the server and
+// reports the outcome in the manner of a build.
+func generatePage(path, pagesDir string,
+    log *templateLog) (*TemplateReport, serverPage) {
+  report := &TemplateReport{ Template: path, Status: "ok" }
+  page := serverPage{}
+  dir, err := pageDir(path, pagesDir)
+  if err == nil {
+    err = os.MkdirAll(dir, 0755)
+  }
+  var outFile *os.File
+  if err == nil {
+    page.goFile = filepath.Join(dir, "page.go")
+    outFile, err = os.Create(page.goFile)
+  }
+  if err != nil {
+    log.errorf("%s\n", err.Error())
+    report.fail("create", BuildError{ Message: err.Error() })
+    return report, page
+  }
+  report.GoFile = page.goFile
+  log.inform("parsing %s\n", path)
+  writer := bufio.NewWriter(outFile)
+  options := templateOptions(log)
+  options.Handler, options.Package = true, "page"
+  result, err := apptemplate.Process(siteRoot, path, writer, options)
+  writer.Flush()
+  outFile.Close()
+  if err != nil {
+    report.failGeneration(err, page.goFile)
+    return report, page
+  }
+  report.result = result
+  report.noteWarnings(result, log)
+  report.Sizes = result.Sizes
+  if fingerprintAssets {
+    err = writeFingerprinted(result, log)
+    if err != nil {
+      log.errorf("%s\n", err.Error())
+      report.fail("fingerprint", BuildError{ Message: err.Error() })
+      return report, page
+    }
+  }
+  page.sourceMap = result.SourceMap
+  _, binaryPath, err := outputPaths(path)
+  if err == nil {
+    binaryPath, err = filepath.Abs(binaryPath)
+  }
+  if err == nil {
+    page.Route = routeFor(binaryRoot(), binaryPath)
+  }
+  if page.Route == "" {
+    err = fmt.Errorf("%s has no route under %s", path, binaryRoot())
+    log.errorf("%s\n", err.Error())
+    report.fail("create", BuildError{ Message: err.Error() })
+    return report, page
+  }
+  rel, _ := filepath.Rel(moduleRoot, dir)
+  page.ImportPath = modulePath + "/" + filepath.ToSlash(rel)
+  log.inform("created %s for %s\n", page.goFile, page.Route)
+  return report, page
+}
+
+// singleArgs reports whether the arguments of build include -single, in
+// which case the site is compiled into one server, and returns the other
+// arguments, which are passed to the server command. The flags of the
+// server command, such as -dir and -o, are thus accepted with -single.
+func singleArgs(args []string) ([]string, bool) {
+  single := false
+  rest := []string{}
+  for i, arg := range args {
+    if arg == "--" {
+      rest = append(rest, args[i:]...)
+      break
+    }
+    switch strings.TrimPrefix(arg, "-") {
+    case "-single", "single", "-single=true", "single=true":
+      single = true
+    case "-single=false", "single=false":
+    default:
+      rest = append(rest, arg)
+    }
+  }
+  return rest, single
+}
+
+// serverMain is the main package of the server.
+var serverMain = template.Must(template.New("server").Parse(
+`// Code generated by buildapp server. DO NOT EDIT.
+
+package main
+
+import (
+  "net/http"
+  "{{.Runtime}}"
+{{- range $i, $page := .Pages}}
+  p{{$i}} "{{$page.ImportPath}}"
+{{- end}}
+)
+
+func main() {
+  mux := http.NewServeMux()
+{{- range $i, $page := .Pages}}
+  runtime.HandlePage(mux, {{printf "%q" $page.Route}}, p{{$i}}.Handler)
+{{- end}}
+  runtime.ServeSite(mux)
+}
+`))
+
+// writeServerMain writes the main package of the server, which routes
+// requests to the pages.
+func writeServerMain(serverDir string, pages []serverPage) error {
+  mainPath := filepath.Join(serverDir, "main.go")
+  file, err := os.Create(mainPath)
+  if err != nil {
+    return err
+  }
+  err = serverMain.Execute(file, struct {
+    Runtime string
+    Pages []serverPage
+  }{ runtimeImport, pages })
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    inform("created %s\n", mainPath)
+  }
+  return err
+}
@@ -0,0 +1,151 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+  "net/http"
+)
+
+// smokeCommand implements "buildapp smoke": it requests the route of every
+// template in the manifest from a deployed site and checks that the status
+// code is the one declared by "status" in the template's meta tags (200 by
+// default). The response headers are checked against the assertions
+// described at checkHeaders. Templates declaring "smoke: skip" are not
+// requested. The return value is the process exit code.
+func smokeCommand(args []string) int {
+  flags := newFlagSet("smoke")
+  var base string
+  var timeout time.Duration
+  flags.StringVar(&base, "base", "",
+      "the base URL of the deployed site, such as https://example.com")
+  flags.DurationVar(&timeout, "timeout", 10*time.Second,
+      "the time limit for each request")
+  flags.Parse(args)
+
+  if base == "" {
+    fmt.Fprintf(messageFile, "smoke: -base is required\n")
+    return 2
+  }
+  base = strings.TrimSuffix(base, "/")
+  err := openManifest()
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+
+  // Redirects are reported rather than followed so that a template can
+  // declare a 3xx status.
+  client := &http.Client{
+    Timeout: timeout,
+    CheckRedirect: func (req *http.Request, via []*http.Request) error {
+      return http.ErrUseLastResponse
+    },
+  }
+
+  checked, failed := 0, 0
+  for _, entry := range manifest.sortedEntries() {
+    if entry.Route == "" || entry.Meta.Get("smoke") == "skip" {
+      continue
+    }
+    url := base + entry.Route
+    problems := smokeTest(client, url, entry)
+    checked++
+    if len(problems) == 0 {
+      inform("ok   %s\n", url)
+      continue
+    }
+    failed++
+    for _, problem := range problems {
+      fmt.Fprintf(messageFile, "FAIL %s: %s\n", url, problem)
+    }
+  }
+
+  fmt.Fprintf(messageFile, "%d of %d routes failed\n", failed, checked)
+  if failed != 0 {
+    return 1
+  }
+  return 0
+}
+
+// smokeTest requests a single URL and returns a list of problems with the
+// response. An empty list means that the route passed.
+func smokeTest(client *http.Client, url string,
+    entry *ManifestEntry) []string {
+  expected := http.StatusOK
+  if status := entry.Meta.Get("status"); status != "" {
+    code, err := strconv.Atoi(status)
+    if err != nil {
+      return []string{ fmt.Sprintf("invalid status in meta: %q", status) }
+    }
+    expected = code
+  }
+  request, err := http.NewRequest("GET", url, nil)
+  if err != nil {
+    return []string{ err.Error() }
+  }
+  // Setting Accept-Encoding ourselves stops the client from decompressing
+  // the body transparently, so the Content-Encoding header stays visible.
+  if isTrue(entry.Meta.Get("require-gzip")) {
+    request.Header.Set("Accept-Encoding", "gzip")
+  }
+  response, err := client.Do(request)
+  if err != nil {
+    return []string{ err.Error() }
+  }
+  response.Body.Close()
+  problems := []string{}
+  if response.StatusCode != expected {
+    problems = append(problems, fmt.Sprintf("expected status %d, got %d",
+        expected, response.StatusCode))
+  }
+  return append(problems, checkHeaders(entry.Meta, response.Header)...)
+}
+
+// checkHeaders verifies response headers against the policies declared in
+// meta tags and returns a description of each violation:
+//   require-header: Name           the header must be present
+//   require-header: Name: value    the header must contain value
+//   forbid-header: Name            the header must be absent
+//   require-gzip: true             the response must be gzip-encoded
+// The first two keys can be declared several times.
+func checkHeaders(meta apptemplate.Meta, header http.Header) []string {
+  problems := []string{}
+  for _, rule := range meta.Values("require-header") {
+    name, value := rule, ""
+    if colon := strings.Index(rule, ":"); colon != -1 {
+      name = strings.TrimSpace(rule[:colon])
+      value = strings.TrimSpace(rule[colon+1:])
+    }
+    actual, present := header[http.CanonicalHeaderKey(name)]
+    if !present {
+      problems = append(problems, fmt.Sprintf("missing header %s", name))
+    } else if value != "" &&
+        !strings.Contains(strings.Join(actual, ", "), value) {
+      problems = append(problems, fmt.Sprintf("header %s is %q, want %q",
+          name, strings.Join(actual, ", "), value))
+    }
+  }
+  for _, name := range meta.Values("forbid-header") {
+    if values, present := header[http.CanonicalHeaderKey(name)]; present {
+      problems = append(problems, fmt.Sprintf("forbidden header %s: %s",
+          name, strings.Join(values, ", ")))
+    }
+  }
+  if isTrue(meta.Get("require-gzip")) &&
+      !strings.Contains(header.Get("Content-Encoding"), "gzip") {
+    problems = append(problems, "response is not gzip-encoded")
+  }
+  return problems
+}
+
+// isTrue interprets a meta value as a boolean.
+func isTrue(value string) bool {
+  switch strings.ToLower(value) {
+  case "true", "yes", "on", "1":
+    return true
+  }
+  return false
+}
@@ -0,0 +1,47 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "encoding/json"
+)
+
+// writeSourceMaps is set by -sourcemap or the sourceMap setting. The
+// source map of each generated .go file is then written beside it as a
+// JSON file, so that other tools can relate the generated code to the
+// templates.
+var writeSourceMaps bool
+
+// mapPath returns the path of the source map file of a generated .go file.
+func mapPath(goCodePath string) string {
+  return goCodePath + ".map"
+}
+
+// writeSourceMap writes the source map file of a generated .go file.
+func writeSourceMap(goCodePath string, result *apptemplate.Result,
+    log *templateLog) error {
+  code, err := os.ReadFile(goCodePath)
+  if err != nil {
+    return err
+  }
+  data, err := json.MarshalIndent(result.SourceMap.MapFile(code, goCodePath),
+      "", "  ")
+  if err != nil {
+    return err
+  }
+  path := mapPath(goCodePath)
+  if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+    return err
+  }
+  log.inform("created %s\n", path)
+  return setPermissions(path, goMode)
+}
+
+// removeSourceMap deletes the source map file of an earlier build, if any.
+func removeSourceMap(goCodePath string) error {
+  err := os.Remove(mapPath(goCodePath))
+  if os.IsNotExist(err) {
+    return nil
+  }
+  return err
+}
@@ -0,0 +1,91 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+  "path/filepath"
+)
+
+// statusCommand implements "buildapp status", which compares the manifest
+// with the files on disk and lists the pages that are out of date. A page
+// is modified if the contents of its templates or embedded assets have
+// changed since it was built, and stale if its binary no longer matches
+// the one that was built. With -deploy, the binaries in a deployed copy of
+// the binary tree are checked as well. The exit code is 1 if any page is
+// out of date.
+func statusCommand(args []string) int {
+  flags := newFlagSet("status")
+  var deployDir string
+  flags.StringVar(&deployDir, "deploy", "",
+      "a deployed copy of the binary tree to compare with the build")
+  flags.Parse(args)
+
+  err := openManifest()
+  if err == nil && deployDir != "" {
+    deployDir, err = filepath.Abs(deployDir)
+  }
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  status := 0
+  for _, entry := range manifest.sortedEntries() {
+    state, reason := entryStatus(entry, deployDir)
+    name := entry.Route
+    if name == "" {
+      name = sitePath(entry.Template)
+    }
+    if state == "ok" {
+      detail("%-10s %s\n", state, name)
+      continue
+    }
+    status = 1
+    fmt.Printf("%-10s %s (%s)\n", state, name, reason)
+  }
+  return status
+}
+
+// entryStatus works out the state of a page: "ok", "failed", "modified",
+// "stale", or "undeployed", with the reason for any state but "ok".
+func entryStatus(entry *ManifestEntry, deployDir string) (state,
+    reason string) {
+  if entry.Failed {
+    return "failed", "the last build failed"
+  }
+  if entry.InputHash == "" || entry.BinaryHash == "" {
+    return "modified", "never built completely"
+  }
+  inputHash, err := hashFiles(entry.Inputs...)
+  if err != nil {
+    return "modified", err.Error()
+  }
+  if inputHash != entry.InputHash {
+    return "modified", "templates or assets changed since the build"
+  }
+  binaryHash, err := hashFile(entry.Binary)
+  if err != nil {
+    return "stale", err.Error()
+  }
+  if binaryHash != entry.BinaryHash {
+    return "stale", sitePath(entry.Binary) + " differs from the build"
+  }
+  if deployDir == "" {
+    return "ok", ""
+  }
+  relPath, err := filepath.Rel(binaryRoot(), entry.Binary)
+  if err != nil {
+    return "undeployed", err.Error()
+  }
+  deployedPath := filepath.Join(deployDir, relPath)
+  deployedHash, err := hashFile(deployedPath)
+  if os.IsNotExist(err) {
+    return "undeployed", deployedPath + " is missing"
+  }
+  if err != nil {
+    return "undeployed", err.Error()
+  }
+  if deployedHash != binaryHash {
+    return "undeployed", deployedPath + " differs from the build"
+  }
+  return "ok", ""
+}
@@ -0,0 +1,61 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "flag"
+  "fmt"
+  "strings"
+)
+
+// unknownTags is set by -unknowntags or the unknownTags setting to allow,
+// warn, or error. It says what becomes of text in a template that looks
+// like a tag but is not one, such as <?inserr x ?>.
+var unknownTags string
+
+// passTags is set by -passtags or the passTags setting. It lists the names
+// of unknown tags, such as php, that are meant to be passed through.
+var passTags string
+
+// tagCheck is the parser's treatment of unknown tags, made from
+// unknownTags by resolveStrict.
+var tagCheck apptemplate.TagCheck
+
+// addStrictFlags adds the flags that check templates for unknown tags.
+func addStrictFlags(flags *flag.FlagSet) {
+  flags.StringVar(&unknownTags, "unknowntags", "",
+      "allow, warn, or error on unknown tags such as <?inserr ?> "+
+      "(default allow)")
+
+  flags.StringVar(&passTags, "passtags", "",
+      "a comma-separated list of unknown tags to pass through, such as php")
+}
+
+// resolveStrict takes the treatment of unknown tags from the configuration
+// unless it is given on the command line, and checks it.
+func resolveStrict() error {
+  if unknownTags == "" {
+    unknownTags = config.UnknownTags
+  }
+  if passTags == "" {
+    passTags = config.PassTags
+  }
+  switch unknownTags {
+  case "", "allow":
+    tagCheck = apptemplate.AllowUnknownTags
+  case "warn":
+    tagCheck = apptemplate.WarnUnknownTags
+  case "error":
+    tagCheck = apptemplate.RejectUnknownTags
+  default:
+    return fmt.Errorf("-unknowntags must be allow, warn, or error, not %q",
+        unknownTags)
+  }
+  return nil
+}
+
+// passTagList returns the tags that are passed through as a list.
+func passTagList() []string {
+  return strings.FieldsFunc(passTags, func(r rune) bool {
+    return r == ',' || r == ' '
+  })
+}
@@ -0,0 +1,136 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "os"
+  "fmt"
+  "bytes"
+  "errors"
+  "strconv"
+  "strings"
+  "encoding/json"
+  "path/filepath"
+)
+
+// vendorRuntime is set by -vendorruntime. The source of the runtime
+// package is then copied into the module in which generated programs are
+// built, under vendoredRuntimeDir, and the programs import that copy. No
+// module needs to be fetched to build them, which suits air-gapped hosts.
+var vendorRuntime bool
+
+// vendoredRuntimeDir is the location of the copied runtime relative to
+// the module root.
+const vendoredRuntimeDir = "internal/boomerang/runtime"
+
+// runtimeImport is the import path of the runtime package in generated
+// programs. It is set by prepareModule when the runtime is vendored.
+var runtimeImport = apptemplate.RuntimePath
+
+// runtimeSource returns the directory that holds the source of the runtime
+// package: the one in -runtimedir, or else the one in the module cache for
+// the runtime version, which is downloaded if necessary.
+func runtimeSource() (string, error) {
+  if runtimeDir != "" {
+    return filepath.Join(runtimeDir, "runtime"), nil
+  }
+  if runtimeVersion == "" {
+    return "", errors.New("-vendorruntime needs -runtimedir or " +
+        "-runtimeversion to find the runtime source")
+  }
+  output, err := runGo("mod", "download", "-json",
+      boomerangModule+"@"+runtimeVersion)
+  if err != nil {
+    return "", err
+  }
+  var download struct { Dir, Error string }
+  err = json.Unmarshal([]byte(output), &download)
+  if err == nil && download.Error != "" {
+    err = errors.New(download.Error)
+  }
+  if err != nil {
+    return "", err
+  }
+  return filepath.Join(download.Dir, "runtime"), nil
+}
+
+// copyRuntime copies the runtime source into the module whose path is
+// given and points runtimeImport at the copy. Files left from an earlier
+// copy are replaced. The helpers package is copied too, if the runtime
+// has one.
+func copyRuntime(modulePath string) error {
+  sourceDir, err := runtimeSource()
+  if err != nil {
+    return err
+  }
+  names, err := filepath.Glob(filepath.Join(sourceDir, "*.go"))
+  if err != nil {
+    return err
+  }
+  if len(names) == 0 {
+    return fmt.Errorf("no runtime source in %s", sourceDir)
+  }
+  targetDir := filepath.Join(moduleRoot, filepath.FromSlash(vendoredRuntimeDir))
+  err = os.RemoveAll(targetDir)
+  if err == nil {
+    err = os.MkdirAll(targetDir, 0755)
+  }
+  if err != nil {
+    return err
+  }
+  for _, name := range names {
+    if strings.HasSuffix(name, "_test.go") {
+      continue
+    }
+    targetPath := filepath.Join(targetDir, filepath.Base(name))
+    err = copyFile(name, targetPath, globalLog)
+    if err == nil {
+      err = setPermissions(targetPath, goMode)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  if err := copyHelpers(sourceDir, targetDir,
+      modulePath + "/" + vendoredRuntimeDir); err != nil {
+    return err
+  }
+  runtimeImport = modulePath + "/" + vendoredRuntimeDir
+  inform("vendored the runtime as %s\n", runtimeImport)
+  return nil
+}
+
+// copyHelpers copies the source of the helpers package from the runtime
+// source to the copy of the runtime, rewriting its import of the runtime
+// to the copy's path.
+func copyHelpers(sourceDir, targetDir, copyImport string) error {
+  names, err := filepath.Glob(filepath.Join(sourceDir, "helpers", "*.go"))
+  if err != nil || len(names) == 0 {
+    return err
+  }
+  targetDir = filepath.Join(targetDir, "helpers")
+  if err := os.MkdirAll(targetDir, 0755); err != nil {
+    return err
+  }
+  for _, name := range names {
+    if strings.HasSuffix(name, "_test.go") {
+      continue
+    }
+    source, err := os.ReadFile(name)
+    if err != nil {
+      return err
+    }
+    source = bytes.ReplaceAll(source,
+        []byte(strconv.Quote(apptemplate.RuntimePath)),
+        []byte(strconv.Quote(copyImport)))
+    targetPath := filepath.Join(targetDir, filepath.Base(name))
+    err = os.WriteFile(targetPath, source, 0644)
+    if err == nil {
+      err = setPermissions(targetPath, goMode)
+    }
+    if err != nil {
+      return err
+    }
+    globalLog.inform("copied %s\n", targetPath)
+  }
+  return nil
+}
@@ -0,0 +1,75 @@
+package builder
+
+import (
+  "github.com/michaellaszlo/boomerang/apptemplate"
+  "context"
+  "os/exec"
+  "strings"
+  "path/filepath"
+)
+
+// runVet is set by -vet, which runs go vet on the generated code of each
+// template after it is compiled.
+var runVet bool
+
+// analyzerCommand, set by -analyzer, is a further command, such as
+// staticcheck, that is run on the generated files. The names of the files
+// are appended to its arguments.
+var analyzerCommand string
+
+// vetCode runs go vet and the analyzer, if they are enabled, on the
+// generated files of a template and reports whether they found nothing.
+// Positions in the generated code are mapped back to template lines
+// through the source map, which is nil after -compile-only.
+func vetCode(ctx context.Context, sources []string,
+    sourceMap *apptemplate.SourceMap, report *TemplateReport,
+    log *templateLog) bool {
+  commands := [][]string{}
+  if runVet {
+    args := []string{ GoPath, "vet", "-mod=mod" }
+    if buildTags != "" {
+      args = append(args, "-tags", buildTags)
+    }
+    commands = append(commands, args)
+  }
+  if fields := strings.Fields(analyzerCommand); len(fields) != 0 {
+    commands = append(commands, fields)
+  }
+  clean := true
+  for _, args := range commands {
+    log.inform("running %s on %s\n", filepath.Base(args[0]), sources[0])
+    cmd := exec.CommandContext(ctx, args[0], append(args[1:], sources...)...)
+    cmd.Dir = moduleRoot
+    cmd.Env = buildEnv()
+    output, err := cmd.CombinedOutput()
+    if err == nil || ctx.Err() != nil {
+      continue  // An interrupt is not a finding.
+    }
+    clean = false
+    errs := compilerErrors(strings.ReplaceAll(string(output), "\nvet: ",
+        "\n"), moduleRoot)
+    for i := range errs {
+      errs[i] = templatePosition(errs[i], sources[0], sourceMap)
+      log.errorf("%s\n", errs[i].String())
+    }
+    report.fail("vet", errs...)
+  }
+  return clean
+}
+
+// templatePosition moves an error in a generated file to the template line
+// that the source map gives for it. The column is dropped because it
+// refers to the generated code.
+func templatePosition(e BuildError, goCodePath string,
+    sourceMap *apptemplate.SourceMap) BuildError {
+  absGoPath, _ := filepath.Abs(goCodePath)
+  if absPath, _ := filepath.Abs(e.File); absPath != absGoPath {
+    return e
+  }
+  position, ok := sourceMap.Lookup(e.Line)
+  if !ok {
+    return e
+  }
+  e.File, e.Line, e.Column = position.Path, position.Line, 0
+  return e
+}
@@ -0,0 +1,80 @@
+package builder
+
+import (
+  "os"
+  "path/filepath"
+)
+
+// followLinks makes the walk descend into symbolic links to directories.
+var followLinks bool
+
+// walkTree is like filepath.Walk except in its treatment of symbolic links
+// to directories. If followLinks is true, the walk descends into them and
+// the walk function receives information about the link target. Every
+// directory is entered only once, however many links lead to it, so that
+// link cycles end. If followLinks is false, linked directories are skipped
+// with a message.
+func walkTree(root string, fn filepath.WalkFunc) error {
+  info, err := os.Stat(root)
+  if err != nil {
+    return fn(root, nil, err)
+  }
+  return walkPath(root, info, fn, map[string]bool{})
+}
+
+// walkPath walks the tree at path, recording each directory that it enters
+// in visited by its path with symbolic links resolved.
+func walkPath(path string, info os.FileInfo, fn filepath.WalkFunc,
+    visited map[string]bool) error {
+  if info.Mode() & os.ModeSymlink != 0 {
+    target, err := os.Stat(path)
+    if err == nil && target.IsDir() {
+      if !followLinks {
+        inform("skipping linked directory %s\n", path)
+        return nil
+      }
+      info = target
+    }
+  }
+  if !info.IsDir() {
+    return fn(path, info, nil)
+  }
+
+  resolved, err := filepath.EvalSymlinks(path)
+  if err == nil {
+    resolved, err = filepath.Abs(resolved)
+  }
+  if err != nil {
+    resolved = path
+  }
+  if visited[resolved] {
+    detail("skipping %s, which was already visited\n", path)
+    return nil
+  }
+  visited[resolved] = true
+
+  err = fn(path, info, nil)
+  if err == filepath.SkipDir {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  entries, err := os.ReadDir(path)
+  if err != nil {
+    return fn(path, info, err)
+  }
+  for _, entry := range entries {
+    childPath := filepath.Join(path, entry.Name())
+    childInfo, err := os.Lstat(childPath)
+    if err != nil {
+      err = fn(childPath, nil, err)
+    } else {
+      err = walkPath(childPath, childInfo, fn, visited)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,102 @@
+package builder
+
+import (
+  "os"
+  "fmt"
+  "time"
+)
+
+// watchCommand implements "buildapp watch", which builds the selected
+// templates and then polls them, along with every template they insert,
+// rebuilding each one whose files have been modified since it was built.
+// New templates that turn up in the walk are built as well, and modified
+// assets are exported again. It runs until it is interrupted, saving the
+// manifest before it exits with interruptedStatus.
+func watchCommand(args []string) int {
+  flags := newFlagSet("watch")
+  addSelectionFlags(flags)
+  addBuildFlags(flags)
+  var interval time.Duration
+  flags.DurationVar(&interval, "interval", time.Second,
+      "the time between checks for modified templates")
+  addLockFlags(flags)
+  flags.Parse(args)
+
+  unlock, err := openManifestLocked()
+  if err == nil {
+    defer unlock()
+    err = prepareModule()
+  }
+  if err != nil {
+    fmt.Fprintf(messageFile, "%s\n", err.Error())
+    return 1
+  }
+  ctx, stop := interruptContext()
+  defer stop()
+
+  // We remember the files that went into each template and the latest
+  // modification time among them when the template was last built.
+  type watchState struct {
+    files []string
+    modTime time.Time
+  }
+  watched := map[string]*watchState{}
+  announce := true
+  for {
+    changed := false
+    forEachFile(flags.Args(), announce, func (path string) {
+      if ctx.Err() != nil {
+        return
+      }
+      state := watched[path]
+      if state != nil && !latestModTime(state.files).After(state.modTime) {
+        return
+      }
+      files := []string{ path }
+      modTime := latestModTime(files)
+      log := newTemplateLog(path)
+      report := processTemplate(ctx, path, log)
+      log.finish()
+      if report.result != nil {
+        files = report.result.Templates
+        if embedAssets || fingerprintAssets {  // The output depends on them.
+          files = append(files, report.result.Assets...)
+        }
+        modTime = latestModTime(files)
+      }
+      watched[path] = &watchState{ files: files, modTime: modTime }
+      changed = true
+    }, exportAsset)
+    if changed || ctx.Err() != nil {
+      err = manifest.save(manifestPath)
+      if err != nil {
+        fmt.Fprintf(messageFile, "%s\n", err.Error())
+      }
+    }
+    if ctx.Err() != nil {
+      inform("interrupted\n")
+      return interruptedStatus
+    }
+    if changed {
+      inform("watching for changes\n")
+    }
+    announce = false
+    select {
+    case <-ctx.Done():
+    case <-time.After(interval):
+    }
+  }
+}
+
+// latestModTime returns the most recent modification time among the named
+// files. Files that cannot be examined are skipped.
+func latestModTime(paths []string) time.Time {
+  var latest time.Time
+  for _, path := range paths {
+    info, err := os.Stat(path)
+    if err == nil && info.ModTime().After(latest) {
+      latest = info.ModTime()
+    }
+  }
+  return latest
+}
@@ -0,0 +1,68 @@
+package runtime
+
+import (
+  "os"
+  "io/fs"
+  "mime"
+  "path"
+  "bufio"
+  "fmt"
+  "strings"
+)
+
+// assets holds the static files embedded in the program by buildapp's
+// -embed mode, keyed by their slash-separated paths under the site root.
+// It is nil if nothing was embedded.
+var assets fs.FS
+
+
+//--- Embedded static assets
+
+// EmbedAssets is called by the code that buildapp generates in -embed mode
+// with the directory of the embedded file system that mirrors the site
+// root. If the request names an embedded asset in its PATH_INFO, the asset
+// is written out as a complete CGI response and the program exits.
+func EmbedAssets(fsys fs.FS, dir string) {
+  sub, err := fs.Sub(fsys, dir)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "runtime: %s\n", err.Error())
+    return
+  }
+  assets = sub
+  pathInfo := os.Getenv("PATH_INFO")
+  if pathInfo == "" {
+    return
+  }
+  data, err := Asset(pathInfo)
+  if err != nil {
+    return
+  }
+  contentType := mime.TypeByExtension(path.Ext(pathInfo))
+  if contentType == "" {
+    contentType = "application/octet-stream"
+  }
+  writer := bufio.NewWriter(os.Stdout)
+  fmt.Fprintf(writer, "Content-Type: %s\n", contentType)
+  fmt.Fprintf(writer, "Content-Length: %d\n\n", len(data))
+  writer.Write(data)
+  writer.Flush()
+  os.Exit(0)
+}
+
+// Asset returns the contents of an embedded asset given its URL path
+// under the site root, such as "/css/site.css".
+func Asset(urlPath string) ([]byte, error) {
+  if assets == nil {
+    return nil, fs.ErrNotExist
+  }
+  name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+  return fs.ReadFile(assets, name)
+}
+
+// AssetURL returns the URL at which an asset named by an asset tag can be
+// requested. Embedded assets are served by the program itself, so their
+// URLs extend the script name. Other assets are served by the web server
+// from the site tree.
+func AssetURL(urlPath string) string {
+  return defaultContext.AssetURL(urlPath)
+}
@@ -0,0 +1,131 @@
+package runtime
+
+import (
+  "strconv"
+  "strings"
+  "net/http"
+  "crypto/subtle"
+  "encoding/base64"
+)
+
+// Authorizer decides whether a client may see a page. Authorize returns
+// nil to let the request through, or an *AuthError to refuse it. Other
+// errors, such as those of a database that holds the accounts, answer the
+// request with a 500 error.
+type Authorizer interface {
+  Authorize(c *Context) error
+}
+
+// AuthorizerFunc lets an ordinary function serve as an Authorizer.
+type AuthorizerFunc func(c *Context) error
+
+// Authorize calls the function.
+func (f AuthorizerFunc) Authorize(c *Context) error {
+  return f(c)
+}
+
+// AuthError is the error with which an Authorizer refuses a request. The
+// status is http.StatusUnauthorized if the client must give credentials,
+// which Challenge, the value of the WWW-Authenticate header, asks for, or
+// http.StatusForbidden if the client may not see the page whoever it is.
+type AuthError struct {
+  Status int
+  Challenge string
+}
+
+// Error implements the error interface.
+func (e *AuthError) Error() string {
+  return http.StatusText(e.Status)
+}
+
+// ErrForbidden refuses a request with 403 Forbidden.
+var ErrForbidden = &AuthError{ Status: http.StatusForbidden }
+
+// BasicAuth is an Authorizer that asks for a user name and a password by
+// HTTP basic authentication and checks them with Validate. Realm names the
+// protected part of the site in the browser's prompt. Apache passes the
+// credentials to CGI programs only with CGIPassAuth On.
+type BasicAuth struct {
+  Realm string
+  Validate func(user, password string) bool
+}
+
+// Authorize lets the request through if its credentials are valid, and
+// otherwise refuses it with a challenge for the realm.
+func (a BasicAuth) Authorize(c *Context) error {
+  user, password, ok := c.basicAuth()
+  if !ok || a.Validate == nil || !a.Validate(user, password) {
+    return &AuthError{ Status: http.StatusUnauthorized,
+        Challenge: "Basic realm=" + strconv.Quote(a.Realm) +
+        `, charset="UTF-8"` }
+  }
+  c.authUser = user
+  return nil
+}
+
+// Authorize stops the page unless each authorizer lets the request
+// through. A refused request is answered with 401 Unauthorized, with the
+// challenge of the authorizer, or with 403 Forbidden, and a plain body;
+// the headers and output of the page are dropped. Call it before the page
+// writes anything, since a response that has been streamed cannot be
+// taken back.
+func (c *Context) Authorize(authorizers ...Authorizer) {
+  for _, authorizer := range authorizers {
+    err := authorizer.Authorize(c)
+    if err == nil {
+      continue
+    }
+    authError, refused := err.(*AuthError)
+    if !refused {
+      c.ServerError("authorization failed: " + err.Error())
+      c.Halt()
+    }
+    c.refuse(authError.Status)
+    if authError.Status == http.StatusUnauthorized &&
+        authError.Challenge != "" {
+      c.SetHeader("WWW-Authenticate", authError.Challenge)
+    }
+    c.Halt()
+  }
+}
+
+// RequireBasicAuth stops the page with 401 Unauthorized unless the client
+// gives a user name and password that validate accepts, and returns the
+// user name. Compare passwords with CheckPassword, which takes the same
+// time whether or not they match.
+func (c *Context) RequireBasicAuth(realm string,
+    validate func(user, password string) bool) string {
+  c.Authorize(BasicAuth{ Realm: realm, Validate: validate })
+  return c.authUser
+}
+
+// AuthUser returns the user name accepted by BasicAuth, or else the one
+// that the web server authenticated, as REMOTE_USER, or "" if there is
+// none.
+func (c *Context) AuthUser() string {
+  if c.authUser != "" {
+    return c.authUser
+  }
+  return c.Getenv("REMOTE_USER")
+}
+
+// CheckPassword reports whether a password matches the expected one, in a
+// time that does not depend on where they differ.
+func CheckPassword(password, expected string) bool {
+  return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+// basicAuth returns the credentials of the Authorization header, if it
+// uses the basic scheme.
+func (c *Context) basicAuth() (string, string, bool) {
+  header := c.Getenv("HTTP_AUTHORIZATION")
+  scheme, encoded, found := strings.Cut(strings.TrimSpace(header), " ")
+  if !found || !strings.EqualFold(scheme, "Basic") {
+    return "", "", false
+  }
+  decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+  if err != nil {
+    return "", "", false
+  }
+  return strings.Cut(string(decoded), ":")
+}
@@ -0,0 +1,229 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "time"
+  "bytes"
+  "strconv"
+  "strings"
+  "crypto/sha256"
+  "encoding/hex"
+  "path/filepath"
+)
+
+// CacheStore keeps the fragments memoized by Cache. A ttl of zero or less
+// means that the value does not expire. Get reports found as false for a
+// missing or expired value.
+type CacheStore interface {
+  Get(key string) (value string, found bool, err error)
+  Set(key, value string, ttl time.Duration) error
+}
+
+// defaultCache can be set at link time to the store of Cache, as buildapp
+// does with its cache setting. See SetCacheStore for the forms.
+var defaultCache = ""
+
+// cacheStore is the store in use, chosen when Cache is first called unless
+// SetCacheStore chose it before.
+var cacheStore CacheStore
+var cacheStoreLock sync.Mutex
+
+// SetCacheStore replaces the store of Cache, as with a store of the
+// program's own. Otherwise the store is named by BOOMERANG_CACHE or by the
+// cache setting of buildapp: "memory", "file" for a directory in TempDir,
+// "file:DIR", or "memcached:HOST:PORT". By default, programs that serve
+// many requests, under FastCGI or in the single server, keep fragments in
+// memory, and CGI programs, which serve one, keep them in files.
+func SetCacheStore(store CacheStore) {
+  cacheStoreLock.Lock()
+  defer cacheStoreLock.Unlock()
+  cacheStore = store
+}
+
+// currentCacheStore returns the store in use, choosing it if need be. A
+// long-running program is one whose context has a response writer.
+func (c *Context) currentCacheStore() CacheStore {
+  cacheStoreLock.Lock()
+  defer cacheStoreLock.Unlock()
+  if cacheStore != nil {
+    return cacheStore
+  }
+  setting, isSet := os.LookupEnv("BOOMERANG_CACHE")
+  if !isSet {
+    setting = defaultCache
+  }
+  kind, arg, _ := strings.Cut(setting, ":")
+  switch {
+  case kind == "memcached":
+    cacheStore = NewMemcachedStore(arg)
+  case kind == "file" && arg != "":
+    cacheStore = NewFileStore(arg)
+  case kind == "file" || (kind == "" && c.writer == nil):
+    cacheStore = NewFileStore(filepath.Join(TempDir(), "boomerang-cache"))
+  default:
+    if kind != "memory" && kind != "" {
+      fmt.Fprintf(os.Stderr, "runtime: unknown cache store %q\n", setting)
+    }
+    cacheStore = NewMemoryStore()
+  }
+  return cacheStore
+}
+
+// Cache returns the fragment stored under a key if it has not expired, and
+// otherwise calls render, stores its result for ttl, and returns it. A ttl
+// of zero or less keeps the fragment until the store drops it. Errors of
+// the store are logged, and the fragment is then rendered anew. The key
+// should name everything that the fragment depends on:
+//
+//   runtime.WriteString(runtime.Cache("sidebar:"+locale, time.Minute,
+//       func() string { return renderSidebar(db, locale) }))
+func (c *Context) Cache(key string, ttl time.Duration,
+    render func() string) string {
+  store := c.currentCacheStore()
+  value, found, err := store.Get(key)
+  if err != nil {
+    c.logLine("error", "cache: "+err.Error())
+  }
+  if found {
+    return value
+  }
+  value = render()
+  if err := store.Set(key, value, ttl); err != nil {
+    c.logLine("error", "cache: "+err.Error())
+  }
+  return value
+}
+
+// expiry returns the time at which a value stored now for ttl expires, or
+// the zero time if it does not.
+func expiry(ttl time.Duration) time.Time {
+  if ttl <= 0 {
+    return time.Time{}
+  }
+  return time.Now().Add(ttl)
+}
+
+// hashKey turns a cache key into a name that is safe in file names and in
+// the memcached protocol.
+func hashKey(key string) string {
+  sum := sha256.Sum256([]byte(key))
+  return hex.EncodeToString(sum[:])
+}
+
+
+//--- Memory store
+
+// MemoryStore keeps fragments in the memory of the process, where they
+// last as long as a FastCGI program or a server.
+type MemoryStore struct {
+  lock sync.Mutex
+  entries map[string]memoryEntry
+  swept time.Time
+}
+
+// memoryEntry is a value of a MemoryStore with its expiry time.
+type memoryEntry struct {
+  value string
+  expires time.Time
+}
+
+// NewMemoryStore makes an empty store in memory.
+func NewMemoryStore() *MemoryStore {
+  return &MemoryStore{ entries: map[string]memoryEntry{},
+      swept: time.Now() }
+}
+
+// Get returns a value that has not expired.
+func (s *MemoryStore) Get(key string) (string, bool, error) {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  entry, found := s.entries[key]
+  if !found || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+    return "", false, nil
+  }
+  return entry.value, true, nil
+}
+
+// Set stores a value. Expired values are swept out at most once a minute.
+func (s *MemoryStore) Set(key, value string, ttl time.Duration) error {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  now := time.Now()
+  if now.Sub(s.swept) > time.Minute {
+    for k, entry := range s.entries {
+      if !entry.expires.IsZero() && now.After(entry.expires) {
+        delete(s.entries, k)
+      }
+    }
+    s.swept = now
+  }
+  s.entries[key] = memoryEntry{ value, expiry(ttl) }
+  return nil
+}
+
+
+//--- File store
+
+// FileStore keeps fragments in files of a directory, where CGI programs
+// can share them across requests. Each file holds the expiry time on its
+// first line and the value after it. The directory must lie within the
+// writable roots.
+type FileStore struct {
+  Dir string
+}
+
+// NewFileStore makes a store in a directory, which is created when the
+// first value is stored.
+func NewFileStore(dir string) *FileStore {
+  return &FileStore{ Dir: dir }
+}
+
+// Get returns a value that has not expired.
+func (s *FileStore) Get(key string) (string, bool, error) {
+  data, err := os.ReadFile(filepath.Join(s.Dir, hashKey(key)))
+  if os.IsNotExist(err) {
+    return "", false, nil
+  }
+  if err != nil {
+    return "", false, err
+  }
+  line, value, found := bytes.Cut(data, []byte("\n"))
+  expires, err := strconv.ParseInt(string(line), 10, 64)
+  if !found || err != nil {
+    return "", false, fmt.Errorf("%s: corrupt cache file",
+        filepath.Join(s.Dir, hashKey(key)))
+  }
+  if expires != 0 && time.Now().UnixNano() > expires {
+    return "", false, nil
+  }
+  return string(value), true, nil
+}
+
+// Set stores a value, replacing the file atomically so that readers never
+// see part of it.
+func (s *FileStore) Set(key, value string, ttl time.Duration) error {
+  if err := MkdirAll(s.Dir, 0755); err != nil {
+    return err
+  }
+  var expires int64
+  if t := expiry(ttl); !t.IsZero() {
+    expires = t.UnixNano()
+  }
+  file, err := CreateTemp(s.Dir, "tmp-*")
+  if err != nil {
+    return err
+  }
+  _, err = fmt.Fprintf(file, "%d\n%s", expires, value)
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = Rename(file.Name(), filepath.Join(s.Dir, hashKey(key)))
+  }
+  if err != nil {
+    os.Remove(file.Name())
+  }
+  return err
+}
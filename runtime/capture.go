@@ -0,0 +1,35 @@
+package runtime
+
+// capture marks where a capture began in the content buffer.
+type capture struct {
+  offset int         // The length of the content buffer.
+  placeholders int   // The number of placeholders reserved.
+}
+
+// BeginCapture starts capturing output: what the page writes from here on
+// goes into a fragment instead of the body, until EndCapture returns it.
+// Captures can be nested, each EndCapture ending the latest capture.
+func (c *Context) BeginCapture() {
+  c.captures = append(c.captures, capture{ offset: c.content.Len(),
+      placeholders: len(c.placeholders) })
+}
+
+// EndCapture ends the latest capture and returns the output written since
+// it began, which is taken out of the body. The fragment can then be
+// measured, cached, or written in several places. A placeholder reserved
+// during the capture gets the text that has been filled in for it so far.
+// Without a capture in progress, EndCapture logs an error and returns "".
+func (c *Context) EndCapture() string {
+  n := len(c.captures)
+  if n == 0 {
+    c.logLine("error", "EndCapture called without BeginCapture")
+    return ""
+  }
+  begun := c.captures[n-1]
+  c.captures = c.captures[:n-1]
+  fragment := fillPlaceholders(c.content.String()[begun.offset:],
+      c.placeholders[begun.placeholders:], begun.offset, c.fills)
+  c.content.Truncate(begun.offset)
+  c.placeholders = c.placeholders[:begun.placeholders]
+  return fragment
+}
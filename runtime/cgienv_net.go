@@ -0,0 +1,26 @@
+//go:build !wasip1
+
+package runtime
+
+import (
+  "net"
+  "net/http"
+  "net/http/cgi"
+  "net/http/fcgi"
+)
+
+// requestFromEnv makes the request of a CGI program from its variables.
+func requestFromEnv(params map[string]string) (*http.Request, error) {
+  return cgi.RequestFromMap(params)
+}
+
+// fastCGIEnv returns the variables that a FastCGI server passed along with
+// a request, of which other requests have none.
+func fastCGIEnv(r *http.Request) map[string]string {
+  return fcgi.ProcessEnv(r)
+}
+
+// serveFastCGI serves FastCGI requests on a listener until it is closed.
+func serveFastCGI(listener net.Listener, handler http.Handler) error {
+  return fcgi.Serve(listener, handler)
+}
@@ -0,0 +1,86 @@
+//go:build wasip1
+
+package runtime
+
+import (
+  "net"
+  "errors"
+  "strconv"
+  "strings"
+  "net/url"
+  "net/http"
+  "crypto/tls"
+)
+
+// requestFromEnv makes the request of a CGI program from its variables as
+// net/http/cgi does. That package is not used under WASI because it links
+// os/exec, which a module has no use for.
+func requestFromEnv(params map[string]string) (*http.Request, error) {
+  r := &http.Request{ Method: params["REQUEST_METHOD"],
+      Proto: params["SERVER_PROTOCOL"], Close: true,
+      Header: http.Header{}, Trailer: http.Header{},
+      Host: params["HTTP_HOST"] }
+  if r.Method == "" {
+    return nil, errors.New("no REQUEST_METHOD in the environment")
+  }
+  var ok bool
+  if r.Proto == "INCLUDED" {  // A server-side include, as RFC 3875 allows.
+    r.ProtoMajor, r.ProtoMinor = 1, 0
+  } else if r.ProtoMajor, r.ProtoMinor, ok =
+      http.ParseHTTPVersion(r.Proto); !ok {
+    return nil, errors.New("invalid SERVER_PROTOCOL " + r.Proto)
+  }
+  if length := params["CONTENT_LENGTH"]; length != "" {
+    var err error
+    r.ContentLength, err = strconv.ParseInt(length, 10, 64)
+    if err != nil {
+      return nil, errors.New("invalid CONTENT_LENGTH " + length)
+    }
+  }
+  if contentType := params["CONTENT_TYPE"]; contentType != "" {
+    r.Header.Set("Content-Type", contentType)
+  }
+  for key, value := range params {
+    if name, found := strings.CutPrefix(key, "HTTP_"); found &&
+        key != "HTTP_HOST" {
+      r.Header.Add(strings.ReplaceAll(name, "_", "-"), value)
+    }
+  }
+  uri := params["REQUEST_URI"]
+  if uri == "" {
+    uri = params["SCRIPT_NAME"] + params["PATH_INFO"]
+    if query := params["QUERY_STRING"]; query != "" {
+      uri += "?" + query
+    }
+  }
+  if https := params["HTTPS"]; https == "on" || https == "ON" ||
+      https == "1" {
+    r.TLS = &tls.ConnectionState{ HandshakeComplete: true }
+  }
+  if r.Host != "" {
+    scheme := "http://"
+    if r.TLS != nil {
+      scheme = "https://"
+    }
+    r.URL, _ = url.Parse(scheme + r.Host + uri)
+  }
+  if r.URL == nil {
+    var err error
+    if r.URL, err = url.Parse(uri); err != nil {
+      return nil, err
+    }
+  }
+  port, _ := strconv.Atoi(params["REMOTE_PORT"])
+  r.RemoteAddr = net.JoinHostPort(params["REMOTE_ADDR"], strconv.Itoa(port))
+  return r, nil
+}
+
+// fastCGIEnv returns no variables, since a module serves no FastCGI.
+func fastCGIEnv(r *http.Request) map[string]string {
+  return map[string]string{}
+}
+
+// serveFastCGI fails, since a module cannot listen for connections.
+func serveFastCGI(listener net.Listener, handler http.Handler) error {
+  return errors.New("FastCGI is not available under WASI")
+}
@@ -0,0 +1,104 @@
+package runtime
+
+import (
+  "bytes"
+  "strconv"
+  "strings"
+  "compress/gzip"
+  "compress/zlib"
+)
+
+// CompressMinSize is the length below which a response body is sent as it
+// is, because compression would gain little. A negative value turns
+// compression off for the whole program.
+var CompressMinSize = 1024
+
+// SetCompression turns the compression of the response on or off. It is
+// on by default.
+func (c *Context) SetCompression(enabled bool) {
+  c.noCompression = !enabled
+}
+
+// compressibleTypes are the media types, besides text/*, whose bodies are
+// worth compressing.
+var compressibleTypes = []string{ "application/json", "application/xml",
+    "application/javascript", "application/xhtml+xml", "image/svg+xml" }
+
+// compressible reports whether a Content-Type names a format that is not
+// compressed already.
+func compressible(contentType string) bool {
+  mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+  mediaType = strings.TrimSpace(mediaType)
+  if strings.HasPrefix(mediaType, "text/") ||
+      strings.HasSuffix(mediaType, "+xml") ||
+      strings.HasSuffix(mediaType, "+json") {
+    return true
+  }
+  for _, known := range compressibleTypes {
+    if mediaType == known {
+      return true
+    }
+  }
+  return false
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring the one with the higher quality and gzip in a tie. It returns
+// "" if the client accepts neither.
+func acceptedEncoding(header string) string {
+  best, bestQuality := "", 0.0
+  for _, item := range strings.Split(header, ",") {
+    coding, params, _ := strings.Cut(item, ";")
+    coding = strings.ToLower(strings.TrimSpace(coding))
+    quality := 1.0
+    if name, value, found := strings.Cut(params, "="); found &&
+        strings.TrimSpace(name) == "q" {
+      if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64);
+          err == nil {
+        quality = q
+      }
+    }
+    if coding == "x-gzip" {
+      coding = "gzip"
+    }
+    if (coding == "gzip" || coding == "deflate") && quality > 0 &&
+        (quality > bestQuality || (quality == bestQuality &&
+        coding == "gzip")) {
+      best, bestQuality = coding, quality
+    }
+  }
+  return best
+}
+
+// compress encodes the body of the response with the encoding that the
+// client prefers, setting Content-Encoding and adding Vary, unless the body
+// is short, of a compressed format, or already encoded by the program. It
+// returns the body to send.
+func (c *Context) compress(body string) string {
+  if c.noCompression || CompressMinSize < 0 || len(body) < CompressMinSize ||
+      !compressible(c.ContentType()) {
+    return body
+  }
+  for _, header := range c.headers {
+    if hasName(header, "Content-Encoding") {
+      return body
+    }
+  }
+  encoding := acceptedEncoding(c.Getenv("HTTP_ACCEPT_ENCODING"))
+  c.AddHeader("Vary", "Accept-Encoding")
+  if encoding == "" {
+    return body
+  }
+  var buffer bytes.Buffer
+  if encoding == "gzip" {
+    writer := gzip.NewWriter(&buffer)
+    writer.Write([]byte(body))
+    writer.Close()
+  } else {
+    writer := zlib.NewWriter(&buffer)
+    writer.Write([]byte(body))
+    writer.Close()
+  }
+  c.SetHeader("Content-Encoding", encoding)
+  return buffer.String()
+}
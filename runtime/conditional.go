@@ -0,0 +1,67 @@
+package runtime
+
+import (
+  "fmt"
+  "time"
+  "strings"
+  "net/http"
+  "crypto/sha256"
+)
+
+// SetETag turns on the computation of a strong ETag over the body of the
+// response. If the request's If-None-Match lists the same tag, the
+// response becomes a 304 Not Modified with no body.
+func (c *Context) SetETag(enabled bool) {
+  c.etag = enabled
+}
+
+// SetLastModified sets the Last-Modified header and reports whether the
+// client's copy, as dated by If-Modified-Since, is still current. In that
+// case the response becomes a 304 Not Modified, and the page can skip
+// making its content. If-None-Match takes precedence when it is given.
+func (c *Context) SetLastModified(t time.Time) bool {
+  c.lastModified = t.UTC().Truncate(time.Second)
+  c.SetHeader("Last-Modified", c.lastModified.Format(http.TimeFormat))
+  return c.Getenv("HTTP_IF_NONE_MATCH") == "" && c.modifiedBefore()
+}
+
+// modifiedBefore reports whether the last modification precedes the time
+// in If-Modified-Since.
+func (c *Context) modifiedBefore() bool {
+  since, err := http.ParseTime(c.Getenv("HTTP_IF_MODIFIED_SINCE"))
+  return err == nil && !c.lastModified.IsZero() &&
+      !c.lastModified.After(since)
+}
+
+// notModified sets the ETag of a body if ETags are on and reports whether
+// the response should be a 304. Only successful GET and HEAD requests are
+// answered conditionally.
+func (c *Context) notModified(body string) bool {
+  method := c.Getenv("REQUEST_METHOD")
+  if c.status() != http.StatusOK || (method != "" && method != "GET" &&
+      method != "HEAD") {
+    return false
+  }
+  noneMatch := c.Getenv("HTTP_IF_NONE_MATCH")
+  if noneMatch == "" && c.modifiedBefore() {
+    return true  // The body may have been skipped, so no tag is made.
+  }
+  if !c.etag {
+    return false
+  }
+  tag := fmt.Sprintf("\"%x\"", sha256.Sum256([]byte(body)))
+  c.SetHeader("ETag", tag)
+  return noneMatch != "" && matchesETag(noneMatch, tag)
+}
+
+// matchesETag reports whether an If-None-Match header lists a tag, by the
+// weak comparison that the header calls for.
+func matchesETag(header, tag string) bool {
+  for _, candidate := range strings.Split(header, ",") {
+    candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+    if candidate == "*" || candidate == tag {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,376 @@
+package runtime
+
+import (
+  "os"
+  "io"
+  "fmt"
+  "net"
+  "bytes"
+  "bufio"
+  "strconv"
+  "strings"
+  "time"
+  "context"
+  "net/http"
+)
+
+// defaultContentType is the Content-Type header of every response unless
+// the program replaces it.
+const defaultContentType = "Content-Type: text/html; charset=utf-8"
+
+// Context carries the response to one request, with the request itself
+// if it did not come by CGI. Pages that serve many requests at once, as in
+// the handler target, each write to a Context of their own; the functions
+// of the package write to the default context.
+type Context struct {
+  statusHeader string
+  locationHeader string
+  headers []string
+  content bytes.Buffer
+  guard *responseGuard         // Claimed by whoever writes the response.
+  writer http.ResponseWriter   // The response writer, or nil for CGI.
+  request *http.Request        // The request, or nil for CGI.
+  env map[string]string        // CGI variables, or nil for the process's.
+  page *PageRequest            // The request as given by Request.
+  noCompression bool           // The body is sent as it is.
+  noTrimming bool              // Surrounding whitespace is kept.
+  etag bool                    // An ETag is computed over the body.
+  lastModified time.Time       // The time given to SetLastModified.
+  template string              // The template of the page, for logs.
+  requestID string             // The ID that correlates log lines.
+  traceID string               // The ID of the trace of the request.
+  spanID string                // The ID of the page's span in the trace.
+  traceFlags string            // The flags of the incoming traceparent.
+  traceGiven bool              // The request came with a traceparent.
+  started time.Time            // When the context was readied, for metrics.
+  placeholders []placeholder   // Places reserved in the content buffer.
+  fills map[string]string      // The text of placeholders, by name.
+  captures []capture           // Captures in progress, the latest last.
+  filters []Filter             // The filters added by the page.
+  csrfID string                // The client's ID for CSRF tokens.
+  locale string                // The locale of messages, once chosen.
+  authUser string              // The user accepted by BasicAuth.
+  ctx context.Context          // Canceled when the client goes away.
+  cancel context.CancelFunc    // Cancels ctx.
+  gone bool                    // A write to the client has failed.
+  usesDB bool                  // DB has been called.
+  truncated bool               // The body was cut at its size limit.
+  streaming bool               // Events are being sent as they come.
+  outputMode OutputMode        // How a CGI program writes its response.
+}
+
+// NewContext makes a context for a request served by net/http. With a nil
+// writer and request, the context makes a CGI response on stdout.
+func NewContext(w http.ResponseWriter, r *http.Request) *Context {
+  c := &Context{}
+  c.reset(w, r)
+  return c
+}
+
+// reset readies a context for a new request, discarding the response to
+// the previous one.
+func (c *Context) reset(w http.ResponseWriter, r *http.Request) {
+  if c.page != nil {
+    c.page.removeUploads()  // Finish may not have run after a panic.
+  }
+  if c.cancel != nil {
+    c.cancel()
+  }
+  *c = Context{ headers: []string{ defaultContentType }, writer: w,
+      request: r, guard: &responseGuard{}, started: time.Now() }
+  base := context.Background()
+  if r != nil {
+    base = r.Context()
+  }
+  c.ctx, c.cancel = context.WithCancel(base)
+  if r != nil {
+    c.env = requestEnv(r)
+    if guard, ok := r.Context().Value(guardKey{}).(*responseGuard); ok {
+      c.guard = guard  // The deadline of the request may claim it first.
+    }
+  }
+}
+
+// defaultContext receives the output of the package-level functions. It
+// makes a CGI response, except while FastCGI requests are served, when it
+// is reset for each request.
+var defaultContext = NewContext(nil, nil)
+
+// Current returns the context that the package-level functions write to.
+// It stays the same for the life of the program, so generated CGI and
+// FastCGI programs keep it in a package variable.
+func Current() *Context {
+  return defaultContext
+}
+
+// appendHeader adds a header line to the response.
+func (c *Context) appendHeader(header string) {
+  c.headers = append(c.headers, header)
+}
+
+
+//--- Output
+
+// WriteString appends a string to the content buffer, within the limit
+// of the body size if there is one.
+func (c *Context) WriteString(s string) {
+  c.writeLimited(s)
+}
+
+// Print calls fmt.Sprint and writes the result to the content buffer.
+func (c *Context) Print(a ...interface{}) {
+  c.WriteString(fmt.Sprint(a...))
+}
+
+// Println calls fmt.Sprintln and writes the result to the content buffer.
+func (c *Context) Println(a ...interface{}) {
+  c.WriteString(fmt.Sprintln(a...))
+}
+
+// Printf calls fmt.Sprintf and writes the result to the content buffer.
+func (c *Context) Printf(format string, a ...interface{}) {
+  c.WriteString(fmt.Sprintf(format, a...))
+}
+
+// Finish writes the whole response: headers, blank line, body. The body is
+// the content buffer with its placeholders filled, surrounding whitespace
+// trimmed unless trimming is off, and the filters applied. Content-Length
+// is its exact length in bytes. The response is written only once; later
+// calls do nothing. The body is compressed if the client accepts it, and
+// replaced by a 304 response if the client's copy is current. Nothing is
+// written if the page ran past its deadline or streamed events. The answer
+// to a HEAD request has the headers, with the Content-Length of the body
+// that a GET would get, but not the body itself. The spool
+// files of uploads are removed, and the database of a CGI program is
+// closed. The request ID is echoed in RequestIDHeader, and the metrics of
+// the response are recorded if there is a sink.
+func (c *Context) Finish() {
+  defer c.release()
+  if c.streaming {
+    c.recordMetrics(c.status(), 0)
+    return
+  }
+  if !c.guard.claim() {
+    c.recordMetrics(http.StatusGatewayTimeout, len(TimeoutPage))
+    return
+  }
+  c.echoRequestID()
+  contentString := c.filledContent()
+  if !c.noTrimming {
+    contentString = strings.TrimSpace(contentString)
+  }
+  contentString = c.filter(contentString)
+  contentString = c.compress(contentString)
+  if c.notModified(contentString) {
+    c.SetHTTPStatus(http.StatusNotModified, "Not Modified")
+    contentString = ""
+  }
+  if c.isHead() {
+    defer c.recordMetrics(c.status(), 0)
+  } else {
+    defer c.recordMetrics(c.status(), len(contentString))
+  }
+  if c.writer != nil {
+    c.writeHTTPResponse(contentString)
+    return
+  }
+  c.DelHeader("Content-Length")  // The runtime knows the length best.
+  length := []string{}
+  if c.status() != http.StatusNotModified {  // A 304 has no body to measure.
+    length = append(length, fmt.Sprintf("Content-Length: %d",
+        len(contentString)))
+  }
+  ignoreSIGPIPE()
+  writer := bufio.NewWriter(os.Stdout)
+  c.writeCGIHeaders(writer, length...)
+  if !c.isHead() {
+    // Nothing follows the body, which is exactly Content-Length bytes.
+    writer.WriteString(contentString)
+  }
+  if err := writer.Flush(); err != nil {
+    c.disconnected(err)
+  }
+}
+
+// release frees what the page held for its request once the response is
+// done with.
+func (c *Context) release() {
+  if c.page != nil {
+    c.page.removeUploads()
+  }
+  c.closeDB()
+  if c.cancel != nil {
+    c.cancel()
+  }
+}
+
+// SetTrimming turns the trimming of whitespace around the body on or off.
+// It is on by default, which drops the line breaks that surround code
+// sections at the edges of a template. Formats in which whitespace counts,
+// such as preformatted text or binary data, should turn it off.
+func (c *Context) SetTrimming(enabled bool) {
+  c.noTrimming = !enabled
+}
+
+// copyHeaders adds the headers of the response to the response writer.
+func (c *Context) copyHeaders() {
+  for _, header := range c.headers {
+    name, value, found := strings.Cut(header, ":")
+    if found {
+      c.writer.Header().Add(strings.TrimSpace(name), strings.TrimSpace(value))
+    }
+  }
+  if c.locationHeader != "" {
+    c.writer.Header().Set("Location", strings.TrimSpace(
+        strings.TrimPrefix(c.locationHeader, "Location:")))
+  }
+}
+
+// writeHTTPResponse writes the response to the response writer.
+func (c *Context) writeHTTPResponse(content string) {
+  status := c.status()
+  c.copyHeaders()
+  if status != http.StatusNotModified {
+    c.writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+  }
+  c.writer.WriteHeader(status)
+  if !c.isHead() {
+    if _, err := io.WriteString(c.writer, content); err != nil {
+      c.disconnected(err)
+    }
+  }
+}
+
+// isHead reports whether the request is a HEAD request, whose response has
+// no body.
+func (c *Context) isHead() bool {
+  return c.Getenv("REQUEST_METHOD") == http.MethodHead
+}
+
+
+//--- HTTP redirection and status modification
+
+// status returns the status code of the response.
+func (c *Context) status() int {
+  if fields := strings.Fields(c.statusHeader); len(fields) >= 2 {
+    if code, err := strconv.Atoi(fields[1]); err == nil {
+      return code
+    }
+  }
+  return http.StatusOK
+}
+
+// SetHTTPStatus sets the status of the response. Only the final call takes
+// effect. An empty reason phrase is replaced by the standard one. A code
+// outside the range 100 to 599 is rejected with a message on stderr, and
+// the status is left as it was. Line breaks in the reason phrase become
+// spaces, as they do in the values of SetHeader.
+func (c *Context) SetHTTPStatus(statusCode int, reasonPhrase string) {
+  if err := c.SetStatus(statusCode); err != nil {
+    fmt.Fprintf(os.Stderr, "runtime: %s\n", err.Error())
+    return
+  }
+  if reasonPhrase != "" {
+    c.statusHeader = headerLine("Status",
+        fmt.Sprintf("%d %s", statusCode, reasonPhrase))
+  }
+}
+
+// Redirect redirects with "301 Moved Permanently" to the given URL.
+func (c *Context) Redirect(url string) {
+  c.RedirectWithStatus(url, 301, "Moved Permanently")
+}
+
+// RedirectWithStatus redirects with the given status to the given URL.
+// Line breaks in the URL become spaces, so that it cannot add headers.
+func (c *Context) RedirectWithStatus(url string, statusCode int,
+    reasonPhrase string) {
+  c.SetHTTPStatus(statusCode, reasonPhrase)
+  c.locationHeader = headerLine("Location", url)
+}
+
+
+//--- Request environment
+
+// Getenv returns a CGI variable of the request, such as QUERY_STRING. For
+// CGI, the variables come from the environment of the process.
+func (c *Context) Getenv(key string) string {
+  if c.env != nil {
+    return c.env[key]
+  }
+  return os.Getenv(key)
+}
+
+// Body returns the body of the request, which is standard input for CGI.
+// It is the body of the request given by Request.
+func (c *Context) Body() io.Reader {
+  return c.Request().HTTP.Body
+}
+
+// Request returns the request that the context answers. For CGI, it is
+// read from the environment of the process.
+func (c *Context) Request() *PageRequest {
+  if c.page == nil && c.request != nil {
+    c.page = newPageRequest(c.request)
+  } else if c.page == nil {
+    c.page = cgiRequest()
+  }
+  return c.page
+}
+
+// FormFile returns a reader of the first file uploaded in a form field,
+// with a description of the file.
+func (c *Context) FormFile(name string) (io.ReadCloser, *Upload, error) {
+  return c.Request().FormFile(name)
+}
+
+// AssetURL returns the URL at which an asset named by an asset tag can be
+// requested. Embedded assets are served by the program itself, so their
+// URLs extend the script name. Other assets are served by the web server
+// from the site tree.
+func (c *Context) AssetURL(urlPath string) string {
+  if _, err := Asset(urlPath); err == nil {
+    return c.Getenv("SCRIPT_NAME") + urlPath
+  }
+  return urlPath
+}
+
+// requestEnv makes the CGI variables of a request served by net/http.
+// The variables of a FastCGI server, such as DOCUMENT_ROOT, are passed
+// through, and those that net/http turns into parts of the request are
+// rebuilt.
+func requestEnv(r *http.Request) map[string]string {
+  env := map[string]string{}
+  for key, value := range fastCGIEnv(r) {
+    env[key] = value
+  }
+  if route, ok := r.Context().Value(routeKey{}).(string); ok {
+    env["SCRIPT_NAME"] = strings.TrimSuffix(route, "/")
+    env["PATH_INFO"] = strings.TrimPrefix(r.URL.Path, env["SCRIPT_NAME"])
+  }
+  env["REQUEST_METHOD"] = r.Method
+  env["REQUEST_URI"] = r.RequestURI
+  env["QUERY_STRING"] = r.URL.RawQuery
+  env["SERVER_PROTOCOL"] = r.Proto
+  env["REMOTE_ADDR"] = r.RemoteAddr
+  if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+    env["REMOTE_ADDR"], env["REMOTE_PORT"] = host, port
+  }
+  if r.TLS != nil {
+    env["HTTPS"] = "on"
+  }
+  if contentType := r.Header.Get("Content-Type"); contentType != "" {
+    env["CONTENT_TYPE"] = contentType
+  }
+  if r.ContentLength >= 0 {
+    env["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+  }
+  for name, values := range r.Header {
+    key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+    env[key] = strings.Join(values, ", ")
+  }
+  if r.Host != "" {
+    env["HTTP_HOST"] = r.Host
+  }
+  return env
+}
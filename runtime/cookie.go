@@ -0,0 +1,45 @@
+package runtime
+
+import (
+  "time"
+  "net/http"
+)
+
+// CookieOptions are the attributes of a cookie set with SetCookie. The
+// zero value makes a session cookie for the current path.
+type CookieOptions struct {
+  Path string             // The path prefix for which the cookie is sent.
+  Domain string           // The domain, if other than the host.
+  Expires time.Time       // The expiry time, if not at the end of a session.
+  MaxAge int              // Seconds until expiry; negative deletes the cookie.
+  Secure bool             // Send the cookie over HTTPS only.
+  HttpOnly bool           // Hide the cookie from scripts.
+  SameSite http.SameSite  // Restrict cross-site requests.
+}
+
+// Cookie returns the value of a cookie sent with the request, which comes
+// from HTTP_COOKIE for CGI, or "" if there is no such cookie.
+func (c *Context) Cookie(name string) string {
+  cookie, err := c.Request().HTTP.Cookie(name)
+  if err != nil {
+    return ""
+  }
+  return cookie.Value
+}
+
+// SetCookie adds a Set-Cookie header to the response. It returns an error,
+// and adds nothing, if the name or an attribute is not valid in a cookie.
+// The options may be nil.
+func (c *Context) SetCookie(name, value string, opts *CookieOptions) error {
+  if opts == nil {
+    opts = &CookieOptions{}
+  }
+  cookie := &http.Cookie{ Name: name, Value: value, Path: opts.Path,
+      Domain: opts.Domain, Expires: opts.Expires, MaxAge: opts.MaxAge,
+      Secure: opts.Secure, HttpOnly: opts.HttpOnly, SameSite: opts.SameSite }
+  if err := cookie.Valid(); err != nil {
+    return err
+  }
+  c.appendHeader("Set-Cookie: " + cookie.String())
+  return nil
+}
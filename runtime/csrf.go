@@ -0,0 +1,135 @@
+package runtime
+
+import (
+  "os"
+  "sync"
+  "errors"
+  "strings"
+  "net/http"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+)
+
+// ErrCSRF is returned by ValidateCSRF when a request that changes state
+// does not carry a valid token.
+var ErrCSRF = errors.New("missing or invalid CSRF token")
+
+// CSRFCookie is the cookie that identifies a client to its tokens, and
+// CSRFField is the form field, as CSRFHeader is the request header, in
+// which a token is sent back.
+const CSRFCookie = "boomerang_csrf"
+const CSRFField = "csrf_token"
+const CSRFHeader = "X-CSRF-Token"
+
+// defaultCSRFKeyFile can be set at link time to a file that holds the key
+// that signs tokens, as buildapp does with its csrfKeyFile setting.
+var defaultCSRFKeyFile = ""
+
+// The signing key is loaded once: from BOOMERANG_CSRF_KEY or, if that is
+// not set, from the key file.
+var csrfKey []byte
+var csrfKeyErr error
+var csrfKeyOnce sync.Once
+
+// loadCSRFKey reads the signing key. An empty key is an error, because a
+// key that differs between processes would reject the tokens of CGI pages.
+func loadCSRFKey() {
+  key, isSet := os.LookupEnv("BOOMERANG_CSRF_KEY")
+  if !isSet && defaultCSRFKeyFile != "" {
+    data, err := os.ReadFile(defaultCSRFKeyFile)
+    if err != nil {
+      csrfKeyErr = err
+      return
+    }
+    key = string(data)
+  }
+  key = strings.TrimSpace(key)
+  if key == "" {
+    csrfKeyErr = errors.New(
+        "no CSRF key: set BOOMERANG_CSRF_KEY or the csrfKeyFile setting")
+    return
+  }
+  csrfKey = []byte(key)
+}
+
+// csrfEncoding encodes the parts of tokens and client IDs.
+var csrfEncoding = base64.RawURLEncoding
+
+// csrfSignature signs a nonce for a client.
+func csrfSignature(clientID, nonce string) string {
+  mac := hmac.New(sha256.New, csrfKey)
+  mac.Write([]byte(clientID + "." + nonce))
+  return csrfEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfClientID returns the ID of the client from the CSRF cookie, making
+// one and setting the cookie if the request did not send it.
+func (c *Context) csrfClientID() string {
+  if c.csrfID != "" {
+    return c.csrfID
+  }
+  c.csrfID = c.Cookie(CSRFCookie)
+  if c.csrfID == "" {
+    id := make([]byte, 18)
+    rand.Read(id)
+    c.csrfID = csrfEncoding.EncodeToString(id)
+    c.SetCookie(CSRFCookie, c.csrfID, &CookieOptions{ Path: "/",
+        HttpOnly: true, Secure: c.Getenv("HTTPS") == "on",
+        SameSite: http.SameSiteLaxMode })
+  }
+  return c.csrfID
+}
+
+// CSRFToken returns a token that ValidateCSRF accepts from the same
+// client. Each call makes a different token, so a token reveals nothing
+// about the others. The token is signed with the site's key and tied to
+// the client by a cookie that CSRFToken sets if needed. Without a key, the
+// error is logged and the token is "".
+func (c *Context) CSRFToken() string {
+  csrfKeyOnce.Do(loadCSRFKey)
+  if csrfKeyErr != nil {
+    c.logLine("error", "CSRFToken: "+csrfKeyErr.Error())
+    return ""
+  }
+  nonceBytes := make([]byte, 12)
+  rand.Read(nonceBytes)
+  nonce := csrfEncoding.EncodeToString(nonceBytes)
+  return nonce + "." + csrfSignature(c.csrfClientID(), nonce)
+}
+
+// CSRFInput returns a hidden form field that carries a new token, to be
+// written inside a form.
+func (c *Context) CSRFInput() SafeHTML {
+  return SafeHTML(`<input type="hidden" name="` + CSRFField + `" value="` +
+      EscapeAttr(c.CSRFToken()) + `">`)
+}
+
+// ValidateCSRF checks the token of a request that may change state: one
+// whose method is not GET, HEAD, OPTIONS, or TRACE. The token is taken
+// from the X-CSRF-Token header or else from the csrf_token form field,
+// and it must have been made by CSRFToken for the same client. It returns
+// nil if the request is safe or the token is valid, and otherwise ErrCSRF
+// or the error that kept the key from loading.
+func (c *Context) ValidateCSRF() error {
+  switch c.Request().Method {
+  case "GET", "HEAD", "OPTIONS", "TRACE":
+    return nil
+  }
+  csrfKeyOnce.Do(loadCSRFKey)
+  if csrfKeyErr != nil {
+    return csrfKeyErr
+  }
+  token := c.Request().Header(CSRFHeader)
+  if token == "" {
+    token = c.Request().Form(CSRFField)
+  }
+  clientID := c.Cookie(CSRFCookie)
+  nonce, signature, found := strings.Cut(token, ".")
+  if !found || clientID == "" || !hmac.Equal([]byte(signature),
+      []byte(csrfSignature(clientID, nonce))) {
+    return ErrCSRF
+  }
+  return nil
+}
@@ -0,0 +1,114 @@
+package runtime
+
+import (
+  "sync"
+  "strings"
+  "testing"
+  "net/url"
+  "net/http"
+  "net/http/httptest"
+)
+
+// setCSRFKey sets the signing key for the rest of a test, or leaves it
+// unset if key is "".
+func setCSRFKey(t *testing.T, key string) {
+  reset := func() {
+    csrfKey, csrfKeyErr, csrfKeyOnce = nil, nil, sync.Once{}
+  }
+  t.Cleanup(reset)
+  reset()
+  t.Setenv("BOOMERANG_CSRF_KEY", key)
+}
+
+// csrfCookie returns the CSRF cookie that a context set, or "".
+func csrfCookie(c *Context) string {
+  for _, header := range c.headers {
+    cookie, found := strings.CutPrefix(header, "Set-Cookie: ")
+    if found && strings.HasPrefix(cookie, CSRFCookie+"=") {
+      value, _, _ := strings.Cut(cookie, ";")
+      return value
+    }
+  }
+  return ""
+}
+
+// postForm makes a context for a form that is posted with a cookie.
+func postForm(cookie string, form url.Values) *Context {
+  r := httptest.NewRequest("POST", "/form", strings.NewReader(form.Encode()))
+  r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  if cookie != "" {
+    r.Header.Set("Cookie", cookie)
+  }
+  return NewContext(httptest.NewRecorder(), r)
+}
+
+// TestCSRFRoundTrip checks that a token is accepted from the client it was
+// made for, in the form or in the header, and refused otherwise.
+func TestCSRFRoundTrip(t *testing.T) {
+  setCSRFKey(t, "secret")
+  page := NewContext(httptest.NewRecorder(),
+      httptest.NewRequest("GET", "/form", nil))
+  token := page.CSRFToken()
+  cookie := csrfCookie(page)
+  if token == "" || cookie == "" {
+    t.Fatalf("token %q, cookie %q", token, cookie)
+  }
+  if other := page.CSRFToken(); other == token {
+    t.Errorf("the same token was made twice")
+  }
+  if !strings.Contains(string(page.CSRFInput()), `name="`+CSRFField+`"`) {
+    t.Errorf("CSRFInput lacks the field: %s", page.CSRFInput())
+  }
+
+  _, signature, _ := strings.Cut(token, ".")
+  cases := []struct {
+    name, cookie, token string
+    valid bool
+  }{
+    { "valid", cookie, token, true },
+    { "no token", cookie, "", false },
+    { "no cookie", "", token, false },
+    { "other client", CSRFCookie + "=someone-else", token, false },
+    { "forged nonce", cookie, "forged." + signature, false },
+    { "altered", cookie, token + "x", false },
+  }
+  for _, c := range cases {
+    form := url.Values{ CSRFField: { c.token } }
+    err := postForm(c.cookie, form).ValidateCSRF()
+    if c.valid && err != nil {
+      t.Errorf("%s: %s", c.name, err.Error())
+    } else if !c.valid && err != ErrCSRF {
+      t.Errorf("%s: error %v, want ErrCSRF", c.name, err)
+    }
+  }
+
+  // The token may come in a header instead, as from a script.
+  context := postForm(cookie, url.Values{})
+  context.request.Header.Set(CSRFHeader, token)
+  if err := context.ValidateCSRF(); err != nil {
+    t.Errorf("token in header: %s", err.Error())
+  }
+
+  // A safe method needs no token.
+  safe := NewContext(httptest.NewRecorder(),
+      httptest.NewRequest(http.MethodGet, "/form", nil))
+  if err := safe.ValidateCSRF(); err != nil {
+    t.Errorf("GET: %s", err.Error())
+  }
+}
+
+// TestCSRFNoKey checks that without a key no token is made and every
+// unsafe request is refused.
+func TestCSRFNoKey(t *testing.T) {
+  setCSRFKey(t, "")
+  page := NewContext(httptest.NewRecorder(),
+      httptest.NewRequest("GET", "/form", nil))
+  if token := page.CSRFToken(); token != "" {
+    t.Errorf("made token %q without a key", token)
+  }
+  err := postForm(CSRFCookie+"=a", url.Values{ CSRFField: { "a.b" } }).
+      ValidateCSRF()
+  if err == nil || err == ErrCSRF {
+    t.Errorf("error %v, want the missing key", err)
+  }
+}
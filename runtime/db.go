@@ -0,0 +1,85 @@
+package runtime
+
+import (
+  "os"
+  "sync"
+  "time"
+  "errors"
+  "database/sql"
+)
+
+// defaultDBDriver and defaultDBSource can be set at link time to the
+// driver and data source name of DB, as buildapp does with its dbDriver
+// and dbSource settings.
+var defaultDBDriver = ""
+var defaultDBSource = ""
+
+// The database handle is opened by the first call of DB and shared by the
+// pages of the process.
+var dbHandle *sql.DB
+var dbLock sync.Mutex
+
+// DBMaxIdleTime is how long a pooled connection may stay idle before it
+// is closed, in programs that serve many requests.
+var DBMaxIdleTime = 5 * time.Minute
+
+// DB returns the site's database, opened with the driver and data source
+// named by BOOMERANG_DB_DRIVER and BOOMERANG_DB_SOURCE or, if those are
+// not set, by the settings that buildapp compiled in. The driver must be
+// registered by an import in the program, such as
+//
+//   import _ "github.com/lib/pq"
+//
+// The handle is opened and checked with a ping on first use and shared
+// after that. Under FastCGI and in the single server it is a pool that
+// lasts for the life of the process; in a CGI program, which serves one
+// request, it is closed when the response is finished.
+func (c *Context) DB() (*sql.DB, error) {
+  dbLock.Lock()
+  defer dbLock.Unlock()
+  if dbHandle != nil {
+    c.usesDB = true
+    return dbHandle, nil
+  }
+  driver, isSet := os.LookupEnv("BOOMERANG_DB_DRIVER")
+  if !isSet {
+    driver = defaultDBDriver
+  }
+  source, isSet := os.LookupEnv("BOOMERANG_DB_SOURCE")
+  if !isSet {
+    source = defaultDBSource
+  }
+  if driver == "" {
+    return nil, errors.New("no database driver: set BOOMERANG_DB_DRIVER " +
+        "or the dbDriver setting")
+  }
+  db, err := sql.Open(driver, source)
+  if err != nil {
+    return nil, err
+  }
+  if err := db.Ping(); err != nil {
+    db.Close()
+    return nil, err
+  }
+  if c.writer == nil {
+    db.SetMaxIdleConns(1)  // One request needs no pool.
+  } else {
+    db.SetConnMaxIdleTime(DBMaxIdleTime)
+  }
+  dbHandle, c.usesDB = db, true
+  return db, nil
+}
+
+// closeDB closes the database of a CGI program once its response is
+// finished. The pool of a long-running program stays open.
+func (c *Context) closeDB() {
+  if !c.usesDB || c.writer != nil {
+    return
+  }
+  dbLock.Lock()
+  defer dbLock.Unlock()
+  if dbHandle != nil {
+    dbHandle.Close()
+    dbHandle = nil
+  }
+}
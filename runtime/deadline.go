@@ -0,0 +1,170 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "time"
+  "context"
+  "strconv"
+  "net/http"
+  goruntime "runtime"
+)
+
+// defaultDeadline can be set at link time to the deadline of pages, as a
+// duration such as "30s", as buildapp does with its deadline setting.
+var defaultDeadline = ""
+
+// The deadline is loaded once from BOOMERANG_DEADLINE or the default.
+var pageDeadline time.Duration
+var deadlineOnce sync.Once
+
+// TimeoutPage is the body of the 504 response that is sent when a page
+// runs past its deadline. A program can replace it, as it can ErrorPage.
+var TimeoutPage = `<!DOCTYPE html>
+<html>
+<head><title>504 Gateway Timeout</title></head>
+<body>
+<h1>Gateway Timeout</h1>
+<p>The page took too long to make.</p>
+</body>
+</html>`
+
+// Deadline returns how long a page may run before it is abandoned, or zero
+// if it may run for as long as it likes. It is taken from BOOMERANG_DEADLINE
+// or, if that is not set, from the deadline setting of buildapp.
+func Deadline() time.Duration {
+  deadlineOnce.Do(func() {
+    value, isSet := os.LookupEnv("BOOMERANG_DEADLINE")
+    if !isSet {
+      value = defaultDeadline
+    }
+    if value == "" {
+      return
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil || d < 0 {
+      fmt.Fprintf(os.Stderr, "runtime: invalid deadline %q\n", value)
+      return
+    }
+    pageDeadline = d
+  })
+  return pageDeadline
+}
+
+// responseGuard decides who writes a response when a page and its deadline
+// race: the page, when it finishes, or the runtime, when time runs out.
+// Whoever claims it first writes, and the other writes nothing.
+type responseGuard struct {
+  lock sync.Mutex
+  claimed bool
+}
+
+// guardKey is the key of the guard in the context of a request.
+type guardKey struct{}
+
+// claim reports whether the caller is the first to claim the response.
+func (g *responseGuard) claim() bool {
+  g.lock.Lock()
+  defer g.lock.Unlock()
+  if g.claimed {
+    return false
+  }
+  g.claimed = true
+  return true
+}
+
+// isClaimed reports whether the response has been claimed.
+func (g *responseGuard) isClaimed() bool {
+  g.lock.Lock()
+  defer g.lock.Unlock()
+  return g.claimed
+}
+
+// logDeadline reports a page that ran out of time, with the stacks of all
+// goroutines, which show where the page was at the time.
+func logDeadline(uri string, elapsed time.Duration) {
+  stacks := make([]byte, 1<<20)
+  stacks = stacks[:goruntime.Stack(stacks, true)]
+  fmt.Fprintf(os.Stderr, "runtime: deadline of %s exceeded serving %s "+
+      "after %s\n%s", Deadline(), uri, elapsed.Round(time.Millisecond),
+      stacks)
+}
+
+// StartDeadline is called by the generated code as a page begins. In a
+// CGI program with a deadline, it starts a timer that, when the deadline
+// passes before the response is written, logs where the page was, writes a
+// 504 response with TimeoutPage as its body, and ends the program. Pages
+// served by FastCGI or by the single server are timed by the runtime's
+// handlers instead.
+func (c *Context) StartDeadline() {
+  deadline := Deadline()
+  if deadline == 0 || c.writer != nil {
+    return
+  }
+  started := time.Now()
+  uri, protocol := c.Getenv("REQUEST_URI"), c.Getenv("SERVER_PROTOCOL")
+  nph := c.nph()
+  headers := []string{ defaultContentType,
+      "Content-Length: " + strconv.Itoa(len(TimeoutPage)) }
+  if RequestIDHeader != "" {
+    headers = append(headers, headerLine(RequestIDHeader, c.RequestID()))
+  }
+  time.AfterFunc(deadline, func() {
+    if !c.guard.claim() {
+      return
+    }
+    logDeadline(uri, time.Since(started))
+    fmt.Fprint(os.Stdout, cgiHead(nph, protocol, "504 Gateway Timeout",
+        nil, headers), TimeoutPage)
+    c.recordMetrics(http.StatusGatewayTimeout, len(TimeoutPage))
+    os.Exit(1)
+  })
+}
+
+// serveWithDeadline runs a handler in a goroutine of its own and answers
+// with a 504 response if it does not finish within the deadline. The page
+// is abandoned to run on, but the response is no longer its to write. It
+// reports whether the handler finished.
+func serveWithDeadline(w http.ResponseWriter, r *http.Request,
+    handler func(http.ResponseWriter, *http.Request)) bool {
+  deadline := Deadline()
+  if deadline == 0 {
+    handler(w, r)
+    return true
+  }
+  guard := &responseGuard{}
+  r = r.WithContext(context.WithValue(r.Context(), guardKey{}, guard))
+  done := make(chan interface{}, 1)
+  started := time.Now()
+  go func() {
+    defer func() {
+      done <- recover()
+    }()
+    handler(w, r)
+  }()
+  timer := time.NewTimer(deadline)
+  defer timer.Stop()
+  select {
+  case recovered := <-done:
+    if recovered != nil {
+      panic(recovered)  // Let net/http deal with it as usual.
+    }
+    return true
+  case <-timer.C:
+  }
+  if !guard.claim() {
+    <-done  // The page is writing its response; wait for it.
+    return true
+  }
+  logDeadline(r.URL.RequestURI(), time.Since(started))
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  w.Header().Set("Content-Length", strconv.Itoa(len(TimeoutPage)))
+  if id := validRequestID(r.Header.Get("X-Request-Id")); id != "" &&
+      RequestIDHeader != "" {
+    w.Header().Set(RequestIDHeader, id)
+  }
+  w.WriteHeader(http.StatusGatewayTimeout)
+  w.Write([]byte(TimeoutPage))
+  return false
+}
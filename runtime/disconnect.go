@@ -0,0 +1,43 @@
+package runtime
+
+import (
+  "errors"
+  "context"
+  "net/http"
+)
+
+// errClientGone is returned by SendEvent once a write to the client has
+// failed.
+var errClientGone = errors.New("the client has gone away")
+
+// RequestContext returns a context that is canceled when the client goes
+// away, so that the page can stop work that no one will see, such as a
+// slow query or a loop of events:
+//
+//   rows, err := db.QueryContext(runtime.RequestContext(), query)
+//
+// The runtime cancels it when a write of the response fails, and, for a
+// request served by net/http, when the server notices that the connection
+// has closed. It is also canceled once the response has been written.
+func (c *Context) RequestContext() context.Context {
+  return c.ctx
+}
+
+// ClientGone reports whether the client has gone away, as when a write
+// of the response failed.
+func (c *Context) ClientGone() bool {
+  return c.gone || (c.request != nil && c.request.Context().Err() != nil)
+}
+
+// disconnected records that a write to the client failed, which is taken
+// to mean that the client has gone away: the event is logged once, and
+// the context of the request is canceled. An error that only says that
+// the response writer cannot flush is not a disconnection.
+func (c *Context) disconnected(err error) {
+  if c.gone || errors.Is(err, http.ErrNotSupported) {
+    return
+  }
+  c.gone = true
+  c.logLine("info", "client disconnected: "+err.Error())
+  c.cancel()
+}
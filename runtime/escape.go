@@ -0,0 +1,90 @@
+package runtime
+
+import (
+  "fmt"
+  "html"
+  "strings"
+  "net/url"
+  "text/template"
+)
+
+// SafeHTML is text that is already fit to be placed in HTML, such as the
+// output of a trusted formatter. PrintEscaped and PrintfEscaped write it
+// as it is.
+type SafeHTML string
+
+// attrReplacer escapes the characters that end or break out of an
+// attribute value, quoted or not, beyond those that EscapeHTML handles.
+var attrReplacer = strings.NewReplacer("`", "&#96;", "=", "&#61;")
+
+// EscapeHTML escapes <, >, &, ', and " so that text can be placed in an
+// HTML element.
+func EscapeHTML(s string) string {
+  return html.EscapeString(s)
+}
+
+// EscapeAttr escapes text for an HTML attribute value. Besides the
+// characters that EscapeHTML escapes, it escapes ` and =, which matter in
+// unquoted values.
+func EscapeAttr(s string) string {
+  return attrReplacer.Replace(html.EscapeString(s))
+}
+
+// EscapeJS escapes text for a JavaScript string literal, including the
+// characters that could end a script element.
+func EscapeJS(s string) string {
+  return template.JSEscapeString(s)
+}
+
+// EscapeURL escapes text for a component of a URL, such as the value of a
+// query parameter.
+func EscapeURL(s string) string {
+  return url.QueryEscape(s)
+}
+
+// escapesMarkup reports whether the content type of the response calls
+// for markup escaping: HTML and XML do, while plain text and JSON are
+// written as they are.
+func (c *Context) escapesMarkup() bool {
+  mediaType := strings.ToLower(c.ContentType())
+  mediaType, _, _ = strings.Cut(mediaType, ";")
+  mediaType = strings.TrimSpace(mediaType)
+  return mediaType == "" || mediaType == "text/html" ||
+      strings.HasSuffix(mediaType, "/xml") ||
+      strings.HasSuffix(mediaType, "+xml")
+}
+
+// escapedValues formats values for PrintEscaped and PrintfEscaped. In
+// markup, each value is formatted and escaped unless it is SafeHTML or a
+// number or boolean, which cannot hold markup.
+func (c *Context) escapedValues(a []interface{}) []interface{} {
+  if !c.escapesMarkup() {
+    return a
+  }
+  escaped := make([]interface{}, len(a))
+  for i, value := range a {
+    switch value := value.(type) {
+    case SafeHTML:
+      escaped[i] = string(value)
+    case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32,
+        uint64, uintptr, float32, float64, complex64, complex128:
+      escaped[i] = value  // Kept for the verbs of Printf; nothing to escape.
+    default:
+      escaped[i] = EscapeHTML(fmt.Sprint(value))
+    }
+  }
+  return escaped
+}
+
+// PrintEscaped is like Print, but the values are escaped for the content
+// type of the response: for HTML and XML, each value is escaped with
+// EscapeHTML unless it is SafeHTML.
+func (c *Context) PrintEscaped(a ...interface{}) {
+  c.Print(c.escapedValues(a)...)
+}
+
+// PrintfEscaped is like Printf, but the arguments, not the format, are
+// escaped as by PrintEscaped.
+func (c *Context) PrintfEscaped(format string, a ...interface{}) {
+  c.Printf(format, c.escapedValues(a)...)
+}
@@ -0,0 +1,57 @@
+package runtime
+
+import (
+  "testing"
+  "net/http/httptest"
+)
+
+// TestEscape checks each escaping function on text that would break out
+// of its context.
+func TestEscape(t *testing.T) {
+  cases := []struct {
+    name string
+    escape func(string) string
+    text, want string
+  }{
+    { "EscapeHTML", EscapeHTML, `<a href="x">Tom & 'Jo'</a>`,
+        "&lt;a href=&#34;x&#34;&gt;Tom &amp; &#39;Jo&#39;&lt;/a&gt;" },
+    { "EscapeAttr", EscapeAttr, "a=`b` \"c\"",
+        "a&#61;&#96;b&#96; &#34;c&#34;" },
+    { "EscapeJS", EscapeJS, `'</script>'`,
+        `\'\u003C/script\u003E\'` },
+    { "EscapeURL", EscapeURL, "a b&c=d/é", "a+b%26c%3Dd%2F%C3%A9" },
+    { "EscapeHTML", EscapeHTML, "plain", "plain" },
+  }
+  for _, c := range cases {
+    if got := c.escape(c.text); got != c.want {
+      t.Errorf("%s(%q) is %q, want %q", c.name, c.text, got, c.want)
+    }
+  }
+}
+
+// TestPrintEscaped checks that values are escaped for markup but not for
+// other content types, and that SafeHTML and numbers are left as they are.
+func TestPrintEscaped(t *testing.T) {
+  cases := []struct {
+    contentType, want string
+  }{
+    { "", "&lt;b&gt; <i>x</i> 3 2.50" },
+    { "text/html; charset=utf-8", "&lt;b&gt; <i>x</i> 3 2.50" },
+    { "application/atom+xml", "&lt;b&gt; <i>x</i> 3 2.50" },
+    { "text/plain", "<b> <i>x</i> 3 2.50" },
+    { "application/json", "<b> <i>x</i> 3 2.50" },
+  }
+  for _, c := range cases {
+    recorder := httptest.NewRecorder()
+    context := NewContext(recorder, httptest.NewRequest("GET", "/", nil))
+    if c.contentType != "" {
+      context.SetContentType(c.contentType)
+    }
+    context.PrintEscaped("<b>", " ", SafeHTML("<i>x</i>"), " ", 3, " ")
+    context.PrintfEscaped("%.2f", 2.5)
+    context.Finish()
+    if got := recorder.Body.String(); got != c.want {
+      t.Errorf("%q: wrote %q, want %q", c.contentType, got, c.want)
+    }
+  }
+}
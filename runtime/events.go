@@ -0,0 +1,89 @@
+package runtime
+
+import (
+  "os"
+  "io"
+  "errors"
+  "strings"
+  "net/http"
+)
+
+// errStreamTaken is returned by SendEvent when the response was written
+// before the first event, as after the deadline of the page.
+var errStreamTaken = errors.New("the response has already been written")
+
+// SendEvent sends a Server-Sent Event to the client at once. The first
+// call turns the response into a stream of events: it sets the
+// Content-Type to text/event-stream, writes the headers set so far, and
+// discards what the page had written to the body. Later output of the
+// page, other than events, is discarded too, and the page's deadline no
+// longer applies. An empty name sends an unnamed "message" event. Each
+// line of the data becomes a data field. The error is that of the write,
+// as when the client has gone away, after which SendEvent fails at once.
+// It ends a loop of updates:
+//
+//   for range ticker.C {
+//     if runtime.SendEvent("load", currentLoad()) != nil {
+//       return
+//     }
+//   }
+func (c *Context) SendEvent(name, data string) error {
+  if c.gone {
+    return errClientGone
+  }
+  if !c.streaming {
+    if err := c.startEvents(); err != nil {
+      return err
+    }
+  }
+  var event strings.Builder
+  if name != "" {
+    event.WriteString("event: " + strings.ReplaceAll(
+        strings.ReplaceAll(name, "\r", ""), "\n", "") + "\n")
+  }
+  data = strings.ReplaceAll(strings.ReplaceAll(data, "\r\n", "\n"), "\r",
+      "\n")
+  for _, line := range strings.Split(data, "\n") {
+    event.WriteString("data: " + line + "\n")
+  }
+  event.WriteString("\n")
+  return c.writeEvent(event.String())
+}
+
+// startEvents writes the headers of an event stream. The response has no
+// Content-Length, and it is not compressed.
+func (c *Context) startEvents() error {
+  if !c.guard.claim() {
+    return errStreamTaken
+  }
+  c.streaming = true
+  c.discardContent()
+  c.SetContentType("text/event-stream")
+  c.SetHeader("Cache-Control", "no-cache")
+  c.DelHeader("Content-Length")
+  c.echoRequestID()
+  if c.writer != nil {
+    c.SetHeader("X-Accel-Buffering", "no")  // Tell nginx not to buffer.
+    c.copyHeaders()
+    c.writer.WriteHeader(c.status())
+    return c.writeEvent("")
+  }
+  ignoreSIGPIPE()
+  c.writeCGIHeaders(os.Stdout)
+  return nil
+}
+
+// writeEvent writes text to the client and flushes it through. A failed
+// write means that the client has gone away.
+func (c *Context) writeEvent(text string) error {
+  var err error
+  if c.writer == nil {
+    _, err = io.WriteString(os.Stdout, text)  // Stdout is not buffered.
+  } else if _, err = io.WriteString(c.writer, text); err == nil {
+    err = http.NewResponseController(c.writer).Flush()
+  }
+  if err != nil {
+    c.disconnected(err)
+  }
+  return err
+}
@@ -0,0 +1,88 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "strings"
+  "net/http"
+)
+
+// fastCGIMutex serializes requests, because the default context is shared
+// by the whole program.
+var fastCGIMutex sync.Mutex
+
+
+//--- FastCGI
+
+// ServeFastCGI is called by the main function that buildapp generates in
+// -fastcgi mode, with the body of the template as the page function. If
+// the program was started by a FastCGI server, which passes a listening
+// socket as standard input, or if BOOMERANG_FASTCGI gives an address to
+// listen on, the program serves requests until the listener is closed,
+// running page for each one with fresh headers and content. Otherwise it
+// runs page once as a CGI program.
+func ServeFastCGI(page func()) {
+  listener, err := fastCGIListener()
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "runtime: %s\n", err.Error())
+    os.Exit(1)
+  }
+  if listener == nil {
+    defer PrintCGI()
+    defer defaultContext.Recover()
+    page()
+    return
+  }
+  err = serveFastCGI(listener, http.HandlerFunc(
+      func (w http.ResponseWriter, r *http.Request) {
+    serveRequest(w, r, page)
+  }))
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "runtime: %s\n", err.Error())
+    os.Exit(1)
+  }
+}
+
+// fastCGIListener returns the listener on which to serve FastCGI, or nil
+// if the program should run as CGI. BOOMERANG_FASTCGI is a TCP address, as
+// in "localhost:9000", or the path of a Unix socket.
+func fastCGIListener() (net.Listener, error) {
+  if address := os.Getenv("BOOMERANG_FASTCGI"); address != "" {
+    if strings.Contains(address, "/") {
+      os.Remove(address)  // A socket left by an earlier run is in the way.
+      return net.Listen("unix", address)
+    }
+    return net.Listen("tcp", address)
+  }
+  if !isListeningSocket(os.Stdin) {
+    return nil, nil  // This is CGI.
+  }
+  return net.FileListener(os.Stdin)
+}
+
+// serveRequest runs the page for one FastCGI request. A panic in the page
+// is logged and answered with a 500 response. A page that runs past the
+// deadline is answered with a 504 response, and because it goes on using
+// the default context, the program then takes no more requests and exits,
+// leaving the FastCGI server to start a fresh one.
+func serveRequest(w http.ResponseWriter, r *http.Request, page func()) {
+  fastCGIMutex.Lock()
+  finished := serveWithDeadline(w, r,
+      func (w http.ResponseWriter, r *http.Request) {
+    defaultContext.reset(w, r)
+    defer defaultContext.Recover()
+    page()
+    PrintCGI()
+  })
+  if !finished {
+    go func() {
+      time.Sleep(time.Second)  // Time to send the 504 response.
+      os.Exit(1)
+    }()
+    return
+  }
+  fastCGIMutex.Unlock()
+}
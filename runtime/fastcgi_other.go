@@ -0,0 +1,14 @@
+//go:build !unix
+
+package runtime
+
+import (
+  "os"
+)
+
+// isListeningSocket reports false where the standard input cannot be
+// examined. FastCGI is then served only at the address given by
+// BOOMERANG_FASTCGI.
+func isListeningSocket(file *os.File) bool {
+  return false
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package runtime
+
+import (
+  "os"
+  "syscall"
+)
+
+// isListeningSocket reports whether a file is a socket that is listening
+// for connections, as the standard input of a FastCGI program is.
+func isListeningSocket(file *os.File) bool {
+  accepting, err := syscall.GetsockoptInt(int(file.Fd()), syscall.SOL_SOCKET,
+      syscall.SO_ACCEPTCONN)
+  return err == nil && accepting != 0
+}
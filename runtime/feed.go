@@ -0,0 +1,228 @@
+package runtime
+
+import (
+  "time"
+  "encoding/xml"
+)
+
+// Feed describes a news feed, which WriteRSS writes as RSS 2.0 and
+// WriteAtom as Atom. Text is escaped as the formats require; the
+// Description of an item may be HTML, which is escaped as text too and
+// read as HTML by feed readers.
+type Feed struct {
+  Title string
+  Link string            // The URL of the site or page that the feed follows.
+  SelfLink string        // The URL of the feed itself, if known.
+  Description string
+  ID string              // A permanent ID for Atom; Link if empty.
+  Author string
+  Updated time.Time      // The time of the newest item if zero.
+  Items []FeedItem
+}
+
+// FeedItem is an entry of a feed.
+type FeedItem struct {
+  Title string
+  Link string
+  Description string     // A summary, which may be HTML.
+  ID string              // A permanent ID; Link if empty.
+  Author string
+  Published time.Time
+  Updated time.Time      // Published if zero.
+}
+
+// updated returns the time at which the feed last changed.
+func (f *Feed) updated() time.Time {
+  if !f.Updated.IsZero() {
+    return f.Updated
+  }
+  var updated time.Time
+  for _, item := range f.Items {
+    if itemTime := item.updated(); itemTime.After(updated) {
+      updated = itemTime
+    }
+  }
+  if updated.IsZero() {
+    updated = time.Now()
+  }
+  return updated
+}
+
+// updated returns the time at which an item last changed.
+func (item *FeedItem) updated() time.Time {
+  if item.Updated.IsZero() {
+    return item.Published
+  }
+  return item.Updated
+}
+
+// id returns the ID of an item.
+func (item *FeedItem) id() string {
+  if item.ID == "" {
+    return item.Link
+  }
+  return item.ID
+}
+
+
+//--- RSS 2.0
+
+type rssDocument struct {
+  XMLName xml.Name `xml:"rss"`
+  Version string `xml:"version,attr"`
+  AtomNS string `xml:"xmlns:atom,attr,omitempty"`
+  Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+  Title string `xml:"title"`
+  Link string `xml:"link"`
+  Description string `xml:"description"`
+  SelfLink *rssAtomLink `xml:"atom:link,omitempty"`
+  LastBuildDate string `xml:"lastBuildDate"`
+  Items []rssItem `xml:"item"`
+}
+
+type rssAtomLink struct {
+  Href string `xml:"href,attr"`
+  Rel string `xml:"rel,attr"`
+  Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+  Title string `xml:"title,omitempty"`
+  Link string `xml:"link,omitempty"`
+  Description string `xml:"description,omitempty"`
+  Author string `xml:"author,omitempty"`
+  GUID *rssGUID `xml:"guid,omitempty"`
+  PubDate string `xml:"pubDate,omitempty"`
+}
+
+type rssGUID struct {
+  IsPermaLink bool `xml:"isPermaLink,attr"`
+  Value string `xml:",chardata"`
+}
+
+// rssDate formats a time as RSS requires, in the style of RFC 822.
+func rssDate(t time.Time) string {
+  if t.IsZero() {
+    return ""
+  }
+  return t.Format(time.RFC1123Z)
+}
+
+// WriteRSS writes a feed as an RSS 2.0 document with the Content-Type
+// application/rss+xml. Each item has a guid, which is a permalink when the
+// item has no ID of its own.
+func (c *Context) WriteRSS(feed *Feed) error {
+  doc := rssDocument{ Version: "2.0", Channel: rssChannel{
+      Title: feed.Title, Link: feed.Link, Description: feed.Description,
+      LastBuildDate: rssDate(feed.updated()) } }
+  if feed.SelfLink != "" {
+    doc.AtomNS = "http://www.w3.org/2005/Atom"
+    doc.Channel.SelfLink = &rssAtomLink{ Href: feed.SelfLink, Rel: "self",
+        Type: "application/rss+xml" }
+  }
+  for _, item := range feed.Items {
+    entry := rssItem{ Title: item.Title, Link: item.Link,
+        Description: item.Description, Author: item.Author,
+        PubDate: rssDate(item.Published) }
+    if id := item.id(); id != "" {
+      entry.GUID = &rssGUID{ IsPermaLink: item.ID == "", Value: id }
+    }
+    doc.Channel.Items = append(doc.Channel.Items, entry)
+  }
+  return c.writeXMLAs(doc, "application/rss+xml")
+}
+
+
+//--- Atom
+
+type atomFeed struct {
+  XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+  Title string `xml:"title"`
+  Subtitle string `xml:"subtitle,omitempty"`
+  ID string `xml:"id"`
+  Updated string `xml:"updated"`
+  Links []atomLink `xml:"link"`
+  Author *atomPerson `xml:"author,omitempty"`
+  Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+  Href string `xml:"href,attr"`
+  Rel string `xml:"rel,attr,omitempty"`
+  Type string `xml:"type,attr,omitempty"`
+}
+
+type atomPerson struct {
+  Name string `xml:"name"`
+}
+
+type atomEntry struct {
+  Title string `xml:"title"`
+  ID string `xml:"id"`
+  Updated string `xml:"updated"`
+  Published string `xml:"published,omitempty"`
+  Links []atomLink `xml:"link"`
+  Author *atomPerson `xml:"author,omitempty"`
+  Summary *atomText `xml:"summary,omitempty"`
+}
+
+type atomText struct {
+  Type string `xml:"type,attr"`
+  Value string `xml:",chardata"`
+}
+
+// atomDate formats a time as Atom requires, in RFC 3339.
+func atomDate(t time.Time) string {
+  if t.IsZero() {
+    return ""
+  }
+  return t.Format(time.RFC3339)
+}
+
+// atomAuthor makes the author element of a name, if there is one.
+func atomAuthor(name string) *atomPerson {
+  if name == "" {
+    return nil
+  }
+  return &atomPerson{ Name: name }
+}
+
+// WriteAtom writes a feed as an Atom document with the Content-Type
+// application/atom+xml. The summaries of items are marked as HTML.
+func (c *Context) WriteAtom(feed *Feed) error {
+  doc := atomFeed{ Title: feed.Title, Subtitle: feed.Description,
+      ID: feed.ID, Updated: atomDate(feed.updated()),
+      Author: atomAuthor(feed.Author) }
+  if doc.ID == "" {
+    doc.ID = feed.Link
+  }
+  if feed.Link != "" {
+    doc.Links = append(doc.Links, atomLink{ Href: feed.Link,
+        Rel: "alternate" })
+  }
+  if feed.SelfLink != "" {
+    doc.Links = append(doc.Links, atomLink{ Href: feed.SelfLink,
+        Rel: "self", Type: "application/atom+xml" })
+  }
+  for _, item := range feed.Items {
+    entry := atomEntry{ Title: item.Title, ID: item.id(),
+        Updated: atomDate(item.updated()),
+        Published: atomDate(item.Published),
+        Author: atomAuthor(item.Author) }
+    if entry.Updated == "" {
+      entry.Updated = doc.Updated
+    }
+    if item.Link != "" {
+      entry.Links = append(entry.Links, atomLink{ Href: item.Link,
+          Rel: "alternate" })
+    }
+    if item.Description != "" {
+      entry.Summary = &atomText{ Type: "html", Value: item.Description }
+    }
+    doc.Entries = append(doc.Entries, entry)
+  }
+  return c.writeXMLAs(doc, "application/atom+xml")
+}
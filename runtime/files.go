@@ -0,0 +1,181 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "errors"
+  "strings"
+  "path/filepath"
+)
+
+// ErrNotWritable is returned by the file helpers when a path lies outside
+// the writable roots.
+var ErrNotWritable = errors.New("path is outside the writable roots")
+
+// defaultWritableRoots can be set at link time to a list of directories
+// separated by os.PathListSeparator, as buildapp does with its
+// writableRoots setting.
+var defaultWritableRoots = ""
+
+// writableRoots is nil while the runtime is unrestricted. Otherwise it lists
+// the only directories, with their subdirectories, that the file helpers
+// may write to. An empty non-nil list makes the runtime read-only.
+var writableRoots []string
+var writableRootsOnce sync.Once
+var writableRootsLock sync.RWMutex
+
+// loadWritableRoots initializes writableRoots from the BOOMERANG_WRITABLE
+// environment variable or, if that is not set, from the link-time default.
+// Setting BOOMERANG_WRITABLE to the empty string makes the runtime
+// read-only.
+func loadWritableRoots() {
+  list, isSet := os.LookupEnv("BOOMERANG_WRITABLE")
+  if !isSet {
+    if defaultWritableRoots == "" {
+      return
+    }
+    list = defaultWritableRoots
+  }
+  setWritableRoots(filepath.SplitList(list))
+}
+
+// SetWritableRoots restricts the file helpers to the named directories and
+// their subdirectories. Calling it with no arguments makes the runtime
+// read-only. Once SetWritableRoots is called, the default roots are not
+// loaded.
+func SetWritableRoots(dirs ...string) {
+  writableRootsOnce.Do(func() {})
+  setWritableRoots(dirs)
+}
+
+// setWritableRoots resolves the directories and then replaces the
+// writable roots with them.
+func setWritableRoots(dirs []string) {
+  roots := []string{}
+  for _, dir := range dirs {
+    if dir == "" {
+      continue
+    }
+    roots = append(roots, resolvePath(dir))
+  }
+  writableRootsLock.Lock()
+  defer writableRootsLock.Unlock()
+  writableRoots = roots
+}
+
+// WritableRoots returns the writable directories, or nil if writing is not
+// restricted.
+func WritableRoots() []string {
+  writableRootsOnce.Do(loadWritableRoots)
+  writableRootsLock.RLock()
+  defer writableRootsLock.RUnlock()
+  return writableRoots
+}
+
+// resolvePath makes a path absolute and resolves symbolic links in the
+// longest part of it that exists, so that a link cannot be used to escape
+// from a writable root.
+func resolvePath(path string) string {
+  path, err := filepath.Abs(path)
+  if err != nil {
+    return filepath.Clean(path)
+  }
+  rest := ""
+  for dir := path; ; dir = filepath.Dir(dir) {
+    if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+      return filepath.Join(resolved, rest)
+    }
+    if dir == filepath.Dir(dir) {
+      return path
+    }
+    rest = filepath.Join(filepath.Base(dir), rest)
+  }
+}
+
+// CheckWritable returns nil if the file helpers may write to path. In
+// read-only mode, the error wraps ErrNotWritable and is also logged to
+// stderr so that a misconfiguration does not go unnoticed.
+func CheckWritable(path string) error {
+  roots := WritableRoots()
+  if roots == nil {
+    return nil
+  }
+  resolved := resolvePath(path)
+  for _, root := range roots {
+    if resolved == root ||
+        strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+      return nil
+    }
+  }
+  err := &os.PathError{ Op: "write", Path: path, Err: ErrNotWritable }
+  fmt.Fprintf(os.Stderr, "runtime: %s (writable roots: %s)\n", err,
+      strings.Join(roots, string(filepath.ListSeparator)))
+  return err
+}
+
+
+//--- File helpers that respect the writable roots
+
+// OpenFile is like os.OpenFile, but it refuses to create, truncate, or
+// open for writing a file outside the writable roots.
+func OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+  if flag & (os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+    if err := CheckWritable(name); err != nil {
+      return nil, err
+    }
+  }
+  return os.OpenFile(name, flag, perm)
+}
+
+// CreateFile is like os.Create within the writable roots.
+func CreateFile(name string) (*os.File, error) {
+  return OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// WriteFile is like os.WriteFile within the writable roots.
+func WriteFile(name string, data []byte, perm os.FileMode) error {
+  if err := CheckWritable(name); err != nil {
+    return err
+  }
+  return os.WriteFile(name, data, perm)
+}
+
+// MkdirAll is like os.MkdirAll within the writable roots.
+func MkdirAll(path string, perm os.FileMode) error {
+  if err := CheckWritable(path); err != nil {
+    return err
+  }
+  return os.MkdirAll(path, perm)
+}
+
+// Remove is like os.Remove within the writable roots.
+func Remove(name string) error {
+  if err := CheckWritable(name); err != nil {
+    return err
+  }
+  return os.Remove(name)
+}
+
+// Rename is like os.Rename. Both paths must lie within the writable roots.
+func Rename(oldPath, newPath string) error {
+  if err := CheckWritable(oldPath); err != nil {
+    return err
+  }
+  if err := CheckWritable(newPath); err != nil {
+    return err
+  }
+  return os.Rename(oldPath, newPath)
+}
+
+// CreateTemp is like os.CreateTemp within the writable roots, except that
+// an empty dir means TempDir().
+func CreateTemp(dir, pattern string) (*os.File, error) {
+  if dir == "" {
+    dir = TempDir()
+  }
+  if err := CheckWritable(dir); err != nil {
+    return nil, err
+  }
+  return os.CreateTemp(dir, pattern)
+}
@@ -0,0 +1,79 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "strings"
+)
+
+// Filter transforms the body of a response before it is sent, as to
+// minify it or to inject a snippet before </body>. It receives the body
+// with its placeholders filled and surrounding whitespace trimmed, and it
+// returns the body to send. Filters must not panic.
+type Filter func(body []byte) []byte
+
+// defaultFilters can be set at link time to a comma-separated list of the
+// names of filters that apply to every page, as buildapp does with its
+// filters setting.
+var defaultFilters = ""
+
+// filterRegistry holds the filters registered by name.
+var filterRegistry = map[string]Filter{}
+var filterRegistryLock sync.Mutex
+
+// RegisterFilter makes a filter known by a name, so that it can be applied
+// to every page by the filters setting of buildapp or by the
+// BOOMERANG_FILTERS environment variable. It is meant to be called from
+// the init function of a package that the templates import.
+func RegisterFilter(name string, filter Filter) {
+  filterRegistryLock.Lock()
+  defer filterRegistryLock.Unlock()
+  filterRegistry[name] = filter
+}
+
+// siteFilters returns the registered filters named by BOOMERANG_FILTERS
+// or, if that is not set, by the link-time default. An unknown name is
+// reported on stderr and skipped.
+func siteFilters() []Filter {
+  list, isSet := os.LookupEnv("BOOMERANG_FILTERS")
+  if !isSet {
+    list = defaultFilters
+  }
+  filterRegistryLock.Lock()
+  defer filterRegistryLock.Unlock()
+  filters := []Filter{}
+  for _, name := range strings.Split(list, ",") {
+    name = strings.TrimSpace(name)
+    if name == "" {
+      continue
+    }
+    filter, found := filterRegistry[name]
+    if !found {
+      fmt.Fprintf(os.Stderr, "runtime: unknown filter %q\n", name)
+      continue
+    }
+    filters = append(filters, filter)
+  }
+  return filters
+}
+
+// AddFilter applies a filter to the body of this response, after the
+// filters of the site and those added before it.
+func (c *Context) AddFilter(filter Filter) {
+  c.filters = append(c.filters, filter)
+}
+
+// filter passes the body through the filters of the site and then those
+// of the page, in order.
+func (c *Context) filter(body string) string {
+  filters := append(siteFilters(), c.filters...)
+  if len(filters) == 0 {
+    return body
+  }
+  data := []byte(body)
+  for _, filter := range filters {
+    data = filter(data)
+  }
+  return string(data)
+}
@@ -0,0 +1,90 @@
+package runtime
+
+import (
+  "mime"
+  "strings"
+  "net/textproto"
+)
+
+// headerLine formats a header for the response. Line breaks in the value
+// become spaces so that a value cannot add headers of its own.
+func headerLine(name, value string) string {
+  value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+  return textproto.CanonicalMIMEHeaderKey(name) + ": " + value
+}
+
+// hasName reports whether a header line has the given name, which is
+// compared without regard to case.
+func hasName(header, name string) bool {
+  headerName, _, _ := strings.Cut(header, ":")
+  return strings.EqualFold(strings.TrimSpace(headerName), name)
+}
+
+// SetHeader sets a response header, replacing any headers of the same
+// name, so that the last call wins. Names are not case-sensitive.
+func (c *Context) SetHeader(name, value string) {
+  c.DelHeader(name)
+  c.AddHeader(name, value)
+}
+
+// AddHeader adds a response header, keeping any others of the same name,
+// as for several Link headers.
+func (c *Context) AddHeader(name, value string) {
+  c.appendHeader(headerLine(name, value))
+}
+
+// DelHeader removes the response headers of the given name, including
+// the default Content-Type.
+func (c *Context) DelHeader(name string) {
+  kept := c.headers[:0]
+  for _, header := range c.headers {
+    if !hasName(header, name) {
+      kept = append(kept, header)
+    }
+  }
+  c.headers = kept
+}
+
+// SetContentType sets the Content-Type of the response. Text and XML types
+// are given a UTF-8 charset unless they name one.
+func (c *Context) SetContentType(mediaType string) {
+  base, params, err := mime.ParseMediaType(mediaType)
+  if err == nil && params["charset"] == "" && (strings.HasPrefix(base,
+      "text/") || strings.HasSuffix(base, "/xml") ||
+      strings.HasSuffix(base, "+xml")) {
+    mediaType += "; charset=utf-8"
+  }
+  c.SetHeader("Content-Type", mediaType)
+}
+
+// ContentType returns the Content-Type of the response, or "" if it has
+// been removed.
+func (c *Context) ContentType() string {
+  for _, header := range c.headers {
+    if hasName(header, "Content-Type") {
+      _, value, _ := strings.Cut(header, ":")
+      return strings.TrimSpace(value)
+    }
+  }
+  return ""
+}
+
+// HTML makes the response an HTML page, which it is by default.
+func (c *Context) HTML() {
+  c.SetContentType("text/html")
+}
+
+// JSON makes the response a JSON document.
+func (c *Context) JSON() {
+  c.SetContentType("application/json")
+}
+
+// PlainText makes the response plain text.
+func (c *Context) PlainText() {
+  c.SetContentType("text/plain")
+}
+
+// XML makes the response an XML document.
+func (c *Context) XML() {
+  c.SetContentType("application/xml")
+}
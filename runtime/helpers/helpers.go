@@ -0,0 +1,227 @@
+// Package helpers holds the small formatting functions that sites keep
+// writing for themselves: dates, truncation, plurals, numbers, currency,
+// slugs, and line breaks. Templates call them as helpers.Truncate and so
+// on without importing the package, since buildapp adds the import to a
+// page that names it.
+package helpers
+
+import (
+  "math"
+  "time"
+  "strconv"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+  "github.com/michaellaszlo/boomerang/runtime"
+)
+
+// dateLayouts are the layouts that Date knows by name.
+var dateLayouts = map[string]string{
+  "date": "2 January 2006",
+  "short": "2 Jan 2006",
+  "iso": "2006-01-02",
+  "time": "15:04",
+  "datetime": "2 January 2006, 15:04",
+  "rfc3339": time.RFC3339,
+  "http": "Mon, 02 Jan 2006 15:04:05 GMT",
+}
+
+// Date formats a time by a named layout, or else by a Go layout such as
+// "Mon 2 Jan". The names are "date" (5 March 2026), "short" (5 Mar 2026),
+// "iso" (2026-03-05), "time" (14:30), "datetime" (5 March 2026, 14:30),
+// "rfc3339", and "http", which is in UTC as HTTP headers are. An empty
+// layout is "date".
+func Date(t time.Time, layout string) string {
+  if layout == "" {
+    layout = "date"
+  }
+  if layout == "http" {
+    t = t.UTC()
+  }
+  if named, found := dateLayouts[layout]; found {
+    layout = named
+  }
+  return t.Format(layout)
+}
+
+// Ago describes how long ago a time was, as "just now", "5 minutes ago",
+// or "yesterday", or how far off it is, as "in 3 hours". Times more than
+// 30 days away are given as dates.
+func Ago(t time.Time) string {
+  elapsed := time.Since(t)
+  future := elapsed < 0
+  if future {
+    elapsed = -elapsed
+  }
+  var amount string
+  switch {
+  case elapsed < time.Minute:
+    return "just now"
+  case elapsed < time.Hour:
+    amount = Plural(int(elapsed/time.Minute), "minute", "minutes")
+  case elapsed < 24*time.Hour:
+    amount = Plural(int(elapsed/time.Hour), "hour", "hours")
+  case elapsed < 48*time.Hour && future:
+    return "tomorrow"
+  case elapsed < 48*time.Hour:
+    return "yesterday"
+  case elapsed <= 30*24*time.Hour:
+    amount = Plural(int(elapsed/(24*time.Hour)), "day", "days")
+  default:
+    return Date(t, "date")
+  }
+  if future {
+    return "in " + amount
+  }
+  return amount + " ago"
+}
+
+// Truncate shortens text to at most n characters, counting the ellipsis
+// that it ends with, and cuts at the end of a word if one ends in the
+// second half of what is kept. Text that fits is returned as it is.
+func Truncate(s string, n int) string {
+  if utf8.RuneCountInString(s) <= n {
+    return s
+  }
+  if n <= 0 {
+    return ""
+  } else if n == 1 {
+    return "…"
+  }
+  runes := []rune(s)[:n-1]
+  for i := len(runes); i > len(runes)/2; i-- {
+    if unicode.IsSpace(runes[i-1]) {
+      runes = runes[:i-1]
+      break
+    }
+  }
+  return strings.TrimRightFunc(string(runes), func(r rune) bool {
+    return unicode.IsSpace(r) || unicode.IsPunct(r)
+  }) + "…"
+}
+
+// Plural gives a count with the singular or the plural of a noun, as
+// "1 comment" or "1,024 comments". For other languages, use the plural
+// forms of runtime.T.
+func Plural(n int, singular, plural string) string {
+  noun := plural
+  if n == 1 || n == -1 {
+    noun = singular
+  }
+  return Number(float64(n), 0) + " " + noun
+}
+
+// Number formats a number with commas between groups of thousands and the
+// given number of decimals, as "1,234,567.89".
+func Number(x float64, decimals int) string {
+  if math.IsNaN(x) || math.IsInf(x, 0) {
+    return strconv.FormatFloat(x, 'f', -1, 64)
+  }
+  if decimals < 0 {
+    decimals = 0
+  }
+  digits := strconv.FormatFloat(math.Abs(x), 'f', decimals, 64)
+  whole, fraction, _ := strings.Cut(digits, ".")
+  grouped := []byte{}
+  for i := 0; i < len(whole); i++ {
+    if i > 0 && (len(whole)-i)%3 == 0 {
+      grouped = append(grouped, ',')
+    }
+    grouped = append(grouped, whole[i])
+  }
+  result := string(grouped)
+  if fraction != "" {
+    result += "." + fraction
+  }
+  if x < 0 && strings.Trim(digits, "0.") != "" {
+    result = "-" + result
+  }
+  return result
+}
+
+// currencies gives the symbols and the decimals of currencies by their
+// ISO 4217 codes.
+var currencies = map[string]struct {
+  symbol string
+  decimals int
+}{
+  "USD": { "$", 2 },
+  "EUR": { "€", 2 },
+  "GBP": { "£", 2 },
+  "JPY": { "¥", 0 },
+  "CNY": { "¥", 2 },
+  "INR": { "₹", 2 },
+  "KRW": { "₩", 0 },
+  "CAD": { "CA$", 2 },
+  "AUD": { "A$", 2 },
+  "CHF": { "CHF ", 2 },
+}
+
+// Currency formats an amount of money in a currency given by its ISO 4217
+// code, as "$1,234.50" for USD or "-€3.00" for EUR. A currency that it
+// does not know is written with its code and two decimals, as
+// "SEK 99.00".
+func Currency(amount float64, code string) string {
+  code = strings.ToUpper(code)
+  currency, found := currencies[code]
+  if !found {
+    currency.symbol, currency.decimals = code+" ", 2
+  }
+  number := Number(amount, currency.decimals)
+  if strings.HasPrefix(number, "-") {
+    return "-" + currency.symbol + number[1:]
+  }
+  return currency.symbol + number
+}
+
+// latinLetters gives the plain letters of the accented Latin letters that
+// Slugify replaces.
+var latinLetters = map[rune]string{}
+
+// init fills latinLetters from the letters that stand for each plain one.
+func init() {
+  for plain, accented := range map[string]string{
+    "a": "àáâãäåāăą", "c": "çćĉċč", "d": "ďđ", "e": "èéêëēĕėęě",
+    "g": "ĝğġģ", "h": "ĥħ", "i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķ",
+    "l": "ĺļľŀł", "n": "ñńņňŉ", "o": "òóôõöøōŏő", "r": "ŕŗř",
+    "s": "śŝşš", "t": "ţťŧ", "u": "ùúûüũūŭůűų", "w": "ŵ", "y": "ýÿŷ",
+    "z": "źżž", "ae": "æ", "oe": "œ", "ss": "ß", "th": "þ", "dh": "ð",
+  } {
+    for _, letter := range accented {
+      latinLetters[letter] = plain
+    }
+  }
+}
+
+// Slugify turns a title into a part of a URL path, as "cafe-creme" from
+// "Café Crème!": letters are put in lower case and stripped of accents,
+// and each run of other characters than letters and digits becomes a
+// hyphen.
+func Slugify(s string) string {
+  var slug strings.Builder
+  hyphen := false
+  for _, r := range strings.ToLower(s) {
+    plain, found := latinLetters[r]
+    if !found && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+      plain, found = string(r), true
+    }
+    if !found {
+      hyphen = true
+      continue
+    }
+    if hyphen && slug.Len() > 0 {
+      slug.WriteByte('-')
+    }
+    slug.WriteString(plain)
+    hyphen = false
+  }
+  return slug.String()
+}
+
+// Nl2br escapes text for HTML and puts a <br> at each line break, so that
+// the lines of a comment or an address show as they were typed.
+func Nl2br(s string) runtime.SafeHTML {
+  s = strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\r", "\n")
+  return runtime.SafeHTML(strings.ReplaceAll(runtime.EscapeHTML(s), "\n",
+      "<br>\n"))
+}
@@ -0,0 +1,271 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "sync"
+  "strings"
+  "path/filepath"
+  "encoding/json"
+)
+
+// defaultLocaleDir can be set at link time to the directory of message
+// catalogs, as buildapp does with its localeDir setting.
+var defaultLocaleDir = ""
+
+// DefaultLocale is the locale of pages whose clients accept none of the
+// catalogs, and the locale in which missing messages are looked up last.
+// buildapp sets it at link time with its defaultLocale setting.
+var DefaultLocale = "en"
+
+// message is a message of a catalog: a single text, or texts by plural
+// category.
+type message struct {
+  text string
+  plural map[string]string
+}
+
+// catalogs maps locales, in lower case with hyphens, to their messages.
+var catalogs map[string]map[string]message
+var catalogsOnce sync.Once
+var catalogsLock sync.RWMutex
+
+// LoadCatalogs replaces the message catalogs with those in a directory.
+// Each file is named for its locale, as in "fr.json" or "pt_BR.po". A JSON
+// catalog is an object that maps each key to its text, or to an object of
+// texts by plural category ("zero", "one", "two", "few", "many", and
+// "other"). A gettext catalog gives the text as msgstr and the plural
+// forms as msgstr[n], in the order of the language's categories; fuzzy
+// and untranslated entries are skipped. Other files are ignored. Once
+// LoadCatalogs is called, the default directory is not loaded.
+func LoadCatalogs(dir string) error {
+  catalogsOnce.Do(func() {})
+  return loadCatalogs(dir)
+}
+
+// loadCatalogs replaces the message catalogs with those in a directory.
+func loadCatalogs(dir string) error {
+  entries, err := os.ReadDir(dir)
+  if err != nil {
+    return err
+  }
+  loaded := map[string]map[string]message{}
+  for _, entry := range entries {
+    extension := filepath.Ext(entry.Name())
+    if entry.IsDir() || (extension != ".json" && extension != ".po") {
+      continue
+    }
+    locale := normalizeLocale(strings.TrimSuffix(entry.Name(), extension))
+    data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+    if err != nil {
+      return err
+    }
+    var messages map[string]message
+    if extension == ".json" {
+      messages, err = parseJSONCatalog(data)
+    } else {
+      messages, err = parsePOCatalog(data, pluralRuleFor(locale))
+    }
+    if err != nil {
+      return fmt.Errorf("%s: %s", filepath.Join(dir, entry.Name()),
+          err.Error())
+    }
+    if loaded[locale] == nil {
+      loaded[locale] = map[string]message{}
+    }
+    for key, m := range messages {
+      loaded[locale][key] = m
+    }
+  }
+  catalogsLock.Lock()
+  catalogs = loaded
+  catalogsLock.Unlock()
+  return nil
+}
+
+// loadDefaultCatalogs loads the catalogs of the directory named by
+// BOOMERANG_LOCALES or, if that is not set, by the link-time default. An
+// error is reported on stderr, and the pages go untranslated.
+func loadDefaultCatalogs() {
+  dir, isSet := os.LookupEnv("BOOMERANG_LOCALES")
+  if !isSet {
+    dir = defaultLocaleDir
+  }
+  if dir == "" {
+    return
+  }
+  if err := loadCatalogs(dir); err != nil {
+    fmt.Fprintf(os.Stderr, "runtime: %s\n", err.Error())
+  }
+}
+
+// parseJSONCatalog reads the messages of a JSON catalog.
+func parseJSONCatalog(data []byte) (map[string]message, error) {
+  raw := map[string]json.RawMessage{}
+  if err := json.Unmarshal(data, &raw); err != nil {
+    return nil, err
+  }
+  messages := map[string]message{}
+  for key, value := range raw {
+    var m message
+    if err := json.Unmarshal(value, &m.text); err != nil {
+      if err := json.Unmarshal(value, &m.plural); err != nil {
+        return nil, fmt.Errorf("message %q is neither a string nor an "+
+            "object of strings", key)
+      }
+    }
+    messages[key] = m
+  }
+  return messages, nil
+}
+
+// normalizeLocale turns a locale tag such as "pt_BR" into "pt-br".
+func normalizeLocale(tag string) string {
+  return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+// baseLanguage returns the language of a locale, as "pt" of "pt-br".
+func baseLanguage(locale string) string {
+  language, _, _ := strings.Cut(locale, "-")
+  return language
+}
+
+// hasCatalog reports whether a locale has a catalog.
+func hasCatalog(locale string) bool {
+  catalogsOnce.Do(loadDefaultCatalogs)
+  catalogsLock.RLock()
+  defer catalogsLock.RUnlock()
+  _, found := catalogs[locale]
+  return found
+}
+
+// lookupMessage finds a message in the catalog of a locale, then in that
+// of its base language, then in that of DefaultLocale.
+func lookupMessage(locale, key string) (message, bool) {
+  catalogsOnce.Do(loadDefaultCatalogs)
+  catalogsLock.RLock()
+  defer catalogsLock.RUnlock()
+  for _, candidate := range []string{ locale, baseLanguage(locale),
+      normalizeLocale(DefaultLocale) } {
+    if m, found := catalogs[candidate][key]; found {
+      return m, true
+    }
+  }
+  return message{}, false
+}
+
+// Locale returns the locale of the response: the one set by SetLocale,
+// or else the first locale in the client's Accept-Language header, by
+// preference, that has a catalog or whose language has one, or else
+// DefaultLocale. It is in lower case, as "pt-br".
+func (c *Context) Locale() string {
+  if c.locale != "" {
+    return c.locale
+  }
+  c.locale = normalizeLocale(DefaultLocale)
+  for _, tag := range acceptedLanguages(c.Getenv("HTTP_ACCEPT_LANGUAGE")) {
+    if hasCatalog(tag) {
+      c.locale = tag
+      break
+    }
+    if hasCatalog(baseLanguage(tag)) {
+      c.locale = baseLanguage(tag)
+      break
+    }
+  }
+  return c.locale
+}
+
+// SetLocale sets the locale of the response, as from a user's settings,
+// in place of the one negotiated with the client.
+func (c *Context) SetLocale(locale string) {
+  c.locale = normalizeLocale(locale)
+}
+
+// acceptedLanguages returns the locales of an Accept-Language header in
+// order of preference, leaving out those with a quality of zero and "*".
+func acceptedLanguages(header string) []string {
+  items := parseAccept(header)
+  sort.SliceStable(items, func(i, j int) bool {
+    return items[i].quality > items[j].quality
+  })
+  tags := []string{}
+  for _, item := range items {
+    if tag := normalizeLocale(item.value); tag != "*" && item.quality > 0 {
+      tags = append(tags, tag)
+    }
+  }
+  return tags
+}
+
+// T translates a message into the locale of the response. The key is
+// looked up in the catalogs, and a key without a translation stands for
+// itself. If the message has plural forms, the first argument is the
+// count that chooses among them by the rules of the locale's language. If
+// there are arguments and the text has verbs, the text is formatted with
+// them as by fmt.Sprintf; write %[1]d and the like to use the arguments in
+// another order. The result is not escaped.
+func (c *Context) T(key string, args ...interface{}) string {
+  locale := c.Locale()
+  m, found := lookupMessage(locale, key)
+  text := key
+  if found {
+    text = m.text
+  }
+  if found && m.plural != nil {
+    category := "other"
+    if count, ok := pluralCount(args); ok {
+      category = pluralRuleFor(locale).category(count)
+    }
+    text = m.plural[category]
+    if text == "" {
+      text = m.plural["other"]
+    }
+  }
+  if len(args) == 0 || !strings.Contains(text, "%") {
+    return text
+  }
+  return fmt.Sprintf(text, args...)
+}
+
+// pluralCount returns the absolute value of the first argument if it is a
+// number, truncated to a whole number.
+func pluralCount(args []interface{}) (int64, bool) {
+  if len(args) == 0 {
+    return 0, false
+  }
+  var n int64
+  switch value := args[0].(type) {
+  case int:
+    n = int64(value)
+  case int8:
+    n = int64(value)
+  case int16:
+    n = int64(value)
+  case int32:
+    n = int64(value)
+  case int64:
+    n = value
+  case uint:
+    n = int64(value)
+  case uint8:
+    n = int64(value)
+  case uint16:
+    n = int64(value)
+  case uint32:
+    n = int64(value)
+  case uint64:
+    n = int64(value)
+  case float32:
+    n = int64(value)
+  case float64:
+    n = int64(value)
+  default:
+    return 0, false
+  }
+  if n < 0 {
+    n = -n
+  }
+  return n, true
+}
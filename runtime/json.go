@@ -0,0 +1,32 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "encoding/json"
+)
+
+// WriteJSON writes the JSON encoding of v to the content buffer and makes
+// the response a JSON document. If v cannot be encoded, the error is logged
+// to stderr, the response becomes a plain 500 error in place of whatever
+// was written before, and the error is returned.
+func (c *Context) WriteJSON(v interface{}) error {
+  data, err := json.Marshal(v)
+  if err != nil {
+    c.encodingError("WriteJSON", err)
+    return err
+  }
+  c.JSON()
+  c.WriteString(string(data))
+  return nil
+}
+
+// encodingError reports a value that an encoder could not encode and
+// replaces the response with a plain 500 error.
+func (c *Context) encodingError(function string, err error) {
+  fmt.Fprintf(os.Stderr, "runtime: %s: %s\n", function, err.Error())
+  c.discardContent()
+  c.SetHTTPStatus(500, "Internal Server Error")
+  c.PlainText()
+  c.content.WriteString("Internal Server Error")
+}
@@ -0,0 +1,253 @@
+package runtime
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "net"
+  "bytes"
+  "strings"
+  "net/url"
+  "net/http"
+  "unicode/utf8"
+  "encoding/json"
+  "encoding/base64"
+)
+
+
+//--- Lambda target
+
+// lambdaEvent holds the fields of the events of API Gateway and Lambda
+// function URLs that make up a request. REST APIs send events of version
+// 1.0, and HTTP APIs and function URLs send events of version 2.0.
+type lambdaEvent struct {
+  Version string                            `json:"version"`
+  HTTPMethod string                         `json:"httpMethod"`
+  Path string                               `json:"path"`
+  RawPath string                            `json:"rawPath"`
+  RawQuery string                           `json:"rawQueryString"`
+  Headers map[string]string                 `json:"headers"`
+  MultiValueHeaders map[string][]string     `json:"multiValueHeaders"`
+  Query map[string]string                   `json:"queryStringParameters"`
+  MultiValueQuery map[string][]string  `json:"multiValueQueryStringParameters"`
+  Cookies []string                          `json:"cookies"`
+  Body string                               `json:"body"`
+  IsBase64Encoded bool                      `json:"isBase64Encoded"`
+  RequestContext struct {
+    DomainName string  `json:"domainName"`
+    HTTP struct {
+      Method string    `json:"method"`
+      SourceIP string  `json:"sourceIp"`
+    } `json:"http"`
+    Identity struct {
+      SourceIP string  `json:"sourceIp"`
+    } `json:"identity"`
+  } `json:"requestContext"`
+}
+
+// lambdaResponse is the response to an event. Events of version 2.0 take
+// single-valued headers and a list of cookies, and those of version 1.0
+// take multi-valued headers.
+type lambdaResponse struct {
+  StatusCode int                          `json:"statusCode"`
+  Headers map[string]string               `json:"headers,omitempty"`
+  MultiValueHeaders map[string][]string  `json:"multiValueHeaders,omitempty"`
+  Cookies []string                        `json:"cookies,omitempty"`
+  Body string                             `json:"body"`
+  IsBase64Encoded bool                    `json:"isBase64Encoded"`
+}
+
+// lambdaAPI is the version path of the Lambda runtime API.
+const lambdaAPI = "/2018-06-01/runtime/"
+
+// ServeLambda runs a page as an AWS Lambda function with a custom runtime,
+// as the programs that buildapp generates for its Lambda target do. It
+// takes events from the Lambda runtime API, whose address is in the
+// AWS_LAMBDA_RUNTIME_API environment variable, serves each as a request to
+// the handler, and returns the response that the handler writes. The
+// events are those of API Gateway REST and HTTP APIs and of Lambda
+// function URLs. A page that runs past the deadline is answered with a 504
+// response. Other platforms that implement the runtime API can run the
+// page too.
+func ServeLambda(handler func(http.ResponseWriter, *http.Request)) {
+  api := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+  if api == "" {
+    fmt.Fprintf(os.Stderr, "runtime: AWS_LAMBDA_RUNTIME_API is not set; " +
+        "the page must run on AWS Lambda\n")
+    os.Exit(1)
+  }
+  base := "http://" + api + lambdaAPI + "invocation/"
+  for {
+    response, err := http.Get(base + "next")
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "runtime: %s\n", err.Error())
+      os.Exit(1)
+    }
+    if response.StatusCode != http.StatusOK {
+      fmt.Fprintf(os.Stderr, "runtime: the Lambda runtime API answered %s\n",
+          response.Status)
+      os.Exit(1)
+    }
+    id := response.Header.Get("Lambda-Runtime-Aws-Request-Id")
+    event, err := io.ReadAll(response.Body)
+    response.Body.Close()
+    var result []byte
+    if err == nil {
+      result, err = serveLambdaEvent(event, handler)
+    }
+    if err != nil {
+      result, _ = json.Marshal(map[string]string{
+        "errorMessage": err.Error(),
+        "errorType": "BoomerangError",
+      })
+      postLambda(base + id + "/error", result)
+      continue
+    }
+    postLambda(base + id + "/response", result)
+  }
+}
+
+// postLambda sends a result to the runtime API.
+func postLambda(url string, data []byte) {
+  response, err := http.Post(url, "application/json", bytes.NewReader(data))
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "runtime: %s\n", err.Error())
+    return
+  }
+  response.Body.Close()
+}
+
+// serveLambdaEvent runs the handler on the request of an event and returns
+// the response to the event.
+func serveLambdaEvent(data []byte,
+    handler func(http.ResponseWriter, *http.Request)) (result []byte,
+    err error) {
+  var event lambdaEvent
+  if err := json.Unmarshal(data, &event); err != nil {
+    return nil, err
+  }
+  request, err := event.request()
+  if err != nil {
+    return nil, err
+  }
+  recorder := &lambdaRecorder{ header: http.Header{} }
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      err = fmt.Errorf("page panicked: %v", recovered)
+    }
+  }()
+  serveWithDeadline(recorder, request, handler)
+  return json.Marshal(event.response(recorder))
+}
+
+// request makes the HTTP request of an event.
+func (event *lambdaEvent) request() (*http.Request, error) {
+  method, path, query := event.HTTPMethod, event.Path, url.Values{}
+  sourceIP := event.RequestContext.Identity.SourceIP
+  if event.Version == "2.0" {
+    method, path = event.RequestContext.HTTP.Method, event.RawPath
+    sourceIP = event.RequestContext.HTTP.SourceIP
+  } else if len(event.MultiValueQuery) != 0 {
+    query = url.Values(event.MultiValueQuery)
+  } else {
+    for key, value := range event.Query {
+      query.Set(key, value)
+    }
+  }
+  rawQuery := event.RawQuery
+  if event.Version != "2.0" {
+    rawQuery = query.Encode()
+  }
+  body := []byte(event.Body)
+  if event.IsBase64Encoded {
+    decoded, err := base64.StdEncoding.DecodeString(event.Body)
+    if err != nil {
+      return nil, err
+    }
+    body = decoded
+  }
+  if path == "" {
+    path = "/"
+  }
+  target := &url.URL{ Scheme: "https", Host: event.RequestContext.DomainName,
+      Path: path, RawQuery: rawQuery }
+  request, err := http.NewRequest(method, target.String(),
+      bytes.NewReader(body))
+  if err != nil {
+    return nil, err
+  }
+  if len(event.MultiValueHeaders) != 0 {
+    for name, values := range event.MultiValueHeaders {
+      for _, value := range values {
+        request.Header.Add(name, value)
+      }
+    }
+  } else {
+    for name, value := range event.Headers {
+      request.Header.Set(name, value)
+    }
+  }
+  if len(event.Cookies) != 0 {
+    request.Header.Set("Cookie", strings.Join(event.Cookies, "; "))
+  }
+  if host := request.Header.Get("Host"); host != "" {
+    request.Host = host
+  }
+  if sourceIP == "" {  // A test event from the console may have none.
+    sourceIP = "0.0.0.0"
+  }
+  request.RemoteAddr = net.JoinHostPort(sourceIP, "0")
+  return request, nil
+}
+
+// response makes the response to an event from what the handler wrote.
+// A body that is not UTF-8 text is encoded in base64.
+func (event *lambdaEvent) response(recorder *lambdaRecorder) *lambdaResponse {
+  response := &lambdaResponse{ StatusCode: recorder.status }
+  if response.StatusCode == 0 {
+    response.StatusCode = http.StatusOK
+  }
+  body := recorder.body.Bytes()
+  if utf8.Valid(body) {
+    response.Body = string(body)
+  } else {
+    response.Body = base64.StdEncoding.EncodeToString(body)
+    response.IsBase64Encoded = true
+  }
+  if event.Version != "2.0" {
+    response.MultiValueHeaders = map[string][]string(recorder.header)
+    return response
+  }
+  response.Headers = map[string]string{}
+  for name, values := range recorder.header {
+    if name == "Set-Cookie" {
+      response.Cookies = values
+    } else {
+      response.Headers[name] = strings.Join(values, ",")
+    }
+  }
+  return response
+}
+
+// lambdaRecorder is the http.ResponseWriter that collects the response to
+// an event.
+type lambdaRecorder struct {
+  header http.Header
+  status int
+  body bytes.Buffer
+}
+
+func (recorder *lambdaRecorder) Header() http.Header {
+  return recorder.header
+}
+
+func (recorder *lambdaRecorder) WriteHeader(status int) {
+  if recorder.status == 0 {
+    recorder.status = status
+  }
+}
+
+func (recorder *lambdaRecorder) Write(data []byte) (int, error) {
+  recorder.WriteHeader(http.StatusOK)
+  return recorder.body.Write(data)
+}
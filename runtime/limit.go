@@ -0,0 +1,79 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "strconv"
+  "unicode/utf8"
+)
+
+// defaultMaxBody and defaultOverflow can be set at link time to the limit
+// of the body in bytes and the overflow policy, as buildapp does with its
+// maxBodySize and overflow settings.
+var defaultMaxBody = ""
+var defaultOverflow = ""
+
+// The limit is loaded once from BOOMERANG_MAX_BODY and BOOMERANG_OVERFLOW
+// or from the defaults. A limit of zero means none.
+var maxBody int
+var truncateOverflow bool
+var limitOnce sync.Once
+
+// loadBodyLimit reads the limit and the policy. A setting that cannot be
+// understood is reported on stderr and ignored.
+func loadBodyLimit() {
+  value, isSet := os.LookupEnv("BOOMERANG_MAX_BODY")
+  if !isSet {
+    value = defaultMaxBody
+  }
+  if value != "" {
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 0 {
+      fmt.Fprintf(os.Stderr, "runtime: invalid body limit %q\n", value)
+    } else {
+      maxBody = n
+    }
+  }
+  policy, isSet := os.LookupEnv("BOOMERANG_OVERFLOW")
+  if !isSet {
+    policy = defaultOverflow
+  }
+  switch policy {
+  case "", "abort":
+  case "truncate":
+    truncateOverflow = true
+  default:
+    fmt.Fprintf(os.Stderr, "runtime: invalid overflow policy %q\n", policy)
+  }
+}
+
+// writeLimited appends to the content buffer within the body limit. When
+// a write would pass the limit, the overflow policy decides: "truncate"
+// keeps what fits, drops the rest of the page's output, and logs a warning
+// once; "abort", the default, logs an error, replaces the response with
+// the 500 error page, and stops the page as Halt does.
+func (c *Context) writeLimited(s string) {
+  limitOnce.Do(loadBodyLimit)
+  if maxBody == 0 || c.content.Len()+len(s) <= maxBody {
+    c.content.WriteString(s)
+    return
+  }
+  if !truncateOverflow {
+    c.logLine("error", fmt.Sprintf("body exceeds the limit of %d bytes",
+        maxBody))
+    c.errorResponse()
+    panic(haltSignal{})
+  }
+  if c.truncated {
+    return
+  }
+  c.truncated = true
+  fit := maxBody - c.content.Len()
+  for fit > 0 && !utf8.RuneStart(s[fit]) {
+    fit--  // Cut between characters.
+  }
+  c.content.WriteString(s[:fit])
+  c.logLine("warning", fmt.Sprintf("body truncated at the limit of %d "+
+      "bytes", maxBody))
+}
@@ -0,0 +1,100 @@
+package runtime
+
+import (
+  "os"
+  "io"
+  "fmt"
+  "sync"
+  "time"
+  "strings"
+  "strconv"
+)
+
+// Log lines are written to stderr, where web servers collect the errors
+// of CGI programs, unless BOOMERANG_LOG is "syslog". Debug lines are
+// written only if BOOMERANG_DEBUG is set to anything but "" or "0".
+var logWriter io.Writer
+var logDebug bool
+var logSyslog bool
+var logOnce sync.Once
+var logMutex sync.Mutex
+
+// openLog chooses where log lines go. If syslog cannot be reached, lines
+// go to stderr.
+func openLog() {
+  logWriter = os.Stderr
+  debug := os.Getenv("BOOMERANG_DEBUG")
+  logDebug = debug != "" && debug != "0"
+  if os.Getenv("BOOMERANG_LOG") == "syslog" {
+    writer, err := openSyslog()
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "runtime: syslog: %s\n", err.Error())
+      return
+    }
+    logWriter, logSyslog = writer, true
+  }
+}
+
+// SetTemplate records the path of the template that a page was made from,
+// which log lines name. The generated code calls it.
+func (c *Context) SetTemplate(path string) {
+  c.template = path
+}
+
+// logLine writes a structured line in the logfmt style: space-separated
+// key=value pairs with the time, level, template, request ID, trace ID if
+// the request came with one other than the request ID, and message. Syslog
+// adds the time itself.
+func (c *Context) logLine(level, message string) {
+  logOnce.Do(openLog)
+  if level == "debug" && !logDebug {
+    return
+  }
+  fields := []string{}
+  if !logSyslog {
+    fields = append(fields, "time="+time.Now().Format(time.RFC3339))
+  }
+  fields = append(fields, "level="+level)
+  if c.template != "" {
+    fields = append(fields, "template="+logValue(c.template))
+  }
+  fields = append(fields, "request="+logValue(c.RequestID()))
+  if c.traceGiven && c.traceID != c.requestID {
+    fields = append(fields, "trace="+c.traceID)
+  }
+  fields = append(fields,
+      "msg="+strconv.Quote(strings.TrimSuffix(message, "\n")))
+  logMutex.Lock()
+  defer logMutex.Unlock()
+  fmt.Fprintln(logWriter, strings.Join(fields, " "))
+}
+
+// logValue quotes a value if it would not read as a single field.
+func logValue(value string) string {
+  if value == "" || strings.ContainsAny(value, " \"=\t\n") {
+    return strconv.Quote(value)
+  }
+  return value
+}
+
+// Log writes a log line with the operands formatted as by fmt.Sprint.
+func (c *Context) Log(a ...interface{}) {
+  c.logLine("info", fmt.Sprint(a...))
+}
+
+// Logf writes a log line with a message formatted as by fmt.Sprintf.
+func (c *Context) Logf(format string, a ...interface{}) {
+  c.logLine("info", fmt.Sprintf(format, a...))
+}
+
+// Debug writes a debug line, formatted as by fmt.Sprint, if debugging is
+// on.
+func (c *Context) Debug(a ...interface{}) {
+  c.logLine("debug", fmt.Sprint(a...))
+}
+
+// Debugf writes a debug line, formatted as by fmt.Sprintf, if debugging is
+// on.
+func (c *Context) Debugf(format string, a ...interface{}) {
+  c.logLine("debug", fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9 || wasip1
+
+package runtime
+
+import (
+  "io"
+  "errors"
+)
+
+// openSyslog fails where there is no syslog.
+func openSyslog() (io.Writer, error) {
+  return nil, errors.New("not available on this system")
+}
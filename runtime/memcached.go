@@ -0,0 +1,99 @@
+package runtime
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "time"
+  "bufio"
+  "strconv"
+  "strings"
+)
+
+// MemcachedStore keeps fragments in a memcached server, which CGI programs
+// on several hosts can share. Keys are hashed to fit the protocol, and
+// each operation uses a connection of its own.
+type MemcachedStore struct {
+  Addr string               // The address of the server, as "host:port".
+  Timeout time.Duration     // The limit of each operation.
+}
+
+// NewMemcachedStore makes a store for the server at addr, with a timeout
+// of one second.
+func NewMemcachedStore(addr string) *MemcachedStore {
+  return &MemcachedStore{ Addr: addr, Timeout: time.Second }
+}
+
+// memcachedKey is the key under which a value is stored in memcached.
+func memcachedKey(key string) string {
+  return "boomerang:" + hashKey(key)
+}
+
+// dial connects to the server with the store's timeout as the deadline.
+func (s *MemcachedStore) dial() (net.Conn, error) {
+  conn, err := net.DialTimeout("tcp", s.Addr, s.Timeout)
+  if err != nil {
+    return nil, err
+  }
+  conn.SetDeadline(time.Now().Add(s.Timeout))
+  return conn, nil
+}
+
+// Get returns a value that has not expired.
+func (s *MemcachedStore) Get(key string) (string, bool, error) {
+  conn, err := s.dial()
+  if err != nil {
+    return "", false, err
+  }
+  defer conn.Close()
+  fmt.Fprintf(conn, "get %s\r\n", memcachedKey(key))
+  reader := bufio.NewReader(conn)
+  line, err := reader.ReadString('\n')
+  if err != nil {
+    return "", false, err
+  }
+  line = strings.TrimRight(line, "\r\n")
+  if line == "END" {
+    return "", false, nil
+  }
+  fields := strings.Fields(line)
+  if len(fields) != 4 || fields[0] != "VALUE" {
+    return "", false, fmt.Errorf("memcached: unexpected reply %q", line)
+  }
+  size, err := strconv.Atoi(fields[3])
+  if err != nil {
+    return "", false, fmt.Errorf("memcached: unexpected reply %q", line)
+  }
+  data := make([]byte, size+2)  // The value is followed by CRLF.
+  if _, err := io.ReadFull(reader, data); err != nil {
+    return "", false, err
+  }
+  return string(data[:size]), true, nil
+}
+
+// Set stores a value. Memcached takes a ttl beyond 30 days to be a time
+// since the epoch, so such a ttl is sent as one.
+func (s *MemcachedStore) Set(key, value string, ttl time.Duration) error {
+  conn, err := s.dial()
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  var exptime int64
+  if ttl > 0 {
+    exptime = int64((ttl + time.Second - 1) / time.Second)
+  }
+  if exptime > 30*24*60*60 {
+    exptime = expiry(ttl).Unix()
+  }
+  fmt.Fprintf(conn, "set %s 0 %d %d\r\n%s\r\n", memcachedKey(key), exptime,
+      len(value), value)
+  line, err := bufio.NewReader(conn).ReadString('\n')
+  if err != nil {
+    return err
+  }
+  if line = strings.TrimRight(line, "\r\n"); line != "STORED" {
+    return fmt.Errorf("memcached: unexpected reply %q", line)
+  }
+  return nil
+}
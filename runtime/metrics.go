@@ -0,0 +1,307 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "bytes"
+  "strconv"
+  "strings"
+  "net/url"
+  "net/http"
+  "encoding/json"
+)
+
+// defaultMetrics can be set at link time to where the metrics of pages
+// go, as buildapp does with its metrics setting. See SetMetricsSink for
+// the forms.
+var defaultMetrics = ""
+
+// PageMetrics describes the response to one request: the template of the
+// page, the status, the time from the start of the page to the end of the
+// response, and the size of the body as sent.
+type PageMetrics struct {
+  Template string
+  Status int
+  Duration time.Duration
+  Bytes int
+}
+
+// MetricsSink receives the metrics of each response that a page writes.
+type MetricsSink interface {
+  Record(m PageMetrics) error
+}
+
+// metricsSink is the sink in use, or nil if metrics are off, chosen when
+// the first response is written unless SetMetricsSink chose it before.
+var metricsSink MetricsSink
+var metricsChosen bool
+var metricsLock sync.Mutex
+
+// SetMetricsSink replaces the sink of the metrics of pages, as with a sink
+// of the program's own, or turns metrics off with nil. Otherwise the sink
+// is named by BOOMERANG_METRICS or by the metrics setting of buildapp:
+// "statsd:HOST:PORT" for a statsd server, or "otlp" or "otlp:URL" for an
+// OpenTelemetry collector. Metrics are off by default.
+func SetMetricsSink(sink MetricsSink) {
+  metricsLock.Lock()
+  defer metricsLock.Unlock()
+  metricsSink, metricsChosen = sink, true
+}
+
+// currentMetricsSink returns the sink in use, choosing it if need be.
+func currentMetricsSink() MetricsSink {
+  metricsLock.Lock()
+  defer metricsLock.Unlock()
+  if metricsChosen {
+    return metricsSink
+  }
+  metricsChosen = true
+  setting, isSet := os.LookupEnv("BOOMERANG_METRICS")
+  if !isSet {
+    setting = defaultMetrics
+  }
+  kind, arg, _ := strings.Cut(setting, ":")
+  switch kind {
+  case "statsd":
+    metricsSink = NewStatsdSink(arg)
+  case "otlp":
+    metricsSink = NewOTLPSink(arg)
+  case "":
+  default:
+    fmt.Fprintf(os.Stderr, "runtime: unknown metrics sink %q\n", setting)
+  }
+  return metricsSink
+}
+
+// recordMetrics sends the metrics of a response to the sink, if there is
+// one. A program that serves many requests sends them in the background,
+// so that a slow collector does not hold up the next request; a CGI
+// program sends them before it exits. Errors go to stderr.
+func (c *Context) recordMetrics(status, size int) {
+  sink := currentMetricsSink()
+  if sink == nil {
+    return
+  }
+  m := PageMetrics{ Template: c.template, Status: status,
+      Duration: time.Since(c.started), Bytes: size }
+  if m.Template == "" {
+    m.Template = c.Getenv("SCRIPT_NAME")
+  }
+  send := func() {
+    if err := sink.Record(m); err != nil {
+      fmt.Fprintf(os.Stderr, "runtime: metrics: %s\n", err.Error())
+    }
+  }
+  if c.writer != nil {
+    go send()
+  } else {
+    send()
+  }
+}
+
+
+//--- Statsd
+
+// StatsdSink sends metrics to a statsd server over UDP. For a template
+// such as blog/post.boo, it sends the timer PREFIX.blog_post_boo.duration
+// in milliseconds, the histogram PREFIX.blog_post_boo.bytes, and the
+// counter PREFIX.blog_post_boo.status.200.
+type StatsdSink struct {
+  Addr string               // The address of the server, as "host:port".
+  Prefix string             // The first part of the metric names.
+}
+
+// NewStatsdSink makes a sink for the server at addr. The prefix is taken
+// from BOOMERANG_METRICS_PREFIX, or is "boomerang".
+func NewStatsdSink(addr string) *StatsdSink {
+  prefix := os.Getenv("BOOMERANG_METRICS_PREFIX")
+  if prefix == "" {
+    prefix = "boomerang"
+  }
+  return &StatsdSink{ Addr: addr, Prefix: prefix }
+}
+
+// Record sends the metrics of a response in one packet.
+func (s *StatsdSink) Record(m PageMetrics) error {
+  conn, err := net.Dial("udp", s.Addr)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  name := s.Prefix + "." + statsdName(m.Template)
+  packet := fmt.Sprintf("%s.duration:%s|ms\n%s.bytes:%d|h\n"+
+      "%s.status.%d:1|c", name, strconv.FormatFloat(float64(m.Duration)/
+      float64(time.Millisecond), 'f', 3, 64), name, m.Bytes, name, m.Status)
+  _, err = conn.Write([]byte(packet))
+  return err
+}
+
+// statsdName turns the path of a template into a part of a metric name,
+// replacing the characters that statsd gives meaning to.
+func statsdName(template string) string {
+  template = strings.TrimPrefix(template, "/")
+  if template == "" {
+    return "unknown"
+  }
+  return strings.Map(func(ch rune) rune {
+    if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' ||
+        ch >= '0' && ch <= '9' || ch == '-' {
+      return ch
+    }
+    return '_'
+  }, template)
+}
+
+
+//--- OpenTelemetry
+
+// OTLPSink sends metrics to an OpenTelemetry collector by OTLP over HTTP
+// in JSON. Each response is exported as a delta: the histograms
+// boomerang.page.duration, in milliseconds, and boomerang.page.size, in
+// bytes, and the counter boomerang.page.requests, with the attributes
+// template and http.response.status_code.
+type OTLPSink struct {
+  Endpoint string             // The URL of the metrics service.
+  Headers map[string]string   // Headers of each export, such as API keys.
+  Service string              // The service.name of the resource.
+  Timeout time.Duration       // The limit of each export.
+}
+
+// NewOTLPSink makes a sink for a collector at endpoint. The endpoint and
+// the other fields default to the standard variables of OpenTelemetry:
+// OTEL_EXPORTER_OTLP_METRICS_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT with
+// /v1/metrics added, or else http://localhost:4318/v1/metrics; the
+// headers of OTEL_EXPORTER_OTLP_METRICS_HEADERS or
+// OTEL_EXPORTER_OTLP_HEADERS; and OTEL_SERVICE_NAME, or else "boomerang".
+// The timeout is one second.
+func NewOTLPSink(endpoint string) *OTLPSink {
+  if endpoint == "" {
+    endpoint = os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT")
+  }
+  if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" &&
+      base != "" {
+    endpoint = strings.TrimSuffix(base, "/") + "/v1/metrics"
+  }
+  if endpoint == "" {
+    endpoint = "http://localhost:4318/v1/metrics"
+  }
+  headers := os.Getenv("OTEL_EXPORTER_OTLP_METRICS_HEADERS")
+  if headers == "" {
+    headers = os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")
+  }
+  service := os.Getenv("OTEL_SERVICE_NAME")
+  if service == "" {
+    service = "boomerang"
+  }
+  return &OTLPSink{ Endpoint: endpoint, Headers: otlpHeaders(headers),
+      Service: service, Timeout: time.Second }
+}
+
+// otlpHeaders parses headers given as name=value pairs separated by
+// commas, with the values URL-encoded.
+func otlpHeaders(list string) map[string]string {
+  headers := map[string]string{}
+  for _, pair := range strings.Split(list, ",") {
+    name, value, found := strings.Cut(pair, "=")
+    name = strings.TrimSpace(name)
+    if !found || name == "" {
+      continue
+    }
+    if decoded, err := url.QueryUnescape(value); err == nil {
+      value = decoded
+    }
+    headers[name] = strings.TrimSpace(value)
+  }
+  return headers
+}
+
+// The bounds of the buckets of the histograms that OTLPSink exports.
+var otlpDurationBounds = []float64{ 5, 10, 25, 50, 100, 250, 500, 1000,
+    2500, 5000, 10000 }
+var otlpSizeBounds = []float64{ 1024, 4096, 16384, 65536, 262144, 1048576,
+    4194304 }
+
+// Record exports the metrics of a response.
+func (s *OTLPSink) Record(m PageMetrics) error {
+  end := time.Now()
+  start := end.Add(-m.Duration)
+  attributes := []interface{}{
+    map[string]interface{}{ "key": "template",
+        "value": map[string]interface{}{ "stringValue": m.Template } },
+    map[string]interface{}{ "key": "http.response.status_code",
+        "value": map[string]interface{}{
+        "intValue": strconv.Itoa(m.Status) } },
+  }
+  point := func() map[string]interface{} {
+    return map[string]interface{}{ "attributes": attributes,
+        "startTimeUnixNano": strconv.FormatInt(start.UnixNano(), 10),
+        "timeUnixNano": strconv.FormatInt(end.UnixNano(), 10) }
+  }
+  histogram := func(name, unit string, value float64,
+      bounds []float64) map[string]interface{} {
+    data := point()
+    counts := make([]string, len(bounds)+1)
+    for i := range counts {
+      counts[i] = "0"
+    }
+    i := 0
+    for i < len(bounds) && value > bounds[i] {
+      i++
+    }
+    counts[i] = "1"
+    data["count"], data["sum"] = "1", value
+    data["bucketCounts"], data["explicitBounds"] = counts, bounds
+    return map[string]interface{}{ "name": name, "unit": unit,
+        "histogram": map[string]interface{}{ "aggregationTemporality": 1,
+        "dataPoints": []interface{}{ data } } }
+  }
+  requests := point()
+  requests["asInt"] = "1"
+  metrics := []interface{}{
+    histogram("boomerang.page.duration", "ms",
+        float64(m.Duration)/float64(time.Millisecond), otlpDurationBounds),
+    histogram("boomerang.page.size", "By", float64(m.Bytes),
+        otlpSizeBounds),
+    map[string]interface{}{ "name": "boomerang.page.requests",
+        "unit": "{request}", "sum": map[string]interface{}{
+        "aggregationTemporality": 1, "isMonotonic": true,
+        "dataPoints": []interface{}{ requests } } },
+  }
+  body, err := json.Marshal(map[string]interface{}{
+    "resourceMetrics": []interface{}{ map[string]interface{}{
+      "resource": map[string]interface{}{ "attributes": []interface{}{
+        map[string]interface{}{ "key": "service.name",
+            "value": map[string]interface{}{ "stringValue": s.Service } },
+      } },
+      "scopeMetrics": []interface{}{ map[string]interface{}{
+        "scope": map[string]interface{}{ "name": "boomerang" },
+        "metrics": metrics,
+      } },
+    } },
+  })
+  if err != nil {
+    return err
+  }
+  request, err := http.NewRequest(http.MethodPost, s.Endpoint,
+      bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+  request.Header.Set("Content-Type", "application/json")
+  for name, value := range s.Headers {
+    request.Header.Set(name, value)
+  }
+  client := &http.Client{ Timeout: s.Timeout }
+  response, err := client.Do(request)
+  if err != nil {
+    return err
+  }
+  response.Body.Close()
+  if response.StatusCode/100 != 2 {
+    return fmt.Errorf("%s: %s", s.Endpoint, response.Status)
+  }
+  return nil
+}
@@ -0,0 +1,168 @@
+package runtime
+
+import (
+  "strconv"
+  "strings"
+)
+
+// acceptItem is an item of an Accept header, such as text/html;level=1 or
+// fr;q=0.8, with its value in lower case, its parameters other than q, and
+// its quality.
+type acceptItem struct {
+  value string
+  params map[string]string
+  quality float64
+}
+
+// parseAccept splits an Accept, Accept-Language, Accept-Encoding, or
+// Accept-Charset header into its items, in order. An item without a
+// q-value, or with one that cannot be read, has a quality of 1.
+func parseAccept(header string) []acceptItem {
+  items := []acceptItem{}
+  for _, part := range strings.Split(header, ",") {
+    fields := strings.Split(part, ";")
+    item := acceptItem{ value: strings.ToLower(strings.TrimSpace(fields[0])),
+        params: map[string]string{}, quality: 1 }
+    if item.value == "" {
+      continue
+    }
+    for _, field := range fields[1:] {
+      name, value, _ := strings.Cut(field, "=")
+      name = strings.ToLower(strings.TrimSpace(name))
+      value = strings.Trim(strings.TrimSpace(value), `"`)
+      if name != "q" {
+        item.params[name] = strings.ToLower(value)
+      } else if q, err := strconv.ParseFloat(value, 64); err == nil &&
+          q >= 0 && q <= 1 {
+        item.quality = q
+      }
+    }
+    items = append(items, item)
+  }
+  return items
+}
+
+// negotiate picks the offer that the items of a header accept with the
+// highest quality, taking the earlier offer in a tie. The quality of an
+// offer is that of the item that matches it most specifically, by the
+// match function, which returns -1 if the item does not match, and
+// otherwise a higher number for a more specific match. An empty header
+// accepts the first offer. negotiate returns "" if no offer is accepted.
+func negotiate(header string, offers []string,
+    match func(item acceptItem, offer string) int) string {
+  if len(offers) == 0 {
+    return ""
+  }
+  items := parseAccept(header)
+  if len(items) == 0 {
+    return offers[0]
+  }
+  best, bestQuality := "", 0.0
+  for _, offer := range offers {
+    quality, specificity := 0.0, -1
+    for _, item := range items {
+      if s := match(item, offer); s > specificity {
+        quality, specificity = item.quality, s
+      }
+    }
+    if quality > bestQuality {
+      best, bestQuality = offer, quality
+    }
+  }
+  return best
+}
+
+// matchMediaType matches a media range, such as text/*, to an offered
+// media type. A range with parameters matches only an offer that has the
+// same ones, and is more specific than the range without them.
+func matchMediaType(item acceptItem, offer string) int {
+  offered := parseAccept(offer)
+  if len(offered) == 0 {
+    return -1
+  }
+  offerType, offerSubtype, _ := strings.Cut(offered[0].value, "/")
+  rangeType, rangeSubtype, _ := strings.Cut(item.value, "/")
+  switch {
+  case rangeType == "*" && rangeSubtype == "*":
+    return 0
+  case rangeType != offerType:
+    return -1
+  case rangeSubtype == "*":
+    return 1
+  case rangeSubtype != offerSubtype:
+    return -1
+  }
+  for name, value := range item.params {
+    if offered[0].params[name] != value {
+      return -1
+    }
+  }
+  return 2 + len(item.params)
+}
+
+// matchLanguage matches a language range to an offered locale. The range
+// matches the locale itself best, then a locale that it is a prefix of,
+// as en of en-gb, then a locale that is a prefix of it, as en of en-gb,
+// and last of all as *.
+func matchLanguage(item acceptItem, offer string) int {
+  tag, offer := normalizeLocale(item.value), normalizeLocale(offer)
+  switch {
+  case tag == offer:
+    return 3
+  case strings.HasPrefix(offer, tag+"-"):
+    return 2
+  case strings.HasPrefix(tag, offer+"-"):
+    return 1
+  case tag == "*":
+    return 0
+  }
+  return -1
+}
+
+// matchToken matches an encoding or charset, or *, to an offer.
+func matchToken(item acceptItem, offer string) int {
+  switch item.value {
+  case strings.ToLower(strings.TrimSpace(offer)):
+    return 1
+  case "*":
+    return 0
+  }
+  return -1
+}
+
+// Negotiate returns the offered media type that the client's Accept header
+// prefers, as "application/json" from "text/html" and "application/json",
+// so that one page can serve several formats. Ranges such as text/* and
+// q-values are honored, the earlier offer wins a tie, and a client without
+// an Accept header gets the first offer. Negotiate returns "" if the
+// client accepts none of the offers. It adds Accept to the Vary header, so
+// that caches keep the responses apart.
+func (c *Context) Negotiate(offers ...string) string {
+  c.AddHeader("Vary", "Accept")
+  return negotiate(c.Getenv("HTTP_ACCEPT"), offers, matchMediaType)
+}
+
+// NegotiateLanguage returns the offered locale that the client's
+// Accept-Language header prefers, as Negotiate does for media types. A
+// language range such as en matches en-gb, and en-gb falls back to en if
+// nothing closer is offered. It adds Accept-Language to the Vary header.
+func (c *Context) NegotiateLanguage(offers ...string) string {
+  c.AddHeader("Vary", "Accept-Language")
+  return negotiate(c.Getenv("HTTP_ACCEPT_LANGUAGE"), offers, matchLanguage)
+}
+
+// NegotiateEncoding returns the offered content coding, such as gzip or
+// br, that the client's Accept-Encoding header prefers, as Negotiate does
+// for media types. It adds Accept-Encoding to the Vary header.
+func (c *Context) NegotiateEncoding(offers ...string) string {
+  c.AddHeader("Vary", "Accept-Encoding")
+  return negotiate(c.Getenv("HTTP_ACCEPT_ENCODING"), offers, matchToken)
+}
+
+// NegotiateCharset returns the offered charset that the client's
+// Accept-Charset header prefers, as Negotiate does for media types. It
+// adds Accept-Charset to the Vary header.
+func (c *Context) NegotiateCharset(offers ...string) string {
+  c.AddHeader("Vary", "Accept-Charset")
+  return negotiate(c.Getenv("HTTP_ACCEPT_CHARSET"), offers, matchToken)
+}
@@ -0,0 +1,87 @@
+package runtime
+
+import (
+  "io"
+  "os"
+  "path"
+  "time"
+  "strings"
+  "net/http"
+)
+
+// OutputMode chooses how a CGI program writes the head of its response.
+type OutputMode int
+
+const (
+  // AutoOutput, the default, uses NPHOutput if BOOMERANG_OUTPUT is "nph"
+  // or the name of the script begins with "nph-", as Apache expects of
+  // non-parsed-header scripts, and CGIOutput otherwise.
+  AutoOutput OutputMode = iota
+  // CGIOutput writes CGI headers, with the status in a Status header, for
+  // the web server to turn into an HTTP response.
+  CGIOutput
+  // NPHOutput writes a complete HTTP response head, which the web server
+  // passes to the client as it is: a status line such as "HTTP/1.1 200
+  // OK", a Date header, the other headers, and CRLF line endings.
+  NPHOutput
+)
+
+// SetOutputMode chooses how a CGI program writes its response. It has no
+// effect under FastCGI or in the single server.
+func (c *Context) SetOutputMode(mode OutputMode) {
+  c.outputMode = mode
+}
+
+// nph reports whether the response is written in NPH mode.
+func (c *Context) nph() bool {
+  switch c.outputMode {
+  case CGIOutput:
+    return false
+  case NPHOutput:
+    return true
+  }
+  return os.Getenv("BOOMERANG_OUTPUT") == "nph" ||
+      strings.HasPrefix(path.Base(c.Getenv("SCRIPT_NAME")), "nph-")
+}
+
+// cgiHead formats the head of a CGI response, ending with the blank line.
+// The status is a code and phrase such as "404 Not Found", or "" for 200.
+// In CGI mode, the Status header goes between the headers and the trailing
+// headers. In NPH mode, the status line comes first, with the protocol of
+// the request, and then the Date.
+func cgiHead(nph bool, protocol, status string,
+    headers, trailing []string) string {
+  lines, eol := []string{}, "\n"
+  if nph {
+    if !strings.HasPrefix(protocol, "HTTP/") {
+      protocol = "HTTP/1.0"
+    }
+    if status == "" {
+      status = "200 OK"
+    }
+    lines = append(lines, protocol+" "+status,
+        "Date: "+time.Now().UTC().Format(http.TimeFormat))
+    lines, eol = append(lines, headers...), "\r\n"
+  } else {
+    lines = append(lines, headers...)
+    if status != "" {
+      lines = append(lines, "Status: "+status)
+    }
+  }
+  lines = append(lines, trailing...)
+  return strings.Join(lines, eol) + eol + eol
+}
+
+// writeCGIHeaders writes the head of the response to a CGI program's
+// output: the headers, the status, the Location header, and the extra
+// headers last.
+func (c *Context) writeCGIHeaders(w io.Writer, extra ...string) {
+  trailing := []string{}
+  if c.locationHeader != "" {
+    trailing = append(trailing, c.locationHeader)
+  }
+  trailing = append(trailing, extra...)
+  status := strings.TrimSpace(strings.TrimPrefix(c.statusHeader, "Status:"))
+  io.WriteString(w, cgiHead(c.nph(), c.Getenv("SERVER_PROTOCOL"), status,
+      c.headers, trailing))
+}
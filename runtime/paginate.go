@@ -0,0 +1,201 @@
+package runtime
+
+import (
+  "strconv"
+  "strings"
+  "net/url"
+  "html/template"
+)
+
+// PageParam is the query parameter that names the page of a list, as in
+// posts.cgi?page=3.
+var PageParam = "page"
+
+// PaginationTemplate is the html/template with which Paginator.HTML draws
+// the links of a list, given the Paginator. A program can replace it, as
+// it can ErrorPage, to change the markup or the wording.
+var PaginationTemplate = `<nav class="pagination" aria-label="Pages">
+{{- if .HasPrev}}<a href="{{.PrevURL}}" rel="prev">Previous</a>{{end}}
+{{- range .Links}}
+  {{- if .Gap}} <span class="gap">…</span>
+  {{- else if .Current}} <a href="{{.URL}}" aria-current="page">{{.Number}}</a>
+  {{- else}} <a href="{{.URL}}">{{.Number}}</a>{{end}}
+{{- end}}
+{{- if .HasNext}} <a href="{{.NextURL}}" rel="next">Next</a>{{end -}}
+</nav>`
+
+// Paginator divides a list of Total items into pages of PerPage items and
+// knows which of them is Current, counting from 1. Window is the number of
+// pages on each side of the current one that Links names; the first and
+// last pages are always named. URL makes the link to a page.
+type Paginator struct {
+  Total int
+  PerPage int
+  Current int
+  Window int
+  URL func(page int) string
+}
+
+// PageLink is a link of a Paginator: a page with its URL, or a gap that
+// stands for the pages that are left out.
+type PageLink struct {
+  Number int
+  URL string
+  Current bool
+  Gap bool
+}
+
+// Paginate makes a Paginator for a list of total items shown perPage at a
+// time. The current page is read from the PageParam parameter of the
+// query, and a page that is missing or out of range is taken to be the
+// nearest one. Links go to the page itself, with the other parameters of
+// the query kept, so that a search can be paged:
+//
+//   pages := runtime.Paginate(count, 20)
+//   rows, err := db.Query("SELECT title FROM posts LIMIT ? OFFSET ?",
+//       pages.PerPage, pages.Offset())
+//   ...
+//   runtime.PrintEscaped(pages.HTML())
+func (c *Context) Paginate(total, perPage int) *Paginator {
+  query, _ := url.ParseQuery(c.Getenv("QUERY_STRING"))
+  path := c.URL("")
+  p := &Paginator{ Total: total, PerPage: perPage, Window: 2,
+      URL: func(page int) string {
+        pageQuery := url.Values{}
+        for name, values := range query {
+          pageQuery[name] = values
+        }
+        pageQuery.Del(PageParam)
+        if page > 1 {
+          pageQuery.Set(PageParam, strconv.Itoa(page))
+        }
+        if len(pageQuery) == 0 {
+          return path
+        }
+        return path + "?" + pageQuery.Encode()
+      } }
+  p.Current, _ = strconv.Atoi(strings.TrimSpace(query.Get(PageParam)))
+  p.Current = p.page(p.Current)
+  return p
+}
+
+// page returns the page that is nearest to n.
+func (p *Paginator) page(n int) int {
+  if n > p.PageCount() {
+    n = p.PageCount()
+  }
+  if n < 1 {
+    n = 1
+  }
+  return n
+}
+
+// PageCount returns the number of pages, which is at least one, so that
+// an empty list has a page on which to say so.
+func (p *Paginator) PageCount() int {
+  if p.PerPage < 1 || p.Total <= p.PerPage {
+    return 1
+  }
+  return (p.Total + p.PerPage - 1) / p.PerPage
+}
+
+// Offset returns the number of items before the current page, for the
+// OFFSET of a query.
+func (p *Paginator) Offset() int {
+  if p.PerPage < 1 {
+    return 0
+  }
+  return (p.page(p.Current) - 1) * p.PerPage
+}
+
+// HasPrev reports whether there is a page before the current one.
+func (p *Paginator) HasPrev() bool {
+  return p.page(p.Current) > 1
+}
+
+// HasNext reports whether there is a page after the current one.
+func (p *Paginator) HasNext() bool {
+  return p.page(p.Current) < p.PageCount()
+}
+
+// PrevURL returns the URL of the page before the current one, or "" if
+// there is none.
+func (p *Paginator) PrevURL() string {
+  if !p.HasPrev() {
+    return ""
+  }
+  return p.PageURL(p.page(p.Current) - 1)
+}
+
+// NextURL returns the URL of the page after the current one, or "" if
+// there is none.
+func (p *Paginator) NextURL() string {
+  if !p.HasNext() {
+    return ""
+  }
+  return p.PageURL(p.page(p.Current) + 1)
+}
+
+// PageURL returns the URL of a page by the URL function, or "" if there
+// is none.
+func (p *Paginator) PageURL(page int) string {
+  if p.URL == nil {
+    return ""
+  }
+  return p.URL(p.page(page))
+}
+
+// Links returns the links of the first and last pages and of those within
+// Window of the current one, in order, with a gap wherever pages are left
+// out, as 1 … 4 5 6 7 8 … 20. A gap never stands for a single page, which
+// is named instead.
+func (p *Paginator) Links() []PageLink {
+  count, current := p.PageCount(), p.page(p.Current)
+  window := p.Window
+  if window < 0 {
+    window = 0
+  }
+  low, high := current-window, current+window
+  if low <= 3 {
+    low = 1
+  }
+  if high >= count-2 {
+    high = count
+  }
+  links := []PageLink{}
+  link := func(n int) {
+    links = append(links, PageLink{ Number: n, URL: p.PageURL(n),
+        Current: n == current })
+  }
+  if low > 1 {
+    link(1)
+    links = append(links, PageLink{ Gap: true })
+  }
+  for n := low; n <= high; n++ {
+    link(n)
+  }
+  if high < count {
+    links = append(links, PageLink{ Gap: true })
+    link(count)
+  }
+  return links
+}
+
+// HTML draws the links of the pages with PaginationTemplate, or returns ""
+// if there is only one page. An error of the template is drawn as an HTML
+// comment.
+func (p *Paginator) HTML() SafeHTML {
+  if p.PageCount() <= 1 {
+    return ""
+  }
+  tmpl, err := template.New("pagination").Parse(PaginationTemplate)
+  var html strings.Builder
+  if err == nil {
+    err = tmpl.Execute(&html, p)
+  }
+  if err != nil {
+    return SafeHTML("<!-- pagination: " + strings.ReplaceAll(err.Error(),
+        "--", "- -") + " -->")
+  }
+  return SafeHTML(html.String())
+}
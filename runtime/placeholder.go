@@ -0,0 +1,71 @@
+package runtime
+
+import (
+  "strings"
+)
+
+// placeholder marks a place in the content buffer that is filled in when
+// the response is finished.
+type placeholder struct {
+  name string
+  offset int   // The length of the content buffer when it was reserved.
+}
+
+// Placeholder reserves a named place in the body at the current point of
+// the output. Its text is given later by Fill, so that a page can write
+// its <title> or a list of scripts near the top once the rest of the page
+// has shown what they should be. A name may be reserved in several
+// places, which all receive the same text. A placeholder that is never
+// filled is left empty.
+func (c *Context) Placeholder(name string) {
+  c.placeholders = append(c.placeholders,
+      placeholder{ name: name, offset: c.content.Len() })
+}
+
+// Fill sets the text of a placeholder, replacing any text given before.
+// The text is written as it is; escape it first if it comes from the
+// request. Fill may be called before or after the placeholder is reserved.
+func (c *Context) Fill(name, text string) {
+  if c.fills == nil {
+    c.fills = map[string]string{}
+  }
+  c.fills[name] = text
+}
+
+// AppendFill adds text to the end of a placeholder's text, as the end of
+// a content-for block does, so that several parts of a page can contribute
+// to one region.
+func (c *Context) AppendFill(name, text string) {
+  c.Fill(name, c.fills[name]+text)
+}
+
+// filledContent returns the content buffer with the placeholders replaced
+// by their text.
+func (c *Context) filledContent() string {
+  return fillPlaceholders(c.content.String(), c.placeholders, 0, c.fills)
+}
+
+// fillPlaceholders replaces placeholders in content that begins at offset
+// base of the content buffer.
+func fillPlaceholders(content string, placeholders []placeholder, base int,
+    fills map[string]string) string {
+  if len(placeholders) == 0 {
+    return content
+  }
+  var filled strings.Builder
+  start := 0
+  for _, p := range placeholders {
+    filled.WriteString(content[start:p.offset-base])
+    filled.WriteString(fills[p.name])
+    start = p.offset - base
+  }
+  filled.WriteString(content[start:])
+  return filled.String()
+}
+
+// discardContent empties the content buffer along with its placeholders
+// and captures, as when the response is replaced by an error.
+func (c *Context) discardContent() {
+  c.content.Reset()
+  c.placeholders, c.fills, c.captures = nil, nil, nil
+}
@@ -0,0 +1,102 @@
+package runtime
+
+// The plural rules follow the cardinal rules of the Unicode CLDR for
+// whole numbers, for the languages that need more than English's. Each
+// rule lists its categories in the order of the msgstr[n] forms of
+// gettext catalogs.
+type pluralRule struct {
+  categories []string
+  category func(n int64) string
+}
+
+// englishPlural is the rule of English and of languages not listed in
+// pluralRules: one for 1, other otherwise.
+var englishPlural = pluralRule{ []string{ "one", "other" },
+    func(n int64) string {
+      if n == 1 {
+        return "one"
+      }
+      return "other"
+    } }
+
+// pluralRules maps base language codes to rules.
+var pluralRules = map[string]pluralRule{}
+
+func init() {
+  invariable := pluralRule{ []string{ "other" },
+      func(n int64) string { return "other" } }
+  zeroOrOne := pluralRule{ []string{ "one", "other" },
+      func(n int64) string {
+        if n == 0 || n == 1 {
+          return "one"
+        }
+        return "other"
+      } }
+  eastSlavic := pluralRule{ []string{ "one", "few", "many" },
+      func(n int64) string {
+        switch {
+        case n%10 == 1 && n%100 != 11:
+          return "one"
+        case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+          return "few"
+        }
+        return "many"
+      } }
+  polish := pluralRule{ []string{ "one", "few", "many" },
+      func(n int64) string {
+        switch {
+        case n == 1:
+          return "one"
+        case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+          return "few"
+        }
+        return "many"
+      } }
+  westSlavic := pluralRule{ []string{ "one", "few", "other" },
+      func(n int64) string {
+        switch {
+        case n == 1:
+          return "one"
+        case n >= 2 && n <= 4:
+          return "few"
+        }
+        return "other"
+      } }
+  arabic := pluralRule{
+      []string{ "zero", "one", "two", "few", "many", "other" },
+      func(n int64) string {
+        switch {
+        case n == 0:
+          return "zero"
+        case n == 1:
+          return "one"
+        case n == 2:
+          return "two"
+        case n%100 >= 3 && n%100 <= 10:
+          return "few"
+        case n%100 >= 11:
+          return "many"
+        }
+        return "other"
+      } }
+  for _, pair := range []struct{ languages []string; rule pluralRule }{
+    { []string{ "ja", "zh", "ko", "th", "vi", "id", "ms" }, invariable },
+    { []string{ "fr", "pt", "hi" }, zeroOrOne },
+    { []string{ "ru", "uk", "be" }, eastSlavic },
+    { []string{ "pl" }, polish },
+    { []string{ "cs", "sk" }, westSlavic },
+    { []string{ "ar" }, arabic },
+  } {
+    for _, language := range pair.languages {
+      pluralRules[language] = pair.rule
+    }
+  }
+}
+
+// pluralRuleFor returns the rule of a locale such as "pt-br".
+func pluralRuleFor(locale string) pluralRule {
+  if rule, found := pluralRules[baseLanguage(locale)]; found {
+    return rule
+  }
+  return englishPlural
+}
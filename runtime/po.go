@@ -0,0 +1,102 @@
+package runtime
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+// poEntry collects the fields of an entry of a gettext catalog.
+type poEntry struct {
+  id, idPlural, context string
+  text string
+  forms map[int]*string   // The plural forms by index.
+  translated bool         // A msgstr has been read.
+  fuzzy bool
+}
+
+// parsePOCatalog reads the messages of a gettext catalog. The plural
+// forms of an entry are mapped to the categories of the rule in order.
+// Message contexts are not distinguished.
+func parsePOCatalog(data []byte, rule pluralRule) (map[string]message,
+    error) {
+  messages := map[string]message{}
+  entry := &poEntry{ forms: map[int]*string{} }
+  var field *string  // The field that continuation lines extend.
+  finish := func() {
+    if entry.id != "" && !entry.fuzzy {
+      if entry.idPlural == "" && entry.text != "" {
+        messages[entry.id] = message{ text: entry.text }
+      } else if entry.idPlural != "" {
+        plural := map[string]string{}
+        for i, text := range entry.forms {
+          if i < len(rule.categories) && *text != "" {
+            plural[rule.categories[i]] = *text
+          }
+        }
+        if len(plural) != 0 {
+          messages[entry.id] = message{ plural: plural }
+        }
+      }
+    }
+    entry, field = &poEntry{ forms: map[int]*string{} }, nil
+  }
+  for number, line := range strings.Split(string(data), "\n") {
+    line = strings.TrimSpace(line)
+    if line == "" {
+      continue
+    }
+    if strings.HasPrefix(line, "#") {
+      if entry.translated {
+        finish()  // A comment begins the next entry.
+      }
+      if strings.HasPrefix(line, "#,") && strings.Contains(line, "fuzzy") {
+        entry.fuzzy = true
+      }
+      continue
+    }
+    keyword, quoted := "", line
+    if !strings.HasPrefix(line, `"`) {
+      keyword, quoted, _ = strings.Cut(line, " ")
+    }
+    value, err := strconv.Unquote(strings.TrimSpace(quoted))
+    if err != nil {
+      return nil, fmt.Errorf("line %d: bad string", number+1)
+    }
+    if (keyword == "msgctxt" || keyword == "msgid") && entry.translated {
+      finish()
+    }
+    switch {
+    case keyword == "":
+      if field == nil {
+        return nil, fmt.Errorf("line %d: string outside an entry", number+1)
+      }
+      *field += value
+    case keyword == "msgctxt":
+      entry.context = value
+      field = &entry.context
+    case keyword == "msgid":
+      entry.id = value
+      field = &entry.id
+    case keyword == "msgid_plural":
+      entry.idPlural = value
+      field = &entry.idPlural
+    case keyword == "msgstr":
+      entry.text, entry.translated = value, true
+      field = &entry.text
+    case strings.HasPrefix(keyword, "msgstr[") &&
+        strings.HasSuffix(keyword, "]"):
+      i, err := strconv.Atoi(keyword[len("msgstr[") : len(keyword)-1])
+      if err != nil {
+        return nil, fmt.Errorf("line %d: bad plural index", number+1)
+      }
+      field = &value
+      entry.forms[i], entry.translated = field, true
+    default:
+      return nil, fmt.Errorf("line %d: unknown keyword %s", number+1,
+          keyword)
+    }
+  }
+  finish()
+  return messages, nil
+}
@@ -0,0 +1,355 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "strconv"
+  "strings"
+  "net/http"
+  "path/filepath"
+)
+
+// RateStore keeps the token buckets of Allow and RateLimit. Take spends a
+// token from the bucket under a key, which holds at most burst tokens and
+// gains one every period, and reports whether there was one to spend, and
+// if not, how long it will be until there is. A bucket that has not been
+// seen is full. Take must be atomic for all the programs that share the
+// store, so that they cannot spend the same token.
+type RateStore interface {
+  Take(key string, every time.Duration, burst int) (allowed bool,
+      retryAfter time.Duration, err error)
+}
+
+// defaultRateStore can be set at link time to the store of the rate
+// limiter, as buildapp does with its rateStore setting. See SetRateStore
+// for the forms.
+var defaultRateStore = ""
+
+// rateStore is the store in use, chosen when a bucket is first taken from
+// unless SetRateStore chose it before.
+var rateStore RateStore
+var rateStoreLock sync.Mutex
+
+// SetRateStore replaces the store of the rate limiter, as with a store of
+// the program's own. Otherwise the store is named by BOOMERANG_RATE_STORE
+// or by the rateStore setting of buildapp: "memory", "file" for a
+// directory in TempDir, "file:DIR", or "redis:HOST:PORT". By default,
+// programs that serve many requests keep buckets in memory, and CGI
+// programs, which serve one, keep them in files.
+func SetRateStore(store RateStore) {
+  rateStoreLock.Lock()
+  defer rateStoreLock.Unlock()
+  rateStore = store
+}
+
+// currentRateStore returns the store in use, choosing it if need be, as
+// currentCacheStore does.
+func (c *Context) currentRateStore() RateStore {
+  rateStoreLock.Lock()
+  defer rateStoreLock.Unlock()
+  if rateStore != nil {
+    return rateStore
+  }
+  setting, isSet := os.LookupEnv("BOOMERANG_RATE_STORE")
+  if !isSet {
+    setting = defaultRateStore
+  }
+  kind, arg, _ := strings.Cut(setting, ":")
+  switch {
+  case kind == "redis":
+    rateStore = NewRedisRateStore(arg)
+  case kind == "file" && arg != "":
+    rateStore = NewFileRateStore(arg)
+  case kind == "file" || (kind == "" && c.writer == nil):
+    rateStore = NewFileRateStore(filepath.Join(TempDir(), "boomerang-rate"))
+  default:
+    if kind != "memory" && kind != "" {
+      fmt.Fprintf(os.Stderr, "runtime: unknown rate store %q\n", setting)
+    }
+    rateStore = NewMemoryRateStore()
+  }
+  return rateStore
+}
+
+// Allow spends a token from the bucket under a key and reports whether
+// there was one, so that a page can limit how often an action is taken.
+// The bucket holds burst tokens, which is at least one, and gains one
+// every period; a period of zero or less sets no limit. The key names the
+// action and who takes it, such as "login:"+ClientIP() or the value of a
+// session cookie. Errors of the store are logged, and the request is then
+// allowed, so that a broken store does not take the site down.
+func (c *Context) Allow(key string, every time.Duration, burst int) bool {
+  allowed, _ := c.takeToken(key, every, burst)
+  return allowed
+}
+
+// RateLimit stops the page with 429 Too Many Requests, a Retry-After
+// header, and a plain body, unless Allow lets the request through. The
+// headers and output of the page are dropped, so call it before the page
+// writes anything, as at the top of a form handler:
+//
+//   runtime.RateLimit("comment:"+runtime.ClientIP(), time.Minute, 5)
+func (c *Context) RateLimit(key string, every time.Duration, burst int) {
+  allowed, retryAfter := c.takeToken(key, every, burst)
+  if allowed {
+    return
+  }
+  c.refuse(http.StatusTooManyRequests)
+  seconds := (retryAfter + time.Second - 1) / time.Second
+  if seconds < 1 {
+    seconds = 1
+  }
+  c.SetHeader("Retry-After", strconv.FormatInt(int64(seconds), 10))
+  c.Halt()
+}
+
+// takeToken takes from a bucket of the store in use, logging an error of
+// the store and allowing the request if there is one.
+func (c *Context) takeToken(key string, every time.Duration,
+    burst int) (bool, time.Duration) {
+  if every <= 0 {
+    return true, 0
+  }
+  if burst < 1 {
+    burst = 1
+  }
+  allowed, retryAfter, err := c.currentRateStore().Take(key, every, burst)
+  if err != nil {
+    c.logLine("error", "rate limit: "+err.Error())
+    return true, 0
+  }
+  return allowed, retryAfter
+}
+
+// ClientIP returns the IP address of the client, from REMOTE_ADDR. If
+// TrustForwarded is set, it is instead the address that the proxy in front
+// of the site added last to X-Forwarded-For, since those before it can be
+// forged by the client.
+func (c *Context) ClientIP() string {
+  if TrustForwarded {
+    forwarded := c.Getenv("HTTP_X_FORWARDED_FOR")
+    last := forwarded[strings.LastIndex(forwarded, ",")+1:]
+    if ip := net.ParseIP(strings.TrimSpace(last)); ip != nil {
+      return ip.String()
+    }
+  }
+  return c.Getenv("REMOTE_ADDR")
+}
+
+// bucket is the state of a token bucket: the tokens it held when it was
+// last updated. A bucket with a zero update time has not been seen.
+type bucket struct {
+  tokens float64
+  updated time.Time
+}
+
+// take refills a bucket for the time since its update, spends a token if
+// there is one, and reports whether there was, and if not, how long it
+// will be until there is.
+func (b *bucket) take(now time.Time, every time.Duration,
+    burst int) (bool, time.Duration) {
+  if b.updated.IsZero() {
+    b.tokens = float64(burst)
+  } else if elapsed := now.Sub(b.updated); elapsed > 0 {
+    b.tokens += float64(elapsed) / float64(every)
+  }
+  if b.tokens > float64(burst) {
+    b.tokens = float64(burst)
+  }
+  b.updated = now
+  if b.tokens >= 1 {
+    b.tokens--
+    return true, 0
+  }
+  return false, time.Duration((1 - b.tokens) * float64(every))
+}
+
+// full returns the time at which a bucket will be full again, after
+// which it need not be kept, since a bucket that has not been seen is
+// full.
+func (b *bucket) full(every time.Duration, burst int) time.Time {
+  return b.updated.Add(time.Duration((float64(burst) - b.tokens) *
+      float64(every)))
+}
+
+
+//--- Memory store
+
+// MemoryRateStore keeps buckets in the memory of the process, which limits
+// the requests of a FastCGI program or a server.
+type MemoryRateStore struct {
+  buckets map[string]*rateEntry
+  swept time.Time
+  lock sync.Mutex
+}
+
+// rateEntry is a bucket of a MemoryRateStore with the time at which it
+// will be full.
+type rateEntry struct {
+  bucket
+  expires time.Time
+}
+
+// NewMemoryRateStore makes an empty store in memory.
+func NewMemoryRateStore() *MemoryRateStore {
+  return &MemoryRateStore{ buckets: map[string]*rateEntry{} }
+}
+
+// Take spends a token. Full buckets are swept out at most once a minute.
+func (s *MemoryRateStore) Take(key string, every time.Duration,
+    burst int) (bool, time.Duration, error) {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  now := time.Now()
+  if now.Sub(s.swept) > time.Minute {
+    for k, entry := range s.buckets {
+      if now.After(entry.expires) {
+        delete(s.buckets, k)
+      }
+    }
+    s.swept = now
+  }
+  entry, found := s.buckets[key]
+  if !found {
+    entry = &rateEntry{}
+    s.buckets[key] = entry
+  }
+  allowed, retryAfter := entry.take(now, every, burst)
+  entry.expires = entry.full(every, burst)
+  return allowed, retryAfter, nil
+}
+
+
+//--- File store
+
+// FileRateStore keeps buckets in files of a directory, where CGI programs
+// on one host can share them. Each file holds the tokens of a bucket and
+// the time of its update, and is locked while a token is taken, on
+// systems that have flock; elsewhere, concurrent requests may spend the
+// same token. The modification time of a file is set to the time at which
+// its bucket will be full, after which it is swept out. The directory must
+// lie within the writable roots.
+type FileRateStore struct {
+  Dir string
+}
+
+// NewFileRateStore makes a store in a directory, which is created when the
+// first bucket is stored.
+func NewFileRateStore(dir string) *FileRateStore {
+  return &FileRateStore{ Dir: dir }
+}
+
+// Take spends a token.
+func (s *FileRateStore) Take(key string, every time.Duration,
+    burst int) (bool, time.Duration, error) {
+  if err := MkdirAll(s.Dir, 0755); err != nil {
+    return false, 0, err
+  }
+  s.sweep()
+  name := filepath.Join(s.Dir, hashKey(key))
+  file, err := s.openLocked(name)
+  if err != nil {
+    return false, 0, err
+  }
+  defer file.Close()
+  defer unlockFile(file)
+  b := bucket{}
+  var updated int64
+  if n, _ := fmt.Fscan(file, &b.tokens, &updated); n == 2 {
+    b.updated = time.Unix(0, updated)
+  }
+  now := time.Now()
+  allowed, retryAfter := b.take(now, every, burst)
+  if err := file.Truncate(0); err != nil {
+    return false, 0, err
+  }
+  _, err = file.WriteAt([]byte(fmt.Sprintf("%g %d\n", b.tokens,
+      b.updated.UnixNano())), 0)
+  if err != nil {
+    return false, 0, err
+  }
+  full := b.full(every, burst)
+  if err := os.Chtimes(name, full, full); err != nil {
+    return false, 0, err
+  }
+  return allowed, retryAfter, nil
+}
+
+// openLocked opens the file of a bucket, creating it if need be, and locks
+// it. If the sweep removed the file between its opening and its locking,
+// it is opened again, so that no token is taken from a bucket that has
+// been unlinked.
+func (s *FileRateStore) openLocked(name string) (*os.File, error) {
+  for {
+    file, err := OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+      return nil, err
+    }
+    if err := lockFile(file); err != nil {
+      file.Close()
+      return nil, err
+    }
+    if isLinked(file, name) {
+      return file, nil
+    }
+    unlockFile(file)
+    file.Close()
+  }
+}
+
+// isLinked reports whether a file is still the one that a path names.
+func isLinked(file *os.File, name string) bool {
+  opened, err := file.Stat()
+  if err != nil {
+    return false
+  }
+  current, err := os.Stat(name)
+  return err == nil && os.SameFile(opened, current)
+}
+
+// sweep removes the files of full buckets, at most once a minute, as
+// recorded by the modification time of a marker file.
+func (s *FileRateStore) sweep() {
+  marker := filepath.Join(s.Dir, ".swept")
+  now := time.Now()
+  if info, err := os.Stat(marker); err == nil &&
+      now.Sub(info.ModTime()) < time.Minute {
+    return
+  }
+  if err := WriteFile(marker, nil, 0644); err != nil {
+    return
+  }
+  entries, err := os.ReadDir(s.Dir)
+  if err != nil {
+    return
+  }
+  for _, entry := range entries {
+    if strings.HasPrefix(entry.Name(), ".") {
+      continue
+    }
+    s.removeFull(filepath.Join(s.Dir, entry.Name()), now)
+  }
+}
+
+// removeFull removes the file of a bucket that is full, holding its lock
+// so that a bucket being taken from is left alone. The bucket is checked
+// under the lock, and the file is removed only if the path still names it,
+// since another sweep may have replaced it with a fresh bucket.
+func (s *FileRateStore) removeFull(name string, now time.Time) {
+  file, err := OpenFile(name, os.O_RDWR, 0)
+  if err != nil {
+    return
+  }
+  defer file.Close()
+  if lockFile(file) != nil {
+    return
+  }
+  defer unlockFile(file)
+  if info, err := file.Stat(); err == nil && now.After(info.ModTime()) &&
+      isLinked(file, name) {
+    Remove(name)
+  }
+}
@@ -0,0 +1,115 @@
+package runtime
+
+import (
+  "os"
+  "sync"
+  "time"
+  "testing"
+  "path/filepath"
+)
+
+// TestBucket takes tokens from a bucket that holds two and gains one every
+// second, at the given offsets from the start.
+func TestBucket(t *testing.T) {
+  start := time.Unix(1000, 0)
+  cases := []struct {
+    at time.Duration
+    allowed bool
+    retryAfter time.Duration
+  }{
+    { 0, true, 0 },
+    { 0, true, 0 },
+    { 0, false, time.Second },
+    { 250 * time.Millisecond, false, 750 * time.Millisecond },
+    { time.Second, true, 0 },
+    { time.Second, false, time.Second },
+    { time.Minute, true, 0 },  // Refilled, but only to the burst.
+    { time.Minute, true, 0 },
+    { time.Minute, false, time.Second },
+  }
+  b := bucket{}
+  for i, c := range cases {
+    allowed, retryAfter := b.take(start.Add(c.at), time.Second, 2)
+    if allowed != c.allowed || retryAfter != c.retryAfter {
+      t.Errorf("take %d: %v, %v; want %v, %v", i+1, allowed, retryAfter,
+          c.allowed, c.retryAfter)
+    }
+  }
+  if full := b.full(time.Second, 2); !full.Equal(
+      start.Add(time.Minute + 2*time.Second)) {
+    t.Errorf("full at %v, want two seconds after the last take", full)
+  }
+}
+
+// takeAll takes from a store in several goroutines at once and returns the
+// number of tokens that were spent.
+func takeAll(t *testing.T, store RateStore, key string, count int) int {
+  var wait sync.WaitGroup
+  var lock sync.Mutex
+  spent := 0
+  for i := 0; i < count; i++ {
+    wait.Add(1)
+    go func() {
+      defer wait.Done()
+      allowed, _, err := store.Take(key, time.Hour, 3)
+      lock.Lock()
+      defer lock.Unlock()
+      if err != nil {
+        t.Error(err)
+      } else if allowed {
+        spent++
+      }
+    }()
+  }
+  wait.Wait()
+  return spent
+}
+
+// TestRateStores checks that each store spends no more than the burst of
+// a bucket, however many requests take from it at once, and keeps the
+// buckets of different keys apart.
+func TestRateStores(t *testing.T) {
+  dir := t.TempDir()
+  savedRoots := WritableRoots()
+  SetWritableRoots(dir)
+  defer SetWritableRoots(savedRoots...)
+  stores := map[string]RateStore{
+    "memory": NewMemoryRateStore(),
+    "file": NewFileRateStore(filepath.Join(dir, "rate")),
+  }
+  for name, store := range stores {
+    if spent := takeAll(t, store, "a", 20); spent != 3 {
+      t.Errorf("%s: spent %d tokens, want 3", name, spent)
+    }
+    if spent := takeAll(t, store, "b", 2); spent != 2 {
+      t.Errorf("%s: spent %d tokens of another key, want 2", name, spent)
+    }
+    allowed, retryAfter, err := store.Take("a", time.Hour, 3)
+    if err != nil || allowed || retryAfter <= 0 ||
+        retryAfter > time.Hour {
+      t.Errorf("%s: empty bucket gave %v, %v, %v", name, allowed,
+          retryAfter, err)
+    }
+  }
+}
+
+// TestFileRateSweep checks that the sweep removes the files of full
+// buckets and keeps the others.
+func TestFileRateSweep(t *testing.T) {
+  dir := t.TempDir()
+  savedRoots := WritableRoots()
+  SetWritableRoots(dir)
+  defer SetWritableRoots(savedRoots...)
+  store := NewFileRateStore(dir)
+  store.Take("full", time.Nanosecond, 1)
+  store.Take("empty", time.Hour, 1)
+  past := time.Now().Add(-time.Hour)
+  os.Chtimes(filepath.Join(dir, ".swept"), past, past)
+  store.sweep()
+  if _, err := os.Stat(filepath.Join(dir, hashKey("full"))); err == nil {
+    t.Errorf("the file of a full bucket was kept")
+  }
+  if _, err := os.Stat(filepath.Join(dir, hashKey("empty"))); err != nil {
+    t.Errorf("the file of an empty bucket was removed: %s", err.Error())
+  }
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package runtime
+
+import (
+  "os"
+)
+
+// lockFile always succeeds on systems without flock, where the buckets of
+// a FileRateStore are not kept apart.
+func lockFile(file *os.File) error {
+  return nil
+}
+
+// unlockFile releases a lock taken by lockFile.
+func unlockFile(file *os.File) {
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package runtime
+
+import (
+  "os"
+  "syscall"
+)
+
+// lockFile takes an exclusive flock on a file, waiting for it if another
+// process holds it.
+func lockFile(file *os.File) error {
+  return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+// unlockFile releases a lock taken by lockFile.
+func unlockFile(file *os.File) {
+  syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
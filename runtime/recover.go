@@ -0,0 +1,70 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "net/http"
+  "runtime/debug"
+)
+
+// ErrorPage is the body of the 500 response that Recover sends when a page
+// panics. A program can replace it, for example in an init function.
+var ErrorPage = `<!DOCTYPE html>
+<html>
+<head><title>500 Internal Server Error</title></head>
+<body>
+<h1>Internal Server Error</h1>
+<p>The page could not be shown because of an error on the server.</p>
+</body>
+</html>`
+
+// Recover is deferred by the code that buildapp generates, so that a panic
+// in a page does not end in a blank response or bring down a server. The
+// panic is logged to stderr with the stack, and unless the response has
+// been written already, it is replaced by a 500 response with ErrorPage as
+// its body. A panic raised by Halt ends the page quietly, and the response
+// is written as it stands. Recover must be deferred directly.
+func (c *Context) Recover() {
+  recovered := recover()
+  if recovered == nil {
+    return
+  }
+  if _, halted := recovered.(haltSignal); halted {
+    c.Finish()
+    return
+  }
+  fmt.Fprintf(os.Stderr, "runtime: panic serving %s (request %s): %v\n%s",
+      c.Getenv("REQUEST_URI"), c.RequestID(), recovered, debug.Stack())
+  if !c.guard.isClaimed() {
+    c.errorResponse()
+    c.Finish()
+  }
+}
+
+// haltSignal is the panic value with which Halt unwinds a page.
+type haltSignal struct{}
+
+// Halt stops the page: the rest of its code does not run, and the
+// response is written as it stands, with whatever status and headers were
+// set. It lets a page stop after a redirect or a 404 without wrapping the
+// rest of its code in a conditional. Halt works by panicking, so it must
+// be called in the goroutine of the page, and a recover in the page's own
+// code must let the panic go on.
+func (c *Context) Halt() {
+  panic(haltSignal{})
+}
+
+// errorResponse replaces the response with a 500 error that has ErrorPage
+// as its body. Headers set by the page, such as cookies, are dropped, as
+// are the filters that it added.
+func (c *Context) errorResponse() {
+  c.discardContent()
+  c.truncated = false
+  c.headers = []string{ defaultContentType }
+  c.locationHeader = ""
+  c.filters = nil
+  c.etag, c.lastModified, c.noTrimming = false, time.Time{}, false
+  c.SetHTTPStatus(http.StatusInternalServerError, "")
+  c.content.WriteString(ErrorPage)
+}
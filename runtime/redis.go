@@ -0,0 +1,156 @@
+package runtime
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "time"
+  "bufio"
+  "errors"
+  "strconv"
+  "strings"
+)
+
+// RedisRateStore keeps buckets in a Redis server, which CGI programs on
+// several hosts can share. Each bucket is a hash that a Lua script updates
+// atomically, and that expires when the bucket is full. The time is that
+// of the program, so the clocks of the hosts should agree. Each take uses
+// a connection of its own.
+type RedisRateStore struct {
+  Addr string               // The address of the server, as "host:port".
+  Password string           // The password for AUTH, if one is needed.
+  Timeout time.Duration     // The limit of each take.
+}
+
+// NewRedisRateStore makes a store for the server at addr, with a timeout
+// of one second.
+func NewRedisRateStore(addr string) *RedisRateStore {
+  return &RedisRateStore{ Addr: addr, Timeout: time.Second }
+}
+
+// redisTakeScript takes a token from the bucket at KEYS[1], given the
+// period and the time in milliseconds and the burst, and returns whether
+// there was one and the milliseconds until there is.
+const redisTakeScript = `
+local every, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]),
+    tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens, updated = tonumber(state[1]), tonumber(state[2])
+if tokens == nil or updated == nil then
+  tokens, updated = burst, now
+end
+if now > updated then
+  tokens = tokens + (now - updated) / every
+end
+if tokens > burst then
+  tokens = burst
+end
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens, allowed = tokens - 1, 1
+else
+  wait = math.ceil((1 - tokens) * every)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated',
+    tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) * every) + 1)
+return {allowed, wait}
+`
+
+// Take spends a token.
+func (s *RedisRateStore) Take(key string, every time.Duration,
+    burst int) (bool, time.Duration, error) {
+  conn, err := net.DialTimeout("tcp", s.Addr, s.Timeout)
+  if err != nil {
+    return false, 0, err
+  }
+  defer conn.Close()
+  conn.SetDeadline(time.Now().Add(s.Timeout))
+  reader := bufio.NewReader(conn)
+  if s.Password != "" {
+    if _, err := redisCall(conn, reader, "AUTH", s.Password); err != nil {
+      return false, 0, err
+    }
+  }
+  everyMS := every.Milliseconds()
+  if everyMS < 1 {
+    everyMS = 1
+  }
+  reply, err := redisCall(conn, reader, "EVAL", redisTakeScript, "1",
+      "boomerang:rate:"+hashKey(key), strconv.FormatInt(everyMS, 10),
+      strconv.Itoa(burst), strconv.FormatInt(time.Now().UnixMilli(), 10))
+  if err != nil {
+    return false, 0, err
+  }
+  values, ok := reply.([]interface{})
+  if !ok || len(values) != 2 {
+    return false, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+  }
+  allowed, ok1 := values[0].(int64)
+  wait, ok2 := values[1].(int64)
+  if !ok1 || !ok2 {
+    return false, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+  }
+  return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+// redisCall sends a command in the Redis protocol and reads its reply.
+func redisCall(conn net.Conn, reader *bufio.Reader,
+    args ...string) (interface{}, error) {
+  command := fmt.Sprintf("*%d\r\n", len(args))
+  for _, arg := range args {
+    command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+  }
+  if _, err := io.WriteString(conn, command); err != nil {
+    return nil, err
+  }
+  return readRedisReply(reader)
+}
+
+// readRedisReply reads a reply in the Redis protocol: a status or bulk
+// string, an int64, a slice of replies, or nil. An error reply is returned
+// as an error.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+  line, err := reader.ReadString('\n')
+  if err != nil {
+    return nil, err
+  }
+  line = strings.TrimRight(line, "\r\n")
+  if line == "" {
+    return nil, errors.New("redis: empty reply")
+  }
+  kind, rest := line[0], line[1:]
+  switch kind {
+  case '+':
+    return rest, nil
+  case '-':
+    return nil, errors.New("redis: " + rest)
+  case ':':
+    return strconv.ParseInt(rest, 10, 64)
+  case '$', '*':
+    n, err := strconv.Atoi(rest)
+    if err != nil {
+      return nil, fmt.Errorf("redis: unexpected reply %q", line)
+    }
+    if n < 0 {
+      return nil, nil
+    }
+    if kind == '$' {
+      data := make([]byte, n+2)  // The string is followed by CRLF.
+      if _, err := io.ReadFull(reader, data); err != nil {
+        return nil, err
+      }
+      return string(data[:n]), nil
+    }
+    values := []interface{}{}
+    for i := 0; i < n; i++ {
+      value, err := readRedisReply(reader)
+      if err != nil {
+        return nil, err
+      }
+      values = append(values, value)
+    }
+    return values, nil
+  }
+  return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,77 @@
+package runtime
+
+import (
+  "os"
+  "io"
+  "strings"
+  "net/url"
+  "net/http"
+)
+
+// PageRequest describes the request that a page answers, whether it came
+// by CGI, by FastCGI, or through the handler target. The query string and
+// the form are parsed when they are first needed.
+type PageRequest struct {
+  Method string        // The HTTP method, such as "GET" or "POST".
+  Path string          // The path of the requested URL.
+  RemoteAddr string    // The address of the client, as "host:port".
+  HTTP *http.Request   // The request in the form of net/http.
+
+  query url.Values
+  uploads map[string][]*Upload  // Files from a multipart body, once parsed.
+  uploadErr error               // The error from parsing a multipart body.
+  spooled []string              // The spool files of uploads.
+}
+
+// newPageRequest describes a request served by net/http.
+func newPageRequest(r *http.Request) *PageRequest {
+  return &PageRequest{ Method: r.Method, Path: r.URL.Path,
+      RemoteAddr: r.RemoteAddr, HTTP: r }
+}
+
+// cgiRequest reads the request of a CGI program from its environment. The
+// body is standard input. Variables that are missing, as when the program
+// is run from a shell, are taken to be those of a plain GET request.
+func cgiRequest() *PageRequest {
+  params := map[string]string{ "REQUEST_METHOD": "GET",
+      "SERVER_PROTOCOL": "HTTP/1.0" }
+  for _, pair := range os.Environ() {
+    if key, value, found := strings.Cut(pair, "="); found && value != "" {
+      params[key] = value
+    }
+  }
+  r, err := requestFromEnv(params)
+  if err != nil {
+    r, _ = http.NewRequest("GET", "/", nil)
+  }
+  r.Body = io.NopCloser(os.Stdin)
+  if r.ContentLength > 0 {
+    r.Body = io.NopCloser(io.LimitReader(os.Stdin, r.ContentLength))
+  }
+  return newPageRequest(r)
+}
+
+// Query returns the first value of a parameter in the query string, or ""
+// if there is none.
+func (r *PageRequest) Query(name string) string {
+  if r.query == nil {
+    r.query = r.HTTP.URL.Query()
+  }
+  return r.query.Get(name)
+}
+
+// Form returns the first value of a form field. Fields in the body of a
+// POST, PUT, or PATCH request, URL-encoded or multipart, take precedence
+// over parameters in the query string. The body is read by the first call.
+func (r *PageRequest) Form(name string) string {
+  if r.isMultipart() {
+    r.parseMultipart()  // The runtime's limits apply, not net/http's.
+  }
+  return r.HTTP.FormValue(name)
+}
+
+// Header returns the first value of a request header, such as
+// "User-Agent", or "" if there is none.
+func (r *PageRequest) Header(name string) string {
+  return r.HTTP.Header.Get(name)
+}
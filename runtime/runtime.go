@@ -7,21 +7,34 @@ package runtime
 
 import (
   "os"
-  "bufio"
-  "bytes"
-  "fmt"
-  "strings"
+  "io"
+  "time"
+  "context"
+  "net/http"
+  "database/sql"
+  "text/template"
 )
 
-var (
-  statusHeader = ""
-  locationHeader = ""
-  headers = []string{ "Content-Type: text/html; charset=utf-8" }
-  contentBuffer = new(bytes.Buffer)
-)
+// defaultTempDir can be set at link time, which is what buildapp does with
+// its -spooldir flag.
+var defaultTempDir = ""
+
+
+//--- Host environment
 
-func appendHeader(header string) {
-  headers = append(headers, header)
+// TempDir returns the directory in which the runtime creates temporary
+// files. The BOOMERANG_TMPDIR environment variable takes precedence over
+// the directory chosen at build time, which in turn takes precedence over
+// the host's default temporary directory. This lets a site run where the
+// web tree is read-only.
+func TempDir() string {
+  if dir := os.Getenv("BOOMERANG_TMPDIR"); dir != "" {
+    return dir
+  }
+  if defaultTempDir != "" {
+    return defaultTempDir
+  }
+  return os.TempDir()
 }
 
 
@@ -29,52 +42,171 @@ func appendHeader(header string) {
 
 // WriteString appends a string to the content buffer.
 func WriteString(s string) {
-  contentBuffer.WriteString(s)
+  defaultContext.WriteString(s)
 }
 
 // Print calls fmt.Sprint and writes the result to the content buffer.
 func Print(a ...interface{}) {
-  contentBuffer.WriteString(fmt.Sprint(a...))
+  defaultContext.Print(a...)
 }
 
 // Println calls fmt.Sprintln and writes the result to the content buffer.
 func Println(a ...interface{}) {
-  contentBuffer.WriteString(fmt.Sprintln(a...))
+  defaultContext.Println(a...)
 }
 
 // Printf calls fmt.Sprintf and writes the result to the content buffer.
 func Printf(format string, a ...interface{}) {
-  contentBuffer.WriteString(fmt.Sprintf(format, a...))
+  defaultContext.Printf(format, a...)
+}
+
+// PrintEscaped is like Print, except that in HTML and XML responses each
+// value is escaped with EscapeHTML unless it is SafeHTML.
+func PrintEscaped(a ...interface{}) {
+  defaultContext.PrintEscaped(a...)
+}
+
+// PrintfEscaped is like Printf, except that the arguments are escaped as
+// by PrintEscaped.
+func PrintfEscaped(format string, a ...interface{}) {
+  defaultContext.PrintfEscaped(format, a...)
+}
+
+// Placeholder reserves a named place in the body, to be given its text by
+// Fill before the response is written:
+//
+//   <title><?code runtime.Placeholder("title") ?></title>
+//   ...
+//   <?code runtime.Fill("title", runtime.EscapeHTML(post.Title)) ?>
+func Placeholder(name string) {
+  defaultContext.Placeholder(name)
+}
+
+// Fill sets the text of a placeholder reserved with Placeholder.
+func Fill(name, text string) {
+  defaultContext.Fill(name, text)
+}
+
+// AppendFill adds text to the text of a placeholder.
+func AppendFill(name, text string) {
+  defaultContext.AppendFill(name, text)
+}
+
+// BeginCapture starts capturing output into a fragment.
+func BeginCapture() {
+  defaultContext.BeginCapture()
+}
+
+// EndCapture ends the latest capture and returns the captured output.
+func EndCapture() string {
+  return defaultContext.EndCapture()
+}
+
+// AddFilter applies a filter to the body of the response, after the
+// filters of the site.
+func AddFilter(filter Filter) {
+  defaultContext.AddFilter(filter)
+}
+
+// WriteXML writes the XML encoding of v and sets the Content-Type to
+// application/xml. If v cannot be encoded, the error is logged and the
+// response becomes a 500 error.
+func WriteXML(v interface{}) error {
+  return defaultContext.WriteXML(v)
+}
+
+// WriteRSS writes a feed as RSS 2.0.
+func WriteRSS(feed *Feed) error {
+  return defaultContext.WriteRSS(feed)
+}
+
+// WriteAtom writes a feed as Atom.
+func WriteAtom(feed *Feed) error {
+  return defaultContext.WriteAtom(feed)
+}
+
+// SetOutputMode chooses between CGI and NPH output for a CGI program.
+func SetOutputMode(mode OutputMode) {
+  defaultContext.SetOutputMode(mode)
+}
+
+// SendEvent sends a Server-Sent Event at once, turning the response into
+// a stream of events on the first call.
+func SendEvent(name, data string) error {
+  return defaultContext.SendEvent(name, data)
+}
+
+// RequestContext returns a context that is canceled when the client goes
+// away or the response has been written.
+func RequestContext() context.Context {
+  return defaultContext.RequestContext()
+}
+
+// ClientGone reports whether the client has gone away.
+func ClientGone() bool {
+  return defaultContext.ClientGone()
+}
+
+// WriteJSON writes the JSON encoding of v and sets the Content-Type to
+// application/json. If v cannot be encoded, the error is logged and the
+// response becomes a 500 error.
+func WriteJSON(v interface{}) error {
+  return defaultContext.WriteJSON(v)
 }
 
 
 //-- Automatic output.
 
 // PrintCGI writes a whole CGI response: headers, blank line, body. The body
-// is made from contentBuffer. The Content-Type and Content-Length
+// is made from the content buffer. The Content-Type and Content-Length
 // headers are printed by default. An additional header may be printed for
-// redirection or an HTTP status change.
+// redirection or an HTTP status change. The response is written only once;
+// later calls do nothing. Under FastCGI, the response goes to the request
+// being served rather than to stdout.
 func PrintCGI() {
-  contentString := strings.TrimSpace(contentBuffer.String())
-  if statusHeader != "" {
-    appendHeader(statusHeader)
-  }
-  if locationHeader != "" {
-    appendHeader(locationHeader)
-  }
-  appendHeader(fmt.Sprintf("Content-Length: %d\n", len(contentString)))
-  headerString := strings.Join(headers, "\n")
-  writer := bufio.NewWriter(os.Stdout)
-  writer.WriteString(headerString)
-  writer.WriteString("\n")
-  writer.WriteString(contentString)
-  writer.WriteString("\n")
-  writer.Flush()
+  defaultContext.Finish()
+}
+
+// SetCompression turns the compression of the response on or off. The
+// body is compressed by default if the client accepts gzip or deflate and
+// the body is at least CompressMinSize bytes of a text format.
+func SetCompression(enabled bool) {
+  defaultContext.SetCompression(enabled)
+}
+
+// SetTrimming turns the trimming of whitespace around the body of the
+// response on or off. It is on by default. The Content-Length header is
+// the exact number of bytes of the body either way.
+func SetTrimming(enabled bool) {
+  defaultContext.SetTrimming(enabled)
+}
+
+// SetETag turns on a strong ETag computed over the body of the response.
+// A request whose If-None-Match lists the same tag gets a 304 Not Modified
+// with no body.
+func SetETag(enabled bool) {
+  defaultContext.SetETag(enabled)
 }
 
-// PrintBody writes out the content buffer.
+// SetLastModified sets the Last-Modified header and reports whether the
+// client's copy is current by If-Modified-Since, in which case the
+// response will be a 304 Not Modified.
+func SetLastModified(t time.Time) bool {
+  return defaultContext.SetLastModified(t)
+}
+
+// PrintBody writes out the content buffer, with its placeholders filled.
 func PrintBody() {
-  contentBuffer.WriteTo(os.Stdout)
+  io.WriteString(os.Stdout, defaultContext.filledContent())
+}
+
+// Truth reports whether a value counts as true in the conditions of Go
+// templates, such as those of if and with actions: it is not the zero
+// value of its type, nor an empty array, slice, map, or string. Templates converted from Go
+// templates by buildapp convert use it in conditions.
+func Truth(value interface{}) bool {
+  truth, _ := template.IsTrue(value)
+  return truth
 }
 
 
@@ -83,9 +215,45 @@ func PrintBody() {
 // SetHTTPStatus causes a status header to be added to the CGI output. It
 // can be called after body content has been emitted because the runtime
 // package buffers all CGI output. SetHTTPStatus can be called several
-// times and only the header for the final call will be emitted.
+// times and only the header for the final call will be emitted. If the
+// reason phrase is empty, the standard one for the code is used. Invalid
+// codes are rejected with a message on stderr.
 func SetHTTPStatus(statusCode int, reasonPhrase string) {
-  statusHeader = fmt.Sprintf("Status: %d %s", statusCode, reasonPhrase)
+  defaultContext.SetHTTPStatus(statusCode, reasonPhrase)
+}
+
+// SetStatus sets the status of the response with the standard reason
+// phrase for the code. The http.Status constants name the codes. It
+// returns an error if the code is not a valid HTTP status.
+func SetStatus(statusCode int) error {
+  return defaultContext.SetStatus(statusCode)
+}
+
+// NotFound sets the status to 404 Not Found.
+func NotFound() {
+  defaultContext.NotFound()
+}
+
+// Forbidden sets the status to 403 Forbidden.
+func Forbidden() {
+  defaultContext.Forbidden()
+}
+
+// ServerError logs a message and replaces the response with a 500 error
+// whose body is ErrorPage.
+func ServerError(message string) {
+  defaultContext.ServerError(message)
+}
+
+// Halt stops the page and writes the response as it stands, as after a
+// call of Redirect or NotFound:
+//
+//   if user == nil {
+//     runtime.Redirect("/login")
+//     runtime.Halt()
+//   }
+func Halt() {
+  defaultContext.Halt()
 }
 
 // Redirect causes a Status header with "301 Moved Permanently" and a
@@ -93,14 +261,332 @@ func SetHTTPStatus(statusCode int, reasonPhrase string) {
 // Like SetHTTPStatus, it can be called after emitting content and it can
 // be called several times, with only the final call taking effect.
 func Redirect(url string) {
-  RedirectWithStatus(url, 301, "Moved Permanently")
+  defaultContext.Redirect(url)
 }
 
 // RedirectWithStatus is like Redirect except it allows the caller to
 // specify a status code and reason phrase.
 func RedirectWithStatus(url string, statusCode int, reasonPhrase string) {
-  SetHTTPStatus(statusCode, reasonPhrase)
-  locationHeader = "Location: " + url
+  defaultContext.RedirectWithStatus(url, statusCode, reasonPhrase)
+}
+
+
+//--- Response headers
+
+// SetHeader sets a response header, such as Cache-Control, replacing any
+// headers of the same name. Names are not case-sensitive. The status and
+// the Location header are set with SetHTTPStatus and Redirect.
+func SetHeader(name, value string) {
+  defaultContext.SetHeader(name, value)
+}
+
+// AddHeader adds a response header without replacing others of the same
+// name.
+func AddHeader(name, value string) {
+  defaultContext.AddHeader(name, value)
+}
+
+// DelHeader removes the response headers of the given name.
+func DelHeader(name string) {
+  defaultContext.DelHeader(name)
+}
+
+// ApplySecurityHeaders sets the headers of a security policy, or of
+// DefaultSecurityPolicy if the policy is nil.
+func ApplySecurityHeaders(policy *SecurityPolicy) {
+  defaultContext.ApplySecurityHeaders(policy)
+}
+
+// SetContentType sets the Content-Type of the response, which is
+// "text/html; charset=utf-8" by default. Text and XML types are given a
+// UTF-8 charset unless they name one.
+func SetContentType(mediaType string) {
+  defaultContext.SetContentType(mediaType)
+}
+
+// ContentType returns the Content-Type of the response.
+func ContentType() string {
+  return defaultContext.ContentType()
+}
+
+// HTML sets the Content-Type to "text/html; charset=utf-8".
+func HTML() {
+  defaultContext.HTML()
 }
 
+// JSON sets the Content-Type to "application/json".
+func JSON() {
+  defaultContext.JSON()
+}
+
+// PlainText sets the Content-Type to "text/plain; charset=utf-8".
+func PlainText() {
+  defaultContext.PlainText()
+}
+
+// XML sets the Content-Type to "application/xml; charset=utf-8".
+func XML() {
+  defaultContext.XML()
+}
 
+
+//--- Request environment
+
+// Getenv returns a CGI variable of the request, such as QUERY_STRING.
+// Under FastCGI, the variables belong to the request being served;
+// otherwise they come from the environment of the process.
+func Getenv(key string) string {
+  return defaultContext.Getenv(key)
+}
+
+// Body returns the body of the request: the request body under FastCGI,
+// or standard input for CGI.
+func Body() io.Reader {
+  return defaultContext.Body()
+}
+
+// Request returns the request being served: under FastCGI, the current
+// request, and for CGI, the request described by the environment and
+// standard input.
+func Request() *PageRequest {
+  return defaultContext.Request()
+}
+
+// FormFile returns a reader of the first file uploaded in a form field of
+// a multipart/form-data request, with a description of the file. Files
+// larger than what UploadMemory allows are spooled to TempDir, and bodies
+// larger than MaxUploadSize are refused.
+func FormFile(name string) (io.ReadCloser, *Upload, error) {
+  return defaultContext.FormFile(name)
+}
+
+
+//--- Cookies
+
+// Cookie returns the value of a cookie sent with the request, or "" if
+// there is no such cookie.
+func Cookie(name string) string {
+  return defaultContext.Cookie(name)
+}
+
+// SetCookie adds a Set-Cookie header with the given attributes to the
+// response. Like the other headers, it can be added after content has been
+// written. The options may be nil.
+func SetCookie(name, value string, opts *CookieOptions) error {
+  return defaultContext.SetCookie(name, value, opts)
+}
+
+
+//--- Forms, locales, access, URLs, caching, and data
+
+// CSRFToken returns a new token for a form or a script to send back, which
+// ValidateCSRF accepts from the same client.
+func CSRFToken() string {
+  return defaultContext.CSRFToken()
+}
+
+// CSRFInput returns a hidden form field that carries a new CSRF token.
+func CSRFInput() SafeHTML {
+  return defaultContext.CSRFInput()
+}
+
+// ValidateCSRF checks the CSRF token of a request that may change state,
+// returning nil if the request is safe or its token is valid.
+func ValidateCSRF() error {
+  return defaultContext.ValidateCSRF()
+}
+
+// T translates a message into the locale of the response, choosing a
+// plural form by the first argument and formatting the text with the
+// arguments if it has verbs:
+//
+//   <?code runtime.PrintEscaped(runtime.T("%d new messages", count)) ?>
+func T(key string, args ...interface{}) string {
+  return defaultContext.T(key, args...)
+}
+
+// Locale returns the locale of the response, negotiated from the client's
+// Accept-Language header unless SetLocale has set it.
+func Locale() string {
+  return defaultContext.Locale()
+}
+
+// SetLocale sets the locale of the response.
+func SetLocale(locale string) {
+  defaultContext.SetLocale(locale)
+}
+
+// Negotiate returns the offered media type that the client's Accept header
+// prefers, or "" if it accepts none, so that a page can serve JSON or HTML:
+//
+//   <?code
+//     if runtime.Negotiate("text/html", "application/json") ==
+//         "application/json" {
+//       runtime.WriteJSON(items)
+//       return
+//     }
+//   ?>
+func Negotiate(offers ...string) string {
+  return defaultContext.Negotiate(offers...)
+}
+
+// Authorize stops the page with 401 Unauthorized or 403 Forbidden unless
+// each authorizer lets the request through.
+func Authorize(authorizers ...Authorizer) {
+  defaultContext.Authorize(authorizers...)
+}
+
+// RequireBasicAuth stops the page with 401 Unauthorized unless the client
+// gives a user name and password that validate accepts, and returns the
+// user name:
+//
+//   <?code
+//     user := runtime.RequireBasicAuth("Admin",
+//         func(user, password string) bool {
+//           return user == "admin" &&
+//               runtime.CheckPassword(password, os.Getenv("ADMIN_PASSWORD"))
+//         })
+//   ?>
+func RequireBasicAuth(realm string,
+    validate func(user, password string) bool) string {
+  return defaultContext.RequireBasicAuth(realm, validate)
+}
+
+// AuthUser returns the user accepted by BasicAuth or authenticated by the
+// web server, or "" if there is none.
+func AuthUser() string {
+  return defaultContext.AuthUser()
+}
+
+// URL returns the URL path of a page or file of the site, resolving a
+// relative path against the page, with a query made of names and values:
+//
+//   <a href="<?code runtime.PrintEscaped(
+//       runtime.URL("search.cgi", "q", term)) ?>">More</a>
+func URL(urlPath string, params ...string) string {
+  return defaultContext.URL(urlPath, params...)
+}
+
+// AbsoluteURL returns the URL of a page or file of the site, as URL does,
+// with the scheme and host by which the client reached the page.
+func AbsoluteURL(urlPath string, params ...string) string {
+  return defaultContext.AbsoluteURL(urlPath, params...)
+}
+
+// Paginate makes a Paginator for a list of total items shown perPage at a
+// time, with the current page taken from the query.
+func Paginate(total, perPage int) *Paginator {
+  return defaultContext.Paginate(total, perPage)
+}
+
+// NegotiateLanguage returns the offered locale that the client's
+// Accept-Language header prefers, or "" if it accepts none.
+func NegotiateLanguage(offers ...string) string {
+  return defaultContext.NegotiateLanguage(offers...)
+}
+
+// NegotiateEncoding returns the offered content coding that the client's
+// Accept-Encoding header prefers, or "" if it accepts none.
+func NegotiateEncoding(offers ...string) string {
+  return defaultContext.NegotiateEncoding(offers...)
+}
+
+// NegotiateCharset returns the offered charset that the client's
+// Accept-Charset header prefers, or "" if it accepts none.
+func NegotiateCharset(offers ...string) string {
+  return defaultContext.NegotiateCharset(offers...)
+}
+
+// Cache returns the fragment stored under a key, or renders, stores, and
+// returns it if there is none that is still fresh.
+func Cache(key string, ttl time.Duration, render func() string) string {
+  return defaultContext.Cache(key, ttl, render)
+}
+
+// Allow spends a token from the bucket under a key, which holds burst
+// tokens and gains one every period, and reports whether there was one.
+func Allow(key string, every time.Duration, burst int) bool {
+  return defaultContext.Allow(key, every, burst)
+}
+
+// RateLimit stops the page with 429 Too Many Requests unless Allow lets
+// the request through:
+//
+//   <?code
+//     runtime.RateLimit("login:"+runtime.ClientIP(), 10*time.Second, 5)
+//   ?>
+func RateLimit(key string, every time.Duration, burst int) {
+  defaultContext.RateLimit(key, every, burst)
+}
+
+// ClientIP returns the IP address of the client.
+func ClientIP() string {
+  return defaultContext.ClientIP()
+}
+
+// DB returns the site's database, configured by BOOMERANG_DB_DRIVER and
+// BOOMERANG_DB_SOURCE or by the dbDriver and dbSource settings.
+func DB() (*sql.DB, error) {
+  return defaultContext.DB()
+}
+
+
+//--- Logging and tracing
+
+// Log writes a structured line to stderr, or to syslog if BOOMERANG_LOG is
+// "syslog", with the time, the template, the request ID, and the operands
+// formatted as by fmt.Sprint.
+func Log(a ...interface{}) {
+  defaultContext.Log(a...)
+}
+
+// Logf is like Log with a message formatted as by fmt.Sprintf.
+func Logf(format string, a ...interface{}) {
+  defaultContext.Logf(format, a...)
+}
+
+// Debug is like Log, but it writes only if the BOOMERANG_DEBUG environment
+// variable is set.
+func Debug(a ...interface{}) {
+  defaultContext.Debug(a...)
+}
+
+// Debugf is like Logf, but it writes only if BOOMERANG_DEBUG is set.
+func Debugf(format string, a ...interface{}) {
+  defaultContext.Debugf(format, a...)
+}
+
+// RequestID returns the identifier that correlates the log lines of the
+// request, from X-Request-Id or traceparent if the request has one.
+func RequestID() string {
+  return defaultContext.RequestID()
+}
+
+// TraceID returns the ID of the distributed trace that the request is part
+// of, from its traceparent header or made up.
+func TraceID() string {
+  return defaultContext.TraceID()
+}
+
+// SpanID returns the ID of the span of the page within the trace.
+func SpanID() string {
+  return defaultContext.SpanID()
+}
+
+// TraceParent returns the traceparent header with which the page calls
+// other services.
+func TraceParent() string {
+  return defaultContext.TraceParent()
+}
+
+// Propagate sets the traceparent, tracestate, and X-Request-Id headers of
+// a request that the page makes to another service:
+//
+//   <?code
+//     request, _ := http.NewRequest("GET", apiURL, nil)
+//     runtime.Propagate(request.Header)
+//     response, err := http.DefaultClient.Do(request)
+//   ?>
+func Propagate(header http.Header) {
+  defaultContext.Propagate(header)
+}
@@ -0,0 +1,52 @@
+package runtime
+
+import (
+  "os"
+  "fmt"
+  "flag"
+  "context"
+  "strings"
+  "net/http"
+)
+
+// routeKey is the key under which HandlePage stores the route of a page in
+// the context of a request.
+type routeKey struct{}
+
+
+//--- Handler target
+
+// HandlePage registers the handler of a page at its route in a mux, as the
+// server that buildapp generates for its handler target does. A route that
+// ends in a slash, such as "/" for index.boo, matches only itself; other
+// routes also match longer paths, whose remainder becomes PATH_INFO. The
+// route becomes SCRIPT_NAME. A page that runs past the deadline is
+// answered with a 504 response.
+func HandlePage(mux *http.ServeMux, route string,
+    handler func(http.ResponseWriter, *http.Request)) {
+  routed := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+    ctx := context.WithValue(r.Context(), routeKey{}, route)
+    serveWithDeadline(w, r.WithContext(ctx), handler)
+  })
+  if strings.HasSuffix(route, "/") {
+    mux.Handle(route + "{$}", routed)
+    return
+  }
+  mux.Handle(route, routed)
+  mux.Handle(route + "/", routed)
+}
+
+// ServeSite runs the server that buildapp generates for its handler
+// target. Requests that no page handles are served from the files of the
+// site directory. The flags -addr and -root choose the address to listen
+// on and the site directory.
+func ServeSite(mux *http.ServeMux) {
+  address := flag.String("addr", ":8080", "the address to listen on")
+  root := flag.String("root", ".", "the directory of the static files")
+  flag.Parse()
+  mux.Handle("/", http.FileServer(http.Dir(*root)))
+  fmt.Fprintf(os.Stderr, "serving %s at %s\n", *root, *address)
+  err := http.ListenAndServe(*address, mux)
+  fmt.Fprintf(os.Stderr, "runtime: %s\n", err.Error())
+  os.Exit(1)
+}
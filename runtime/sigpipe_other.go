@@ -0,0 +1,8 @@
+//go:build !unix
+
+package runtime
+
+// ignoreSIGPIPE does nothing on systems without SIGPIPE, where a write to
+// a closed pipe fails with an error.
+func ignoreSIGPIPE() {
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package runtime
+
+import (
+  "syscall"
+  "os/signal"
+)
+
+// ignoreSIGPIPE keeps a CGI program alive when the web server closes its
+// standard output, as it does when the client goes away, so that the
+// write fails with an error that the runtime can log. Go would otherwise
+// end the program with SIGPIPE.
+func ignoreSIGPIPE() {
+  signal.Ignore(syscall.SIGPIPE)
+}
@@ -0,0 +1,50 @@
+package runtime
+
+import (
+  "fmt"
+  "net/http"
+)
+
+// SetStatus sets the status of the response with the standard reason
+// phrase for the code, such as "Not Found" for http.StatusNotFound. It
+// returns an error, and changes nothing, if the code is not a valid HTTP
+// status.
+func (c *Context) SetStatus(statusCode int) error {
+  if statusCode < 100 || statusCode > 599 {
+    return fmt.Errorf("invalid HTTP status code %d", statusCode)
+  }
+  reasonPhrase := http.StatusText(statusCode)
+  if reasonPhrase == "" {
+    reasonPhrase = "Status " + fmt.Sprint(statusCode)
+  }
+  c.statusHeader = fmt.Sprintf("Status: %d %s", statusCode, reasonPhrase)
+  return nil
+}
+
+// NotFound sets the status to 404 Not Found.
+func (c *Context) NotFound() {
+  c.SetStatus(http.StatusNotFound)
+}
+
+// Forbidden sets the status to 403 Forbidden.
+func (c *Context) Forbidden() {
+  c.SetStatus(http.StatusForbidden)
+}
+
+// refuse replaces the response with a plain one that gives a status, as
+// for a request that the page will not serve. The headers and output of
+// the page are dropped, and headers set afterward are kept.
+func (c *Context) refuse(statusCode int) {
+  c.errorResponse()
+  c.discardContent()
+  c.SetHTTPStatus(statusCode, "")
+  c.PlainText()
+  c.content.WriteString(http.StatusText(statusCode))
+}
+
+// ServerError logs a message and replaces the response with a 500 error
+// whose body is ErrorPage. The message is not shown to the client.
+func (c *Context) ServerError(message string) {
+  c.logLine("error", message)
+  c.errorResponse()
+}
@@ -0,0 +1,232 @@
+// Package testkit exercises the programs of Boomerang pages in go test,
+// without a web server. Run executes a compiled CGI program in a fake CGI
+// environment, with the request body on its standard input, and parses
+// what it writes to standard output. Serve calls the Handler function of a
+// page generated for the single server. Either way, the result is a
+// Response with assertions on the status, the headers, and the body:
+//
+//   func TestPost(t *testing.T) {
+//     program := testkit.Build(t, "../blog/post.go")
+//     request := testkit.NewRequest("GET", "/blog/post.cgi?id=7", "")
+//     r := testkit.Run(t, program, request)
+//     r.AssertStatus(200)
+//     r.AssertHeader("Content-Type", "text/html; charset=utf-8")
+//     r.AssertBodyContains("<h1>")
+//   }
+package testkit
+
+import (
+  "os"
+  "io"
+  "fmt"
+  "bytes"
+  "bufio"
+  "strconv"
+  "strings"
+  "testing"
+  "os/exec"
+  "net/url"
+  "net/http"
+  "path/filepath"
+  "net/http/httptest"
+  "net/textproto"
+)
+
+// Request describes a request to a page.
+type Request struct {
+  Method string             // The HTTP method, such as "GET".
+  Target string             // The path and query, as "/page.cgi?id=7".
+  Header http.Header        // The request headers.
+  Body string               // The request body.
+  Env map[string]string     // Extra CGI variables, which take precedence.
+}
+
+// NewRequest makes a request with no headers. A body that is not empty is
+// sent as application/x-www-form-urlencoded unless a Content-Type header
+// is set before the request is run.
+func NewRequest(method, target, body string) *Request {
+  r := &Request{ Method: method, Target: target, Header: http.Header{},
+      Body: body, Env: map[string]string{} }
+  if body != "" {
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  }
+  return r
+}
+
+// PostForm makes a POST request whose body is the encoded form.
+func PostForm(target string, form url.Values) *Request {
+  return NewRequest("POST", target, form.Encode())
+}
+
+// Response is what a page answered, with assertions that report failures
+// to the test that made it.
+type Response struct {
+  Status int              // The status code, 200 if none was given.
+  Header http.Header      // The response headers.
+  Body string             // The response body.
+  Stderr string           // What a CGI program wrote to stderr.
+  t testing.TB
+}
+
+// Build compiles a Go file generated from a template into a program in the
+// test's temporary directory and returns its path. The file is built in
+// the module that contains it. The test fails at once if it does not
+// compile.
+func Build(t testing.TB, goFile string) string {
+  t.Helper()
+  goFile, err := filepath.Abs(goFile)
+  if err != nil {
+    t.Fatalf("testkit: %s", err.Error())
+  }
+  program := filepath.Join(t.TempDir(), strings.TrimSuffix(
+      filepath.Base(goFile), ".go"))
+  cmd := exec.Command("go", "build", "-o", program, filepath.Base(goFile))
+  cmd.Dir = filepath.Dir(goFile)
+  if output, err := cmd.CombinedOutput(); err != nil {
+    t.Fatalf("testkit: building %s: %s\n%s", goFile, err.Error(), output)
+  }
+  return program
+}
+
+// cgiEnv returns the environment of a CGI program run for a request: the
+// test's own environment, so that settings such as BOOMERANG_TMPDIR carry
+// over, followed by the CGI variables.
+func (r *Request) cgiEnv() []string {
+  path, query, _ := strings.Cut(r.Target, "?")
+  env := append(os.Environ(),
+      "GATEWAY_INTERFACE=CGI/1.1",
+      "SERVER_PROTOCOL=HTTP/1.1",
+      "SERVER_NAME=localhost",
+      "SERVER_PORT=80",
+      "HTTP_HOST=localhost",
+      "REMOTE_ADDR=127.0.0.1",
+      "REQUEST_METHOD="+r.Method,
+      "REQUEST_URI="+r.Target,
+      "SCRIPT_NAME="+path,
+      "QUERY_STRING="+query,
+      "CONTENT_LENGTH="+strconv.Itoa(len(r.Body)))
+  for name, values := range r.Header {
+    key := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+    if key != "CONTENT_TYPE" {
+      key = "HTTP_" + key
+    }
+    env = append(env, key+"="+strings.Join(values, ", "))
+  }
+  for key, value := range r.Env {
+    env = append(env, key+"="+value)  // The last of a name wins.
+  }
+  return env
+}
+
+// Run executes a CGI program for a request and returns its response. The
+// test fails at once if the program cannot be run or its output is not a
+// CGI response; a program that exits with an error after writing a
+// response, as after a deadline, is not a failure by itself.
+func Run(t testing.TB, program string, r *Request) *Response {
+  t.Helper()
+  cmd := exec.Command(program)
+  cmd.Env = r.cgiEnv()
+  cmd.Stdin = strings.NewReader(r.Body)
+  var stdout, stderr bytes.Buffer
+  cmd.Stdout, cmd.Stderr = &stdout, &stderr
+  if err := cmd.Run(); err != nil {
+    if _, exited := err.(*exec.ExitError); !exited {
+      t.Fatalf("testkit: running %s: %s", program, err.Error())
+    }
+  }
+  response, err := parseCGIResponse(stdout.Bytes())
+  if err != nil {
+    t.Fatalf("testkit: %s: %s\nstderr:\n%s", program, err.Error(),
+        stderr.String())
+  }
+  response.Stderr, response.t = stderr.String(), t
+  return response
+}
+
+// parseCGIResponse reads the headers and body that a CGI program wrote.
+// The Status header becomes the status code.
+func parseCGIResponse(output []byte) (*Response, error) {
+  reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(output)))
+  header, err := reader.ReadMIMEHeader()
+  if err != nil && err != io.EOF {
+    return nil, err
+  }
+  body, err := io.ReadAll(reader.R)
+  if err != nil {
+    return nil, err
+  }
+  response := &Response{ Status: http.StatusOK, Header: http.Header(header),
+      Body: string(body) }
+  if status := header.Get("Status"); status != "" {
+    code, _, _ := strings.Cut(status, " ")
+    response.Status, err = strconv.Atoi(code)
+    if err != nil {
+      return nil, fmt.Errorf("bad Status header %q", status)
+    }
+    response.Header.Del("Status")
+  }
+  return response, nil
+}
+
+// Serve calls the Handler function of a page generated for the single
+// server and returns its response.
+func Serve(t testing.TB, handler func(http.ResponseWriter, *http.Request),
+    r *Request) *Response {
+  t.Helper()
+  request := httptest.NewRequest(r.Method, r.Target,
+      strings.NewReader(r.Body))
+  for name, values := range r.Header {
+    request.Header[name] = values
+  }
+  recorder := httptest.NewRecorder()
+  handler(recorder, request)
+  result := recorder.Result()
+  return &Response{ Status: result.StatusCode, Header: result.Header,
+      Body: recorder.Body.String(), t: t }
+}
+
+
+//--- Assertions
+
+// AssertStatus checks the status code.
+func (r *Response) AssertStatus(code int) {
+  r.t.Helper()
+  if r.Status != code {
+    r.t.Errorf("status is %d, want %d", r.Status, code)
+  }
+}
+
+// AssertHeader checks the first value of a response header. An empty
+// value checks that the header is missing.
+func (r *Response) AssertHeader(name, value string) {
+  r.t.Helper()
+  if got := r.Header.Get(name); got != value {
+    r.t.Errorf("header %s is %q, want %q", name, got, value)
+  }
+}
+
+// AssertBody checks the whole body.
+func (r *Response) AssertBody(body string) {
+  r.t.Helper()
+  if r.Body != body {
+    r.t.Errorf("body is %q, want %q", r.Body, body)
+  }
+}
+
+// AssertBodyContains checks that the body contains a string.
+func (r *Response) AssertBodyContains(s string) {
+  r.t.Helper()
+  if !strings.Contains(r.Body, s) {
+    r.t.Errorf("body does not contain %q; body:\n%s", s, r.Body)
+  }
+}
+
+// AssertRedirect checks that the response redirects to a location with a
+// 3xx status.
+func (r *Response) AssertRedirect(location string) {
+  r.t.Helper()
+  if r.Status < 300 || r.Status > 399 {
+    r.t.Errorf("status is %d, want a redirect", r.Status)
+  }
+  r.AssertHeader("Location", location)
+}
@@ -0,0 +1,180 @@
+package testkit
+
+import (
+  "os"
+  "fmt"
+  "strings"
+  "testing"
+  "net/url"
+  "net/http"
+  "path/filepath"
+)
+
+// recorder is a test whose failures are recorded instead of reported, so
+// that the assertions can be seen to fail.
+type recorder struct {
+  testing.TB
+  failures []string
+}
+
+// Helper does nothing, since a recorder reports no lines.
+func (r *recorder) Helper() {
+}
+
+// Errorf records a failure.
+func (r *recorder) Errorf(format string, args ...interface{}) {
+  r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+// TestParseCGIResponse checks that the Status header becomes the status
+// code and that the body is kept byte for byte.
+func TestParseCGIResponse(t *testing.T) {
+  cases := []struct {
+    output string
+    status int
+    header, value string
+    body string
+    fails bool
+  }{
+    { "Content-Type: text/plain\r\n\r\nhello", 200, "Content-Type",
+        "text/plain", "hello", false },
+    { "Status: 404 Not Found\nContent-Type: text/html\n\n<p>gone</p>\n",
+        404, "Content-Type", "text/html", "<p>gone</p>\n", false },
+    { "Status: 302 Found\nLocation: /next\n\n", 302, "Location", "/next",
+        "", false },
+    { "Status: 200\n\n", 200, "Status", "", "", false },
+    { "Status: bad\n\n", 0, "", "", "", true },
+  }
+  for _, c := range cases {
+    response, err := parseCGIResponse([]byte(c.output))
+    if c.fails {
+      if err == nil {
+        t.Errorf("%q: no error", c.output)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%q: %s", c.output, err.Error())
+      continue
+    }
+    if response.Status != c.status {
+      t.Errorf("%q: status %d, want %d", c.output, response.Status, c.status)
+    }
+    if got := response.Header.Get(c.header); got != c.value {
+      t.Errorf("%q: %s is %q, want %q", c.output, c.header, got, c.value)
+    }
+    if response.Body != c.body {
+      t.Errorf("%q: body %q, want %q", c.output, response.Body, c.body)
+    }
+  }
+}
+
+// TestCGIEnv checks the CGI variables of a request: the path and query are
+// split, headers become HTTP_ variables except for Content-Type, and the
+// extra variables come last, so that they win.
+func TestCGIEnv(t *testing.T) {
+  r := PostForm("/form.cgi?step=2", url.Values{ "name": { "Ada" } })
+  r.Header.Set("X-Request-Id", "abc")
+  r.Env["REMOTE_ADDR"] = "10.0.0.1"
+  env := map[string]string{}
+  for _, pair := range r.cgiEnv() {
+    key, value, _ := strings.Cut(pair, "=")
+    env[key] = value
+  }
+  want := map[string]string{
+    "REQUEST_METHOD": "POST",
+    "REQUEST_URI": "/form.cgi?step=2",
+    "SCRIPT_NAME": "/form.cgi",
+    "QUERY_STRING": "step=2",
+    "CONTENT_LENGTH": "8",
+    "CONTENT_TYPE": "application/x-www-form-urlencoded",
+    "HTTP_X_REQUEST_ID": "abc",
+    "REMOTE_ADDR": "10.0.0.1",
+  }
+  for key, value := range want {
+    if env[key] != value {
+      t.Errorf("%s is %q, want %q", key, env[key], value)
+    }
+  }
+  if _, found := env["HTTP_CONTENT_TYPE"]; found {
+    t.Errorf("Content-Type is also given as HTTP_CONTENT_TYPE")
+  }
+}
+
+// TestAssertions checks that each assertion passes on a matching response
+// and fails on one that does not match.
+func TestAssertions(t *testing.T) {
+  header := http.Header{}
+  header.Set("Location", "/next")
+  passing := &recorder{ TB: t }
+  r := &Response{ Status: 302, Header: header, Body: "moved", t: passing }
+  r.AssertStatus(302)
+  r.AssertHeader("Location", "/next")
+  r.AssertHeader("X-Missing", "")
+  r.AssertBody("moved")
+  r.AssertBodyContains("move")
+  r.AssertRedirect("/next")
+  if len(passing.failures) != 0 {
+    t.Errorf("matching assertions failed: %q", passing.failures)
+  }
+  failing := &recorder{ TB: t }
+  r.t = failing
+  r.AssertStatus(200)
+  r.AssertHeader("Location", "/elsewhere")
+  r.AssertBody("stayed")
+  r.AssertBodyContains("stay")
+  r.Status = 200
+  r.AssertRedirect("/next")
+  if len(failing.failures) != 5 {
+    t.Errorf("got %d failures, want 5: %q", len(failing.failures),
+        failing.failures)
+  }
+}
+
+// TestServe runs a handler for a request and checks what it wrote.
+func TestServe(t *testing.T) {
+  handler := func(w http.ResponseWriter, r *http.Request) {
+    r.ParseForm()
+    w.Header().Set("Content-Type", "text/plain")
+    w.WriteHeader(http.StatusCreated)
+    fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, r.PostForm.Get("name"))
+  }
+  r := Serve(t, handler, PostForm("/people", url.Values{ "name": { "Ada" } }))
+  r.AssertStatus(http.StatusCreated)
+  r.AssertHeader("Content-Type", "text/plain")
+  r.AssertBody("POST /people Ada")
+}
+
+// cgiProgram is a CGI program that echoes its request.
+const cgiProgram = `package main
+
+import (
+  "io"
+  "os"
+  "fmt"
+)
+
+func main() {
+  body, _ := io.ReadAll(os.Stdin)
+  fmt.Print("Status: 201 Created\n")
+  fmt.Print("Content-Type: text/plain\n\n")
+  fmt.Printf("%s %s %s", os.Getenv("REQUEST_METHOD"),
+      os.Getenv("QUERY_STRING"), body)
+}
+`
+
+// TestBuildAndRun builds a CGI program and runs it for a request.
+func TestBuildAndRun(t *testing.T) {
+  if testing.Short() {
+    t.Skip("builds a program")
+  }
+  goFile := filepath.Join(t.TempDir(), "echo.go")
+  if err := os.WriteFile(goFile, []byte(cgiProgram), 0644); err != nil {
+    t.Fatal(err)
+  }
+  program := Build(t, goFile)
+  r := Run(t, program, NewRequest("PUT", "/echo.cgi?id=7", "data"))
+  r.AssertStatus(http.StatusCreated)
+  r.AssertHeader("Content-Type", "text/plain")
+  r.AssertBody("PUT id=7 data")
+}
@@ -0,0 +1,167 @@
+package runtime
+
+import (
+  "strings"
+  "net/http"
+  "crypto/rand"
+  "encoding/hex"
+)
+
+// RequestIDHeader is the response header in which the request ID is
+// echoed, so that a client or a proxy can match the response to the log
+// lines of the page. A page that sets the header itself keeps its own
+// value, and "" turns the echo off.
+var RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the longest request ID taken from a client. Longer
+// IDs, and those with characters other than printable ASCII, are ignored,
+// since the ID is written into log lines and echoed in a header.
+const maxRequestIDLength = 128
+
+// RequestID returns the identifier that correlates the log lines of a
+// request. It is taken from an X-Request-Id header, or else it is the
+// trace ID of a W3C traceparent header, or the UNIQUE_ID variable of
+// Apache's mod_unique_id, or else the trace ID that the page starts.
+func (c *Context) RequestID() string {
+  if c.requestID == "" {
+    c.requestID = validRequestID(c.Getenv("HTTP_X_REQUEST_ID"))
+  }
+  if c.loadTrace(); c.requestID == "" && c.traceGiven {
+    c.requestID = c.traceID
+  }
+  if c.requestID == "" {
+    c.requestID = validRequestID(c.Getenv("UNIQUE_ID"))
+  }
+  if c.requestID == "" {
+    c.requestID = c.TraceID()
+  }
+  return c.requestID
+}
+
+// validRequestID returns an ID if it is short and printable, and "" if it
+// is not.
+func validRequestID(id string) string {
+  if len(id) > maxRequestIDLength {
+    return ""
+  }
+  for i := 0; i < len(id); i++ {
+    if id[i] <= ' ' || id[i] > '~' {
+      return ""
+    }
+  }
+  return id
+}
+
+// TraceID returns the ID of the distributed trace that the request is part
+// of, as 32 hexadecimal digits. It is taken from the traceparent header of
+// the request, which a proxy or a tracing library adds, or else made up,
+// so that the page starts a trace of its own.
+func (c *Context) TraceID() string {
+  c.loadTrace()
+  return c.traceID
+}
+
+// SpanID returns the ID of the span of the page within the trace, as 16
+// hexadecimal digits. It is made up for each request.
+func (c *Context) SpanID() string {
+  c.loadTrace()
+  return c.spanID
+}
+
+// TraceParent returns the traceparent header with which the page calls
+// other services, naming the trace and the page's span as the parent of
+// theirs. The sampling flag is passed on from the incoming header.
+func (c *Context) TraceParent() string {
+  c.loadTrace()
+  return "00-" + c.traceID + "-" + c.spanID + "-" + c.traceFlags
+}
+
+// Propagate sets the headers of a request that the page makes to another
+// service so that the service's logs and traces can be matched to the
+// page's: traceparent, the tracestate of the incoming request if it had
+// one, and X-Request-Id.
+//
+//   request, _ := http.NewRequest("GET", apiURL, nil)
+//   runtime.Propagate(request.Header)
+func (c *Context) Propagate(header http.Header) {
+  header.Set("Traceparent", c.TraceParent())
+  if c.traceGiven {
+    if state := c.Getenv("HTTP_TRACESTATE"); state != "" {
+      header.Set("Tracestate", state)
+    }
+  }
+  header.Set("X-Request-Id", c.RequestID())
+}
+
+// loadTrace reads the traceparent header once, keeping its trace ID and
+// flags if it is valid, and makes up the span of the page, and the trace
+// ID too if there is none.
+func (c *Context) loadTrace() {
+  if c.spanID != "" {
+    return
+  }
+  traceID, flags, ok := parseTraceParent(c.Getenv("HTTP_TRACEPARENT"))
+  if ok {
+    c.traceID, c.traceFlags, c.traceGiven = traceID, flags, true
+  } else {
+    c.traceID, c.traceFlags = randomHex(16), "00"
+  }
+  c.spanID = randomHex(8)
+}
+
+// parseTraceParent returns the trace ID and the flags of a traceparent
+// header, as given by the W3C Trace Context recommendation, and reports
+// whether the header is valid. Versions after 00 may add fields, which
+// are ignored.
+func parseTraceParent(header string) (string, string, bool) {
+  fields := strings.Split(strings.TrimSpace(header), "-")
+  if len(fields) < 4 {
+    return "", "", false
+  }
+  version, traceID, parentID, flags := fields[0], fields[1], fields[2],
+      fields[3]
+  if !isHex(version, 2) || version == "ff" ||
+      (version == "00" && len(fields) != 4) {
+    return "", "", false
+  }
+  if !isHex(traceID, 32) || traceID == strings.Repeat("0", 32) ||
+      !isHex(parentID, 16) || parentID == strings.Repeat("0", 16) ||
+      !isHex(flags, 2) {
+    return "", "", false
+  }
+  return traceID, flags, true
+}
+
+// isHex reports whether s is made of n lower-case hexadecimal digits.
+func isHex(s string, n int) bool {
+  if len(s) != n {
+    return false
+  }
+  for i := 0; i < len(s); i++ {
+    if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+      return false
+    }
+  }
+  return true
+}
+
+// randomHex returns n random bytes as hexadecimal digits.
+func randomHex(n int) string {
+  id := make([]byte, n)
+  rand.Read(id)
+  return hex.EncodeToString(id)
+}
+
+// echoRequestID adds the request ID to the response in RequestIDHeader,
+// unless the page has set that header.
+func (c *Context) echoRequestID() {
+  if RequestIDHeader == "" {
+    return
+  }
+  for _, header := range c.headers {
+    if hasName(header, RequestIDHeader) {
+      return
+    }
+  }
+  c.AddHeader(RequestIDHeader, c.RequestID())
+}
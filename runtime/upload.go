@@ -0,0 +1,183 @@
+package runtime
+
+import (
+  "os"
+  "io"
+  "bytes"
+  "errors"
+  "strings"
+  "net/url"
+  "net/http"
+  "mime/multipart"
+  "net/textproto"
+)
+
+// MaxUploadSize limits the size of a multipart/form-data request body. A
+// larger body makes FormFile and Form fail with an *http.MaxBytesError.
+var MaxUploadSize int64 = 32 << 20
+
+// UploadMemory is the number of bytes of a multipart body that are kept in
+// memory. Uploaded files beyond it are spooled to files in TempDir, which
+// are removed when the response is finished.
+var UploadMemory int64 = 1 << 20
+
+// errFormValueTooLarge is returned when a form field that is not a file
+// does not fit in memory.
+var errFormValueTooLarge = errors.New("multipart form value too large")
+
+// Upload describes a file sent in a multipart/form-data request body.
+type Upload struct {
+  Filename string               // The base name of the file on the client.
+  ContentType string            // The type given by the client, if any.
+  Size int64                    // The length of the content in bytes.
+  Header textproto.MIMEHeader   // The headers of the file's part.
+
+  content []byte  // The content if it is kept in memory.
+  path string     // The spool file if it is not.
+}
+
+// Open returns a reader of the content of an uploaded file. The caller
+// should close it.
+func (u *Upload) Open() (io.ReadCloser, error) {
+  if u.path != "" {
+    return os.Open(u.path)
+  }
+  return io.NopCloser(bytes.NewReader(u.content)), nil
+}
+
+// FormFile returns a reader of the first file uploaded in a form field,
+// with a description of the file. If the field holds no file, the error is
+// http.ErrMissingFile; if the body is not multipart/form-data, it is
+// http.ErrNotMultipart.
+func (r *PageRequest) FormFile(name string) (io.ReadCloser, *Upload,
+    error) {
+  if err := r.parseMultipart(); err != nil {
+    return nil, nil, err
+  }
+  files := r.uploads[name]
+  if len(files) == 0 {
+    return nil, nil, http.ErrMissingFile
+  }
+  reader, err := files[0].Open()
+  if err != nil {
+    return nil, nil, err
+  }
+  return reader, files[0], nil
+}
+
+// isMultipart reports whether the body of the request is multipart form
+// data.
+func (r *PageRequest) isMultipart() bool {
+  contentType := r.HTTP.Header.Get("Content-Type")
+  return strings.HasPrefix(strings.ToLower(contentType),
+      "multipart/form-data")
+}
+
+// parseMultipart reads a multipart/form-data body once, within
+// MaxUploadSize. Files are kept in memory up to UploadMemory in all and
+// spooled to temporary files after that. The other fields join the form
+// of the request, ahead of the parameters in the query string.
+func (r *PageRequest) parseMultipart() error {
+  if r.uploads != nil || r.uploadErr != nil {
+    return r.uploadErr
+  }
+  r.uploads = map[string][]*Upload{}
+  if !r.isMultipart() {
+    r.uploadErr = http.ErrNotMultipart
+    return r.uploadErr
+  }
+  r.HTTP.Body = http.MaxBytesReader(nil, r.HTTP.Body, MaxUploadSize)
+  reader, err := r.HTTP.MultipartReader()
+  if err != nil {
+    r.uploadErr = err
+    return err
+  }
+  values := url.Values{}
+  memory := UploadMemory
+  for {
+    part, err := reader.NextPart()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      r.uploadErr = err
+      return err
+    }
+    name := part.FormName()
+    if name == "" {
+      continue
+    }
+    if part.FileName() == "" {  // An ordinary field is kept in memory.
+      var value bytes.Buffer
+      n, err := io.CopyN(&value, part, memory+1)
+      if err != nil && err != io.EOF {
+        r.uploadErr = err
+        return err
+      }
+      if n > memory {
+        r.uploadErr = errFormValueTooLarge
+        return r.uploadErr
+      }
+      memory -= n
+      values.Add(name, value.String())
+      continue
+    }
+    upload, err := r.readUpload(part, &memory)
+    if err != nil {
+      r.uploadErr = err
+      return err
+    }
+    r.uploads[name] = append(r.uploads[name], upload)
+  }
+  // The fields join the form that FormValue consults.
+  r.HTTP.MultipartForm = &multipart.Form{ Value: values }
+  if err := r.HTTP.ParseForm(); err != nil {
+    r.uploadErr = err
+    return err
+  }
+  for key, list := range values {
+    r.HTTP.Form[key] = append(list, r.HTTP.Form[key]...)
+    r.HTTP.PostForm[key] = append(r.HTTP.PostForm[key], list...)
+  }
+  return nil
+}
+
+// readUpload reads the file in a part, in memory if it fits in what is
+// left of the memory allowance and otherwise into a spool file.
+func (r *PageRequest) readUpload(part *multipart.Part,
+    memory *int64) (*Upload, error) {
+  upload := &Upload{ Filename: part.FileName(),
+      ContentType: part.Header.Get("Content-Type"), Header: part.Header }
+  var content bytes.Buffer
+  n, err := io.CopyN(&content, part, *memory+1)
+  if err != nil && err != io.EOF {
+    return nil, err
+  }
+  if n <= *memory {
+    *memory -= n
+    upload.content, upload.Size = content.Bytes(), n
+    return upload, nil
+  }
+  file, err := CreateTemp("", "upload-*")
+  if err != nil {
+    return nil, err
+  }
+  r.spooled = append(r.spooled, file.Name())
+  upload.path = file.Name()
+  upload.Size, err = io.Copy(file, io.MultiReader(&content, part))
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return nil, err
+  }
+  return upload, nil
+}
+
+// removeUploads removes the spool files of uploaded files.
+func (r *PageRequest) removeUploads() {
+  for _, path := range r.spooled {
+    os.Remove(path)
+  }
+  r.spooled = nil
+}
@@ -0,0 +1,118 @@
+package runtime
+
+import (
+  "net"
+  "strings"
+  "net/url"
+)
+
+// TrustForwarded makes AbsoluteURL take the scheme and host from the
+// X-Forwarded-Proto and X-Forwarded-Host headers, and ClientIP take the
+// address from X-Forwarded-For, which a reverse proxy in front of the site
+// sets. Set it only when such a proxy is the sole way to reach the site,
+// since clients can send the headers themselves.
+var TrustForwarded = false
+
+// URL returns the URL path of a page or file of the site, with a query
+// made of params, which are names and values in turn, as in
+// URL("/search.cgi", "q", term, "page", "2"). The path is plain text, and
+// the characters that a URL does not allow in it are escaped, as are the
+// params. A relative path is resolved against the page, so that "edit.cgi"
+// names a page beside it and "" the page itself, whatever route it is
+// served at.
+func (c *Context) URL(urlPath string, params ...string) string {
+  base := &url.URL{ Path: c.pageURLPath() }
+  target := base.ResolveReference(&url.URL{ Path: urlPath })
+  query := []string{}
+  for i := 0; i < len(params); i += 2 {
+    value := ""
+    if i+1 < len(params) {
+      value = params[i+1]
+    }
+    query = append(query, url.QueryEscape(params[i]) + "=" +
+        url.QueryEscape(value))
+  }
+  target.RawQuery = strings.Join(query, "&")
+  if target.Path == "" {
+    target.Path = "/"
+  }
+  return target.String()
+}
+
+// AbsoluteURL returns the URL of a page or file of the site, as URL does,
+// with the scheme and host by which the client reached the page, for links
+// that leave the site, such as those of emails and feeds. The scheme is
+// https if the HTTPS variable is on, and the host is that of the Host
+// header, or else SERVER_NAME and SERVER_PORT. If the host is unknown, as
+// when the program is run from a shell, the URL path is returned alone.
+func (c *Context) AbsoluteURL(urlPath string, params ...string) string {
+  scheme, host := "http", c.Getenv("HTTP_HOST")
+  if https := strings.ToLower(c.Getenv("HTTPS")); https == "on" ||
+      https == "1" {
+    scheme = "https"
+  }
+  if TrustForwarded {
+    proto := strings.ToLower(firstForwarded(
+        c.Getenv("HTTP_X_FORWARDED_PROTO")))
+    if proto == "http" || proto == "https" {
+      scheme = proto
+    }
+    if forwardedHost := firstForwarded(c.Getenv("HTTP_X_FORWARDED_HOST"));
+        validHost(forwardedHost) {
+      host = forwardedHost
+    }
+  }
+  if !validHost(host) {
+    host = c.Getenv("SERVER_NAME")
+    port := c.Getenv("SERVER_PORT")
+    if port != "" && !(scheme == "http" && port == "80") &&
+        !(scheme == "https" && port == "443") {
+      host = net.JoinHostPort(host, port)
+    }
+  }
+  urlPath = c.URL(urlPath, params...)
+  if !validHost(host) {
+    return urlPath
+  }
+  return scheme + "://" + host + urlPath
+}
+
+// pageURLPath returns the URL path of the page, against which URL resolves
+// relative paths. An index page served at the route of its directory by
+// HandlePage is in that directory, though SCRIPT_NAME leaves out the
+// final slash.
+func (c *Context) pageURLPath() string {
+  if c.request != nil {
+    route, ok := c.request.Context().Value(routeKey{}).(string)
+    if ok && strings.HasSuffix(route, "/") {
+      return route
+    }
+  }
+  if scriptName := c.Getenv("SCRIPT_NAME"); scriptName != "" {
+    return scriptName
+  }
+  return "/"
+}
+
+// firstForwarded returns the first value of a forwarding header, which
+// each proxy on the way appends to.
+func firstForwarded(header string) string {
+  value, _, _ := strings.Cut(header, ",")
+  return strings.TrimSpace(value)
+}
+
+// validHost reports whether a host, with an optional port, is made of the
+// characters of names and IP addresses, so that a forged Host header
+// cannot turn a URL into one of another shape.
+func validHost(host string) bool {
+  if host == "" || strings.HasPrefix(host, ":") {
+    return false
+  }
+  for _, ch := range host {
+    if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' ||
+        ch >= '0' && ch <= '9' || strings.ContainsRune(".-:[]", ch)) {
+      return false
+    }
+  }
+  return true
+}
@@ -0,0 +1,27 @@
+package runtime
+
+import (
+  "encoding/xml"
+)
+
+// WriteXML writes the XML encoding of v, after an XML declaration, to the
+// content buffer and makes the response an XML document. If v cannot be
+// encoded, the error is logged to stderr, the response becomes a plain 500
+// error in place of whatever was written before, and the error is
+// returned.
+func (c *Context) WriteXML(v interface{}) error {
+  return c.writeXMLAs(v, "application/xml")
+}
+
+// writeXMLAs writes v as an XML document of the given media type.
+func (c *Context) writeXMLAs(v interface{}, mediaType string) error {
+  data, err := xml.Marshal(v)
+  if err != nil {
+    c.encodingError("WriteXML", err)
+    return err
+  }
+  c.SetContentType(mediaType)
+  c.WriteString(xml.Header)
+  c.WriteString(string(data))
+  return nil
+}